@@ -0,0 +1,558 @@
+// Generates typed client stubs and a dispatcher for a service from its
+// remote functions definition (.rpc file).
+//
+// Definition syntax:
+//
+//	package fs
+//	service FsService
+//
+//	struct ChildEntry {
+//		name string
+//		size int64
+//	}
+//
+//	function 2 ChildrenList {
+//		request {
+//			path string
+//		}
+//		response {
+//			children []ChildEntry
+//			data
+//		}
+//	}
+//
+// Function ids are part of the wire protocol and must be >= 2 (0 and 1 are
+// reserved for responses and errors). Fields types are the ones supported by
+// typedio, lists of structs ([]Struct) and "data" which maps to the data of
+// the message. For each function, the service type must have a method
+// Remote<Function>(message *comm.Message, request *<Function>Request).
+//
+// Lists are prefixed by their count on 16 bits: building a message having a
+// list of more than 65535 entries returns an error, and comm refuses to send
+// messages whose payload is bigger than comm.MAX_PAYLOAD_SIZE.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	reserved_functions = 2
+	max_list_size      = 65535
+)
+
+var (
+	scalarTypes = map[string]string{
+		"string":  "String",
+		"bool":    "Bool",
+		"int64":   "Int64",
+		"int32":   "Int32",
+		"int16":   "Int16",
+		"uint64":  "Uint64",
+		"uint32":  "Uint32",
+		"uint16":  "Uint16",
+		"uint8":   "Uint8",
+		"float32": "Float32",
+		"float64": "Float64",
+	}
+)
+
+type definition struct {
+	source    string
+	pkg       string
+	service   string
+	structs   []*structDef
+	functions []*functionDef
+}
+
+type structDef struct {
+	name   string
+	fields []*fieldDef
+	data   bool
+}
+
+type fieldDef struct {
+	name string
+	typ  string // scalar type or struct name for lists
+	list bool
+}
+
+type functionDef struct {
+	id       int
+	name     string
+	request  *structDef
+	response *structDef
+}
+
+func main() {
+	var output *string = flag.String("o", "", "output file (default: <definition>.go)")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: gostore-rpcgen [-o output.go] definition.rpc\n")
+		os.Exit(2)
+	}
+
+	path := flag.Arg(0)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		fatal("couldn't read definition: %s", err)
+	}
+
+	def, err := parse(string(content))
+	if err != nil {
+		fatal("%s: %s", path, err)
+	}
+	def.source = path[strings.LastIndex(path, "/")+1:]
+
+	outpath := *output
+	if outpath == "" {
+		outpath = path + ".go"
+	}
+
+	err = ioutil.WriteFile(outpath, generate(def), 0644)
+	if err != nil {
+		fatal("couldn't write %s: %s", outpath, err)
+	}
+}
+
+func fatal(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "gostore-rpcgen: "+format+"\n", v...)
+	os.Exit(1)
+}
+
+
+/*
+ * Parsing
+ */
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenize(content string) []string {
+	tokens := make([]string, 0)
+	for _, line := range strings.Split(content, "\n", -1) {
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+
+		line = strings.Replace(line, "{", " { ", -1)
+		line = strings.Replace(line, "}", " } ", -1)
+		line = strings.Replace(line, ";", " ", -1)
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	return tokens
+}
+
+func (p *parser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) expect(token string) os.Error {
+	if got := p.next(); got != token {
+		return os.NewError(fmt.Sprintf("expected '%s', got '%s'", token, got))
+	}
+	return nil
+}
+
+func parse(content string) (*definition, os.Error) {
+	p := &parser{tokenize(content), 0}
+	def := new(definition)
+	structs := make(map[string]*structDef)
+	ids := make(map[int]bool)
+
+	for p.peek() != "" {
+		switch keyword := p.next(); keyword {
+		case "package":
+			def.pkg = p.next()
+
+		case "service":
+			def.service = p.next()
+
+		case "struct":
+			st, err := p.parseFields(p.next())
+			if err != nil {
+				return nil, err
+			}
+			if st.data {
+				return nil, os.NewError(fmt.Sprintf("struct %s can't contain data", st.name))
+			}
+			structs[st.name] = st
+			def.structs = append(def.structs, st)
+
+		case "function":
+			fn, err := p.parseFunction()
+			if err != nil {
+				return nil, err
+			}
+			if fn.id < reserved_functions || fn.id > 255 {
+				return nil, os.NewError(fmt.Sprintf("function %s id must be between %d and 255", fn.name, reserved_functions))
+			}
+			if ids[fn.id] {
+				return nil, os.NewError(fmt.Sprintf("function id %d used twice", fn.id))
+			}
+			ids[fn.id] = true
+			def.functions = append(def.functions, fn)
+
+		default:
+			return nil, os.NewError(fmt.Sprintf("unexpected '%s'", keyword))
+		}
+	}
+
+	if def.pkg == "" || def.service == "" {
+		return nil, os.NewError("package and service must be declared")
+	}
+
+	// validate types of fields
+	for _, fn := range def.functions {
+		for _, st := range []*structDef{fn.request, fn.response} {
+			for _, field := range st.fields {
+				if _, found := structs[field.typ]; field.list && !found {
+					return nil, os.NewError(fmt.Sprintf("unknown struct %s in function %s", field.typ, fn.name))
+				}
+			}
+		}
+	}
+
+	return def, nil
+}
+
+func (p *parser) parseFunction() (*functionDef, os.Error) {
+	fn := new(functionDef)
+
+	id, err := strconv.Atoi(p.next())
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("invalid function id: %s", err))
+	}
+	fn.id = id
+	fn.name = p.next()
+	fn.request = &structDef{name: fn.name + "Request"}
+	fn.response = &structDef{name: fn.name + "Response"}
+
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	for p.peek() != "}" {
+		switch part := p.next(); part {
+		case "request":
+			fn.request, err = p.parseFields(fn.name + "Request")
+		case "response":
+			fn.response, err = p.parseFields(fn.name + "Response")
+		default:
+			err = os.NewError(fmt.Sprintf("unexpected '%s' in function %s", part, fn.name))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fn, p.expect("}")
+}
+
+func (p *parser) parseFields(name string) (*structDef, os.Error) {
+	st := &structDef{name: name}
+
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	for p.peek() != "}" && p.peek() != "" {
+		fname := p.next()
+		if _, found := scalarTypes[p.peek()]; fname == "data" && !found && !strings.HasPrefix(p.peek(), "[]") {
+			st.data = true
+			continue
+		}
+
+		field := &fieldDef{name: fname}
+		field.typ = p.next()
+		if strings.HasPrefix(field.typ, "[]") {
+			field.list = true
+			field.typ = field.typ[2:]
+		} else if _, found := scalarTypes[field.typ]; !found {
+			return nil, os.NewError(fmt.Sprintf("unsupported type '%s' for field %s of %s", field.typ, fname, name))
+		}
+
+		st.fields = append(st.fields, field)
+	}
+
+	return st, p.expect("}")
+}
+
+
+/*
+ * Generation
+ */
+func exported(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// ChildrenList -> FUNC_CHILDREN_LIST
+func constName(name string) string {
+	c := "FUNC"
+	for i, char := range name {
+		if i == 0 || (char >= 'A' && char <= 'Z') {
+			c += "_"
+		}
+		c += strings.ToUpper(string(char))
+	}
+	return c
+}
+
+func (f *fieldDef) goType() string {
+	if f.list {
+		return "[]" + f.typ
+	}
+	return f.typ
+}
+
+func (st *structDef) empty() bool {
+	return len(st.fields) == 0 && !st.data
+}
+
+func padding(name string, width int) string {
+	return name + strings.Repeat(" ", width-len(name))
+}
+
+func generate(def *definition) []byte {
+	b := new(bytes.Buffer)
+
+	fmt.Fprintf(b, "// Code generated by gostore-rpcgen from \"%s\"\n", def.source)
+	fmt.Fprintf(b, "// DO NOT EDIT!\n\n")
+	fmt.Fprintf(b, "package %s\n\n", def.pkg)
+	fmt.Fprintf(b, "import \"fmt\"\n")
+	fmt.Fprintf(b, "import \"gostore/comm\"\n")
+	fmt.Fprintf(b, "import \"gostore/tools/buffer\"\n")
+	fmt.Fprintf(b, "import \"io\"\n")
+	fmt.Fprintf(b, "import \"os\"\n\n")
+	fmt.Fprintf(b, "// Reference fmt, io & os imports to suppress error if they are not otherwise used.\n")
+	fmt.Fprintf(b, "var _ = fmt.Sprintf\n")
+	fmt.Fprintf(b, "var _ io.Reader\n")
+	fmt.Fprintf(b, "var _ os.Error\n\n")
+
+	// function ids
+	width := 0
+	for _, fn := range def.functions {
+		if len(constName(fn.name)) > width {
+			width = len(constName(fn.name))
+		}
+	}
+	fmt.Fprintf(b, "// Remote functions ids\n")
+	fmt.Fprintf(b, "const (\n")
+	for _, fn := range def.functions {
+		fmt.Fprintf(b, "\t%s = %d\n", padding(constName(fn.name), width), fn.id)
+	}
+	fmt.Fprintf(b, ")\n\n")
+
+	// function names to ids
+	width = 0
+	for _, fn := range def.functions {
+		if len(fn.name)+9 > width {
+			width = len(fn.name) + 9
+		}
+	}
+	fmt.Fprintf(b, "var %sFunctions = map[string]byte{\n", strings.ToLower(def.service[:1])+def.service[1:])
+	for _, fn := range def.functions {
+		fmt.Fprintf(b, "\t%s %s,\n", padding(fmt.Sprintf("\"Remote%s\":", fn.name), width), constName(fn.name))
+	}
+	fmt.Fprintf(b, "}\n\n")
+
+	// structures
+	for _, st := range def.structs {
+		generateStruct(b, st)
+	}
+
+	for _, fn := range def.functions {
+		if !fn.request.empty() {
+			generateStruct(b, fn.request)
+			fmt.Fprintf(b, "func Read%s(message *comm.Message) (*%s, os.Error) {\n", fn.request.name, fn.request.name)
+			generateMessageRead(b, fn.request)
+			fmt.Fprintf(b, "}\n\n")
+		}
+
+		if !fn.response.empty() {
+			generateStruct(b, fn.response)
+			fmt.Fprintf(b, "func Read%s(message *comm.Message) (*%s, os.Error) {\n", fn.response.name, fn.response.name)
+			generateMessageRead(b, fn.response)
+			fmt.Fprintf(b, "}\n\n")
+		}
+	}
+
+	// client
+	client := def.service + "Client"
+	fmt.Fprintf(b, "// Typed client of the %s remote functions\n", def.service)
+	fmt.Fprintf(b, "type %s struct {\n", client)
+	fmt.Fprintf(b, "\tcomm      *comm.Comm\n")
+	fmt.Fprintf(b, "\tserviceId byte\n")
+	fmt.Fprintf(b, "}\n\n")
+	fmt.Fprintf(b, "func New%s(c *comm.Comm, serviceId byte) *%s {\n", client, client)
+	fmt.Fprintf(b, "\treturn &%s{c, serviceId}\n", client)
+	fmt.Fprintf(b, "}\n\n")
+
+	for _, fn := range def.functions {
+		fmt.Fprintf(b, "// Returns a message calling Remote%s\n", fn.name)
+		if fn.request.empty() {
+			fmt.Fprintf(b, "func (c *%s) New%sMessage() (*comm.Message, os.Error) {\n", client, fn.name)
+		} else {
+			fmt.Fprintf(b, "func (c *%s) New%sMessage(request *%s) (*comm.Message, os.Error) {\n", client, fn.name, fn.request.name)
+		}
+		generateMessageWrite(b, fn.request, "request")
+		fmt.Fprintf(b, "\tmessage.FunctionId = %s\n", constName(fn.name))
+		fmt.Fprintf(b, "\treturn message, nil\n")
+		fmt.Fprintf(b, "}\n\n")
+
+		if !fn.response.empty() {
+			fmt.Fprintf(b, "// Returns a response message to Remote%s\n", fn.name)
+			fmt.Fprintf(b, "func (c *%s) New%s(response *%s) (*comm.Message, os.Error) {\n", client, fn.response.name, fn.response.name)
+			generateMessageWrite(b, fn.response, "response")
+			fmt.Fprintf(b, "\treturn message, nil\n")
+			fmt.Fprintf(b, "}\n\n")
+		}
+	}
+
+	// dispatcher
+	fmt.Fprintf(b, "// Returns the ids of the remote functions of the service\n")
+	fmt.Fprintf(b, "func (s *%s) Functions() map[string]byte {\n", def.service)
+	fmt.Fprintf(b, "\treturn %sFunctions\n", strings.ToLower(def.service[:1])+def.service[1:])
+	fmt.Fprintf(b, "}\n\n")
+
+	fmt.Fprintf(b, "// Decodes the request of a message and calls its remote function\n")
+	fmt.Fprintf(b, "func (s *%s) Dispatch(message *comm.Message) (handled bool, err os.Error) {\n", def.service)
+	fmt.Fprintf(b, "\tswitch message.FunctionId {\n")
+	for _, fn := range def.functions {
+		fmt.Fprintf(b, "\tcase %s:\n", constName(fn.name))
+		if fn.request.empty() {
+			fmt.Fprintf(b, "\t\ts.Remote%s(message)\n", fn.name)
+		} else {
+			fmt.Fprintf(b, "\t\trequest, err := Read%s(message)\n", fn.request.name)
+			fmt.Fprintf(b, "\t\tif err != nil {\n")
+			fmt.Fprintf(b, "\t\t\treturn true, err\n")
+			fmt.Fprintf(b, "\t\t}\n")
+			fmt.Fprintf(b, "\t\ts.Remote%s(message, request)\n", fn.name)
+		}
+		fmt.Fprintf(b, "\t\treturn true, nil\n")
+	}
+	fmt.Fprintf(b, "\t}\n\n")
+	fmt.Fprintf(b, "\treturn false, nil\n")
+	fmt.Fprintf(b, "}\n")
+
+	return b.Bytes()
+}
+
+func generateStruct(b *bytes.Buffer, st *structDef) {
+	width := 0
+	for _, field := range st.fields {
+		if len(field.name) > width {
+			width = len(field.name)
+		}
+	}
+	if st.data && width < len("DataSize") {
+		width = len("DataSize")
+	}
+
+	fmt.Fprintf(b, "type %s struct {\n", st.name)
+	for _, field := range st.fields {
+		fmt.Fprintf(b, "\t%s %s\n", padding(exported(field.name), width), field.goType())
+	}
+	if st.data {
+		fmt.Fprintf(b, "\t%s io.Reader\n", padding("Data", width))
+		fmt.Fprintf(b, "\t%s int64\n", padding("DataSize", width))
+	}
+	fmt.Fprintf(b, "}\n\n")
+
+	// payload writing
+	fmt.Fprintf(b, "func (s *%s) write(buf *buffer.Buffer) os.Error {\n", st.name)
+	for _, field := range st.fields {
+		if field.list {
+			fmt.Fprintf(b, "\tif len(s.%s) > %d {\n", exported(field.name), max_list_size)
+			fmt.Fprintf(b, "\t\treturn os.NewError(fmt.Sprintf(\"%s.%s has %%d entries, more than %d\", len(s.%s)))\n", st.name, exported(field.name), max_list_size, exported(field.name))
+			fmt.Fprintf(b, "\t}\n")
+			fmt.Fprintf(b, "\tbuf.WriteUint16(uint16(len(s.%s)))\n", exported(field.name))
+			fmt.Fprintf(b, "\tfor i := range s.%s {\n", exported(field.name))
+			fmt.Fprintf(b, "\t\tif err := s.%s[i].write(buf); err != nil {\n", exported(field.name))
+			fmt.Fprintf(b, "\t\t\treturn err\n")
+			fmt.Fprintf(b, "\t\t}\n")
+			fmt.Fprintf(b, "\t}\n")
+		} else {
+			fmt.Fprintf(b, "\tbuf.Write%s(s.%s)\n", scalarTypes[field.typ], exported(field.name))
+		}
+	}
+	fmt.Fprintf(b, "\treturn nil\n")
+	fmt.Fprintf(b, "}\n\n")
+
+	// payload reading
+	fmt.Fprintf(b, "func (s *%s) read(buf *buffer.Buffer) (err os.Error) {\n", st.name)
+	for _, field := range st.fields {
+		if field.list {
+			fmt.Fprintf(b, "\tvar %sCount uint16\n", field.name)
+			fmt.Fprintf(b, "\t%sCount, err = buf.ReadUint16()\n", field.name)
+			fmt.Fprintf(b, "\tif err != nil {\n")
+			fmt.Fprintf(b, "\t\treturn\n")
+			fmt.Fprintf(b, "\t}\n")
+			fmt.Fprintf(b, "\ts.%s = make(%s, %sCount)\n", exported(field.name), field.goType(), field.name)
+			fmt.Fprintf(b, "\tfor i := range s.%s {\n", exported(field.name))
+			fmt.Fprintf(b, "\t\terr = s.%s[i].read(buf)\n", exported(field.name))
+			fmt.Fprintf(b, "\t\tif err != nil {\n")
+			fmt.Fprintf(b, "\t\t\treturn\n")
+			fmt.Fprintf(b, "\t\t}\n")
+			fmt.Fprintf(b, "\t}\n\n")
+		} else {
+			fmt.Fprintf(b, "\ts.%s, err = buf.Read%s()\n", exported(field.name), scalarTypes[field.typ])
+			fmt.Fprintf(b, "\tif err != nil {\n")
+			fmt.Fprintf(b, "\t\treturn\n")
+			fmt.Fprintf(b, "\t}\n\n")
+		}
+	}
+	fmt.Fprintf(b, "\treturn nil\n")
+	fmt.Fprintf(b, "}\n\n")
+}
+
+func generateMessageWrite(b *bytes.Buffer, st *structDef, variable string) {
+	if st.data {
+		fmt.Fprintf(b, "\tmessage := c.comm.NewDataMessage(c.serviceId)\n")
+	} else {
+		fmt.Fprintf(b, "\tmessage := c.comm.NewMsgMessage(c.serviceId)\n")
+	}
+
+	if !st.empty() {
+		fmt.Fprintf(b, "\tif err := %s.write(message.Message); err != nil {\n", variable)
+		fmt.Fprintf(b, "\t\treturn nil, err\n")
+		fmt.Fprintf(b, "\t}\n")
+	}
+
+	if st.data {
+		fmt.Fprintf(b, "\tmessage.Data = %s.Data\n", variable)
+		fmt.Fprintf(b, "\tmessage.DataSize = %s.DataSize\n", variable)
+	}
+}
+
+func generateMessageRead(b *bytes.Buffer, st *structDef) {
+	fmt.Fprintf(b, "\ts := new(%s)\n", st.name)
+	fmt.Fprintf(b, "\tif err := s.read(message.Message); err != nil {\n")
+	fmt.Fprintf(b, "\t\treturn nil, err\n")
+	fmt.Fprintf(b, "\t}\n")
+	if st.data {
+		fmt.Fprintf(b, "\ts.Data = message.Data\n")
+		fmt.Fprintf(b, "\ts.DataSize = message.DataSize\n")
+	}
+	fmt.Fprintf(b, "\treturn s, nil\n")
+}
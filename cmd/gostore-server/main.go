@@ -4,6 +4,7 @@ import (
 	"gostore/log"
 	"gostore"
 	"gostore/process"
+	"gostore/tools/metrics"
 	"flag"
 	_ "http/pprof"
 	"http"
@@ -13,10 +14,32 @@ func main() {
 	// Flags
 	var configpath *string = flag.String("config", "gostore.conf", "configuration")
 	var verbosity *int = flag.Int("verbosity", 3, "degree of verbosity")
+	var loglevels *string = flag.String("loglevels", "", "levels of subsystems (ex: comm=debug,fs=warning)")
+	var logformat *string = flag.String("logformat", "text", "format of the log (text or json)")
+	var logfile *string = flag.String("logfile", "", "log to this file instead of the console")
+	var logsize *int64 = flag.Int64("logsize", 100*1024*1024, "size of the log file before it's rotated")
+	var logfiles *int = flag.Int("logfiles", 5, "number of rotated log files kept")
 	flag.Parse()
 
 	// Set log verbosity
 	log.MaxLevel = *verbosity
+	if err := log.SetLevels(*loglevels); err != nil {
+		log.Fatal("Invalid log levels: %s\n", err)
+	}
+
+	format := log.FormatText
+	if *logformat == "json" {
+		format = log.FormatJSON
+	}
+	if *logfile != "" {
+		sink, err := log.NewFileSink(*logfile, format, *logsize, *logfiles)
+		if err != nil {
+			log.Fatal("Couldn't open log file: %s\n", err)
+		}
+		log.SetSinks(sink)
+	} else {
+		log.SetSinks(log.NewConsoleSink(format))
+	}
 
 	log.Info("Reading config\n")
 	config := gostore.LoadConfig(*configpath)
@@ -27,6 +50,9 @@ func main() {
 
 	log.Info("Server started\n")
 
+	// metrics for Prometheus and log levels, next to the profiling of http/pprof
+	http.Handle("/metrics", metrics.Default)
+	http.HandleFunc("/log/levels", log.LevelsHandler)
 	http.ListenAndServe(":8080", nil)
 
 	// Wait
@@ -7,12 +7,17 @@
 package cluster
 
 import (
+	"sync"
 	"gostore"
 	"gostore/log"
 )
 
 const (
 	MAX_NODE_ID = 65535
+
+	// Tokens of a node of weight 1 in the global ring. The more tokens, the
+	// more evenly keys are spread between nodes.
+	DEFAULT_VIRTUAL_NODES = 64
 )
 
 
@@ -29,6 +34,8 @@ type Cluster struct {
 	MyNode *Node
 
 	Notifier *WatcherNotifier
+
+	statusMutex *sync.Mutex // protects the status of the nodes
 }
 
 // Returns a new cluster configured using the given configuration
@@ -39,6 +46,7 @@ func NewCluster(config gostore.Config) *Cluster {
 	cls.Nodes = newNodes()
 	cls.Rings = newRingsConfig(config.Rings, config.GlobalRing)
 	cls.Notifier = NewWatcherNotifier()
+	cls.statusMutex = new(sync.Mutex)
 
 	return cls
 }
@@ -53,21 +61,12 @@ func (c *Cluster) SetMyNode(node *Node) {
 // Takes all nodes, get their membership to rings and add them to each rings.
 func (c *Cluster) FillRings() {
 	for node := range c.Nodes.Iter() {
-		nbrings := uint8(len(node.Rings))
-
-		if nbrings > 0 {
-			var r uint8
-			for r = 0; r < nbrings; r++ {
-				nodering := node.Rings[r]
-				ring := c.Rings.GetRing(nodering.Ring)
-				if ring != nil {
-					ring.AddNode(nodering.Token, node)
-				}
+		for ringId, tokens := range c.nodeRingTokens(node) {
+			ring := c.Rings.GetRing(ringId)
+			if ring != nil {
+				ring.ring.AddElements(nodeElements(node, tokens)...)
 			}
 		}
-
-		// add all nodes to the default ring
-		c.Rings.GetGlobalRing().AddNode(node.Hash(), node)
 	}
 }
 
@@ -80,15 +79,16 @@ func (c *Cluster) MergeNode(nNode *Node, notify bool) {
 		oNode.Adhoc = nNode.Adhoc
 		oNode.TcpPort = nNode.TcpPort
 		oNode.UdpPort = nNode.UdpPort
+		oNode.Zone = nNode.Zone
+		oNode.Rack = nNode.Rack
 
-		if oNode.Status != nNode.Status {
-			switch oNode.Status {
+		c.statusMutex.Lock()
+		oStatus := oNode.Status
+		if oStatus != nNode.Status {
+			switch oStatus {
 			case Status_Offline:
 				if nNode.Status == Status_Joining {
 					oNode.Status = Status_Joining
-					if notify {
-						c.Notifier.NotifyNodeJoining(oNode)
-					}
 				} else {
 					log.Fatal("Invalid node status transition")
 				}
@@ -96,10 +96,6 @@ func (c *Cluster) MergeNode(nNode *Node, notify bool) {
 			case Status_Joining:
 				if nNode.Status == Status_Online {
 					oNode.Status = Status_Online
-					if notify {
-						c.Notifier.NotifyNodeOnline(oNode)
-					}
-
 				} else {
 					log.Fatal("Invalid node status transition")
 				}
@@ -107,8 +103,20 @@ func (c *Cluster) MergeNode(nNode *Node, notify bool) {
 				log.Fatal("Unsupported node status transition")
 			}
 		}
+		c.statusMutex.Unlock()
 
-		// TODO: Rings
+		if notify && oStatus != oNode.Status {
+			if oNode.Status == Status_Joining {
+				c.Notifier.NotifyNodeJoining(oNode)
+			} else {
+				c.Notifier.NotifyNodeOnline(oNode)
+			}
+		}
+
+		before := c.nodeRingTokens(oNode)
+		oNode.Weight = nNode.Weight
+		oNode.Rings = nNode.Rings
+		c.updateRings(oNode, before, notify)
 
 	} else {
 		c.Nodes.Add(nNode)
@@ -119,5 +127,22 @@ func (c *Cluster) MergeNode(nNode *Node, notify bool) {
 				c.Notifier.NotifyNodeJoining(nNode)
 			}
 		}
+		c.updateRings(nNode, nil, notify)
 	}
 }
+
+// Changes the status of a node if its current status is one of the given
+// ones, returning true if it was changed. Watchers aren't notified.
+func (c *Cluster) ChangeNodeStatus(node *Node, status byte, from ...byte) bool {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	for _, current := range from {
+		if node.Status == current {
+			node.Status = status
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"gostore/tools/hashring"
+)
+
+// Range of tokens of a ring, from Start (excluded) to End (included),
+// wrapping around the ring if End isn't after Start
+type TokenRange struct {
+	Start string
+	End   string
+}
+
+// Returns true if the token is in the range
+func (r TokenRange) Contains(token string) bool {
+	if r.Start < r.End {
+		return token > r.Start && token <= r.End
+	}
+
+	// wraps around the ring (the whole ring if start and end are equal)
+	return token > r.Start || token <= r.End || r.Start == r.End
+}
+
+func (r TokenRange) String() string {
+	return fmt.Sprintf("(%s,%s]", r.Start, r.End)
+}
+
+// Range of tokens whose nodes changed after a ring membership change. If the
+// placement of the ring isn't ranged, a single range covering the whole ring
+// is moved, with no nodes before and after.
+type MovedRange struct {
+	TokenRange
+
+	From *ResolveResult // nodes before the change
+	To   *ResolveResult // nodes after the change
+}
+
+// Adds a node to a ring at new tokens, or at tokens derived from its id if
+// none are given, and notifies watchers of the token ranges moved to it.
+// Adding a node to the global ring without tokens gives it a weight of 1 if
+// it had none.
+func (c *Cluster) AddNodeToRing(node *Node, ringId uint8, tokens ...string) ([]*MovedRange, os.Error) {
+	ring := c.Rings.GetRing(ringId)
+	if ring == nil {
+		return nil, os.NewError(fmt.Sprintf("Ring %d doesn't exist", ringId))
+	}
+
+	before := c.nodeRingTokens(node)
+	if len(tokens) == 0 && ringId == c.Rings.globalRing {
+		if node.Weight == 0 {
+			node.Weight = 1
+		}
+	} else {
+		if len(tokens) == 0 {
+			tokens = ring.nodeTokens(node)
+		}
+		for _, token := range tokens {
+			node.AddRing(ringId, token)
+		}
+	}
+
+	moved := c.updateRings(node, before, true)
+	return moved[ringId], nil
+}
+
+// Removes a node from a ring and notifies watchers of the token ranges moved
+// away from it. Removing a node from the global ring sets its weight to 0.
+func (c *Cluster) RemoveNodeFromRing(node *Node, ringId uint8) ([]*MovedRange, os.Error) {
+	before := c.nodeRingTokens(node)
+	if len(before[ringId]) == 0 {
+		return nil, os.NewError(fmt.Sprintf("Node %d isn't in ring %d", node.Id, ringId))
+	}
+
+	if ringId == c.Rings.globalRing {
+		node.Weight = 0
+	}
+
+	rings := make([]NodeRing, 0, len(node.Rings))
+	for _, nodering := range node.Rings {
+		if nodering.Ring != ringId {
+			rings = append(rings, nodering)
+		}
+	}
+	node.Rings = rings
+
+	moved := c.updateRings(node, before, true)
+	return moved[ringId], nil
+}
+
+// Returns the tokens of a node in each ring it is member of: the tokens of
+// its rings, and for the global ring the tokens derived from its id
+func (c *Cluster) nodeRingTokens(node *Node) map[uint8][]string {
+	tokens := make(map[uint8][]string)
+	for _, nodering := range node.Rings {
+		tokens[nodering.Ring] = append(tokens[nodering.Ring], nodering.Token)
+	}
+
+	global := c.Rings.GetGlobalRing()
+	if derived := global.nodeTokens(node); len(derived) > 0 {
+		tokens[global.id] = append(tokens[global.id], derived...)
+	}
+
+	return tokens
+}
+
+// Moves a node in the rings whose tokens changed since before (nil if the
+// node wasn't in any ring), notifying watchers if needed. Returns the ranges
+// moved in each ring.
+func (c *Cluster) updateRings(node *Node, before map[uint8][]string, notify bool) map[uint8][]*MovedRange {
+	after := c.nodeRingTokens(node)
+	for ringId := range before {
+		if _, found := after[ringId]; !found {
+			after[ringId] = nil
+		}
+	}
+
+	moved := make(map[uint8][]*MovedRange)
+	for ringId, tokens := range after {
+		ring := c.Rings.GetRing(ringId)
+		if ring == nil || sameTokens(before[ringId], tokens) {
+			continue
+		}
+
+		moved[ringId] = ring.setNodeTokens(node, tokens)
+
+		if notify {
+			if len(tokens) > 0 {
+				c.Notifier.NotifyNodeJoiningRing(node, ring, moved[ringId])
+			} else {
+				c.Notifier.NotifyNodeLeavingRing(node, ring, moved[ringId])
+			}
+		}
+	}
+
+	return moved
+}
+
+func sameTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := make([]string, len(a))
+	copy(sortedA, a)
+	sort.SortStrings(sortedA)
+
+	sortedB := make([]string, len(b))
+	copy(sortedB, b)
+	sort.SortStrings(sortedB)
+
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Replaces the tokens of a node in the ring (none to remove it) and returns
+// the ranges whose nodes changed
+func (cr *Ring) setNodeTokens(node *Node, tokens []string) []*MovedRange {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	before := cr.ring.Copy()
+	cr.ring.ReplaceValue(node, nodeElements(node, tokens)...)
+
+	return cr.movedRanges(before, cr.ring)
+}
+
+// Returns the ranges whose nodes differ between two versions of the ring.
+// Nodes only change at tokens of one of the versions, so each range between
+// consecutive tokens of both versions is resolved at its end in both.
+func (cr *Ring) movedRanges(before, after *hashring.HashRing) []*MovedRange {
+	if !cr.placement.Ranged() {
+		return []*MovedRange{&MovedRange{TokenRange{"", ""}, new(ResolveResult), new(ResolveResult)}}
+	}
+
+	bounds := append(ringTokens(before), ringTokens(after)...)
+	sort.SortStrings(bounds)
+
+	unique := bounds[:0]
+	for _, token := range bounds {
+		if len(unique) == 0 || token != unique[len(unique)-1] {
+			unique = append(unique, token)
+		}
+	}
+	bounds = unique
+
+	moved := make([]*MovedRange, 0)
+	for i, end := range bounds {
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+
+		from := cr.resolve(before, end)
+		to := cr.resolve(after, end)
+		if from.SameNodes(to) {
+			continue
+		}
+
+		// extend the previous range if it moved the same way
+		if len(moved) > 0 {
+			last := moved[len(moved)-1]
+			if last.End == start && last.From.SameNodes(from) && last.To.SameNodes(to) {
+				last.End = end
+				continue
+			}
+		}
+
+		moved = append(moved, &MovedRange{TokenRange{start, end}, from, to})
+	}
+
+	return moved
+}
+
+// Returns the tokens of a hash ring, in order
+func ringTokens(ring *hashring.HashRing) []string {
+	tokens := make([]string, 0, ring.Count())
+
+	first := ring.FirstElement()
+	if first != nil {
+		tokens = append(tokens, first.Hash)
+		for cur := first.Next(); cur != first; cur = cur.Next() {
+			tokens = append(tokens, cur.Hash)
+		}
+	}
+
+	return tokens
+}
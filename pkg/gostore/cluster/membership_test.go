@@ -0,0 +1,174 @@
+package cluster_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"gostore/cluster"
+)
+
+// Returns the tokens at which the nodes of a ring can change: the test keys
+// and the tokens of the given nodes
+func probeTokens(nodes ...*cluster.Node) []string {
+	probes := make([]string, 0, KEYS_COUNT)
+	for i := 0; i < KEYS_COUNT; i++ {
+		probes = append(probes, keyToken(i))
+	}
+	for _, node := range nodes {
+		probes = append(probes, node.Tokens(cluster.DEFAULT_VIRTUAL_NODES*int(node.Weight))...)
+	}
+	return probes
+}
+
+func resolveProbes(ring *cluster.Ring, probes []string) []*cluster.ResolveResult {
+	results := make([]*cluster.ResolveResult, len(probes))
+	for i, probe := range probes {
+		results[i] = ring.ResolveToken(probe)
+	}
+	return results
+}
+
+// Checks moved ranges against the nodes of each probe resolved before and
+// after a change: a probe whose nodes changed must be in exactly one range
+// moving it the same way, and the others in none.
+func checkMovedRanges(probes []string, before, after []*cluster.ResolveResult, moved []*cluster.MovedRange) os.Error {
+	for i, probe := range probes {
+		var found *cluster.MovedRange
+		for _, r := range moved {
+			if r.Contains(probe) {
+				if found != nil {
+					return os.NewError(fmt.Sprintf("token %s is in ranges %s and %s", probe, found, r))
+				}
+				found = r
+			}
+		}
+
+		changed := !before[i].SameNodes(after[i])
+		switch {
+		case changed && found == nil:
+			return os.NewError(fmt.Sprintf("token %s moved but isn't in any range", probe))
+		case !changed && found != nil:
+			return os.NewError(fmt.Sprintf("token %s didn't move but is in range %s", probe, found))
+		case changed && (!found.From.SameNodes(before[i]) || !found.To.SameNodes(after[i])):
+			return os.NewError(fmt.Sprintf("token %s didn't move as its range %s", probe, found))
+		}
+	}
+	return nil
+}
+
+// Returns true if the node is in each range's nodes before (or after) the
+// change
+func inEachRange(node *cluster.Node, moved []*cluster.MovedRange, before bool) bool {
+	for _, r := range moved {
+		res := r.To
+		if before {
+			res = r.From
+		}
+		if !res.InOnlineNodes(node) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAddNodeToRing(t *testing.T) {
+	added := newNode(4, 0)
+	cls := newRingCluster("walk", 2, newNode(1, 1), newNode(2, 1), newNode(3, 1), added)
+	watcher := newRingWatcher()
+	cls.Notifier.Bind(watcher)
+
+	ring := cls.Rings.GetGlobalRing()
+	probes := probeTokens(cls.Nodes.Get(1), cls.Nodes.Get(2), cls.Nodes.Get(3), newNode(4, 1))
+	before := resolveProbes(ring, probes)
+
+	moved, err := cls.AddNodeToRing(added, 0)
+	if err != nil {
+		t.Fatalf("1) Couldn't add node to ring: %s", err)
+	}
+	if added.Weight != 1 {
+		t.Errorf("2) Node added to the global ring should have a weight of 1, got %d", added.Weight)
+	}
+	if len(moved) == 0 {
+		t.Fatalf("3) Adding a node should have moved ranges")
+	}
+
+	after := resolveProbes(ring, probes)
+	if err := checkMovedRanges(probes, before, after, moved); err != nil {
+		t.Errorf("4) Moved ranges don't match the ring: %s", err)
+	}
+	if !inEachRange(added, moved, false) || inEachRange(added, moved, true) {
+		t.Errorf("5) Ranges should have moved to the added node: %v", moved)
+	}
+
+	if len(watcher.joined) != 1 || len(watcher.left) != 0 {
+		t.Fatalf("6) Watcher should have been notified once of the node joining, got %d joining and %d leaving", len(watcher.joined), len(watcher.left))
+	}
+	if change := watcher.joined[0]; change.node != added || change.ring != ring || len(change.moved) != len(moved) {
+		t.Errorf("7) Watcher should have been notified of the moved ranges, got %s in ring %d with %d ranges", change.node, change.ring.Id(), len(change.moved))
+	}
+
+	if _, err := cls.AddNodeToRing(added, 9); err == nil {
+		t.Errorf("8) Adding a node to a ring that doesn't exist should have failed")
+	}
+}
+
+func TestRemoveNodeFromRing(t *testing.T) {
+	removed := newNode(2, 1)
+	cls := newRingCluster("walk", 2, newNode(1, 1), removed, newNode(3, 1))
+	watcher := newRingWatcher()
+	cls.Notifier.Bind(watcher)
+
+	ring := cls.Rings.GetGlobalRing()
+	probes := probeTokens(cls.Nodes.Get(1), removed, cls.Nodes.Get(3))
+	before := resolveProbes(ring, probes)
+
+	moved, err := cls.RemoveNodeFromRing(removed, 0)
+	if err != nil {
+		t.Fatalf("1) Couldn't remove node from ring: %s", err)
+	}
+	if removed.Weight != 0 {
+		t.Errorf("2) Node removed from the global ring should have a weight of 0, got %d", removed.Weight)
+	}
+	if len(moved) == 0 {
+		t.Fatalf("3) Removing a node should have moved ranges")
+	}
+
+	after := resolveProbes(ring, probes)
+	if err := checkMovedRanges(probes, before, after, moved); err != nil {
+		t.Errorf("4) Moved ranges don't match the ring: %s", err)
+	}
+	if !inEachRange(removed, moved, true) || inEachRange(removed, moved, false) {
+		t.Errorf("5) Ranges should have moved away from the removed node: %v", moved)
+	}
+	for i := range after {
+		if after[i].InOnlineNodes(removed) {
+			t.Fatalf("6) Token %s still resolves to the removed node", probes[i])
+		}
+	}
+
+	if len(watcher.left) != 1 || len(watcher.joined) != 0 {
+		t.Fatalf("7) Watcher should have been notified once of the node leaving, got %d joining and %d leaving", len(watcher.joined), len(watcher.left))
+	}
+	if change := watcher.left[0]; change.node != removed || change.ring != ring || len(change.moved) != len(moved) {
+		t.Errorf("8) Watcher should have been notified of the moved ranges, got %s in ring %d with %d ranges", change.node, change.ring.Id(), len(change.moved))
+	}
+
+	if _, err := cls.RemoveNodeFromRing(removed, 0); err == nil {
+		t.Errorf("9) Removing a node that isn't in the ring should have failed")
+	}
+
+	// adding the node back moves the same ranges back to it
+	moved, err = cls.AddNodeToRing(removed, 0)
+	if err != nil {
+		t.Fatalf("10) Couldn't add node back to ring: %s", err)
+	}
+	if err := checkMovedRanges(probes, after, before, moved); err != nil {
+		t.Errorf("11) Moved ranges don't match the ring: %s", err)
+	}
+	restored := resolveProbes(ring, probes)
+	for i := range restored {
+		if !restored[i].SameNodes(before[i]) {
+			t.Fatalf("12) Token %s should have resolved to its nodes before the removal", probes[i])
+		}
+	}
+}
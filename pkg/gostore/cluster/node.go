@@ -21,6 +21,15 @@ const (
 	Status_Leaving
 )
 
+const (
+	// Set on the status byte of a serialized node when it is followed by the
+	// format version. Nodes serialized before weights and failure domains
+	// existed have no version, and are still written that way when they
+	// don't use them so that older nodes can read them.
+	NODE_FORMAT_FLAG    = 0x80
+	NODE_FORMAT_VERSION = 1 // weight, zone and rack
+)
+
 
 // Represents a node of a cluster
 type Node struct {
@@ -32,6 +41,14 @@ type Node struct {
 	UdpPort uint16
 	Status  byte
 
+	// Share of the global ring relative to other nodes, 0 if the node isn't
+	// part of it
+	Weight uint16
+
+	// Failure domains of the node, see TopologyPlacement
+	Zone string
+	Rack string
+
 	// Rings in which the node is member
 	Rings []NodeRing
 
@@ -53,6 +70,7 @@ func NewNode(id uint16, address net.IP, tcpport uint16, udpport uint16) *Node {
 	node.Address = address
 	node.TcpPort = tcpport
 	node.UdpPort = udpport
+	node.Weight = 1
 
 	node.Rings = make([]NodeRing, 0)
 
@@ -65,6 +83,7 @@ func NewAdhocNode(address net.IP, tcpport uint16, udpport uint16) *Node {
 	node.Address = address
 	node.TcpPort = tcpport
 	node.UdpPort = udpport
+	node.Weight = 1
 
 	node.Rings = make([]NodeRing, 0)
 
@@ -73,6 +92,7 @@ func NewAdhocNode(address net.IP, tcpport uint16, udpport uint16) *Node {
 
 func NewEmptyNode() *Node {
 	node := new(Node)
+	node.Weight = 1
 	node.Rings = make([]NodeRing, 0)
 	return node
 }
@@ -101,6 +121,20 @@ func (n *Node) Hash() string {
 	return n.hash
 }
 
+// Returns the tokens of the node in a ring where it has count virtual nodes.
+// Tokens only depend on the node id so that they don't move when the node
+// changes (status, address).
+func (n *Node) Tokens(count int) []string {
+	tokens := make([]string, count)
+	for i := 0; i < count; i++ {
+		hash := md5.New()
+		hash.Write([]byte(fmt.Sprintf("%d-%d", n.Id, i)))
+		tokens[i] = fmt.Sprintf("%x", hash.Sum())
+	}
+
+	return tokens
+}
+
 func (n *Node) ChangeTo(node *Node) {
 	node.Address = n.Address
 	node.TcpPort = n.TcpPort
@@ -131,6 +165,11 @@ func (n *Node) Equals(node *Node) bool {
 	return false
 }
 
+// Returns the rack of the node, unique across zones
+func (n *Node) rackKey() string {
+	return n.Zone + "/" + n.Rack
+}
+
 // Add a ring in which the node is member
 func (n *Node) AddRing(ringId byte, token string) {
 	nr := NodeRing{token, ringId}
@@ -147,6 +186,8 @@ func StatusToString(status byte) string {
 		return "D"
 	case Status_Joining:
 		return "J"
+	case Status_Disconnceting:
+		return "S"
 	}
 
 	return "?"
@@ -159,7 +200,17 @@ func (n *Node) Serialize(writer typedio.Writer) (err os.Error) {
 		return
 	}
 
-	err = writer.WriteUint8(n.Status) // status
+	versioned := n.Weight != 1 || n.Zone != "" || n.Rack != ""
+	if versioned {
+		err = writer.WriteUint8(n.Status | NODE_FORMAT_FLAG) // status, with version
+		if err != nil {
+			return
+		}
+
+		err = writer.WriteUint8(NODE_FORMAT_VERSION) // format version
+	} else {
+		err = writer.WriteUint8(n.Status) // status
+	}
 	if err != nil {
 		return
 	}
@@ -179,6 +230,23 @@ func (n *Node) Serialize(writer typedio.Writer) (err os.Error) {
 		return
 	}
 
+	if versioned {
+		err = writer.WriteUint16(n.Weight) // weight
+		if err != nil {
+			return
+		}
+
+		err = writer.WriteString(n.Zone) // zone
+		if err != nil {
+			return
+		}
+
+		err = writer.WriteString(n.Rack) // rack
+		if err != nil {
+			return
+		}
+	}
+
 	err = writer.WriteUint8(uint8(len(n.Rings))) // nb rings
 	if err != nil {
 		return
@@ -211,6 +279,19 @@ func (n *Node) Unserialize(reader typedio.Reader) (err os.Error) {
 		return err
 	}
 
+	var version uint8 // no version before weights existed
+	if n.Status&NODE_FORMAT_FLAG != 0 {
+		n.Status &^= NODE_FORMAT_FLAG
+
+		version, err = reader.ReadUint8() // format version
+		if err != nil {
+			return err
+		}
+		if version > NODE_FORMAT_VERSION {
+			return os.NewError(fmt.Sprintf("Unknown node format version %d", version))
+		}
+	}
+
 	strAddr, err := reader.ReadString() // address
 	if err != nil {
 		return err
@@ -227,6 +308,24 @@ func (n *Node) Unserialize(reader typedio.Reader) (err os.Error) {
 		return err
 	}
 
+	n.Weight, n.Zone, n.Rack = 1, "", ""
+	if version >= 1 {
+		n.Weight, err = reader.ReadUint16() // weight
+		if err != nil {
+			return err
+		}
+
+		n.Zone, err = reader.ReadString() // zone
+		if err != nil {
+			return err
+		}
+
+		n.Rack, err = reader.ReadString() // rack
+		if err != nil {
+			return err
+		}
+	}
+
 	nbRings, err := reader.ReadUint8() // nb rings
 	if err != nil {
 		return err
@@ -246,6 +345,8 @@ func (n *Node) Unserialize(reader typedio.Reader) (err os.Error) {
 		if err != nil {
 			return err
 		}
+
+		n.Rings[i] = nodeRing
 	}
 
 	return nil
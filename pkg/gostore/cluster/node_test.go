@@ -0,0 +1,124 @@
+package cluster_test
+
+import (
+	"net"
+	"testing"
+	"gostore/cluster"
+	"gostore/tools/buffer"
+)
+
+// Node 3, online, 127.0.0.1:30000/30001, token "abc" in ring 1, as
+// serialized before nodes had a weight, a zone and a rack
+var legacyNode = []byte{
+	0x03, 0x00, // id
+	0x02,                                           // status
+	0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // address size
+	0x31, 0x32, 0x37, 0x2e, 0x30, 0x2e, 0x30, 0x2e, 0x31, // address
+	0x30, 0x75, // tcp port
+	0x31, 0x75, // udp port
+	0x01,                                           // nb rings
+	0x01,                                           // ring
+	0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // token size
+	0x61, 0x62, 0x63, // token
+}
+
+func serializeNode(t *testing.T, node *cluster.Node) *buffer.Buffer {
+	buff := buffer.New()
+	if err := node.Serialize(buff); err != nil {
+		t.Fatalf("Couldn't serialize %s: %s", node, err)
+	}
+	buff.Seek(0, 0)
+	return buff
+}
+
+func TestUnserializeLegacyNode(t *testing.T) {
+	buff := buffer.New()
+	buff.Write(legacyNode)
+	buff.WriteUint16(4) // next node in a file or a commit log
+	buff.Seek(0, 0)
+
+	node := cluster.NewEmptyNode()
+	err := node.Unserialize(buff)
+	if err != nil {
+		t.Fatalf("1) Couldn't unserialize legacy node: %s", err)
+	}
+
+	if node.Id != 3 || node.Status != cluster.Status_Online || node.Address.String() != "127.0.0.1" || node.TcpPort != 30000 || node.UdpPort != 30001 {
+		t.Errorf("2) Legacy node wasn't unserialized correctly: %s %s %d %d", node, node.Address, node.TcpPort, node.UdpPort)
+	}
+	if node.Weight != 1 || node.Zone != "" || node.Rack != "" {
+		t.Errorf("3) Legacy node should have the default weight and no zone or rack: %d %s %s", node.Weight, node.Zone, node.Rack)
+	}
+	if len(node.Rings) != 1 || node.Rings[0].Ring != 1 || node.Rings[0].Token != "abc" {
+		t.Errorf("4) Legacy node should be in ring 1 at abc: %v", node.Rings)
+	}
+
+	if next, _ := buff.ReadUint16(); next != 4 {
+		t.Errorf("5) Unserializing should stop at the end of the legacy node, got %d", next)
+	}
+}
+
+func TestSerializeDefaultNodeAsLegacy(t *testing.T) {
+	node := cluster.NewNode(3, net.ParseIP("127.0.0.1"), 30000, 30001)
+	node.Status = cluster.Status_Online
+	node.AddRing(1, "abc")
+
+	// older nodes must still be able to read nodes that don't use weights
+	// and failure domains
+	data := serializeNode(t, node).Bytes()
+	if string(data) != string(legacyNode) {
+		t.Errorf("Node with default weight should be serialized as legacy: %v", data)
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	node := cluster.NewNode(3, net.ParseIP("127.0.0.1"), 30000, 30001)
+	node.Status = cluster.Status_Offline
+	node.Weight = 5
+	node.Zone = "us-east"
+	node.Rack = "r12"
+	node.AddRing(1, "abc")
+	node.AddRing(2, "def")
+
+	buff := serializeNode(t, node)
+	if data := buff.Bytes(); data[2]&cluster.NODE_FORMAT_FLAG == 0 || data[3] != cluster.NODE_FORMAT_VERSION {
+		t.Errorf("1) Node with a weight should be serialized with a version: %v", data[:4])
+	}
+
+	read := cluster.NewEmptyNode()
+	err := read.Unserialize(buff)
+	if err != nil {
+		t.Fatalf("2) Couldn't unserialize node: %s", err)
+	}
+
+	if read.Id != 3 || read.Status != cluster.Status_Offline || read.TcpPort != 30000 || read.UdpPort != 30001 {
+		t.Errorf("3) Node wasn't unserialized correctly: %s %d %d", read, read.TcpPort, read.UdpPort)
+	}
+	if read.Weight != 5 || read.Zone != "us-east" || read.Rack != "r12" {
+		t.Errorf("4) Weight and failure domains weren't unserialized: %d %s %s", read.Weight, read.Zone, read.Rack)
+	}
+	if len(read.Rings) != 2 || read.Rings[1].Ring != 2 || read.Rings[1].Token != "def" {
+		t.Errorf("5) Rings weren't unserialized: %v", read.Rings)
+	}
+
+	// a node removed from the global ring must keep its weight of 0
+	node.Weight = 0
+	node.Zone, node.Rack = "", ""
+	read = cluster.NewEmptyNode()
+	read.Unserialize(serializeNode(t, node))
+	if read.Weight != 0 {
+		t.Errorf("6) Node with a weight of 0 should stay out of the global ring, got %d", read.Weight)
+	}
+}
+
+func TestUnserializeUnknownVersion(t *testing.T) {
+	data := []byte{0x03, 0x00, 0x02 | cluster.NODE_FORMAT_FLAG, cluster.NODE_FORMAT_VERSION + 1}
+	buff := buffer.New()
+	buff.Write(data)
+	buff.Seek(0, 0)
+
+	node := cluster.NewEmptyNode()
+	if err := node.Unserialize(buff); err == nil {
+		t.Errorf("Node of an unknown format version shouldn't be unserialized")
+	}
+}
@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math"
+	"sort"
+	"gostore/tools/hashring"
+)
+
+// Strategy choosing the nodes of a ring that manage a token
+type Placement interface {
+	// Adds to the result the nodes of the hash ring managing the token, at
+	// most count of them, the first one being the master
+	Place(ring *hashring.HashRing, token string, count int, res *ResolveResult)
+
+	// Returns true if the nodes managing a token only change at tokens of
+	// the ring, so that moved ranges can be computed between them
+	Ranged() bool
+}
+
+// Returns the placement strategy of a name: "walk" (or empty), "rendezvous"
+// or "topology"
+func NewPlacement(name string) Placement {
+	switch name {
+	case "", "walk":
+		return new(WalkPlacement)
+	case "rendezvous":
+		return new(RendezvousPlacement)
+	case "topology":
+		return new(TopologyPlacement)
+	}
+
+	return nil
+}
+
+
+// Consistent hashing: nodes of the first tokens following the token,
+// clockwise
+type WalkPlacement struct{}
+
+func (p *WalkPlacement) Place(ring *hashring.HashRing, token string, count int, res *ResolveResult) {
+	// resolve the key in the ring
+	ringElem := ring.ResolveString(token)
+	if ringElem == nil {
+		return
+	}
+
+	// add the first node found
+	firstElem := ringElem
+	res.Add((firstElem.Value).(*Node))
+
+	// iterate until we have the replication factor we want or we went around
+	// the ring, skipping other tokens of nodes already found
+	for ringElem = ringElem.Next(); res.Count() < count && ringElem != firstElem; ringElem = ringElem.Next() {
+		res.Add((ringElem.Value).(*Node))
+	}
+}
+
+func (p *WalkPlacement) Ranged() bool { return true }
+
+
+// Rendezvous (highest random weight) hashing: the nodes having the highest
+// score for the token, scores being random but weighted by the nodes'
+// weight. Tokens of the nodes in the ring are ignored, and removing a node
+// only moves the keys it managed, but resolving is linear in the number of
+// nodes.
+type RendezvousPlacement struct{}
+
+func (p *RendezvousPlacement) Place(ring *hashring.HashRing, token string, count int, res *ResolveResult) {
+	values := ring.Values()
+	scored := make(scoredNodes, len(values))
+	for i, value := range values {
+		node := value.(*Node)
+		scored[i] = scoredNode{node, rendezvousScore(node, token)}
+	}
+	sort.Sort(scored)
+
+	for i := 0; i < len(scored) && res.Count() < count; i++ {
+		res.Add(scored[i].node)
+	}
+}
+
+func (p *RendezvousPlacement) Ranged() bool { return false }
+
+// Returns -weight/ln(h), h being a hash of the token and the node in (0,1),
+// which makes the probability of a node having the highest score
+// proportional to its weight
+func rendezvousScore(node *Node, token string) float64 {
+	hash := md5.New()
+	hash.Write([]byte(fmt.Sprintf("%s-%d", token, node.Id)))
+	sum := hash.Sum()
+
+	var h uint64
+	for i := 0; i < 8; i++ {
+		h = h<<8 | uint64(sum[i])
+	}
+	unit := (float64(h>>11) + 0.5) / (1 << 53)
+
+	weight := float64(node.Weight)
+	if weight == 0 {
+		weight = 1
+	}
+	return -weight / math.Log(unit)
+}
+
+type scoredNode struct {
+	node  *Node
+	score float64
+}
+
+type scoredNodes []scoredNode
+
+func (s scoredNodes) Len() int { return len(s) }
+
+func (s scoredNodes) Less(i, j int) bool {
+	if s[i].score == s[j].score {
+		return s[i].node.Id < s[j].node.Id
+	}
+	return s[i].score > s[j].score
+}
+
+func (s scoredNodes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+
+// Consistent hashing spreading replicas on distinct zones, then distinct
+// racks, declared per node. Walking the ring clockwise, nodes in a zone
+// already used are skipped, then nodes in a rack already used, and are only
+// used if there aren't enough zones or racks for all the replicas.
+type TopologyPlacement struct{}
+
+func (p *TopologyPlacement) Place(ring *hashring.HashRing, token string, count int, res *ResolveResult) {
+	ringElem := ring.ResolveString(token)
+	if ringElem == nil {
+		return
+	}
+
+	// zones and racks of the ring, to stop walking once all of them are used
+	zones, racks := make(map[string]bool), make(map[string]bool)
+	values := ring.Values()
+	for _, value := range values {
+		node := value.(*Node)
+		zones[node.Zone] = true
+		racks[node.rackKey()] = true
+	}
+
+	usedZones, usedRacks := make(map[string]bool), make(map[string]bool)
+	seen := make(map[uint16]bool)
+	sameZone, sameRack := make([]*Node, 0), make([]*Node, 0)
+
+	add := func(node *Node) {
+		res.Add(node)
+		usedZones[node.Zone] = true
+		usedRacks[node.rackKey()] = true
+	}
+
+	firstElem := ringElem
+	for {
+		node := (ringElem.Value).(*Node)
+		if !seen[node.Id] {
+			seen[node.Id] = true
+
+			switch {
+			case !usedZones[node.Zone]:
+				add(node)
+			case !usedRacks[node.rackKey()]:
+				sameZone = append(sameZone, node)
+			default:
+				sameRack = append(sameRack, node)
+			}
+		}
+
+		ringElem = ringElem.Next()
+		if res.Count() >= count || len(seen) == len(values) || ringElem == firstElem || len(usedZones) == len(zones) {
+			break
+		}
+	}
+
+	// no zone left, use the nodes of racks not used yet
+	for _, node := range sameZone {
+		if res.Count() < count && !usedRacks[node.rackKey()] {
+			add(node)
+		} else {
+			sameRack = append(sameRack, node)
+		}
+	}
+
+	// keep walking for nodes in other racks as long as there are some
+	for res.Count() < count && len(seen) < len(values) && ringElem != firstElem && len(usedRacks) < len(racks) {
+		node := (ringElem.Value).(*Node)
+		if !seen[node.Id] {
+			seen[node.Id] = true
+
+			if !usedRacks[node.rackKey()] {
+				add(node)
+			} else {
+				sameRack = append(sameRack, node)
+			}
+		}
+		ringElem = ringElem.Next()
+	}
+
+	// no rack left either, use nodes in racks already used
+	for _, node := range sameRack {
+		if res.Count() >= count {
+			return
+		}
+		add(node)
+	}
+	for ; res.Count() < count && len(seen) < len(values) && ringElem != firstElem; ringElem = ringElem.Next() {
+		node := (ringElem.Value).(*Node)
+		if !seen[node.Id] {
+			seen[node.Id] = true
+			add(node)
+		}
+	}
+}
+
+func (p *TopologyPlacement) Ranged() bool { return true }
@@ -0,0 +1,145 @@
+package cluster_test
+
+import (
+	"testing"
+	"gostore/cluster"
+)
+
+// Returns a node in a zone and rack
+func newPlacedNode(id uint16, zone, rack string) *cluster.Node {
+	node := newNode(id, 1)
+	node.Zone = zone
+	node.Rack = rack
+	return node
+}
+
+// 8 nodes in 3 zones and 6 racks, some racks having many nodes
+func topologyNodes() []*cluster.Node {
+	return []*cluster.Node{
+		newPlacedNode(1, "a", "r1"), newPlacedNode(2, "a", "r1"), newPlacedNode(3, "a", "r2"),
+		newPlacedNode(4, "b", "r1"), newPlacedNode(5, "b", "r2"),
+		newPlacedNode(6, "c", "r1"), newPlacedNode(7, "c", "r1"), newPlacedNode(8, "c", "r2"),
+	}
+}
+
+// Returns the number of distinct zones and racks of the resolved nodes
+func failureDomains(res *cluster.ResolveResult) (zones int, racks int) {
+	zoneSet, rackSet := make(map[string]bool), make(map[string]bool)
+	for i := 0; i < res.Count(); i++ {
+		node := res.Get(i)
+		zoneSet[node.Zone] = true
+		rackSet[node.Zone+"/"+node.Rack] = true
+	}
+	return len(zoneSet), len(rackSet)
+}
+
+func TestTopologyPlacement(t *testing.T) {
+	walk := resolveKeys(newRingCluster("walk", 1, topologyNodes()...).Rings.GetGlobalRing())
+
+	// replication factor: nodes, zones and racks expected
+	for repFactor, expected := range map[int][3]int{1: [3]int{1, 1, 1}, 2: [3]int{2, 2, 2}, 3: [3]int{3, 3, 3}, 5: [3]int{5, 3, 5}, 8: [3]int{8, 3, 6}, 10: [3]int{8, 3, 6}} {
+		cls := newRingCluster("topology", repFactor, topologyNodes()...)
+		for i, res := range resolveKeys(cls.Rings.GetGlobalRing()) {
+			if err := checkReplicas(res, expected[0]); err != nil {
+				t.Fatalf("1) Key %d has wrong replicas with a replication factor of %d: %s", i, repFactor, err)
+			}
+
+			if zones, racks := failureDomains(res); zones != expected[1] || racks != expected[2] {
+				t.Fatalf("2) Replicas of key %d should have been in %d zones and %d racks with a replication factor of %d, got %d and %d", i, expected[1], expected[2], repFactor, zones, racks)
+			}
+
+			// the master is the node of the first token, as when walking
+			if res.GetFirst().Id != walk[i].GetFirst().Id {
+				t.Fatalf("3) Master of key %d should have been %d, got %d", i, walk[i].GetFirst().Id, res.GetFirst().Id)
+			}
+		}
+	}
+
+	// a single zone still spreads replicas on racks
+	cls := newRingCluster("topology", 2, newPlacedNode(1, "a", "r1"), newPlacedNode(2, "a", "r1"), newPlacedNode(3, "a", "r2"))
+	for i, res := range resolveKeys(cls.Rings.GetGlobalRing()) {
+		if _, racks := failureDomains(res); res.Count() != 2 || racks != 2 {
+			t.Fatalf("4) Replicas of key %d should have been in 2 racks, got %d nodes in %d racks", i, res.Count(), racks)
+		}
+	}
+}
+
+func TestRendezvousPlacementWeights(t *testing.T) {
+	cls := newRingCluster("rendezvous", 1, newNode(1, 1), newNode(2, 1), newNode(3, 2), newNode(4, 4))
+
+	shares := masterShares(resolveKeys(cls.Rings.GetGlobalRing()))
+	for id, weight := range map[uint16]float64{1: 1, 2: 1, 3: 2, 4: 4} {
+		expected := weight / 8
+		if shares[id] < expected*0.9 || shares[id] > expected*1.1 {
+			t.Errorf("1) Node %d of weight %.0f should have had a share of %.3f, got %.3f", id, weight, expected, shares[id])
+		}
+	}
+
+	cls = newRingCluster("rendezvous", 3, newNode(1, 1), newNode(2, 1), newNode(3, 2), newNode(4, 4))
+	for i, res := range resolveKeys(cls.Rings.GetGlobalRing()) {
+		if err := checkReplicas(res, 3); err != nil {
+			t.Fatalf("2) Key %d has wrong replicas: %s", i, err)
+		}
+	}
+}
+
+func TestRendezvousPlacementRemove(t *testing.T) {
+	removed := newNode(5, 1)
+	cls := newRingCluster("rendezvous", 2, newNode(1, 1), newNode(2, 1), newNode(3, 1), newNode(4, 1), removed)
+	watcher := newRingWatcher()
+	cls.Notifier.Bind(watcher)
+
+	ring := cls.Rings.GetGlobalRing()
+	before := resolveKeys(ring)
+
+	// ranges can't be computed, the whole ring moves
+	moved, err := cls.RemoveNodeFromRing(removed, 0)
+	if err != nil {
+		t.Fatalf("1) Couldn't remove node from ring: %s", err)
+	}
+	if len(moved) != 1 || moved[0].Start != moved[0].End || moved[0].From.Count() != 0 || moved[0].To.Count() != 0 {
+		t.Errorf("2) Removing a node should have moved the whole ring, got %v", moved)
+	}
+	if len(watcher.left) != 1 {
+		t.Errorf("3) Watcher should have been notified of the node leaving, got %d", len(watcher.left))
+	}
+
+	// keys only move away from the removed node, the others keeping their
+	// nodes in the same order
+	after := resolveKeys(ring)
+	movedKeys := 0
+	for i := range before {
+		kept := 0
+		for j := 0; j < before[i].Count(); j++ {
+			node := before[i].Get(j)
+			if node.Id == removed.Id {
+				continue
+			}
+			if kept >= after[i].Count() || after[i].Get(kept).Id != node.Id {
+				t.Fatalf("4) Key %d moved away from %d although it wasn't on the removed node", i, node.Id)
+			}
+			kept++
+		}
+
+		if after[i].InOnlineNodes(removed) {
+			t.Fatalf("5) Key %d still resolves to the removed node", i)
+		}
+		if kept < before[i].Count() {
+			movedKeys++
+		}
+	}
+	if movedKeys == 0 {
+		t.Errorf("6) Some keys should have been on the removed node")
+	}
+
+	// adding the node back moves its keys back to it
+	if _, err := cls.AddNodeToRing(removed, 0); err != nil {
+		t.Fatalf("7) Couldn't add node back to ring: %s", err)
+	}
+	restored := resolveKeys(ring)
+	for i := range restored {
+		if !restored[i].SameNodes(before[i]) {
+			t.Fatalf("8) Key %d should have resolved to its nodes before the removal", i)
+		}
+	}
+}
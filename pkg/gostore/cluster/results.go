@@ -92,6 +92,21 @@ func (r *ResolveResult) GetFirst() *Node {
 	return nil
 }
 
+// Returns true if both results have the same nodes, in the same order
+func (r *ResolveResult) SameNodes(other *ResolveResult) bool {
+	if r.Count() != other.Count() {
+		return false
+	}
+
+	for i := 0; i < r.Count(); i++ {
+		if r.Get(i).Id != other.Get(i).Id {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (r *ResolveResult) IsFirst(node *Node) bool {
 	if r.Count() > 0 && r.Get(0).Equals(node) {
 		return true
@@ -7,6 +7,7 @@ import (
 	"crypto/md5"
 	"gostore/log"
 	"fmt"
+	"sync"
 	"gostore/tools/hashring"
 )
 
@@ -17,6 +18,10 @@ type Ring struct {
 	id        uint8
 	ring      *hashring.HashRing
 	repFactor int
+	vnodes    int // tokens of a node of weight 1 (see AddNodeTokens)
+	placement Placement
+
+	mutex *sync.Mutex // serializes membership changes
 }
 
 // Returns a new cluster ring
@@ -24,14 +29,46 @@ func NewRing(repFactor int) *Ring {
 	cr := new(Ring)
 	cr.ring = hashring.NewRing()
 	cr.repFactor = repFactor
+	cr.vnodes = DEFAULT_VIRTUAL_NODES
+	cr.placement = new(WalkPlacement)
+	cr.mutex = new(sync.Mutex)
 	return cr
 }
 
+// Changes the strategy choosing the nodes managing tokens
+func (cr *Ring) SetPlacement(placement Placement) {
+	cr.placement = placement
+}
+
+// Returns the id of the ring in the cluster
+func (cr *Ring) Id() uint8 {
+	return cr.id
+}
+
 // Adds a node to the current ring
 func (cr *Ring) AddNode(token string, node *Node) {
 	cr.ring.AddElement(hashring.NewElement(token, node))
 }
 
+// Adds a node to the current ring at tokens derived from its id, as many
+// as the ring's virtual nodes times the node's weight
+func (cr *Ring) AddNodeTokens(node *Node) {
+	cr.ring.AddElements(nodeElements(node, cr.nodeTokens(node))...)
+}
+
+// Returns the tokens derived from the id of a node in this ring
+func (cr *Ring) nodeTokens(node *Node) []string {
+	return node.Tokens(cr.vnodes * int(node.Weight))
+}
+
+func nodeElements(node *Node, tokens []string) []*hashring.Element {
+	elements := make([]*hashring.Element, len(tokens))
+	for i, token := range tokens {
+		elements[i] = hashring.NewElement(token, node)
+	}
+	return elements
+}
+
 // Return string representatin of the ring
 func (cr *Ring) String() string {
 	nodes := ""
@@ -72,29 +109,20 @@ func (cr *Ring) Resolve(key string) *ResolveResult {
 // Ex: 	if only 1 node is in the ring and using a replicator factor
 // 		of 2, only 1 node will be returned
 func (cr *Ring) ResolveToken(token string) *ResolveResult {
-	res := new(ResolveResult)
-	res.token = token
-
-	// resolve the key in the ring
-	ringElem := cr.ring.ResolveString(token)
-	if ringElem == nil {
+	res := cr.resolve(cr.ring, token)
+	if res.Count() == 0 {
 		log.Fatal("Cluster: Got no element in ring %s for resolving of %s", cr, token)
 	}
 
-	// add the first node found
-	firstNode := (ringElem.Value).(*Node)
-	res.Add(firstNode)
-
-	// iterate until we have the replication factor we want
-	var curNode *Node
-	for i := res.Count(); res.Count() < cr.repFactor && curNode != firstNode; i++ {
-		nextElem := ringElem.Next()
-
-		curNode = (nextElem.Value).(*Node)
-		res.Add(curNode)
-
-		ringElem = nextElem
-	}
+	return res
+}
 
+// Resolves nodes that are manager for a given token in a hash ring having
+// the nodes of this ring, or a previous version of it. No nodes are returned
+// if the hash ring is empty.
+func (cr *Ring) resolve(ring *hashring.HashRing, token string) *ResolveResult {
+	res := new(ResolveResult)
+	res.token = token
+	cr.placement.Place(ring, token, cr.repFactor, res)
 	return res
 }
@@ -0,0 +1,188 @@
+package cluster_test
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"gostore"
+	"gostore/cluster"
+)
+
+const KEYS_COUNT = 10000
+
+// Returns an online node of the given weight
+func newNode(id uint16, weight uint16) *cluster.Node {
+	node := cluster.NewNode(id, net.ParseIP("127.0.0.1"), 30000+2*id, 30001+2*id)
+	node.Status = cluster.Status_Online
+	node.Weight = weight
+	return node
+}
+
+// Returns a cluster having the nodes in its global ring 0, of the given
+// placement and replication factor
+func newRingCluster(placement string, repFactor int, nodes ...*cluster.Node) *cluster.Cluster {
+	rings := []gostore.ConfigRing{gostore.ConfigRing{Id: 0, ReplicationFactor: uint8(repFactor), Placement: placement}}
+	cls := cluster.NewCluster(gostore.Config{Rings: rings, GlobalRing: 0})
+	for _, node := range nodes {
+		cls.MergeNode(node, false)
+	}
+	return cls
+}
+
+// Returns the token of the i-th test key
+func keyToken(i int) string {
+	hash := md5.New()
+	hash.Write([]byte(fmt.Sprintf("key%d", i)))
+	return fmt.Sprintf("%x", hash.Sum())
+}
+
+// Resolves the test keys in a ring
+func resolveKeys(ring *cluster.Ring) []*cluster.ResolveResult {
+	results := make([]*cluster.ResolveResult, KEYS_COUNT)
+	for i := range results {
+		results[i] = ring.ResolveToken(keyToken(i))
+	}
+	return results
+}
+
+// Returns the share of the keys each node is master of
+func masterShares(results []*cluster.ResolveResult) map[uint16]float64 {
+	shares := make(map[uint16]float64)
+	for _, res := range results {
+		shares[res.GetFirst().Id] += 1 / float64(len(results))
+	}
+	return shares
+}
+
+// Returns an error if a result has a node twice or not count nodes
+func checkReplicas(res *cluster.ResolveResult, count int) os.Error {
+	if res.Count() != count {
+		return os.NewError(fmt.Sprintf("expected %d nodes, got %d", count, res.Count()))
+	}
+
+	seen := make(map[uint16]bool)
+	for i := 0; i < res.Count(); i++ {
+		id := res.Get(i).Id
+		if seen[id] {
+			return os.NewError(fmt.Sprintf("node %d resolved twice", id))
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func TestWeightedTokens(t *testing.T) {
+	cls := newRingCluster("walk", 1, newNode(1, 1), newNode(2, 2), newNode(3, 3), newNode(4, 0))
+
+	// a heavier node keeps the tokens it had, so that only keys moving to
+	// it change nodes
+	node := cls.Nodes.Get(3)
+	light, heavy := node.Tokens(cluster.DEFAULT_VIRTUAL_NODES), node.Tokens(cluster.DEFAULT_VIRTUAL_NODES*3)
+	for i := range light {
+		if light[i] != heavy[i] {
+			t.Fatalf("1) Token %d of the node changed with its weight: %s to %s", i, light[i], heavy[i])
+		}
+	}
+
+	shares := masterShares(resolveKeys(cls.Rings.GetGlobalRing()))
+	for id, weight := range map[uint16]float64{1: 1, 2: 2, 3: 3} {
+		expected := weight / 6
+		if shares[id] < expected*0.8 || shares[id] > expected*1.2 {
+			t.Errorf("2) Node %d of weight %.0f should have had a share of %.3f, got %.3f", id, weight, expected, shares[id])
+		}
+	}
+
+	if shares[4] != 0 {
+		t.Errorf("3) Node of weight 0 shouldn't have any key, got a share of %.3f", shares[4])
+	}
+}
+
+func TestWalkPlacementReplicas(t *testing.T) {
+	// heavy node has many consecutive tokens that must be skipped
+	cls := newRingCluster("walk", 3, newNode(1, 1), newNode(2, 8), newNode(3, 1), newNode(4, 2), newNode(5, 1))
+	for i, res := range resolveKeys(cls.Rings.GetGlobalRing()) {
+		if err := checkReplicas(res, 3); err != nil {
+			t.Fatalf("1) Key %d has wrong replicas: %s", i, err)
+		}
+	}
+
+	// replication factor above the number of nodes
+	cls = newRingCluster("walk", 5, newNode(1, 1), newNode(2, 3), newNode(3, 1))
+	for i, res := range resolveKeys(cls.Rings.GetGlobalRing()) {
+		if err := checkReplicas(res, 3); err != nil {
+			t.Fatalf("2) Key %d has wrong replicas: %s", i, err)
+		}
+	}
+}
+
+func TestTokensIgnoreStatus(t *testing.T) {
+	cls := newRingCluster("walk", 2, newNode(1, 1), newNode(2, 1), newNode(3, 2))
+	watcher := newRingWatcher()
+	cls.Notifier.Bind(watcher)
+
+	node := cls.Nodes.Get(2)
+	tokens := node.Tokens(cluster.DEFAULT_VIRTUAL_NODES)
+	before := resolveKeys(cls.Rings.GetGlobalRing())
+
+	if !cls.ChangeNodeStatus(node, cluster.Status_Offline, cluster.Status_Online) {
+		t.Fatalf("1) Node should have gone offline")
+	}
+	changed := node.Tokens(cluster.DEFAULT_VIRTUAL_NODES)
+	for i := range tokens {
+		if tokens[i] != changed[i] {
+			t.Fatalf("2) Token %d of the node changed with its status: %s to %s", i, tokens[i], changed[i])
+		}
+	}
+
+	// merging the node with a new status doesn't move it in the ring either
+	joining := newNode(2, 1)
+	joining.Status = cluster.Status_Joining
+	cls.MergeNode(joining, true)
+	if node.Status != cluster.Status_Joining {
+		t.Fatalf("3) Merged node should be joining, got %s", node)
+	}
+
+	after := resolveKeys(cls.Rings.GetGlobalRing())
+	for i := range before {
+		if !before[i].SameNodes(after[i]) {
+			t.Fatalf("4) Key %d moved when the status of a node changed", i)
+		}
+	}
+	if len(watcher.joined) != 0 || len(watcher.left) != 0 {
+		t.Errorf("5) No ring change should have been notified, got %d joining and %d leaving", len(watcher.joined), len(watcher.left))
+	}
+}
+
+// Watcher recording the ring changes it is notified of
+type ringWatcher struct {
+	joined []ringChange
+	left   []ringChange
+}
+
+type ringChange struct {
+	node  *cluster.Node
+	ring  *cluster.Ring
+	moved []*cluster.MovedRange
+}
+
+func newRingWatcher() *ringWatcher {
+	return &ringWatcher{make([]ringChange, 0), make([]ringChange, 0)}
+}
+
+func (w *ringWatcher) NodeJoining(node *cluster.Node)       {}
+func (w *ringWatcher) NodeConnecting(node *cluster.Node)    {}
+func (w *ringWatcher) NodeOnline(node *cluster.Node)        {}
+func (w *ringWatcher) NodeDisconnecting(node *cluster.Node) {}
+func (w *ringWatcher) NodeOffline(node *cluster.Node)       {}
+func (w *ringWatcher) NodeLeaving(node *cluster.Node)       {}
+func (w *ringWatcher) NodeLeaved(node *cluster.Node)        {}
+
+func (w *ringWatcher) NodeJoiningRing(node *cluster.Node, ring *cluster.Ring, moved []*cluster.MovedRange) {
+	w.joined = append(w.joined, ringChange{node, ring, moved})
+}
+
+func (w *ringWatcher) NodeLeavingRing(node *cluster.Node, ring *cluster.Ring, moved []*cluster.MovedRange) {
+	w.left = append(w.left, ringChange{node, ring, moved})
+}
@@ -22,7 +22,17 @@ func newRingsConfig(ringConfigs []gostore.ConfigRing, globalRing byte) *Rings {
 	rings.globalRing = globalRing
 
 	for _, confring := range ringConfigs {
-		rings.AddRing(confring.Id, NewRing(int(confring.ReplicationFactor)))
+		ring := NewRing(int(confring.ReplicationFactor))
+		if confring.VirtualNodes > 0 {
+			ring.vnodes = int(confring.VirtualNodes)
+		}
+
+		placement := NewPlacement(confring.Placement)
+		if placement == nil {
+			log.Fatal("Unknown placement %s for ring %d", confring.Placement, confring.Id)
+		}
+		ring.SetPlacement(placement)
+		rings.AddRing(confring.Id, ring)
 	}
 
 	if rings.GetRing(globalRing) == nil {
@@ -47,6 +57,7 @@ func (r *Rings) AddRing(index uint8, ring *Ring) {
 		r.rings = newRings
 	}
 
+	ring.id = index
 	r.rings[index] = ring
 	r.count++
 }
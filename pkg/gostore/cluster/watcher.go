@@ -9,9 +9,12 @@ type Watcher interface {
 	NodeLeaving(node *Node)
 	NodeLeaved(node *Node)
 
-	//NodeJoiningRing(node *Node, nodeRing NodeRing, ring *Ring)
+	// A node got new tokens in a ring, moving the given ranges to it
+	NodeJoiningRing(node *Node, ring *Ring, moved []*MovedRange)
 	//NodeJoinedRing(node *Node, nodeRing NodeRing, ring *Ring)
-	//NodeLeavingRing(node *Node, nodeRing NodeRing, ring *Ring)
+
+	// A node lost its tokens in a ring, moving the given ranges away from it
+	NodeLeavingRing(node *Node, ring *Ring, moved []*MovedRange)
 	//NodeLeavedRing(node *Node, nodeRing NodeRing, ring *Ring)
 }
 
@@ -53,10 +56,31 @@ func (wn *WatcherNotifier) NotifyNodeDisconnecting(node *Node) {
 }
 
 func (wn *WatcherNotifier) NotifyNodeOffline(node *Node) {
+	for _, watcher := range wn.watchers {
+		watcher.NodeOffline(node)
+	}
 }
 
 func (wn *WatcherNotifier) NotifyNodeLeaving(node *Node) {
+	for _, watcher := range wn.watchers {
+		watcher.NodeLeaving(node)
+	}
 }
 
 func (wn *WatcherNotifier) NotifyNodeLeaved(node *Node) {
+	for _, watcher := range wn.watchers {
+		watcher.NodeLeaved(node)
+	}
+}
+
+func (wn *WatcherNotifier) NotifyNodeJoiningRing(node *Node, ring *Ring, moved []*MovedRange) {
+	for _, watcher := range wn.watchers {
+		watcher.NodeJoiningRing(node, ring, moved)
+	}
+}
+
+func (wn *WatcherNotifier) NotifyNodeLeavingRing(node *Node, ring *Ring, moved []*MovedRange) {
+	for _, watcher := range wn.watchers {
+		watcher.NodeLeavingRing(node, ring, moved)
+	}
 }
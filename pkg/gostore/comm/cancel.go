@@ -0,0 +1,225 @@
+package comm
+
+import (
+	"container/list"
+	"gostore/cluster"
+	"sync"
+)
+
+const (
+	NET_FUNC_CANCEL = RESERVED_FUNCTIONS + 1 // Cancellation of a call chain
+)
+
+// Call chains going through this node, so that they can be canceled. A chain
+// is identified by the key of its initial message and is made of the message
+// being handled here, the nodes it has been redirected to and the messages
+// sent on its behalf (see Message.Follow). Canceling a chain aborts all of
+// them, on this node and on the next hops.
+type cancelRegistry struct {
+	comm  *Comm
+	mutex *sync.Mutex
+
+	entries map[string]*cancelEntry
+	order   *list.List // oldest first
+}
+
+type cancelEntry struct {
+	key  string
+	time int64
+	elem *list.Element
+
+	canceled bool
+	messages []*Message      // messages of the chain handled by this node
+	forwards []*cluster.Node // nodes to which the message has been redirected
+	children []*Message      // messages sent on behalf of the chain
+}
+
+func newCancelRegistry(comm *Comm) *cancelRegistry {
+	cr := new(cancelRegistry)
+	cr.comm = comm
+	cr.mutex = new(sync.Mutex)
+	cr.entries = make(map[string]*cancelEntry)
+	cr.order = list.New()
+	return cr
+}
+
+// Returns the entry of a chain, creating it if needed. Must be called with
+// the mutex locked.
+func (cr *cancelRegistry) getEntry(key string) *cancelEntry {
+	now := cr.comm.clock.Now()
+	retention := int64(cr.comm.DedupRetention) * 1000 * 1000
+
+	// expire old chains, they can't be canceled anymore
+	for cr.order.Len() > 0 {
+		front := cr.order.Front()
+		entry := front.Value.(*cancelEntry)
+		if now-entry.time < retention && cr.order.Len() <= cr.comm.DedupMaxEntries {
+			break
+		}
+
+		cr.order.Remove(front)
+		cr.entries[entry.key] = nil, false
+	}
+
+	entry, found := cr.entries[key]
+	if !found {
+		entry = new(cancelEntry)
+		entry.key = key
+		entry.time = now
+		entry.elem = cr.order.PushBack(entry)
+		cr.entries[key] = entry
+	}
+
+	return entry
+}
+
+// Registers a message received by this node. Returns false if its chain has
+// already been canceled.
+func (cr *cancelRegistry) received(message *Message) bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	entry := cr.getEntry(message.Key().String())
+	if entry.canceled {
+		message.cancel()
+		return false
+	}
+
+	entry.messages = append(entry.messages, message)
+	return true
+}
+
+// Unregisters a message once handled by its service function, it can't be
+// canceled anymore on this node.
+func (cr *cancelRegistry) handled(message *Message) {
+	cr.mutex.Lock()
+	entry, found := cr.entries[message.Key().String()]
+	if found {
+		for i, other := range entry.messages {
+			if other == message {
+				entry.messages = append(entry.messages[:i], entry.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	cr.mutex.Unlock()
+}
+
+// Registers the redirection of a message to another node
+func (cr *cancelRegistry) forwarded(message *Message, node *cluster.Node) {
+	cr.mutex.Lock()
+	entry := cr.getEntry(message.Key().String())
+	entry.forwards = append(entry.forwards, node)
+	cr.mutex.Unlock()
+}
+
+// Registers a message sent on behalf of a chain. Returns false if the chain
+// has already been canceled.
+func (cr *cancelRegistry) followed(message *Message) bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	entry := cr.getEntry(message.parentKey)
+	if entry.canceled {
+		return false
+	}
+
+	// retries are sent again, but only need to be registered once
+	for _, child := range entry.children {
+		if child == message {
+			return true
+		}
+	}
+
+	entry.children = append(entry.children, message)
+	return true
+}
+
+// Marks a message as canceled
+func (cr *cancelRegistry) mark(message *Message) {
+	cr.mutex.Lock()
+	message.cancel()
+	cr.mutex.Unlock()
+}
+
+// Cancels a chain on this node and returns the nodes and messages the
+// cancellation needs to be propagated to.
+func (cr *cancelRegistry) cancel(key string) (forwards []*cluster.Node, children []*Message) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	entry := cr.getEntry(key)
+	if entry.canceled {
+		return nil, nil
+	}
+	entry.canceled = true
+
+	for _, message := range entry.messages {
+		message.cancel()
+	}
+
+	forwards, children = entry.forwards, entry.children
+	entry.messages, entry.forwards, entry.children = nil, nil, nil
+	return
+}
+
+// Cancels a message sent by this node and the whole call chain it started:
+// stops tracking it, calls its OnError callback with ErrorCanceled and sends
+// a cancel message to the node handling it, which propagates it to the next
+// hops and to messages sent on behalf of the call.
+func (comm *Comm) Cancel(message *Message) {
+	key := message.Key().String()
+
+	var destination *cluster.Node
+	comm.trackersMutex.Lock()
+	tracker, tracked := comm.messageTrackers[key]
+	if tracked {
+		destination = tracker.destination
+		comm.removeTracker(tracker)
+	}
+	comm.trackersMutex.Unlock()
+
+	comm.logger.Debug("Canceling message %s", message)
+	comm.cancels.mark(message)
+
+	if destination != nil && !destination.Equals(comm.Cluster.MyNode) {
+		comm.sendCancel(destination, key)
+	}
+	comm.cancelChain(key)
+
+	if tracked && message.OnError != nil {
+		go message.OnError(message, ErrorCanceled)
+	}
+}
+
+// Cancels a chain on this node and propagates the cancellation
+func (comm *Comm) cancelChain(key string) {
+	forwards, children := comm.cancels.cancel(key)
+
+	for _, node := range forwards {
+		comm.sendCancel(node, key)
+	}
+
+	for _, child := range children {
+		comm.Cancel(child)
+	}
+}
+
+func (comm *Comm) sendCancel(node *cluster.Node, key string) {
+	message := comm.NewMsgMessage(NET_SERVICE)
+	message.FunctionId = NET_FUNC_CANCEL
+	message.Message.WriteString(key) // key of the canceled message
+	comm.SendNode(node, message)
+}
+
+// Handles a cancel message sent by the previous hop of a chain
+func (comm *Comm) handleCancel(message *Message) {
+	key, err := message.Message.ReadString() // key of the canceled message
+	if err != nil {
+		comm.logger.Error("Couldn't read cancel message %s: %s", message, err)
+		return
+	}
+
+	comm.logger.Debug("Received cancellation of %s", key)
+	comm.cancelChain(key)
+}
@@ -0,0 +1,157 @@
+package comm_test
+
+import (
+	"os"
+	"testing"
+	"time"
+	"gostore/cluster"
+	"gostore/comm"
+)
+
+// Echo service relaying the calls of its RemoteRelay function to the
+// RemoteLater function of the next node, on behalf of the relayed call
+type relayService struct {
+	*echoService
+
+	next  *cluster.Node
+	delay int64         // ns spent before relaying
+	errs  chan os.Error // errors of the relayed calls
+}
+
+func (rs *relayService) Functions() map[string]byte {
+	functions := rs.echoService.Functions()
+	functions["RemoteRelay"] = comm.RESERVED_FUNCTIONS + 4
+	return functions
+}
+
+func (rs *relayService) RemoteRelay(message *comm.Message) {
+	payload := message.Message.Bytes()[:message.Message.Size]
+
+	rs.mutex.Lock()
+	rs.received = append(rs.received, string(payload))
+	rs.mutex.Unlock()
+
+	<-rs.comm.Clock().After(rs.delay)
+
+	relayed := rs.comm.NewMsgMessage(ECHO_SERVICE)
+	relayed.Function = "RemoteLater"
+	relayed.Message.Write(payload)
+	relayed.Timeout = WAIT_TIMEOUT
+	relayed.Follow(message)
+
+	relayed.OnResponse = func(response *comm.Message) {
+		answer := rs.comm.NewMsgMessage(ECHO_SERVICE)
+		answer.Message.Write(response.Message.Bytes()[:response.Message.Size])
+		rs.comm.RespondSource(message, answer)
+	}
+	relayed.OnError = func(response *comm.Message, err os.Error) {
+		rs.errs <- err
+		rs.comm.RespondError(message, err)
+	}
+
+	rs.comm.SendNode(rs.next, relayed)
+}
+
+// Returns a cluster of 3 nodes in which node 1 relays to node 2 after a delay
+func newRelayCluster(delay int) (*testCluster, *relayService) {
+	var relay *relayService
+	tc := newTestClusterServices(3, comm.NewMemoryTransport(), func(i int, es *echoService) comm.Service {
+		rs := &relayService{echoService: es, delay: int64(delay) * 1000 * 1000, errs: make(chan os.Error, 1)}
+		if i == 1 {
+			relay = rs
+		}
+		return rs
+	})
+	relay.next = tc.node(1, 2)
+
+	return tc, relay
+}
+
+// Returns the error of a relayed call, nil if it didn't fail in time
+func relayedError(rs *relayService) os.Error {
+	select {
+	case err := <-rs.errs:
+		return err
+	case <-time.After(WAIT_TIMEOUT * 1000 * 1000):
+	}
+	return nil
+}
+
+func TestCancelChain(t *testing.T) {
+	tc, relay := newRelayCluster(0)
+
+	// the relayed call is being handled by the last node when canceled
+	message := tc.comms[0].NewMsgMessage(ECHO_SERVICE)
+	message.Function = "RemoteRelay"
+	message.Message.Write([]byte("inflight"))
+	message.Timeout = WAIT_TIMEOUT
+	errs := make(chan os.Error, 1)
+	message.OnError = func(response *comm.Message, err os.Error) {
+		errs <- err
+	}
+	tc.comms[0].SendNode(tc.node(0, 1), message)
+
+	if !waitFor(func() bool { return len(tc.echos[2].Received()) == 1 }) {
+		t.Fatalf("1) Relayed call should have reached the last node")
+	}
+	message.Cancel()
+
+	if err := <-errs; err != comm.ErrorCanceled {
+		t.Errorf("2) Canceled call should have failed with %s, got %s", comm.ErrorCanceled, err)
+	}
+	if err := relayedError(relay); err != comm.ErrorCanceled {
+		t.Errorf("3) Relayed call should have been canceled, got %s", err)
+	}
+
+	// the call is canceled before being relayed
+	tc, relay = newRelayCluster(300)
+
+	message = tc.comms[0].NewMsgMessage(ECHO_SERVICE)
+	message.Function = "RemoteRelay"
+	message.Message.Write([]byte("later"))
+	message.Timeout = WAIT_TIMEOUT
+	tc.comms[0].SendNode(tc.node(0, 1), message)
+
+	if !waitFor(func() bool { return len(tc.echos[1].Received()) == 1 }) {
+		t.Fatalf("4) Call should have reached the relay")
+	}
+	message.Cancel()
+
+	if err := relayedError(relay); err != comm.ErrorCanceled {
+		t.Errorf("5) Call canceled before being relayed shouldn't have been sent, got %s", err)
+	}
+	if received := tc.echos[2].Received(); len(received) != 0 {
+		t.Errorf("6) Last node shouldn't have handled a canceled call: %v", received)
+	}
+}
+
+func TestDeadlineSecondHop(t *testing.T) {
+	tc, relay := newRelayCluster(300)
+
+	// the budget of the call is spent by the relay
+	message := tc.comms[0].NewMsgMessage(ECHO_SERVICE)
+	message.Function = "RemoteRelay"
+	message.Message.Write([]byte("late"))
+	message.SetDeadline(200)
+	_, err := tc.call(0, 1, message)
+	if err == nil {
+		t.Errorf("1) Call should have failed once its deadline passed")
+	}
+
+	if err := relayedError(relay); err != comm.ErrorDeadlineExceeded {
+		t.Errorf("2) Relayed call should have been rejected with %s, got %s", comm.ErrorDeadlineExceeded, err)
+	}
+	if received := tc.echos[2].Received(); len(received) != 0 {
+		t.Errorf("3) Last node shouldn't have handled an expired call: %v", received)
+	}
+
+	// the same call within its budget goes through both hops
+	message = tc.comms[0].NewMsgMessage(ECHO_SERVICE)
+	message.Function = "RemoteRelay"
+	message.Message.Write([]byte("intime"))
+	message.SetDeadline(WAIT_TIMEOUT)
+	response, err := tc.call(0, 1, message)
+	if err != nil || response != "intime" {
+		t.Errorf("4) Call should have been relayed, got %s %s", response, err)
+	}
+}
@@ -0,0 +1,174 @@
+package comm
+
+import (
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"gostore/tools/typedio"
+)
+
+const (
+	CHECKSUM_SIZE = 4 // Size of a CRC32C checksum
+
+	checksum_flag_data = 0x01 // the data of the message is checksummed too
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func newChecksum() hash.Hash32 {
+	return crc32.New(castagnoli)
+}
+
+// Counters of corrupted messages received by this node
+type CorruptionStats struct {
+	UDP  uint64 // UDP packets with an invalid checksum
+	TCP  uint64 // TCP messages with an invalid checksum
+	Data uint64 // data of messages with an invalid checksum
+}
+
+type corruptionCounters struct {
+	mutex *sync.Mutex
+	stats CorruptionStats
+}
+
+func newCorruptionCounters() *corruptionCounters {
+	cc := new(corruptionCounters)
+	cc.mutex = new(sync.Mutex)
+	return cc
+}
+
+func (cc *corruptionCounters) add(counter *uint64) {
+	cc.mutex.Lock()
+	*counter++
+	cc.mutex.Unlock()
+}
+
+// Returns the number of corrupted messages received since the start
+func (comm *Comm) CorruptionStats() CorruptionStats {
+	comm.corruptions.mutex.Lock()
+	defer comm.corruptions.mutex.Unlock()
+	return comm.corruptions.stats
+}
+
+// Responds to the node that sent a message received corrupted, so that it
+// can send it again without waiting for its timeout. Since the header itself
+// may be corrupted, responses and messages whose sender is unknown are
+// dropped. The response isn't kept for duplicates, the message hasn't been
+// received.
+func (comm *Comm) respondCorrupted(message *Message) {
+	if message.FunctionId == FUNC_RESPONSE || message.FunctionId == FUNC_ERROR || message.InitId != 0 {
+		return
+	}
+
+	source, sender := message.SourceNode(), message.senderNode()
+	if source == nil || sender == nil {
+		return
+	}
+
+	errorMsg := comm.NewMsgMessage(message.ServiceId)
+	errorMsg.FunctionId = FUNC_ERROR
+	errorMsg.SetSourceNode(source)
+	errorMsg.SetMiddleNode(comm.Cluster.MyNode)
+	errorMsg.InitId = message.Id
+	WriteErrorPayload(errorMsg, ErrorCorrupted)
+
+	comm.SendNode(sender, errorMsg)
+}
+
+// Reader computing the checksum of what it reads
+type checksumReader struct {
+	reader io.Reader
+	hash   hash.Hash32
+}
+
+func (cr *checksumReader) Read(b []byte) (n int, err os.Error) {
+	n, err = cr.reader.Read(b)
+	cr.hash.Write(b[:n])
+	return
+}
+
+// Writer computing the checksum of what it writes
+type checksumWriter struct {
+	writer io.Writer
+	hash   hash.Hash32
+}
+
+func (cw *checksumWriter) Write(b []byte) (n int, err os.Error) {
+	n, err = cw.writer.Write(b)
+	cw.hash.Write(b[:n])
+	return
+}
+
+func writeChecksum(writer io.Writer, sum hash.Hash32) os.Error {
+	return typedio.NewWriter(writer).WriteUint32(sum.Sum32()) // checksum
+}
+
+// Reads a checksum and compares it to the computed one
+func verifyChecksum(reader io.Reader, sum hash.Hash32) os.Error {
+	expected, err := typedio.NewReader(reader).ReadUint32() // checksum
+	if err != nil {
+		return err
+	}
+
+	if expected != sum.Sum32() {
+		return ErrorCorrupted
+	}
+	return nil
+}
+
+// Reader of checksummed data: reads the data and verifies the checksum that
+// follows it once it has all been read.
+type dataChecksumReader struct {
+	comm      *Comm
+	reader    io.Reader
+	hash      hash.Hash32
+	remaining int64
+	err       os.Error
+}
+
+func newDataChecksumReader(comm *Comm, reader io.Reader, size int64) *dataChecksumReader {
+	return &dataChecksumReader{comm: comm, reader: reader, hash: newChecksum(), remaining: size}
+}
+
+func (dr *dataChecksumReader) Read(b []byte) (n int, err os.Error) {
+	if dr.err != nil {
+		return 0, dr.err
+	}
+
+	if dr.remaining > 0 {
+		if int64(len(b)) > dr.remaining {
+			b = b[:dr.remaining]
+		}
+
+		n, err = dr.reader.Read(b)
+		dr.hash.Write(b[:n])
+		dr.remaining -= int64(n)
+		if err != nil && err != os.EOF {
+			dr.err = err
+			return
+		}
+		if dr.remaining > 0 {
+			if err == os.EOF {
+				dr.err = io.ErrUnexpectedEOF
+			}
+			return n, dr.err
+		}
+	}
+
+	dr.err = verifyChecksum(dr.reader, dr.hash)
+	if dr.err == ErrorCorrupted {
+		dr.comm.logger.Error("Received corrupted data")
+		dr.comm.corruptions.add(&dr.comm.corruptions.stats.Data)
+	} else if dr.err == nil {
+		dr.err = os.EOF
+	}
+
+	// a corruption is reported with the last bytes, which are often read by
+	// exact size only
+	if n > 0 && dr.err == os.EOF {
+		return n, nil
+	}
+	return n, dr.err
+}
@@ -0,0 +1,94 @@
+package comm_test
+
+import (
+	"testing"
+	"gostore/comm"
+)
+
+const (
+	CORRUPTED_MARKER = "corrupt me"
+
+	// offsets in the header of a request without initial id
+	offset_id           = 4  // first byte of the 64 bits id
+	offset_first_option = 13 // type of the first option, the checksum
+)
+
+func TestCorruptedHeader(t *testing.T) {
+	transport := newCorruptingTransport(CORRUPTED_MARKER, true, offset_id, 0x01)
+	tc := newTestCluster(2, transport)
+
+	payload, err := tc.call(0, 1, tc.echoMessage(0, CORRUPTED_MARKER, nil))
+	if err != nil || payload != CORRUPTED_MARKER {
+		t.Errorf("1) Message should have been retried after its corruption, got %s %s", payload, err)
+	}
+
+	if stats := tc.comms[1].CorruptionStats(); stats.UDP != 1 {
+		t.Errorf("2) Corrupted packet should have been counted: %v", stats)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 1 || received[0] != CORRUPTED_MARKER {
+		t.Errorf("3) Message should have been handled once, uncorrupted: %v", received)
+	}
+}
+
+func TestHeaderWithoutChecksum(t *testing.T) {
+	// turns the checksum option into an unknown option, which is skipped
+	transport := newCorruptingTransport(CORRUPTED_MARKER, true, offset_first_option, 0x40)
+	tc := newTestCluster(2, transport)
+
+	payload, err := tc.call(0, 1, tc.echoMessage(0, CORRUPTED_MARKER, nil))
+	if err != nil || payload != CORRUPTED_MARKER {
+		t.Errorf("1) Message should have been retried after losing its checksum, got %s %s", payload, err)
+	}
+
+	if stats := tc.comms[1].CorruptionStats(); stats.UDP != 1 {
+		t.Errorf("2) Message without checksum should have been rejected as corrupted: %v", stats)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 1 {
+		t.Errorf("3) Message should have been handled once: %v", received)
+	}
+}
+
+func TestPeerWithoutChecksums(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+	tc.comms[0].Checksums = false
+
+	// headers of versions older than checksums, without and with options
+	payload, err := tc.call(0, 1, tc.echoMessage(0, "unchecked", nil))
+	if err != nil || payload != "unchecked" {
+		t.Errorf("1) Message without checksum from an older version should have been accepted, got %s %s", payload, err)
+	}
+
+	message := tc.echoMessage(0, "options", nil)
+	message.SetDeadline(WAIT_TIMEOUT)
+	payload, err = tc.call(0, 1, message)
+	if err != nil || payload != "options" {
+		t.Errorf("2) Message with options and without checksum should have been accepted, got %s %s", payload, err)
+	}
+
+	if stats := tc.comms[1].CorruptionStats(); stats.UDP != 0 {
+		t.Errorf("3) Messages without checksum shouldn't have been counted as corrupted: %v", stats)
+	}
+}
+
+func TestCorruptedData(t *testing.T) {
+	transport := newCorruptingTransport(CORRUPTED_MARKER, false, -1, 0x01)
+	tc := newTestCluster(2, transport)
+
+	message := tc.echoMessage(0, "data ", []byte(CORRUPTED_MARKER))
+	message.DataChecksum = true
+
+	payload, err := tc.call(0, 1, message)
+	if err != nil || payload != "data "+CORRUPTED_MARKER {
+		t.Errorf("1) Message should have been retried after the corruption of its data, got %s %s", payload, err)
+	}
+
+	if stats := tc.comms[1].CorruptionStats(); stats.Data != 1 || stats.TCP != 0 {
+		t.Errorf("2) Corrupted data should have been counted: %v", stats)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 1 || received[0] != "data "+CORRUPTED_MARKER {
+		t.Errorf("3) Data should have been handled once, uncorrupted: %v", received)
+	}
+}
@@ -0,0 +1,43 @@
+package comm
+
+import (
+	"time"
+)
+
+// Clock used by the communication layer for timeouts, retries, deadlines and
+// retention of received messages. Transports that simulate the network also
+// provide the clock of the simulation (see SimTransport), which the
+// communication layer uses instead of the real one.
+type Clock interface {
+	Now() int64                  // current time in ns
+	After(ns int64) <-chan int64 // receives the current time once ns have elapsed
+}
+
+type realClock struct{}
+
+func (realClock) Now() int64 {
+	return time.Nanoseconds()
+}
+
+func (realClock) After(ns int64) <-chan int64 {
+	return time.After(ns)
+}
+
+// Returns the clock of the transport if it provides one, else the real clock
+func transportClock(transport Transport) Clock {
+	if clock, ok := transport.(Clock); ok {
+		return clock
+	}
+
+	// faults can be injected in a simulation
+	if ft, ok := transport.(*FaultTransport); ok {
+		return transportClock(ft.transport)
+	}
+	return realClock{}
+}
+
+// Returns the clock used by the communication layer. Services should use it
+// for times exchanged with the communication layer, like deadlines.
+func (comm *Comm) Clock() Clock {
+	return comm.clock
+}
@@ -5,12 +5,13 @@ package comm
 
 import (
 	"gostore/cluster"
-	"net"
 	"gostore/log"
 	"io"
 	"os"
 	"sync"
 	"bufio"
+	"bytes"
+	"rand"
 )
 
 const (
@@ -19,8 +20,15 @@ const (
 	FUNC_ERROR         = 1
 
 	TRACKER_CLEAN_TIME = 5000 // 5 seconds
-	TRACKER_LOOP_SLEEP = 100  // 100 ms
+	TRACKER_LOOP_SLEEP = 100  // 100 ms, when communications are paused
 	MAX_MSG_SIZE       = 8000
+	MAX_PAYLOAD_SIZE   = 65535 // Maximum size of the payload of a message (not its data)
+
+	QUEUE_DEPTH        = 1000  // Default depth of nodes outbound queue
+	QUEUE_IDLE_TIMEOUT = 60000 // 60 seconds without messages before a queue is removed
+
+	DEDUP_RETENTION   = 60000  // 60 seconds, must be longer than retries of a message
+	DEDUP_MAX_ENTRIES = 100000 // Maximum number of received messages remembered
 )
 
 type Comm struct {
@@ -32,22 +40,86 @@ type Comm struct {
 	// cluster instance
 	Cluster *cluster.Cluster
 
-	// Server listening for incoming messages
-	server *Server
+	// Logger of the node, its entries have the id of the node
+	logger *log.Logger
+
+	// Transport used to exchange messages and server listening for incoming messages
+	transport Transport
+	server    *Server
+
+	// Clock of timeouts and deadlines, simulated by some transports, and
+	// randomness of retries
+	clock  Clock
+	random *rand.Rand
 
 	// Connections pool
 	pool *Pool
 
 	// Message id and its mutex
 	seqmutex *sync.Mutex
-	seqid    uint16
+	seqid    uint64
 
-	// Messages that need tracking
+	// Messages that need tracking, and their deadlines
 	messageTrackers map[string]*MessageTracker
+	trackersHeap    trackerHeap
+	trackersWake    chan bool
 	trackersMutex   *sync.Mutex
+
+	// Outbound queues per destination node
+	queues      map[string]*sendQueue
+	queuesMutex *sync.Mutex
+	queuesSwept int64 // last time idle queues were removed
+
+	QueueDepth    int  // Maximum number of messages waiting in a node queue
+	QueueBlocking bool // If true, wait when a queue is full instead of failing
+
+	// Received messages, to suppress duplicates
+	dedup           *dedupWindow
+	DedupRetention  int // ms
+	DedupMaxEntries int
+
+	// Functions tables of other nodes
+	peers *peersTables
+
+	// Call chains going through this node, for cancellation
+	cancels *cancelRegistry
+
+	// Streamed responses received and sent by this node
+	streams      map[string]*ResponseStream
+	outStreams   map[string]*Stream
+	streamsMutex *sync.Mutex
+
+	// TLS and UDP authentication
+	security *security
+
+	// Checksums of sent messages and corrupted messages received
+	Checksums   bool // if true, sent messages are checksummed and received version 4 ones must be
+	corruptions *corruptionCounters
+
+	// Messages sent and received in fragments
+	Fragmentation     bool // if true, messages too big for an UDP packet are fragmented instead of sent by TCP
+	ReassemblyTimeout int  // ms after which a message whose fragments didn't all arrive is dropped
+	fragments         *fragmentation
+
+	// Spans of the traced messages handled by this node
+	Tracing       bool // if true, call chains are traced
+	TraceMaxSpans int  // Maximum number of ended spans kept
+	traces        *spanRecorder
+
+	// Failure detection of other nodes, if enabled in the configuration
+	HeartbeatInterval int     // ms
+	PhiDisconnecting  float64 // suspicion above which a node is disconnecting
+	PhiOffline        float64 // suspicion above which a node is offline
+	detector          *failureDetector
 }
 
 func NewComm(cluster *cluster.Cluster) *Comm {
+	return NewCommTransport(cluster, NewNetTransport())
+}
+
+// Returns a communication layer exchanging messages with the given transport
+// instead of TCP and UDP
+func NewCommTransport(cluster *cluster.Cluster, transport Transport) *Comm {
 	comm := new(Comm)
 
 	comm.running = true
@@ -55,21 +127,71 @@ func NewComm(cluster *cluster.Cluster) *Comm {
 
 	mynode := cluster.MyNode
 	comm.Cluster = cluster
+	comm.logger = log.Subsystem("comm").With("node", mynode.Id)
 
-	tcpaddr := net.TCPAddr{mynode.Address, int(mynode.TcpPort)}
-	udpaddr := net.UDPAddr{mynode.Address, int(mynode.UdpPort)}
-	comm.server = NewServer(comm, &tcpaddr, &udpaddr)
-
-	comm.pool = NewPool()
+	comm.transport = transport
+	comm.clock = transportClock(transport)
+	comm.random = rand.New(rand.NewSource(comm.clock.Now() + int64(mynode.Id)))
+	comm.security = newSecurity(comm)
+	comm.pool = NewPool(comm)
+	comm.server = NewServer(comm, mynode)
 
 	comm.seqmutex = new(sync.Mutex)
-	comm.seqid = 1
+	// start from the current time so that ids used before a restart
+	// aren't reused (other nodes remember received ids)
+	comm.seqid = uint64(comm.clock.Now())
 
 	// message trackers
 	comm.messageTrackers = make(map[string]*MessageTracker)
+	comm.trackersHeap = make(trackerHeap, 0)
+	comm.trackersWake = make(chan bool, 1)
 	comm.trackersMutex = new(sync.Mutex)
 	go comm.startMessageTracker()
 
+	// outbound queues
+	comm.queues = make(map[string]*sendQueue)
+	comm.queuesMutex = new(sync.Mutex)
+	comm.QueueDepth = QUEUE_DEPTH
+	comm.QueueBlocking = false
+
+	// duplicates suppression
+	comm.dedup = newDedupWindow(comm)
+	comm.DedupRetention = DEDUP_RETENTION
+	comm.DedupMaxEntries = DEDUP_MAX_ENTRIES
+
+	// functions tables of other nodes
+	comm.peers = newPeersTables()
+
+	// checksums
+	comm.Checksums = true
+	comm.corruptions = newCorruptionCounters()
+
+	// fragmentation
+	comm.Fragmentation = false
+	comm.ReassemblyTimeout = FRAGMENT_REASSEMBLY_TIMEOUT
+	comm.fragments = newFragmentation(comm)
+
+	// call chains cancellation
+	comm.cancels = newCancelRegistry(comm)
+
+	// tracing
+	comm.Tracing = true
+	comm.TraceMaxSpans = TRACE_MAX_SPANS
+	comm.traces = newSpanRecorder(comm)
+
+	// failure detection
+	comm.HeartbeatInterval = HEARTBEAT_INTERVAL
+	comm.PhiDisconnecting = PHI_DISCONNECTING
+	comm.PhiOffline = PHI_OFFLINE
+	if cluster.Config.FailureDetector.Enabled {
+		comm.startFailureDetector(cluster.Config.FailureDetector)
+	}
+
+	// streamed responses
+	comm.streams = make(map[string]*ResponseStream)
+	comm.outStreams = make(map[string]*Stream)
+	comm.streamsMutex = new(sync.Mutex)
+
 	return comm
 }
 
@@ -103,9 +225,28 @@ func (comm *Comm) NewMessage() *Message {
 func (comm *Comm) SendNode(node *cluster.Node, message *Message) {
 	// resolve function and service names
 	message.PrepareSend()
+	comm.traceRoot(message)
+
+	// don't send messages of an abandoned call chain
+	if message.Expired() {
+		comm.abortSend(node, message, ErrorDeadlineExceeded)
+		return
+	}
+	if message.Canceled() || (message.parentKey != "" && !comm.cancels.followed(message)) {
+		comm.abortSend(node, message, ErrorCanceled)
+		return
+	}
+
+	// the size of the payload is written on 16 bits
+	if message.Message.Size > MAX_PAYLOAD_SIZE {
+		comm.abortSend(node, message, ErrorMessageTooBig)
+		return
+	}
+
+	metricSent.With(comm.metricNode(), metricService(message.ServiceId)).Inc()
 
 	if node.Equals(comm.Cluster.MyNode) {
-		log.Debug("%d: Looping message (%s) locally\n", comm.Cluster.MyNode.Id, message)
+		comm.logger.Debug("Looping message (%s) locally", message)
 
 		// if this message need a acknowledge, add it to the ack watcher
 		if message.Timeout > 0 || message.OnError != nil || message.OnResponse != nil {
@@ -117,57 +258,138 @@ func (comm *Comm) SendNode(node *cluster.Node, message *Message) {
 		message.Release()
 
 	} else {
+		// make sure the node knows the function under the same id
+		if err := comm.checkFunction(node, message.ServiceId, message.FunctionId); err != nil {
+			comm.abortSend(node, message, err)
+			return
+		}
+
 		// watch message here, because getting a connection may timeout if node is
 		// down and trying to open a TCP connection
 		if message.Timeout > 0 || message.OnError != nil || message.OnResponse != nil {
 			comm.watchMessage(message, node)
 		}
 
-		// TODO: Replace by a queue using channel so we don't create too many connections
-		go func() {
-			// We use TCP if message is more than 8000 bytes (maximum UDP packet size)
-			var connection *Connection
-			if message.Type == T_MSG && message.TotalSize() < MAX_MSG_SIZE {
-				connection = comm.pool.GetMsgConnection(node)
-			} else {
-				connection = comm.pool.GetDataConnection(node)
-			}
+		message.hold()
+		comm.enqueue(node, message)
+	}
+}
 
-			if connection == nil {
-				// Report as an error because the tracker should have reported the timeout if its a timeout
-				if message.OnError != nil {
-					message.OnError(message, os.NewError("Couldn't get TCP connection to node"))
-				} else {
-					log.Error("Couldn't get a connection for message %s to %s\n", message, node)
-				}
+// Gives up sending a message, reporting the error to its OnError callback
+func (comm *Comm) abortSend(node *cluster.Node, message *Message, err os.Error) {
+	comm.messageLog(message).Error("Cannot send message %s to %s: %s", message, node, err)
 
-				return
-			}
+	comm.unwatchMessage(message)
+	if message.OnError != nil {
+		message.OnError(message, err)
+	}
+	message.Release()
+}
 
-			log.Debug("%d: Sending message (%s) to %s via %s\n", comm.Cluster.MyNode.Id, message, node, connection)
+// Returns the maximum size of a message sent in a single UDP packet
+func (comm *Comm) maxPacketSize() uint64 {
+	maxPacketSize := uint64(MAX_MSG_SIZE)
+	if comm.security.udpAuthenticated() {
+		maxPacketSize -= UDP_AUTH_SIZE
+	}
+	return maxPacketSize
+}
 
-			bufwriter := bufio.NewWriter(io.Writer(connection.gocon))
-			buffer := io.Writer(bufwriter)
+// Returns the protocol a message is sent with. We use TCP if message is more
+// than 8000 bytes (maximum UDP packet size) unless it can be fragmented.
+func (comm *Comm) sendProto(message *Message) int {
+	maxPacketSize := comm.maxPacketSize()
+	if message.Type == T_MSG && !message.reliable && (message.TotalSize() < maxPacketSize || comm.needsFragmentation(message, maxPacketSize)) {
+		return P_UDP
+	}
+	return P_TCP
+}
 
-			message.SeekZero()
-			err := message.writeMessage(buffer)
-			if err != nil {
-				log.Error("%d: Got an error writing message %s to socket for %s via %s: %s\n", err, comm.Cluster.MyNode.Id, message, node, connection, err)
-			}
+// Writes a message to a node. Called by the send queue of the node.
+func (comm *Comm) writeMessage(node *cluster.Node, message *Message) {
+	// data is compressed if the message or its service asks for it and the
+	// node supports the codec
+	message.codec = comm.dataCodec(node, message)
+	message.checksum = comm.Checksums
+	message.dataChecksum = comm.Checksums && message.DataChecksum
+
+	maxPacketSize := comm.maxPacketSize()
+
+	// the fault injection transport may drop the message, as if it was lost
+	if comm.faultDropped(node, message) {
+		comm.logger.Debug("Dropping message %s to %s by fault injection", message, node)
+		message.Release()
+		return
+	}
+
+	if comm.needsFragmentation(message, maxPacketSize) {
+		comm.writeFragmented(node, message)
+		return
+	}
+
+	var connection *Connection
+	if comm.sendProto(message) == P_UDP {
+		connection = comm.pool.GetMsgConnection(node)
+	} else {
+		connection = comm.pool.GetDataConnection(node)
+	}
+
+	if connection == nil {
+		// Report as an error because the tracker should have reported the timeout if its a timeout
+		if message.OnError != nil {
+			message.OnError(message, os.NewError("Couldn't get TCP connection to node"))
+		} else {
+			comm.logger.Error("Couldn't get a connection for message %s to %s", message, node)
+		}
 
+		message.Release()
+		return
+	}
+
+	comm.logger.Debug("Sending message (%s) to %s via %s", message, node, connection)
+
+	bufwriter := bufio.NewWriter(io.Writer(connection.gocon))
+	buffer := io.Writer(bufwriter)
+
+	// an UDP message is written in a single packet, signed if needed
+	var packet *bytes.Buffer
+	if connection.proto == P_UDP {
+		packet = bytes.NewBuffer(make([]byte, 0, MAX_MSG_SIZE))
+		buffer = io.Writer(packet)
+	}
+
+	message.SeekZero()
+	err := message.writeMessage(buffer)
+	if err != nil {
+		comm.logger.Error("Got an error writing message %s to socket for %s via %s: %s", message, node, connection, err)
+	}
+
+	if err == nil {
+		if packet != nil {
+			if comm.security.udpAuthenticated() {
+				comm.security.signPacket(packet)
+			}
+			_, err = connection.gocon.Write(packet.Bytes())
+		} else {
 			err = bufwriter.Flush()
-			if err != nil {
-				log.Error("%d: Got an error sending message %s to %s via %s: %s\n", comm.Cluster.MyNode.Id, message, node, connection, err)
-				if message.OnError != nil {
-					message.OnError(message, err)
-				}
+		}
+
+		if err != nil {
+			comm.logger.Error("Got an error sending message %s to %s via %s: %s", message, node, connection, err)
+			if message.OnError != nil {
+				message.OnError(message, err)
 			}
+		}
+	}
 
-			// release the message and connection
-			connection.Release()
-			message.Release()
-		}()
+	// release the message and connection. A connection that failed
+	// may be broken, so it doesn't go back to the pool.
+	if err != nil {
+		connection.Close()
+	} else {
+		connection.Release()
 	}
+	message.Release()
 }
 
 func (comm *Comm) SendFirst(res *cluster.ResolveResult, message *Message) {
@@ -177,7 +399,7 @@ func (comm *Comm) SendFirst(res *cluster.ResolveResult, message *Message) {
 		return
 	}
 
-	log.Fatal("Couldn't send message (%s) to first (%s). No node found.\n", message, node)
+	comm.logger.Fatal("Couldn't send message (%s) to first (%s). No node found.", message, node)
 }
 
 func (comm *Comm) SendOne(res *cluster.ResolveResult, message *Message) {
@@ -188,23 +410,38 @@ func (comm *Comm) SendOne(res *cluster.ResolveResult, message *Message) {
 		return
 	}
 
-	log.Fatal("Couldn't send the message (%s) to one. No node found.\n", message)
+	comm.logger.Fatal("Couldn't send the message (%s) to one. No node found.", message)
 }
 
 func (comm *Comm) RespondSource(initialMessage *Message, message *Message) {
+	// the caller would otherwise only get a timeout
+	if message.Message.Size > MAX_PAYLOAD_SIZE {
+		comm.RespondError(initialMessage, ErrorMessageTooBig)
+		return
+	}
+
 	message.SetMiddleNode(comm.Cluster.MyNode)
 	message.SetSourceNode(initialMessage.SourceNode())
 	message.InitId = initialMessage.Id
+	message.Trace(initialMessage)
 
+	comm.dedup.responded(initialMessage, initialMessage.SourceNode(), message)
 	comm.SendNode(initialMessage.SourceNode(), message)
 }
 
 func (comm *Comm) RespondMiddle(initialMessage *Message, message *Message) {
+	if message.Message.Size > MAX_PAYLOAD_SIZE {
+		comm.RespondError(initialMessage, ErrorMessageTooBig)
+		return
+	}
+
 	message.SetMiddleNode(comm.Cluster.MyNode)
 	message.SetSourceNode(initialMessage.SourceNode())
 
 	message.InitId = initialMessage.Id
+	message.Trace(initialMessage)
 
+	comm.dedup.responded(initialMessage, initialMessage.MiddleNode(), message)
 	comm.SendNode(initialMessage.MiddleNode(), message)
 }
 
@@ -217,49 +454,93 @@ func (comm *Comm) RespondError(initialMessage *Message, error os.Error) {
 	errorMsg.SetSourceNode(initSrc)
 	errorMsg.SetMiddleNode(comm.Cluster.MyNode)
 	errorMsg.InitId = initialMessage.Id
+	errorMsg.Trace(initialMessage)
 	WriteErrorPayload(errorMsg, error)
+	comm.spanError(initialMessage, error)
+
+	// data received corrupted is sent again by the source, which must then
+	// be handled instead of getting this error replayed
+	replayable := error != ErrorCorrupted
+	if !replayable {
+		comm.dedup.forget(initialMessage)
+	}
 
 	if initMiddle != nil && !initMiddle.Equals(initSrc) {
 		// respond error to middle 
+		if replayable {
+			comm.dedup.responded(initialMessage, initMiddle, errorMsg)
+		}
 		comm.SendNode(initialMessage.MiddleNode(), errorMsg)
 	} else {
 		// respond error to source
+		if replayable {
+			comm.dedup.responded(initialMessage, initSrc, errorMsg)
+		}
 		comm.SendNode(initialMessage.SourceNode(), errorMsg)
 	}
 }
 
 func (comm *Comm) RedirectNode(node *cluster.Node, message *Message) {
 	message.SetMiddleNode(comm.Cluster.MyNode)
+
+	// the next hop is traced as a child of the handling by this node
+	if message.span != nil {
+		message.SpanId = message.span.Id
+	}
+
+	// the next hop needs to be canceled with the chain
+	comm.cancels.forwarded(message, node)
 	comm.SendNode(node, message)
 }
 
 func (comm *Comm) RedirectFirst(res *cluster.ResolveResult, message *Message) {
-	message.SetMiddleNode(comm.Cluster.MyNode)
-	comm.SendFirst(res, message)
+	node := res.GetFirst()
+	if node != nil {
+		comm.RedirectNode(node, message)
+		return
+	}
+
+	comm.logger.Fatal("Couldn't redirect message (%s) to first. No node found.", message)
 }
 
 func (comm *Comm) RedirectOne(res *cluster.ResolveResult, message *Message) {
-	message.SetMiddleNode(comm.Cluster.MyNode)
-	comm.SendOne(res, message)
+	// TODO: Round robin
+	node := res.GetOnline(0)
+	if node != nil {
+		comm.RedirectNode(node, message)
+		return
+	}
+
+	comm.logger.Fatal("Couldn't redirect the message (%s) to one. No node found.", message)
 }
 
 func (comm *Comm) handleMessage(message *Message) {
-	// TODO: We should make sure we don't handle a message twice (since UDP can duplicate packets)
+	metricReceived.With(comm.metricNode(), metricService(message.ServiceId)).Inc()
 
 	if message.FunctionId == FUNC_ERROR {
-		log.Info("Comm: Received an error: %s\n", message)
+		comm.logger.Info("Received an error: %s", message)
 	}
 
 	// Check if the message needed an acknowledgement or check if
 	// it has an error callback
 	handled := false
 	if message.SourceNode().Equals(comm.Cluster.MyNode) {
+		// frames of a streamed response are handled by their stream
+		if message.streamFrame && comm.handleStreamFrame(message) {
+			return
+		}
+
 		handled = comm.handleTracker(message)
 	}
 
-	// Service #0 is net and there is no implementation yet.
+	// Service #0 is the communication layer itself (handshakes)
+	if message.ServiceId == NET_SERVICE && message.FunctionId >= RESERVED_FUNCTIONS && !handled {
+		comm.handleNetMessage(message)
+		return
+	}
+
 	// Function = RESPONSE should be handled by callback
-	if message.ServiceId != 0 && message.FunctionId != FUNC_RESPONSE && !handled {
+	if message.ServiceId != NET_SERVICE && message.FunctionId != FUNC_RESPONSE && !handled {
 		serviceWrapper := comm.GetWrapper(message.ServiceId)
 
 		if serviceWrapper.service != nil {
@@ -269,22 +550,69 @@ func (comm *Comm) handleMessage(message *Message) {
 				message.SeekZero()
 				serviceWrapper.service.HandleUnmanagedError(message, err)
 			} else {
-				// call the right function
-				handled := serviceWrapper.callFunction(message.FunctionId, message)
+				// make sure we don't handle a message twice (since UDP can duplicate
+				// packets and sources retry messages)
+				if comm.dedup.isDuplicate(message) {
+					message.Release()
+					return
+				}
+
+				// the call chain may have been canceled or be out of time
+				if !comm.cancels.received(message) {
+					comm.messageLog(message).Debug("Dropping message %s of a canceled chain", message)
+					comm.dedup.handled(message)
+					message.Release()
+					return
+				}
+				if message.Expired() {
+					comm.messageLog(message).Warning("Message %s received after its deadline", message)
+					comm.RespondError(message, ErrorDeadlineExceeded)
+					comm.dedup.handled(message)
+					comm.cancels.handled(message)
+					return
+				}
+
+				// make sure the source meant the same function as ours
+				if err := comm.checkFunction(message.SourceNode(), message.ServiceId, message.FunctionId); err != nil {
+					comm.messageLog(message).Error("Rejecting message %s: %s", message, err)
+					comm.RespondError(message, err)
+					comm.dedup.handled(message)
+					comm.cancels.handled(message)
+					return
+				}
 
-				if !handled {
+				// call the right function
+				span := comm.startSpan(message)
+				start := comm.clock.Now()
+				comm.faultDelay(message)
+				handled, err := serviceWrapper.callFunction(message.FunctionId, message)
+				function := serviceWrapper.id2name[message.FunctionId]
+				metricHandle.With(comm.metricNode(), metricService(message.ServiceId), function).ObserveDuration(comm.clock.Now() - start)
+				comm.dedup.handled(message)
+				comm.cancels.handled(message)
+
+				if err != nil {
+					comm.messageLog(message).Error("Couldn't decode request of message %s: %s", message, err)
+					comm.RespondError(message, err)
+				} else if !handled {
 					serviceWrapper.service.HandleUnmanagedMessage(message)
 				}
+				comm.endSpan(message, span)
 			}
 		} else {
-			log.Error("Comm: Couldn't find service for message %s\n", message)
+			comm.messageLog(message).Error("Couldn't find service for message %s", message)
 		}
 	}
 }
 
-func (comm *Comm) nextSequenceId() uint16 {
+// Returns a logger whose entries have the service and id of a message
+func (comm *Comm) messageLog(message *Message) *log.Logger {
+	return comm.logger.With("service", message.ServiceId, "message", message.Id)
+}
+
+func (comm *Comm) nextSequenceId() uint64 {
 	comm.seqmutex.Lock()
-	var seq uint16 = comm.seqid
+	var seq uint64 = comm.seqid
 	comm.seqid += 1
 	comm.seqmutex.Unlock()
 	return seq
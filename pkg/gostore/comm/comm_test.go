@@ -0,0 +1,368 @@
+package comm_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"gostore"
+	"gostore/cluster"
+	"gostore/comm"
+	"gostore/tools/buffer"
+)
+
+const (
+	ECHO_SERVICE = 1
+	WAIT_TIMEOUT = 5000 // ms a test waits for a response
+)
+
+// Service responding with the message and the data it received
+type echoService struct {
+	comm *comm.Comm
+
+	mutex    *sync.Mutex
+	received []string // payloads and data handled successfully
+}
+
+func (es *echoService) Functions() map[string]byte {
+	return map[string]byte{
+		"RemoteEcho":   comm.RESERVED_FUNCTIONS,
+		"RemoteLength": comm.RESERVED_FUNCTIONS + 1,
+		"RemoteCount":  comm.RESERVED_FUNCTIONS + 2,
+		"RemoteLater":  comm.RESERVED_FUNCTIONS + 3,
+	}
+}
+
+func (es *echoService) RemoteEcho(message *comm.Message) {
+	payload := string(message.Message.Bytes()[:message.Message.Size])
+
+	if message.Type == comm.T_DATA {
+		data := make([]byte, message.DataSize)
+		_, err := io.ReadFull(message.Data, data)
+		if err != nil {
+			es.comm.RespondError(message, err)
+			return
+		}
+		payload += string(data)
+	}
+
+	es.mutex.Lock()
+	es.received = append(es.received, payload)
+	es.mutex.Unlock()
+
+	response := es.comm.NewMsgMessage(ECHO_SERVICE)
+	response.Message.Write([]byte(payload))
+	es.comm.RespondSource(message, response)
+}
+
+// Responds with the length of the message only, for big messages
+func (es *echoService) RemoteLength(message *comm.Message) {
+	payload := string(message.Message.Bytes()[:message.Message.Size])
+
+	es.mutex.Lock()
+	es.received = append(es.received, payload)
+	es.mutex.Unlock()
+
+	response := es.comm.NewMsgMessage(ECHO_SERVICE)
+	response.Message.Write([]byte(fmt.Sprintf("%d", len(payload))))
+	es.comm.RespondSource(message, response)
+}
+
+// Streams the numbers from 0 to the count in the message, or fails after the
+// first number if the count is negative
+func (es *echoService) RemoteCount(message *comm.Message) {
+	payload := string(message.Message.Bytes()[:message.Message.Size])
+
+	es.mutex.Lock()
+	es.received = append(es.received, payload)
+	es.mutex.Unlock()
+
+	count, err := strconv.Atoi(payload)
+	if err != nil {
+		es.comm.RespondError(message, err)
+		return
+	}
+
+	stream := es.comm.OpenStream(message)
+	for i := 0; i < count || (count < 0 && i == 0); i++ {
+		frame := es.comm.NewMsgMessage(ECHO_SERVICE)
+		frame.Message.Write([]byte(fmt.Sprintf("%d", i)))
+		if stream.Send(frame) != nil {
+			return
+		}
+	}
+
+	if count < 0 {
+		stream.Error(os.NewError("Negative count"))
+	} else {
+		stream.End()
+	}
+}
+
+// Echoes the message from another goroutine, after the function returned
+func (es *echoService) RemoteLater(message *comm.Message) {
+	payload := string(message.Message.Bytes()[:message.Message.Size])
+
+	es.mutex.Lock()
+	es.received = append(es.received, payload)
+	es.mutex.Unlock()
+
+	go func() {
+		time.Sleep(300 * 1000 * 1000)
+		response := es.comm.NewMsgMessage(ECHO_SERVICE)
+		response.Message.Write([]byte(payload))
+		es.comm.RespondSource(message, response)
+	}()
+}
+
+func (es *echoService) Received() []string {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	return es.received
+}
+
+func (es *echoService) HandleUnmanagedMessage(message *comm.Message)             {}
+func (es *echoService) HandleUnmanagedError(message *comm.Message, err os.Error) {}
+func (es *echoService) Boot()                                                    {}
+
+// Nodes of a test cluster, communicating with the given transport
+type testCluster struct {
+	comms []*comm.Comm
+	echos []*echoService
+}
+
+func newTestCluster(count int, transport comm.Transport) *testCluster {
+	return newTestClusterServices(count, transport, nil)
+}
+
+// Returns a test cluster whose nodes run the service returned by a function
+// instead of the echo service, if the function isn't nil
+func newTestClusterServices(count int, transport comm.Transport, service func(i int, es *echoService) comm.Service) *testCluster {
+	tc := new(testCluster)
+	tc.comms = make([]*comm.Comm, count)
+	tc.echos = make([]*echoService, count)
+
+	nodes := make([]gostore.ConfigNode, count)
+	for i := 0; i < count; i++ {
+		nodes[i].NodeId = uint16(i)
+		nodes[i].NodeIP = "127.0.0.1"
+		nodes[i].TCPPort = uint16(31000 + i*10)
+		nodes[i].UDPPort = uint16(31000 + i*10 + 1)
+	}
+
+	rings := make([]gostore.ConfigRing, 1)
+	rings[0].Id = 0
+	rings[0].ReplicationFactor = 1
+
+	sconfig := gostore.ConfigService{Id: ECHO_SERVICE, Type: "echo"}
+
+	for i := 0; i < count; i++ {
+		conf := gostore.Config{Nodes: nodes, Rings: rings, CurrentNode: uint16(i)}
+
+		cls := cluster.NewCluster(conf)
+		for _, confnode := range nodes {
+			node := cluster.NewNode(confnode.NodeId, net.ParseIP(confnode.NodeIP), confnode.TCPPort, confnode.UDPPort)
+			node.Status = cluster.Status_Online
+			cls.Nodes.Add(node)
+		}
+		cls.SetMyNode(cls.Nodes.Get(uint16(i)))
+
+		tc.comms[i] = comm.NewCommTransport(cls, transport)
+		tc.echos[i] = &echoService{comm: tc.comms[i], mutex: new(sync.Mutex)}
+		if service != nil {
+			tc.comms[i].AddService(service(i, tc.echos[i]), sconfig)
+		} else {
+			tc.comms[i].AddService(comm.Service(tc.echos[i]), sconfig)
+		}
+		tc.comms[i].BootServices()
+	}
+
+	return tc
+}
+
+// Returns node to as seen by node from
+func (tc *testCluster) node(from int, to int) *cluster.Node {
+	return tc.comms[from].Cluster.Nodes.Get(uint16(to))
+}
+
+// Returns a message calling the echo function, with data if data isn't nil
+func (tc *testCluster) echoMessage(from int, payload string, data []byte) *comm.Message {
+	var message *comm.Message
+	if data != nil {
+		message = tc.comms[from].NewDataMessage(ECHO_SERVICE)
+		buf := buffer.New()
+		buf.Write(data)
+		buf.Seek(0, 0)
+		message.Data = buf
+		message.DataSize = int64(len(data))
+	} else {
+		message = tc.comms[from].NewMsgMessage(ECHO_SERVICE)
+	}
+
+	message.Function = "RemoteEcho"
+	message.Message.Write([]byte(payload))
+	message.Timeout = 200
+	message.Retries = 3
+	return message
+}
+
+// Sends a message and waits for its response, returns the payload of the
+// response
+func (tc *testCluster) call(from int, to int, message *comm.Message) (string, os.Error) {
+	responses := make(chan string, 1)
+	errors := make(chan os.Error, 1)
+
+	message.LastTimeoutAsError = true
+	message.OnResponse = func(response *comm.Message) {
+		responses <- string(response.Message.Bytes()[:response.Message.Size])
+	}
+	message.OnError = func(response *comm.Message, err os.Error) {
+		errors <- err
+	}
+
+	tc.comms[from].SendNode(tc.node(from, to), message)
+
+	select {
+	case payload := <-responses:
+		return payload, nil
+	case err := <-errors:
+		return "", err
+	case <-time.After(WAIT_TIMEOUT * 1000 * 1000):
+	}
+	return "", os.NewError("No response")
+}
+
+// Waits until a condition is true, returns false if it didn't get true in time
+func waitFor(condition func() bool) bool {
+	for waited := 0; waited < WAIT_TIMEOUT; waited += 10 {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * 1000 * 1000)
+	}
+	return condition()
+}
+
+// Transport corrupting the first write containing a marker
+type corruptingTransport struct {
+	comm.Transport
+
+	mutex   *sync.Mutex
+	marker  []byte
+	packets bool // corrupts packets if true, else streams
+	offset  int  // offset of the corrupted byte in the write, -1 to corrupt the marker
+	mask    byte // bits flipped
+	left    int  // corruptions left
+}
+
+func newCorruptingTransport(marker string, packets bool, offset int, mask byte) *corruptingTransport {
+	ct := &corruptingTransport{Transport: comm.NewMemoryTransport(), mutex: new(sync.Mutex)}
+	ct.marker = []byte(marker)
+	ct.packets = packets
+	ct.offset = offset
+	ct.mask = mask
+	ct.left = 1
+	return ct
+}
+
+func (ct *corruptingTransport) DialStream(node *cluster.Node) (net.Conn, os.Error) {
+	con, err := ct.Transport.DialStream(node)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptingConn{con, ct, false}, nil
+}
+
+func (ct *corruptingTransport) DialPacket(node *cluster.Node) (net.Conn, os.Error) {
+	con, err := ct.Transport.DialPacket(node)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptingConn{con, ct, true}, nil
+}
+
+func (ct *corruptingTransport) corrupt(b []byte, packet bool) []byte {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	index := bytes.Index(b, ct.marker)
+	if ct.left == 0 || packet != ct.packets || index < 0 {
+		return b
+	}
+	ct.left--
+
+	corrupted := make([]byte, len(b))
+	copy(corrupted, b)
+	if ct.offset >= 0 {
+		index = ct.offset
+	}
+	corrupted[index] ^= ct.mask
+	return corrupted
+}
+
+type corruptingConn struct {
+	net.Conn
+	transport *corruptingTransport
+	packet    bool
+}
+
+func (cc *corruptingConn) Write(b []byte) (int, os.Error) {
+	_, err := cc.Conn.Write(cc.transport.corrupt(b, cc.packet))
+	return len(b), err
+}
+
+// Transport dropping the packets for which a function returns true
+type droppingTransport struct {
+	comm.Transport
+
+	mutex *sync.Mutex
+	drop  func(to *cluster.Node, packet []byte) bool
+}
+
+func newDroppingTransport(drop func(to *cluster.Node, packet []byte) bool) *droppingTransport {
+	return &droppingTransport{comm.NewMemoryTransport(), new(sync.Mutex), drop}
+}
+
+func (dt *droppingTransport) DialPacket(node *cluster.Node) (net.Conn, os.Error) {
+	con, err := dt.Transport.DialPacket(node)
+	if err != nil {
+		return nil, err
+	}
+	return &droppingConn{con, dt, node}, nil
+}
+
+type droppingConn struct {
+	net.Conn
+	transport *droppingTransport
+	to        *cluster.Node
+}
+
+func (dc *droppingConn) Write(b []byte) (int, os.Error) {
+	dc.transport.mutex.Lock()
+	drop := dc.transport.drop(dc.to, b)
+	dc.transport.mutex.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+	return dc.Conn.Write(b)
+}
+
+func TestEcho(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+
+	payload, err := tc.call(0, 1, tc.echoMessage(0, "hello", nil))
+	if err != nil || payload != "hello" {
+		t.Errorf("1) Message should have been echoed by UDP, got %s %s", payload, err)
+	}
+
+	payload, err = tc.call(0, 1, tc.echoMessage(0, "hello ", []byte("world")))
+	if err != nil || payload != "hello world" {
+		t.Errorf("2) Data message should have been echoed by TCP, got %s %s", payload, err)
+	}
+}
@@ -0,0 +1,379 @@
+package comm
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"gostore/cluster"
+	"gostore/log"
+	"gostore/tools/buffer"
+	"gostore/tools/typedio"
+)
+
+const (
+	CODEC_NONE  = 0
+	CODEC_FLATE = 1
+	CODEC_GZIP  = 2
+
+	COMPRESSION_MIN_SIZE = 1024  // Data smaller than this isn't worth compressing
+	COMPRESSION_CHUNK    = 32768 // Size of the chunks compressed data is sent in
+)
+
+// Compression codec of data messages. Codecs are identified by an id sent in
+// the header of compressed messages, which must never change once used.
+type Codec interface {
+	Id() byte
+	Name() string
+	NewWriter(writer io.Writer) (io.WriteCloser, os.Error)
+	NewReader(reader io.Reader) (io.ReadCloser, os.Error)
+}
+
+var (
+	codecs      = make(map[byte]Codec)
+	codecsMutex = new(sync.Mutex)
+)
+
+func init() {
+	RegisterCodec(flateCodec{})
+	RegisterCodec(gzipCodec{})
+}
+
+// Registers a compression codec. Nodes only compress data sent to nodes that
+// have registered the same codec, which they learn by handshaking.
+func RegisterCodec(codec Codec) {
+	if codec.Id() == CODEC_NONE {
+		log.Fatal("Codec id cannot be 0")
+	}
+
+	codecsMutex.Lock()
+	codecs[codec.Id()] = codec
+	codecsMutex.Unlock()
+}
+
+// Returns a registered codec by its id, nil if not registered
+func GetCodec(id byte) Codec {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	return codecs[id]
+}
+
+// Returns a registered codec by its name, nil if not registered
+func GetCodecByName(name string) Codec {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+func writeCodecs(buf *buffer.Buffer) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	buf.WriteUint8(uint8(len(codecs))) // codecs count
+	for id, _ := range codecs {
+		buf.WriteUint8(id) // codec id
+	}
+}
+
+// Reads the codecs supported by a node. Nodes that don't support compression
+// don't send them.
+func readCodecs(buf *buffer.Buffer) (supported map[byte]bool, err os.Error) {
+	supported = make(map[byte]bool)
+	if buf.Pointer >= buf.Size {
+		return supported, nil
+	}
+
+	count, err := buf.ReadUint8() // codecs count
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint8(0); i < count; i++ {
+		id, err := buf.ReadUint8() // codec id
+		if err != nil {
+			return nil, err
+		}
+		supported[id] = true
+	}
+
+	return supported, nil
+}
+
+// Mime types of data that is already compressed, which isn't compressed again
+var compressedMimeTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"audio/",
+	"video/",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+// Returns true if data of the given mime type is already compressed
+func CompressedMimeType(mimetype string) bool {
+	mimetype = strings.ToLower(mimetype)
+	for _, prefix := range compressedMimeTypes {
+		if strings.HasPrefix(mimetype, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the codec to compress the data of a message sent to a node with,
+// nil if it shouldn't be compressed. The codec of the message is used if set,
+// else the one configured for its service.
+func (comm *Comm) dataCodec(node *cluster.Node, message *Message) Codec {
+	if message.Type != T_DATA || message.DataSize < COMPRESSION_MIN_SIZE || CompressedMimeType(message.MimeType) {
+		return nil
+	}
+
+	codec := message.Codec
+	if codec == nil {
+		if wrapper := comm.GetWrapper(message.ServiceId); wrapper != nil {
+			codec = wrapper.codec
+		}
+	}
+
+	if codec == nil || !comm.peers.supportsCodec(node, codec.Id()) {
+		return nil
+	}
+
+	return codec
+}
+
+// Writes the data of a message compressed by a codec. Since the compressed
+// size isn't known in advance, it is written in chunks prefixed by their size
+// and ended by an empty chunk, followed by the checksum of the chunks if asked.
+func writeCompressed(writer io.Writer, codec Codec, data io.Reader, size int64, checksum bool) (err os.Error) {
+	chunks := &chunkWriter{writer: typedio.NewWriter(writer), chunk: make([]byte, 0, COMPRESSION_CHUNK)}
+	if checksum {
+		chunks.hash = newChecksum()
+	}
+
+	compressor, err := codec.NewWriter(chunks)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copyn(compressor, data, size)
+	if err != nil {
+		return err
+	}
+
+	err = compressor.Close()
+	if err != nil {
+		return err
+	}
+
+	return chunks.Close()
+}
+
+// Writer of compressed data chunks
+type chunkWriter struct {
+	writer typedio.Writer
+	chunk  []byte
+	hash   hash.Hash32 // checksum of the chunks, nil if not checksummed
+}
+
+func (cw *chunkWriter) Write(b []byte) (n int, err os.Error) {
+	for len(b) > 0 {
+		free := cap(cw.chunk) - len(cw.chunk)
+		if free > len(b) {
+			free = len(b)
+		}
+
+		cw.chunk = append(cw.chunk, b[:free]...)
+		b = b[free:]
+		n += free
+
+		if len(cw.chunk) == cap(cw.chunk) {
+			err = cw.flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (cw *chunkWriter) flush() (err os.Error) {
+	if len(cw.chunk) == 0 {
+		return nil
+	}
+
+	err = cw.writer.WriteUint32(uint32(len(cw.chunk))) // chunk size
+	if err != nil {
+		return
+	}
+
+	_, err = cw.writer.Write(cw.chunk) // chunk data
+	if cw.hash != nil {
+		cw.hash.Write(cw.chunk)
+	}
+	cw.chunk = cw.chunk[:0]
+	return
+}
+
+// Writes the last chunk, the end marker and the checksum
+func (cw *chunkWriter) Close() (err os.Error) {
+	err = cw.flush()
+	if err != nil {
+		return
+	}
+
+	err = cw.writer.WriteUint32(0) // end of data
+	if err != nil || cw.hash == nil {
+		return
+	}
+
+	return writeChecksum(cw.writer, cw.hash) // checksum
+}
+
+// Reader of compressed data chunks. Returns os.EOF after the end marker, or
+// ErrorCorrupted if the checksum of the chunks doesn't match.
+type chunkReader struct {
+	comm      *Comm
+	reader    typedio.Reader
+	remaining uint32      // remaining bytes in the current chunk
+	hash      hash.Hash32 // checksum of the chunks, nil if not checksummed
+	err       os.Error    // end of the chunks
+}
+
+func newChunkReader(comm *Comm, reader io.Reader, checksum bool) *chunkReader {
+	cr := &chunkReader{comm: comm, reader: typedio.NewReader(reader)}
+	if checksum {
+		cr.hash = newChecksum()
+	}
+	return cr
+}
+
+func (cr *chunkReader) Read(b []byte) (n int, err os.Error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	if cr.remaining == 0 {
+		cr.remaining, err = cr.reader.ReadUint32() // chunk size
+		if err != nil {
+			return 0, err
+		}
+
+		if cr.remaining == 0 {
+			cr.err = os.EOF
+			if cr.hash != nil {
+				err = verifyChecksum(cr.reader, cr.hash) // checksum
+				if err == ErrorCorrupted {
+					cr.comm.logger.Error("Received corrupted compressed data")
+					cr.comm.corruptions.add(&cr.comm.corruptions.stats.Data)
+				}
+				if err != nil {
+					cr.err = err
+				}
+			}
+			return 0, cr.err
+		}
+	}
+
+	if uint32(len(b)) > cr.remaining {
+		b = b[:cr.remaining]
+	}
+
+	n, err = cr.reader.Read(b) // chunk data
+	if cr.hash != nil {
+		cr.hash.Write(b[:n])
+	}
+	cr.remaining -= uint32(n)
+	if err == os.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// Reader of decompressed data. The decompressor is created on the first read
+// since it may need to read from the connection. Reads the compressed data up
+// to its end marker once the decompressed data has been read, so that what
+// follows on the connection can be read and the checksum verified.
+type decompressReader struct {
+	codec        Codec
+	chunks       io.Reader
+	decompressor io.ReadCloser
+	remaining    int64 // size of the decompressed data left to read
+}
+
+func newDecompressReader(codec Codec, chunks io.Reader, size int64) *decompressReader {
+	return &decompressReader{codec: codec, chunks: chunks, remaining: size}
+}
+
+func (dr *decompressReader) Read(b []byte) (n int, err os.Error) {
+	if dr.decompressor == nil {
+		dr.decompressor, err = dr.codec.NewReader(dr.chunks)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = dr.decompressor.Read(b)
+	dr.remaining -= int64(n)
+	if err == os.EOF || (err == nil && dr.remaining <= 0) {
+		// the codec may not need the end marker to know it has reached the end
+		_, err = io.Copy(ioutil.Discard, dr.chunks)
+		if err == nil && n == 0 {
+			err = os.EOF
+		}
+	}
+	return
+}
+
+// Raw deflate, fast level
+type flateCodec struct{}
+
+func (flateCodec) Id() byte     { return CODEC_FLATE }
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) NewWriter(writer io.Writer) (io.WriteCloser, os.Error) {
+	return flate.NewWriter(writer, flate.BestSpeed), nil
+}
+
+func (flateCodec) NewReader(reader io.Reader) (io.ReadCloser, os.Error) {
+	return flate.NewReader(reader), nil
+}
+
+// Gzip, default level
+type gzipCodec struct{}
+
+func (gzipCodec) Id() byte     { return CODEC_GZIP }
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(writer io.Writer) (io.WriteCloser, os.Error) {
+	compressor, err := gzip.NewWriter(writer)
+	if err != nil {
+		return nil, err
+	}
+	return compressor, nil
+}
+
+func (gzipCodec) NewReader(reader io.Reader) (io.ReadCloser, os.Error) {
+	decompressor, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return decompressor, nil
+}
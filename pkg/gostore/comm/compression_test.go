@@ -0,0 +1,223 @@
+package comm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"rand"
+	"testing"
+	"gostore/cluster"
+	"gostore/log"
+	"gostore/tools/typedio"
+)
+
+const COMPRESSION_TEST_SERVICE = 1
+
+// Returns compressible text, or random bytes that don't compress
+func compressionData(size int, compressible bool) []byte {
+	data := make([]byte, size)
+	if compressible {
+		for i := 0; i < size; i += 10 {
+			copy(data[i:], fmt.Sprintf("line %04d\n", i/10%10000))
+		}
+		return data
+	}
+
+	random := rand.New(rand.NewSource(int64(size)))
+	for i := range data {
+		data[i] = byte(random.Intn(256))
+	}
+	return data
+}
+
+func codecName(codec Codec) string {
+	if codec == nil {
+		return "none"
+	}
+	return codec.Name()
+}
+
+func newCompressionTestComm() *Comm {
+	comm := new(Comm)
+	comm.Services = newServices()
+	comm.peers = newPeersTables()
+	comm.corruptions = newCorruptionCounters()
+	comm.logger = log.Subsystem("comm")
+	return comm
+}
+
+// Compresses data like a message would be sent, followed by what comes next
+// on the connection
+func compress(t *testing.T, codec Codec, data []byte, checksum bool) *bytes.Buffer {
+	wire := bytes.NewBuffer(nil)
+	err := writeCompressed(wire, codec, bytes.NewBuffer(data), int64(len(data)), checksum)
+	if err != nil {
+		t.Fatalf("Couldn't compress %d bytes with %s: %s", len(data), codec.Name(), err)
+	}
+	wire.WriteString("next")
+	return wire
+}
+
+func decompress(comm *Comm, codec Codec, wire io.Reader, size int, checksum bool) ([]byte, os.Error) {
+	return ioutil.ReadAll(newDecompressReader(codec, newChunkReader(comm, wire, checksum), int64(size)))
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	comm := newCompressionTestComm()
+
+	for _, id := range []byte{CODEC_FLATE, CODEC_GZIP} {
+		codec := GetCodec(id)
+		if codec == nil || codecName(GetCodecByName(codec.Name())) != codec.Name() {
+			t.Fatalf("1) Codec %d should have been registered", id)
+		}
+
+		for _, size := range []int{0, 100, COMPRESSION_MIN_SIZE, 3*COMPRESSION_CHUNK + 17} {
+			for _, compressible := range []bool{true, false} {
+				for _, checksum := range []bool{false, true} {
+					data := compressionData(size, compressible)
+					wire := compress(t, codec, data, checksum)
+					if compressible && size > COMPRESSION_MIN_SIZE && wire.Len() >= size {
+						t.Errorf("2) %s should have compressed %d bytes, got %d", codec.Name(), size, wire.Len())
+					}
+
+					read, err := decompress(comm, codec, wire, size, checksum)
+					if err != nil || !bytes.Equal(read, data) {
+						t.Fatalf("3) %s should have decompressed %d bytes (checksum %v), got %d %s", codec.Name(), size, checksum, len(read), err)
+					}
+
+					// the whole compressed data is read, up to its end
+					if next := wire.String(); next != "next" {
+						t.Errorf("4) %s should have stopped at the end of the compressed data, left %q", codec.Name(), next)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCompressedChunks(t *testing.T) {
+	comm := newCompressionTestComm()
+	codec := GetCodec(CODEC_FLATE)
+
+	// random data doesn't compress, it takes many chunks
+	data := compressionData(3*COMPRESSION_CHUNK, false)
+	wire := compress(t, codec, data, true)
+	framed := wire.Bytes()
+
+	reader := typedio.NewReader(wire)
+	chunks := 0
+	for {
+		size, err := reader.ReadUint32()
+		if err != nil {
+			t.Fatalf("1) Couldn't read size of chunk %d: %s", chunks, err)
+		}
+		if size == 0 {
+			break
+		}
+		if size > COMPRESSION_CHUNK {
+			t.Fatalf("2) Chunk %d is bigger than a chunk: %d", chunks, size)
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(wire, chunk); err != nil {
+			t.Fatalf("3) Couldn't read chunk %d: %s", chunks, err)
+		}
+		chunks++
+
+		// only the last chunk isn't full
+		if size < COMPRESSION_CHUNK && wire.Len() > 4+4+len("next") {
+			t.Errorf("4) Chunk %d isn't full but isn't the last one: %d", chunks-1, size)
+		}
+	}
+	if chunks < 3 {
+		t.Errorf("5) Incompressible data should have taken more than 3 chunks, got %d", chunks)
+	}
+	if wire.Len() != 4+len("next") {
+		t.Errorf("6) End marker should have been followed by the checksum, got %d bytes", wire.Len())
+	}
+
+	// a corrupted chunk doesn't match the checksum
+	corrupted := make([]byte, len(framed))
+	copy(corrupted, framed)
+	corrupted[4+COMPRESSION_CHUNK/2] ^= 0x01
+	chunkReader := newChunkReader(comm, bytes.NewBuffer(corrupted), true)
+	if _, err := ioutil.ReadAll(chunkReader); err != ErrorCorrupted {
+		t.Errorf("7) Corrupted chunk should have failed with %s, got %s", ErrorCorrupted, err)
+	}
+	if comm.corruptions.stats.Data != 1 {
+		t.Errorf("8) Corrupted data should have been counted, got %d", comm.corruptions.stats.Data)
+	}
+
+	// chunks cut before their end marker
+	truncated := bytes.NewBuffer(framed[:4+COMPRESSION_CHUNK+4+10])
+	if _, err := ioutil.ReadAll(newChunkReader(comm, truncated, false)); err == nil {
+		t.Errorf("9) Truncated chunks should have failed")
+	}
+}
+
+func TestCompressedMimeTypes(t *testing.T) {
+	for mimetype, compressed := range map[string]bool{
+		"image/jpeg":       true,
+		"Image/PNG":        true,
+		"video/mp4":        true,
+		"audio/ogg":        true,
+		"application/zip":  true,
+		"application/json": false,
+		"text/plain":       false,
+		"image/svg+xml":    false,
+		"":                 false,
+	} {
+		if CompressedMimeType(mimetype) != compressed {
+			t.Errorf("Mime type '%s' should have been compressed: %v", mimetype, compressed)
+		}
+	}
+}
+
+func TestDataCodec(t *testing.T) {
+	comm := newCompressionTestComm()
+	comm.Services.wrappers[COMPRESSION_TEST_SERVICE] = &serviceWrapper{id: COMPRESSION_TEST_SERVICE, codec: GetCodec(CODEC_GZIP)}
+
+	// node 1 supports both codecs, node 2 only flate and node 3 none (it
+	// doesn't know compression)
+	nodes := make([]*cluster.Node, 4)
+	for i := range nodes {
+		nodes[i] = cluster.NewNode(uint16(i), net.ParseIP("127.0.0.1"), 0, 0)
+	}
+	comm.peers.set(nodes[1], nil, map[byte]bool{CODEC_FLATE: true, CODEC_GZIP: true})
+	comm.peers.set(nodes[2], nil, map[byte]bool{CODEC_FLATE: true})
+	comm.peers.set(nodes[3], nil, map[byte]bool{})
+
+	message := func(size int64, mimetype string, codec Codec) *Message {
+		return &Message{Type: T_DATA, ServiceId: COMPRESSION_TEST_SERVICE, DataSize: size, MimeType: mimetype, Codec: codec}
+	}
+	flate, gzip := GetCodec(CODEC_FLATE), GetCodec(CODEC_GZIP)
+	adhoc := cluster.NewAdhocNode(net.ParseIP("127.0.0.1"), 0, 0)
+	noData := &Message{Type: T_MSG, ServiceId: COMPRESSION_TEST_SERVICE}
+
+	tests := []struct {
+		node     *cluster.Node
+		message  *Message
+		expected Codec
+	}{
+		{nodes[1], message(4096, "text/plain", nil), gzip},          // codec of the service
+		{nodes[1], message(4096, "text/plain", flate), flate},       // codec of the message
+		{nodes[1], message(COMPRESSION_MIN_SIZE-1, "", nil), nil},   // too small
+		{nodes[1], message(4096, "image/jpeg", nil), nil},           // already compressed
+		{nodes[1], message(4096, "application/x-gzip", flate), nil}, // already compressed
+		{nodes[1], noData, nil},                                     // no data
+		{nodes[2], message(4096, "", nil), nil},                     // codec of the service not supported
+		{nodes[2], message(4096, "", flate), flate},                 // codec of the message supported
+		{nodes[3], message(4096, "", flate), nil},                   // no codec in common
+		{nodes[0], message(4096, "", nil), nil},                     // codecs not handshaked yet
+		{adhoc, message(4096, "", nil), nil},                        // adhoc nodes don't handshake
+	}
+
+	for i, test := range tests {
+		if codec := comm.dataCodec(test.node, test.message); codecName(codec) != codecName(test.expected) {
+			t.Errorf("%d) Data sent to %s should have been compressed with %s, got %s", i+1, test.node, codecName(test.expected), codecName(codec))
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package comm
 
 import (
+	"gostore/cluster"
 	"net"
 	"fmt"
+	"io"
+	"os"
+	"bufio"
+	"sync"
 )
 
 const (
@@ -14,11 +19,31 @@ const (
 )
 
 type Connection struct {
+	id    int
 	gocon net.Conn
 	pool  *Pool
 	proto int // P_TCP or P_UDP
 
 	direction int // D_OUTBOUN, D_INBOUND
+
+	// node the other end has been authenticated as (TLS only)
+	peer *cluster.Node
+
+	// node at the other end, once known
+	node *cluster.Node
+
+	// pooling information (TCP only)
+	reader     *bufio.Reader
+	poolKey    string
+	pooled     bool
+	lastUsed   int64
+	lastProbed int64
+	closed     bool // guarded by the mutex of the pool
+
+	// data frame currently being read on this connection
+	frameMutex *sync.Mutex
+	frame      *frameReader
+	frameDone  chan bool
 }
 
 func NewConnection(pool *Pool, proto int, direction int, conn net.Conn) *Connection {
@@ -27,9 +52,20 @@ func NewConnection(pool *Pool, proto int, direction int, conn net.Conn) *Connect
 	con.pool = pool
 	con.proto = proto
 	con.direction = direction
+	con.lastUsed = pool.comm.clock.Now()
+
+	if proto == P_TCP {
+		con.id = pool.nextConnectionId()
+		con.reader = bufio.NewReader(conn)
+		con.frameMutex = new(sync.Mutex)
+		con.frameDone = make(chan bool, 1)
+	}
+
 	return con
 }
 
+// Releases the connection after a write. TCP connections are put back
+// into the pool, UDP outbound connections are closed.
 func (c *Connection) Release() {
 	if c.proto == P_TCP {
 		c.pool.Release(c)
@@ -42,9 +78,53 @@ func (c *Connection) Release() {
 }
 
 func (c *Connection) Close() {
-	if c.direction == D_Outbound || c.direction == D_Inbound {
-		c.Close()
+	// inbound UDP connections share the server socket
+	if c.proto == P_UDP && c.direction == D_Inbound {
+		return
+	}
+
+	// the pool checks the flag under its mutex
+	c.pool.mutex.Lock()
+	c.closed = true
+	c.pool.mutex.Unlock()
+
+	if c.proto == P_TCP {
+		c.pool.remove(c)
 	}
+
+	c.gocon.Close()
+}
+
+// Returns true if the connection has been closed by this node
+func (c *Connection) isClosed() bool {
+	c.pool.mutex.Lock()
+	defer c.pool.mutex.Unlock()
+	return c.closed
+}
+
+// Opens a data frame read from the connection by the given reader. The
+// reading loop of the connection will wait for the frame to be released
+// before reading the next message. The size of a frame is -1 if it isn't
+// known (compressed data), it is then released when its reader ends.
+func (c *Connection) openFrame(reader io.Reader, size int64) *frameReader {
+	frame := &frameReader{c, reader, size}
+
+	c.frameMutex.Lock()
+	c.frame = frame
+	c.frameMutex.Unlock()
+
+	return frame
+}
+
+// Closes a data frame once it has been consumed, making the reading loop
+// continue reading other messages.
+func (c *Connection) releaseFrame(frame *frameReader) {
+	c.frameMutex.Lock()
+	if c.frame == frame {
+		c.frame = nil
+		c.frameDone <- true
+	}
+	c.frameMutex.Unlock()
 }
 
 func (c *Connection) String() string {
@@ -55,5 +135,28 @@ func (c *Connection) String() string {
 		proto = "UDP"
 	}
 
-	return fmt.Sprintf("Connection(#%d, %s)", -1, proto)
+	return fmt.Sprintf("Connection(#%d, %s)", c.id, proto)
+}
+
+
+// Reader of a data frame. Releases the frame automatically once all
+// its data has been read.
+type frameReader struct {
+	connection *Connection
+	reader     io.Reader
+	remaining  int64 // -1 if unknown
+}
+
+func (fr *frameReader) Read(b []byte) (n int, err os.Error) {
+	n, err = fr.reader.Read(b)
+
+	if fr.remaining >= 0 {
+		fr.remaining -= int64(n)
+	}
+
+	if fr.remaining == 0 || err != nil {
+		fr.connection.releaseFrame(fr)
+	}
+
+	return
 }
@@ -0,0 +1,144 @@
+package comm
+
+import (
+	"container/list"
+	"gostore/cluster"
+	"sync"
+)
+
+const (
+	dedup_in_progress = iota // message is being handled
+	dedup_handled            // handled, but no response that can be replayed yet
+	dedup_responded          // handled and the response is kept for replay
+)
+
+// Window of recently received messages, used to make sure a message
+// isn't handled twice when UDP duplicates a packet or when the source
+// retries a message of which the response got lost.
+//
+// Duplicates of a message that got responded are answered with the kept
+// response. The others are dropped until the message expires from the
+// window, even if it was handled without a response that can be replayed
+// (redirected, responded with data or responded later by another
+// goroutine): handling it again could run a non idempotent function twice.
+type dedupWindow struct {
+	comm  *Comm
+	mutex *sync.Mutex
+
+	entries map[string]*dedupEntry
+	order   *list.List // oldest first
+}
+
+type dedupEntry struct {
+	hash string
+	time int64
+	elem *list.Element
+
+	state       int
+	response    *Message
+	destination *cluster.Node
+}
+
+func newDedupWindow(comm *Comm) *dedupWindow {
+	dw := new(dedupWindow)
+	dw.comm = comm
+	dw.mutex = new(sync.Mutex)
+	dw.entries = make(map[string]*dedupEntry)
+	dw.order = list.New()
+	return dw
+}
+
+// Removes entries older than the retention or over the maximum number of
+// entries. Must be called with the mutex locked.
+func (dw *dedupWindow) expire(now int64) {
+	retention := int64(dw.comm.DedupRetention) * 1000 * 1000
+
+	for dw.order.Len() > 0 {
+		front := dw.order.Front()
+		entry := front.Value.(*dedupEntry)
+
+		if now-entry.time < retention && dw.order.Len() <= dw.comm.DedupMaxEntries {
+			break
+		}
+
+		dw.order.Remove(front)
+		dw.entries[entry.hash] = nil, false
+	}
+}
+
+// Checks if a message has already been received. If it has been handled and
+// its response was kept, the response is sent again. Returns true if the
+// message must not be handled.
+func (dw *dedupWindow) isDuplicate(message *Message) bool {
+	now := dw.comm.clock.Now()
+	hash := message.Key().String()
+
+	dw.mutex.Lock()
+	dw.expire(now)
+
+	entry, found := dw.entries[hash]
+	if !found {
+		entry = new(dedupEntry)
+		entry.hash = hash
+		entry.time = now
+		entry.state = dedup_in_progress
+		entry.elem = dw.order.PushBack(entry)
+		dw.entries[hash] = entry
+
+		dw.mutex.Unlock()
+		return false
+	}
+
+	if entry.state == dedup_responded {
+		response := entry.response.clone()
+		destination := entry.destination
+		dw.mutex.Unlock()
+
+		dw.comm.logger.Debug("Replaying response %s for duplicate message %s", response, message)
+		dw.comm.SendNode(destination, response)
+		return true
+	}
+	dw.mutex.Unlock()
+
+	dw.comm.logger.Debug("Dropping duplicate of message %s without a response to replay", message)
+	return true
+}
+
+// Marks a message as handled by its service function
+func (dw *dedupWindow) handled(message *Message) {
+	dw.mutex.Lock()
+	entry, found := dw.entries[message.Key().String()]
+	if found && entry.state == dedup_in_progress {
+		entry.state = dedup_handled
+	}
+	dw.mutex.Unlock()
+}
+
+// Forgets a message, so that it gets handled if it is sent again (ex: its
+// data was received corrupted)
+func (dw *dedupWindow) forget(message *Message) {
+	dw.mutex.Lock()
+	entry, found := dw.entries[message.Key().String()]
+	if found {
+		dw.order.Remove(entry.elem)
+		dw.entries[entry.hash] = nil, false
+	}
+	dw.mutex.Unlock()
+}
+
+// Keeps the response sent for a message so that it can be replayed to
+// duplicates. Responses containing data can't be replayed.
+func (dw *dedupWindow) responded(initialMessage *Message, destination *cluster.Node, response *Message) {
+	if response.Type != T_MSG {
+		return
+	}
+
+	dw.mutex.Lock()
+	entry, found := dw.entries[initialMessage.Key().String()]
+	if found {
+		entry.state = dedup_responded
+		entry.response = response.clone()
+		entry.destination = destination
+	}
+	dw.mutex.Unlock()
+}
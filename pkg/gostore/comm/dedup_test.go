@@ -0,0 +1,105 @@
+package comm_test
+
+import (
+	"testing"
+	"time"
+	"gostore/comm"
+)
+
+const FAULTS_SEED = 1
+
+func TestDuplicatedPackets(t *testing.T) {
+	faults := comm.NewFaultTransport(comm.NewMemoryTransport(), FAULTS_SEED)
+	faults.SetDuplicate(1)
+	tc := newTestCluster(2, faults)
+
+	payload, err := tc.call(0, 1, tc.echoMessage(0, "twice", nil))
+	if err != nil || payload != "twice" {
+		t.Errorf("1) Message should have been echoed, got %s %s", payload, err)
+	}
+
+	time.Sleep(100 * 1000 * 1000)
+	if received := tc.echos[1].Received(); len(received) != 1 {
+		t.Errorf("2) Duplicated message should have been handled once: %v", received)
+	}
+}
+
+func TestLostResponseReplayed(t *testing.T) {
+	faults := comm.NewFaultTransport(comm.NewMemoryTransport(), FAULTS_SEED)
+	tc := newTestCluster(2, faults)
+
+	// the first response is lost, the retry gets the kept response
+	faults.DropNext(1, 0, 1)
+	payload, err := tc.call(0, 1, tc.echoMessage(0, "retried", nil))
+	if err != nil || payload != "retried" {
+		t.Errorf("1) Response should have been replayed, got %s %s", payload, err)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 1 {
+		t.Errorf("2) Retried message should have been handled once: %v", received)
+	}
+}
+
+func TestDuplicateOfPendingResponse(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+
+	// responded after the function returned, no response to replay yet
+	first := tc.echoMessage(0, "first", nil)
+	first.Function = "RemoteLater"
+	first.Timeout = 1000
+	results := make(chan string, 1)
+	go func() {
+		payload, _ := tc.call(0, 1, first)
+		results <- payload
+	}()
+	time.Sleep(100 * 1000 * 1000)
+
+	second := tc.echoMessage(0, "second", nil)
+	second.Function = "RemoteLater"
+	second.Id = first.Id
+	second.Timeout = 0 // not tracked, the first message is
+	tc.comms[0].SendNode(tc.node(0, 1), second)
+
+	if payload := <-results; payload != "first" {
+		t.Errorf("1) First message should have been responded, got %s", payload)
+	}
+
+	time.Sleep(100 * 1000 * 1000)
+	if received := tc.echos[1].Received(); len(received) != 1 {
+		t.Errorf("2) Duplicate shouldn't have been handled while the response was pending: %v", received)
+	}
+}
+
+func TestDedupRetention(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+
+	first := tc.echoMessage(0, "first", nil)
+	id := first.Id
+	payload, err := tc.call(0, 1, first)
+	if err != nil || payload != "first" {
+		t.Errorf("1) Message should have been echoed, got %s %s", payload, err)
+	}
+
+	// a message with the same id is a duplicate, whatever its content
+	second := tc.echoMessage(0, "second", nil)
+	second.Id = id
+	payload, err = tc.call(0, 1, second)
+	if err != nil || payload != "first" {
+		t.Errorf("2) Response of the first message should have been replayed, got %s %s", payload, err)
+	}
+
+	// once forgotten, the id is handled again
+	tc.comms[1].DedupRetention = 100
+	time.Sleep(200 * 1000 * 1000)
+
+	third := tc.echoMessage(0, "third", nil)
+	third.Id = id
+	payload, err = tc.call(0, 1, third)
+	if err != nil || payload != "third" {
+		t.Errorf("3) Message should have been handled after the retention, got %s %s", payload, err)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 2 {
+		t.Errorf("4) Messages should have been handled twice: %v", received)
+	}
+}
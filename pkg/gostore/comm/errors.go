@@ -5,8 +5,15 @@ import (
 )
 
 var (
-	ErrorTimeout = os.NewError("Message timeout")
-	ErrorUnknown = os.NewError("Unknown error")
+	ErrorTimeout              = os.NewError("Message timeout")
+	ErrorUnknown              = os.NewError("Unknown error")
+	ErrorQueueFull            = os.NewError("Node send queue is full")
+	ErrorUnknownFunction      = os.NewError("Unknown function")
+	ErrorIncompatibleFunction = os.NewError("Incompatible function")
+	ErrorCanceled             = os.NewError("Call canceled")
+	ErrorDeadlineExceeded     = os.NewError("Call deadline exceeded")
+	ErrorCorrupted            = os.NewError("Corrupted message")
+	ErrorMessageTooBig        = os.NewError("Message payload too big")
 )
 
 func WriteErrorPayload(message *Message, error os.Error) {
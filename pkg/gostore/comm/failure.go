@@ -0,0 +1,273 @@
+package comm
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"gostore"
+	"gostore/cluster"
+	"gostore/tools/metrics"
+)
+
+const (
+	NET_FUNC_HEARTBEAT = RESERVED_FUNCTIONS + 6 // Heartbeat of a node, for failure detection
+
+	HEARTBEAT_INTERVAL  = 1000 // 1 second, between heartbeats sent to each node
+	HEARTBEAT_WINDOW    = 100  // Intervals between heartbeats remembered per node
+	HEARTBEAT_MIN_STDEV = 200  // 200 ms, minimum deviation of intervals, so that regular heartbeats don't make phi explode
+	HEARTBEAT_PAUSE     = 1000 // 1 second, pause (like a GC) tolerated on top of the mean interval
+	PHI_DISCONNECTING   = 5    // Suspicion above which a node is disconnecting
+	PHI_OFFLINE         = 10   // Suspicion above which a node is offline
+)
+
+var metricPhi = metrics.NewGauge("gostore_comm_node_phi", "Suspicion of failure of other nodes by the failure detector", "node", "peer")
+
+// Phi accrual failure detector. Nodes send heartbeats to all other nodes by
+// UDP at a regular interval, and each node keeps the intervals between the
+// last heartbeats it received from each node. The suspicion that a node
+// failed (phi) is the -log10 of the probability that its next heartbeat
+// arrives even later than now, estimated from a normal distribution of the
+// intervals: a phi of 1 means a 10% chance of being wrong when declaring the
+// node dead, 2 a 1% chance, and so on.
+//
+// A node whose phi goes above Comm.PhiDisconnecting is disconnecting, then
+// offline above Comm.PhiOffline, and the watchers of the cluster are
+// notified. A disconnecting or offline node, including nodes loaded as offline
+// when the cluster starts, is online again as soon as it sends heartbeats.
+type failureDetector struct {
+	comm  *Comm
+	mutex *sync.Mutex
+
+	histories map[uint16]*heartbeatHistory
+}
+
+// Arrival times of the heartbeats of a node
+type heartbeatHistory struct {
+	node      *cluster.Node
+	last      int64   // ns, arrival of the last heartbeat
+	intervals []int64 // ms, circular
+	next      int
+	count     int
+	sum       float64
+	squares   float64
+}
+
+func newFailureDetector(comm *Comm) *failureDetector {
+	fd := new(failureDetector)
+	fd.comm = comm
+	fd.mutex = new(sync.Mutex)
+	fd.histories = make(map[uint16]*heartbeatHistory)
+	return fd
+}
+
+func newHeartbeatHistory(node *cluster.Node, now int64, interval int) *heartbeatHistory {
+	h := new(heartbeatHistory)
+	h.node = node
+	h.last = now
+	h.intervals = make([]int64, HEARTBEAT_WINDOW)
+
+	// the detector starts as if the node had sent heartbeats at the expected
+	// interval, so that a node that is never heard of is suspected too
+	h.add(int64(interval))
+	return h
+}
+
+func (h *heartbeatHistory) add(interval int64) {
+	if h.count == len(h.intervals) {
+		old := float64(h.intervals[h.next])
+		h.sum -= old
+		h.squares -= old * old
+	} else {
+		h.count++
+	}
+
+	h.intervals[h.next] = interval
+	h.next = (h.next + 1) % len(h.intervals)
+	h.sum += float64(interval)
+	h.squares += float64(interval) * float64(interval)
+}
+
+// Returns the suspicion that the node failed, given the time elapsed since
+// its last heartbeat
+func (h *heartbeatHistory) phi(now int64, minStdev float64, pause float64) float64 {
+	mean := h.sum / float64(h.count)
+	stdev := math.Sqrt(math.Fmax(h.squares/float64(h.count)-mean*mean, 0))
+	stdev = math.Fmax(stdev, minStdev)
+	mean += pause
+
+	// logistic approximation of the cumulative normal distribution
+	elapsed := float64(now-h.last) / 1e6
+	y := (elapsed - mean) / stdev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// Starts sending heartbeats and checking other nodes' at each heartbeat
+// interval, with the thresholds of the configuration if set
+func (comm *Comm) startFailureDetector(config gostore.ConfigFailureDetector) {
+	if config.HeartbeatInterval > 0 {
+		comm.HeartbeatInterval = config.HeartbeatInterval
+	}
+	if config.PhiDisconnecting > 0 {
+		comm.PhiDisconnecting = config.PhiDisconnecting
+	}
+	if config.PhiOffline > 0 {
+		comm.PhiOffline = config.PhiOffline
+	}
+	comm.detector = newFailureDetector(comm)
+
+	go func() {
+		for {
+			<-comm.clock.After(int64(comm.HeartbeatInterval) * 1000 * 1000)
+
+			// a paused node looks dead to others
+			if comm.running {
+				comm.sendHeartbeats()
+				comm.detector.check()
+			}
+		}
+	}()
+}
+
+func (comm *Comm) sendHeartbeats() {
+	for node := range comm.Cluster.Nodes.Iter() {
+		if node.Adhoc || node.Equals(comm.Cluster.MyNode) {
+			continue
+		}
+
+		message := comm.NewMsgMessage(NET_SERVICE)
+		message.FunctionId = NET_FUNC_HEARTBEAT
+		comm.SendNode(node, message)
+	}
+}
+
+// Handles the heartbeat of another node
+func (comm *Comm) handleHeartbeat(message *Message) {
+	node := message.SourceNode()
+	if node == nil || node.Adhoc || comm.detector == nil {
+		return
+	}
+
+	comm.detector.heartbeat(node)
+}
+
+// Returns the suspicion that a node failed, 0 if it isn't watched by the
+// failure detector
+func (comm *Comm) Phi(node *cluster.Node) float64 {
+	if comm.detector == nil {
+		return 0
+	}
+
+	fd := comm.detector
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	history, found := fd.histories[node.Id]
+	if !found {
+		return 0
+	}
+	return history.phi(fd.comm.clock.Now(), HEARTBEAT_MIN_STDEV, HEARTBEAT_PAUSE)
+}
+
+// Returns the history of a node, creating it if needed, and true if it was
+// created. Must be called with the mutex locked.
+func (fd *failureDetector) history(node *cluster.Node, now int64) (*heartbeatHistory, bool) {
+	history, found := fd.histories[node.Id]
+	if !found {
+		history = newHeartbeatHistory(node, now, fd.comm.HeartbeatInterval)
+		fd.histories[node.Id] = history
+	}
+	return history, !found
+}
+
+// Exports the suspicion of a node whose history was created. Must be called
+// with the mutex unlocked, since the gauge reads the suspicion with it.
+func (fd *failureDetector) export(node *cluster.Node) {
+	metricPhi.Func(func() float64 {
+		return fd.comm.Phi(node)
+	}, fd.comm.metricNode(), fmt.Sprintf("%d", node.Id))
+}
+
+func (fd *failureDetector) heartbeat(node *cluster.Node) {
+	comm := fd.comm
+	fd.mutex.Lock()
+	now := comm.clock.Now()
+	history, found := fd.histories[node.Id]
+	if found {
+		history.add((now - history.last) / 1e6)
+		history.last = now
+	} else {
+		fd.history(node, now)
+	}
+	fd.mutex.Unlock()
+
+	if !found {
+		fd.export(node)
+	}
+
+	// a node that was down is back
+	if comm.Cluster.ChangeNodeStatus(node, cluster.Status_Online, cluster.Status_Disconnceting, cluster.Status_Offline) {
+		comm.logger.Warning("Node %s is sending heartbeats again", node)
+		comm.Cluster.Notifier.NotifyNodeOnline(node)
+	}
+}
+
+// Changes the status of the nodes whose suspicion went above the thresholds
+func (fd *failureDetector) check() {
+	comm := fd.comm
+	created := make([]*cluster.Node, 0)
+	disconnecting := make([]*cluster.Node, 0)
+	offline := make([]*cluster.Node, 0)
+
+	fd.mutex.Lock()
+	now := comm.clock.Now()
+	for node := range comm.Cluster.Nodes.Iter() {
+		if node.Adhoc || node.Equals(comm.Cluster.MyNode) {
+			continue
+		}
+
+		history, isNew := fd.history(node, now)
+		if isNew {
+			created = append(created, node)
+		}
+
+		phi := history.phi(now, HEARTBEAT_MIN_STDEV, HEARTBEAT_PAUSE)
+		if phi >= comm.PhiOffline {
+			offline = append(offline, node)
+		} else if phi >= comm.PhiDisconnecting {
+			disconnecting = append(disconnecting, node)
+		}
+	}
+	fd.mutex.Unlock()
+
+	// statuses are changed and watchers notified without the mutex, since
+	// they may call back the detector (Phi)
+	for _, node := range created {
+		fd.export(node)
+	}
+
+	// only nodes that are up can go down
+	for _, node := range disconnecting {
+		if comm.Cluster.ChangeNodeStatus(node, cluster.Status_Disconnceting, cluster.Status_Online) {
+			comm.logger.Warning("Node %s is disconnecting, no heartbeat since %d ms", node, comm.heartbeatAge(node, now))
+			comm.Cluster.Notifier.NotifyNodeDisconnecting(node)
+		}
+	}
+	for _, node := range offline {
+		if comm.Cluster.ChangeNodeStatus(node, cluster.Status_Offline, cluster.Status_Online, cluster.Status_Disconnceting) {
+			comm.logger.Warning("Node %s is offline, no heartbeat since %d ms", node, comm.heartbeatAge(node, now))
+			comm.peers.forget(node)
+			comm.Cluster.Notifier.NotifyNodeOffline(node)
+		}
+	}
+}
+
+// Returns the ms elapsed since the last heartbeat of a node
+func (comm *Comm) heartbeatAge(node *cluster.Node, now int64) int64 {
+	comm.detector.mutex.Lock()
+	defer comm.detector.mutex.Unlock()
+	return (now - comm.detector.histories[node.Id].last) / 1e6
+}
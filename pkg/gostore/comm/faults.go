@@ -0,0 +1,662 @@
+package comm
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"rand"
+	"strconv"
+	"strings"
+	"sync"
+	"gostore/cluster"
+)
+
+const (
+	NET_FUNC_FAULTS = RESERVED_FUNCTIONS + 5 // Fault injection script sent to a node
+
+	FAULTS_TIMEOUT       = 1000 // 1 second
+	FAULTS_RETRIES       = 3
+	FAULTS_REORDER_DELAY = 50 // 50 ms, additional delay of reordered packets
+)
+
+var ErrorFaultsUnavailable = os.NewError("Fault injection not available on this node")
+
+// Transport injecting faults in the messages exchanged by nodes, for tests.
+// It wraps another transport and can drop, duplicate, delay and reorder
+// packets by probability, delay writes on streams, partition the nodes in
+// groups that can't communicate with each other, drop the next messages from
+// a node to another, corrupt writes on streams and slow down functions of
+// services on a node. Delays
+// are waited on the clock of the wrapped transport, so faults can be
+// injected in a simulation.
+//
+// Faults can be changed at any time, from tests or by sending a script to a
+// node (see Script and Comm.InjectFaults). Randomness comes from a seeded
+// generator, so that a test can replay the same faults.
+//
+// Partitions and dropped messages are enforced by the sending node: nodes that
+// share the transport (in the same process) are partitioned both ways, but a
+// node on another process needs to be told about the partition too. Partitions
+// drop all the messages, but only messages of services are counted and
+// dropped by DropNext, not the ones of the communication layer itself
+// (handshakes, heartbeats, stream credits, fragments acks, ...).
+type FaultTransport struct {
+	transport Transport
+	mutex     *sync.Mutex
+	random    *rand.Rand
+
+	enabled bool
+
+	drop      float64 // probability of dropping a packet
+	duplicate float64 // probability of duplicating a packet
+	reorder   float64 // probability of delaying a packet after the ones sent after it
+	delayMin  int     // ms
+	delayMax  int     // ms
+
+	partitions map[uint16]int   // group of the partitioned nodes
+	dropNext   map[string]int   // messages left to drop, by sending and receiving nodes and optionally service and function
+	slow       map[string]int64 // delay of functions, by node, service and function
+	corrupt    []string         // markers of the next stream writes to corrupt
+}
+
+func NewFaultTransport(transport Transport, seed int64) *FaultTransport {
+	ft := new(FaultTransport)
+	ft.transport = transport
+	ft.mutex = new(sync.Mutex)
+	ft.random = rand.New(rand.NewSource(seed))
+	ft.enabled = true
+	ft.partitions = make(map[uint16]int)
+	ft.dropNext = make(map[string]int)
+	ft.slow = make(map[string]int64)
+	return ft
+}
+
+// Enables the faults. They are enabled when the transport is created.
+func (ft *FaultTransport) Enable() {
+	ft.mutex.Lock()
+	ft.enabled = true
+	ft.mutex.Unlock()
+}
+
+// Disables the faults, without forgetting them
+func (ft *FaultTransport) Disable() {
+	ft.mutex.Lock()
+	ft.enabled = false
+	ft.mutex.Unlock()
+}
+
+func (ft *FaultTransport) Enabled() bool {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return ft.enabled
+}
+
+// Removes all the faults
+func (ft *FaultTransport) Reset() {
+	ft.mutex.Lock()
+	ft.drop, ft.duplicate, ft.reorder = 0, 0, 0
+	ft.delayMin, ft.delayMax = 0, 0
+	ft.partitions = make(map[uint16]int)
+	ft.dropNext = make(map[string]int)
+	ft.slow = make(map[string]int64)
+	ft.corrupt = nil
+	ft.mutex.Unlock()
+}
+
+// Sets the probability (0 to 1) of dropping a packet
+func (ft *FaultTransport) SetDrop(probability float64) {
+	ft.mutex.Lock()
+	ft.drop = probability
+	ft.mutex.Unlock()
+}
+
+// Sets the probability (0 to 1) of sending a packet twice
+func (ft *FaultTransport) SetDuplicate(probability float64) {
+	ft.mutex.Lock()
+	ft.duplicate = probability
+	ft.mutex.Unlock()
+}
+
+// Sets the probability (0 to 1) of delaying a packet enough for the packets
+// sent after it to arrive first
+func (ft *FaultTransport) SetReorder(probability float64) {
+	ft.mutex.Lock()
+	ft.reorder = probability
+	ft.mutex.Unlock()
+}
+
+// Delays packets and stream writes by a random delay between min and max ms
+func (ft *FaultTransport) SetDelay(min int, max int) {
+	if max < min {
+		max = min
+	}
+
+	ft.mutex.Lock()
+	ft.delayMin, ft.delayMax = min, max
+	ft.mutex.Unlock()
+}
+
+// Partitions nodes in groups. Messages between nodes of different groups are
+// dropped, nodes that aren't in a group aren't affected. Replaces the
+// previous partition.
+func (ft *FaultTransport) Partition(groups ...[]uint16) {
+	ft.mutex.Lock()
+	ft.partitions = make(map[uint16]int)
+	for group, nodes := range groups {
+		for _, node := range nodes {
+			ft.partitions[node] = group
+		}
+	}
+	ft.mutex.Unlock()
+}
+
+// Removes the partition and the messages left to drop
+func (ft *FaultTransport) Heal() {
+	ft.mutex.Lock()
+	ft.partitions = make(map[uint16]int)
+	ft.dropNext = make(map[string]int)
+	ft.mutex.Unlock()
+}
+
+// Drops the next messages of services sent by a node to another, whatever
+// the way they are sent
+func (ft *FaultTransport) DropNext(from uint16, to uint16, count int) {
+	ft.setDropNext(fmt.Sprintf("%d>%d", from, to), count)
+}
+
+// Drops the next calls of a function of a service sent by a node to another
+func (ft *FaultTransport) DropNextFunction(from uint16, to uint16, serviceId byte, functionId byte, count int) {
+	ft.setDropNext(fmt.Sprintf("%d>%d/%d/%d", from, to, serviceId, functionId), count)
+}
+
+func (ft *FaultTransport) setDropNext(key string, count int) {
+	ft.mutex.Lock()
+	if count > 0 {
+		ft.dropNext[key] = count
+	} else {
+		ft.dropNext[key] = 0, false
+	}
+	ft.mutex.Unlock()
+}
+
+// Delays the calls of a function of a service on a node by some ms, as if
+// the node was slow to handle them. A delay of 0 removes the slow down.
+func (ft *FaultTransport) SlowFunction(node uint16, serviceId byte, functionId byte, delay int) {
+	key := fmt.Sprintf("%d/%d/%d", node, serviceId, functionId)
+
+	ft.mutex.Lock()
+	if delay > 0 {
+		ft.slow[key] = int64(delay) * 1000 * 1000
+	} else {
+		ft.slow[key] = 0, false
+	}
+	ft.mutex.Unlock()
+}
+
+// Corrupts the next write on a stream containing a marker by flipping a bit
+// of the marker, as if it got corrupted on the network
+func (ft *FaultTransport) CorruptNext(marker string) {
+	ft.mutex.Lock()
+	ft.corrupt = append(ft.corrupt, marker)
+	ft.mutex.Unlock()
+}
+
+// Applies a fault injection script. A script has one command by line, blank
+// lines and lines starting by # are ignored:
+//
+//	enable                              enables the faults
+//	disable                             disables the faults
+//	reset                               removes all the faults
+//	heal                                removes the partition and the messages left to drop
+//	drop <probability>                  drops packets
+//	duplicate <probability>             duplicates packets
+//	reorder <probability>               reorders packets
+//	delay <min ms> [<max ms>]           delays packets and stream writes
+//	partition <id,id,..> <id,id,..> ..  partitions nodes in groups
+//	dropnext <from> <to> <count> [<service> <function>]
+//	                                    drops the next messages from a node to another,
+//	                                    or the next calls of a function
+//	slow <node> <service> <function> <ms>  slows down a function on a node
+//
+// The script is only applied if all its commands are valid.
+func (ft *FaultTransport) Script(script string) os.Error {
+	commands := make([]func(), 0)
+
+	for i, line := range strings.Split(script, "\n", -1) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		command, err := ft.parseCommand(fields)
+		if err != nil {
+			return os.NewError(fmt.Sprintf("Faults script line %d: %s", i+1, err))
+		}
+		commands = append(commands, command)
+	}
+
+	for _, command := range commands {
+		command()
+	}
+	return nil
+}
+
+func (ft *FaultTransport) parseCommand(fields []string) (command func(), err os.Error) {
+	args := fields[1:]
+
+	switch fields[0] {
+	case "enable", "disable", "reset", "heal":
+		if len(args) != 0 {
+			return nil, os.NewError(fmt.Sprintf("%s takes no argument", fields[0]))
+		}
+
+		switch fields[0] {
+		case "enable":
+			return func() { ft.Enable() }, nil
+		case "disable":
+			return func() { ft.Disable() }, nil
+		case "reset":
+			return func() { ft.Reset() }, nil
+		}
+		return func() { ft.Heal() }, nil
+
+	case "drop", "duplicate", "reorder":
+		if len(args) != 1 {
+			return nil, os.NewError(fmt.Sprintf("%s takes a probability", fields[0]))
+		}
+
+		probability, err := strconv.Atof64(args[0])
+		if err != nil || probability < 0 || probability > 1 {
+			return nil, os.NewError(fmt.Sprintf("invalid probability %s", args[0]))
+		}
+
+		switch fields[0] {
+		case "drop":
+			return func() { ft.SetDrop(probability) }, nil
+		case "duplicate":
+			return func() { ft.SetDuplicate(probability) }, nil
+		}
+		return func() { ft.SetReorder(probability) }, nil
+
+	case "delay":
+		if len(args) != 1 && len(args) != 2 {
+			return nil, os.NewError("delay takes a minimum and an optional maximum")
+		}
+
+		ints, err := parseInts(args, 0, 1<<31-1)
+		if err != nil {
+			return nil, err
+		}
+
+		max := ints[0]
+		if len(ints) == 2 {
+			max = ints[1]
+		}
+		return func() { ft.SetDelay(ints[0], max) }, nil
+
+	case "partition":
+		groups := make([][]uint16, len(args))
+		for i, arg := range args {
+			ids, err := parseInts(strings.Split(arg, ",", -1), 0, 1<<16-1)
+			if err != nil {
+				return nil, err
+			}
+
+			groups[i] = make([]uint16, len(ids))
+			for j, id := range ids {
+				groups[i][j] = uint16(id)
+			}
+		}
+		return func() { ft.Partition(groups...) }, nil
+
+	case "dropnext":
+		if len(args) != 3 && len(args) != 5 {
+			return nil, os.NewError("dropnext takes a sending node, a receiving node, a count and an optional service and function")
+		}
+
+		ints, err := parseInts(args, 0, 1<<16-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(ints) == 3 {
+			return func() { ft.DropNext(uint16(ints[0]), uint16(ints[1]), ints[2]) }, nil
+		}
+
+		if ints[3] > 255 || ints[4] > 255 {
+			return nil, os.NewError("invalid service or function id")
+		}
+		return func() { ft.DropNextFunction(uint16(ints[0]), uint16(ints[1]), byte(ints[3]), byte(ints[4]), ints[2]) }, nil
+
+	case "slow":
+		if len(args) != 4 {
+			return nil, os.NewError("slow takes a node, a service, a function and a delay")
+		}
+
+		ints, err := parseInts(args, 0, 1<<16-1)
+		if err != nil {
+			return nil, err
+		}
+		if ints[1] > 255 || ints[2] > 255 {
+			return nil, os.NewError("invalid service or function id")
+		}
+		return func() { ft.SlowFunction(uint16(ints[0]), byte(ints[1]), byte(ints[2]), ints[3]) }, nil
+	}
+
+	return nil, os.NewError(fmt.Sprintf("unknown command %s", fields[0]))
+}
+
+func parseInts(args []string, min int, max int) ([]int, os.Error) {
+	ints := make([]int, len(args))
+	for i, arg := range args {
+		value, err := strconv.Atoi(arg)
+		if err != nil || value < min || value > max {
+			return nil, os.NewError(fmt.Sprintf("invalid number %s", arg))
+		}
+		ints[i] = value
+	}
+	return ints, nil
+}
+
+// Returns true if a message sent by a node to another must be dropped because
+// the nodes are partitioned or the next messages between them are dropped
+func (ft *FaultTransport) dropMessage(from *cluster.Node, to *cluster.Node, message *Message) bool {
+	if from.Adhoc || to.Adhoc {
+		return false
+	}
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if !ft.enabled {
+		return false
+	}
+
+	fromGroup, fromFound := ft.partitions[from.Id]
+	toGroup, toFound := ft.partitions[to.Id]
+	if fromFound && toFound && fromGroup != toGroup {
+		return true
+	}
+
+	if message.ServiceId == NET_SERVICE {
+		return false
+	}
+
+	keys := []string{
+		fmt.Sprintf("%d>%d/%d/%d", from.Id, to.Id, message.ServiceId, message.FunctionId),
+		fmt.Sprintf("%d>%d", from.Id, to.Id),
+	}
+	for _, key := range keys {
+		if count, found := ft.dropNext[key]; found {
+			if count > 1 {
+				ft.dropNext[key] = count - 1
+			} else {
+				ft.dropNext[key] = 0, false
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// Waits some ns on the clock of the wrapped transport
+func (ft *FaultTransport) sleep(delay int64) {
+	<-transportClock(ft.transport).After(delay)
+}
+
+// Returns the delay in ns to wait before calling a function on a node
+func (ft *FaultTransport) functionDelay(node *cluster.Node, serviceId byte, functionId byte) int64 {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if !ft.enabled {
+		return 0
+	}
+	return ft.slow[fmt.Sprintf("%d/%d/%d", node.Id, serviceId, functionId)]
+}
+
+// Returns the delay in ns of a packet or a stream write. Must be called with
+// the mutex locked.
+func (ft *FaultTransport) randomDelay() int64 {
+	delay := ft.delayMin
+	if ft.delayMax > ft.delayMin {
+		delay += ft.random.Intn(ft.delayMax - ft.delayMin + 1)
+	}
+	return int64(delay) * 1000 * 1000
+}
+
+func (ft *FaultTransport) streamDelay() int64 {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if !ft.enabled {
+		return 0
+	}
+	return ft.randomDelay()
+}
+
+// Returns a copy of a stream write with a bit flipped if it contains the
+// marker of a corruption left to do, else the write itself
+func (ft *FaultTransport) corruptWrite(b []byte) []byte {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if !ft.enabled {
+		return b
+	}
+
+	for i, marker := range ft.corrupt {
+		index := bytes.Index(b, []byte(marker))
+		if index < 0 {
+			continue
+		}
+		ft.corrupt = append(ft.corrupt[:i], ft.corrupt[i+1:]...)
+
+		corrupted := make([]byte, len(b))
+		copy(corrupted, b)
+		corrupted[index] ^= 0x01
+		return corrupted
+	}
+	return b
+}
+
+// Decides the fate of a packet: returns the number of copies to send (0 if
+// it's dropped) and the delay in ns to send them after
+func (ft *FaultTransport) packetFate() (copies int, delay int64) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if !ft.enabled {
+		return 1, 0
+	}
+
+	if ft.random.Float64() < ft.drop {
+		return 0, 0
+	}
+
+	copies = 1
+	if ft.random.Float64() < ft.duplicate {
+		copies = 2
+	}
+
+	delay = ft.randomDelay()
+	if ft.random.Float64() < ft.reorder {
+		delay += int64(ft.delayMax-ft.delayMin+FAULTS_REORDER_DELAY) * 1000 * 1000
+	}
+
+	return copies, delay
+}
+
+func (ft *FaultTransport) ListenStream(node *cluster.Node) (net.Listener, os.Error) {
+	listener, err := ft.transport.ListenStream(node)
+	if err != nil {
+		return nil, err
+	}
+	return &faultListener{listener, ft}, nil
+}
+
+// Packets are faulted by the sending node
+func (ft *FaultTransport) ListenPacket(node *cluster.Node) (net.PacketConn, os.Error) {
+	return ft.transport.ListenPacket(node)
+}
+
+func (ft *FaultTransport) DialStream(node *cluster.Node) (net.Conn, os.Error) {
+	return ft.DialStreamFrom(nil, node)
+}
+
+func (ft *FaultTransport) DialPacket(node *cluster.Node) (net.Conn, os.Error) {
+	return ft.DialPacketFrom(nil, node)
+}
+
+// The sending node is passed on to the wrapped transport, for simulations
+func (ft *FaultTransport) DialStreamFrom(from *cluster.Node, node *cluster.Node) (net.Conn, os.Error) {
+	con, err := dialStream(ft.transport, from, node)
+	if err != nil {
+		return nil, err
+	}
+	return &faultStreamConn{con, ft}, nil
+}
+
+func (ft *FaultTransport) DialPacketFrom(from *cluster.Node, node *cluster.Node) (net.Conn, os.Error) {
+	con, err := dialPacket(ft.transport, from, node)
+	if err != nil {
+		return nil, err
+	}
+	return &faultPacketConn{con, ft}, nil
+}
+
+// Listener of streams whose writes are delayed, since nodes also respond
+// through the streams opened by other nodes
+type faultListener struct {
+	net.Listener
+	transport *FaultTransport
+}
+
+func (fl *faultListener) Accept() (net.Conn, os.Error) {
+	con, err := fl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &faultStreamConn{con, fl.transport}, nil
+}
+
+// Stream whose writes are delayed or corrupted. Streams are reliable, what is
+// written on them isn't dropped nor reordered.
+type faultStreamConn struct {
+	net.Conn
+	transport *FaultTransport
+}
+
+func (fc *faultStreamConn) Write(b []byte) (int, os.Error) {
+	if delay := fc.transport.streamDelay(); delay > 0 {
+		fc.transport.sleep(delay)
+	}
+	_, err := fc.Conn.Write(fc.transport.corruptWrite(b))
+	return len(b), err
+}
+
+// Sending end of packets that can be dropped, duplicated, delayed or reordered
+type faultPacketConn struct {
+	net.Conn
+	transport *FaultTransport
+}
+
+func (fc *faultPacketConn) Write(b []byte) (int, os.Error) {
+	copies, delay := fc.transport.packetFate()
+	if copies == 0 {
+		return len(b), nil
+	}
+
+	if delay == 0 {
+		for i := 0; i < copies; i++ {
+			_, err := fc.Conn.Write(b)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+
+	// like on the network, errors of delayed packets aren't reported
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	go func() {
+		fc.transport.sleep(delay)
+		for i := 0; i < copies; i++ {
+			fc.Conn.Write(packet)
+		}
+	}()
+	return len(b), nil
+}
+
+// Returns true if a message to a node must be dropped by the fault injection
+// transport
+func (comm *Comm) faultDropped(node *cluster.Node, message *Message) bool {
+	ft, ok := comm.transport.(*FaultTransport)
+	return ok && ft.dropMessage(comm.Cluster.MyNode, node, message)
+}
+
+// Waits before calling a function slowed down by the fault injection
+// transport
+func (comm *Comm) faultDelay(message *Message) {
+	if ft, ok := comm.transport.(*FaultTransport); ok {
+		if delay := ft.functionDelay(comm.Cluster.MyNode, message.ServiceId, message.FunctionId); delay > 0 {
+			comm.logger.Debug("Slowing down message %s by %d ms", message, delay/1000000)
+			<-comm.clock.After(delay)
+		}
+	}
+}
+
+// Sends a fault injection script to a node, which applies it to its
+// transport. Fails if the node doesn't use a fault injection transport.
+func (comm *Comm) InjectFaults(node *cluster.Node, script string) os.Error {
+	result := make(chan os.Error, 1)
+
+	message := comm.NewMsgMessage(NET_SERVICE)
+	message.FunctionId = NET_FUNC_FAULTS
+	message.Message.WriteString(script) // script
+
+	message.Timeout = FAULTS_TIMEOUT
+	message.Retries = FAULTS_RETRIES
+	message.LastTimeoutAsError = true
+	// only the first outcome is kept, a failed send still times out
+	done := func(err os.Error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	message.OnError = func(response *Message, error os.Error) {
+		done(error)
+	}
+	message.OnResponse = func(response *Message) {
+		done(nil)
+	}
+
+	comm.SendNode(node, message)
+	return <-result
+}
+
+func (comm *Comm) handleFaults(message *Message) {
+	script, err := message.Message.ReadString() // script
+	if err != nil {
+		comm.RespondError(message, err)
+		return
+	}
+
+	ft, ok := comm.transport.(*FaultTransport)
+	if !ok {
+		comm.RespondError(message, ErrorFaultsUnavailable)
+		return
+	}
+
+	comm.logger.Warning("Applying fault injection script from %s", message.SourceNode())
+	err = ft.Script(script)
+	if err != nil {
+		comm.RespondError(message, err)
+		return
+	}
+
+	comm.RespondSource(message, comm.NewMsgMessage(NET_SERVICE))
+}
@@ -0,0 +1,335 @@
+package comm
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"gostore/cluster"
+)
+
+const (
+	NET_FUNC_FRAGMENT     = RESERVED_FUNCTIONS + 3 // Fragment of a message too big for an UDP packet
+	NET_FUNC_FRAGMENT_ACK = RESERVED_FUNCTIONS + 4 // Fragments of a message received so far
+
+	FRAGMENT_SIZE               = 7000  // Size of the data of a fragment, fits in an UDP packet with its header
+	FRAGMENT_MAX_SIZE           = 65535 // Maximum size of a fragmented message, bigger ones are sent by TCP
+	FRAGMENT_MAX_COUNT          = 32    // Maximum number of fragments of a message (acks are 32 bits bitmaps)
+	FRAGMENT_ACK_TIMEOUT        = 200   // 200 ms, time to wait for acks before retransmitting fragments
+	FRAGMENT_RETRIES            = 5     // Retransmissions of fragments before giving up
+	FRAGMENT_REASSEMBLY_TIMEOUT = 5000  // 5 seconds, default time after which an incomplete message is dropped
+	FRAGMENT_MAX_REASSEMBLIES   = 1000  // Maximum number of messages being reassembled
+)
+
+// Fragmentation of messages sent by UDP. Messages that don't fit in an UDP
+// packet are split in fragments sent as messages of the communication layer
+// and reassembled by the receiving node before being handled. The receiving
+// node acknowledges the fragments it received so far at each fragment, and
+// the fragments that haven't been acknowledged are sent again until the
+// whole message is acknowledged.
+//
+// Fragmentation is optional (see Comm.Fragmentation) and must be enabled on
+// all nodes since older nodes don't know fragments.
+type fragmentation struct {
+	comm  *Comm
+	mutex *sync.Mutex
+
+	outgoing map[string]*fragmentedMessage // messages being sent, by destination and message key
+	incoming map[string]*reassembly        // messages being received, by sender and message key
+	stats    FragmentationStats
+}
+
+// Counters of the messages sent and received in fragments by this node
+type FragmentationStats struct {
+	Fragmented    uint64 // messages sent in fragments
+	Retransmitted uint64 // fragments sent again because they weren't acknowledged
+	Reassembled   uint64 // messages received in fragments
+	Expired       uint64 // messages dropped because their fragments didn't all arrive in time
+}
+
+// Message being sent in fragments
+type fragmentedMessage struct {
+	key       string
+	node      *cluster.Node
+	fragments [][]byte
+	acked     uint32    // bitmap of acknowledged fragments
+	done      chan bool // closed when all fragments are acknowledged
+}
+
+// Message being reassembled
+type reassembly struct {
+	fragments [][]byte
+	received  uint32 // bitmap of received fragments
+	time      int64
+	complete  bool
+}
+
+func newFragmentation(comm *Comm) *fragmentation {
+	frag := new(fragmentation)
+	frag.comm = comm
+	frag.mutex = new(sync.Mutex)
+	frag.outgoing = make(map[string]*fragmentedMessage)
+	frag.incoming = make(map[string]*reassembly)
+	return frag
+}
+
+// Returns the number of messages sent and received in fragments since the start
+func (comm *Comm) FragmentationStats() FragmentationStats {
+	comm.fragments.mutex.Lock()
+	defer comm.fragments.mutex.Unlock()
+	return comm.fragments.stats
+}
+
+// Returns true if a message needs to be fragmented to be sent by UDP
+func (comm *Comm) needsFragmentation(message *Message, maxPacketSize uint64) bool {
+	size := message.TotalSize()
+	return comm.Fragmentation && message.Type == T_MSG && !message.reliable && size >= maxPacketSize && size < FRAGMENT_MAX_SIZE
+}
+
+// Writes a message to a node in fragments. Called by the send queue of the
+// node, the retransmissions are done in their own goroutine.
+func (comm *Comm) writeFragmented(node *cluster.Node, message *Message) {
+	packet := new(bytes.Buffer)
+	message.SeekZero()
+	err := message.writeMessage(packet)
+	if err != nil {
+		comm.logger.Error("Couldn't write message %s to fragment it for %s: %s", message, node, err)
+		if message.OnError != nil {
+			message.OnError(message, err)
+		}
+	}
+
+	message.Release()
+	if err != nil {
+		return
+	}
+
+	out := new(fragmentedMessage)
+	out.key = message.Key().String()
+	out.node = node
+	out.done = make(chan bool)
+
+	data := packet.Bytes()
+	for len(data) > 0 {
+		size := FRAGMENT_SIZE
+		if size > len(data) {
+			size = len(data)
+		}
+		out.fragments = append(out.fragments, data[:size])
+		data = data[size:]
+	}
+
+	outKey := fmt.Sprintf("%s@%s", out.key, poolKey(node))
+	comm.fragments.mutex.Lock()
+	if _, found := comm.fragments.outgoing[outKey]; found {
+		// a retry of the message, still being sent
+		comm.fragments.mutex.Unlock()
+		return
+	}
+	comm.fragments.outgoing[outKey] = out
+	comm.fragments.stats.Fragmented++
+	comm.fragments.mutex.Unlock()
+
+	comm.logger.Debug("Sending message %s to %s in %d fragments", message, node, len(out.fragments))
+	comm.sendFragments(out, false)
+
+	go func() {
+		for retry := 0; retry < FRAGMENT_RETRIES; retry++ {
+			select {
+			case <-out.done:
+				return
+			case <-comm.clock.After(FRAGMENT_ACK_TIMEOUT * 1000 * 1000):
+			}
+
+			comm.logger.Debug("Retransmitting fragments of %s to %s (%d of %d)", out.key, node, retry+1, FRAGMENT_RETRIES)
+			comm.sendFragments(out, true)
+		}
+
+		select {
+		case <-out.done:
+		case <-comm.clock.After(FRAGMENT_ACK_TIMEOUT * 1000 * 1000):
+			// the tracker of the message will retry it or report a timeout
+			comm.logger.Warning("Giving up sending fragments of %s to %s", out.key, node)
+		}
+
+		comm.fragments.mutex.Lock()
+		comm.fragments.outgoing[outKey] = nil, false
+		comm.fragments.mutex.Unlock()
+	}()
+}
+
+// Sends the fragments of a message that haven't been acknowledged yet
+func (comm *Comm) sendFragments(out *fragmentedMessage, retransmit bool) {
+	comm.fragments.mutex.Lock()
+	acked := out.acked
+	comm.fragments.mutex.Unlock()
+
+	for i, fragment := range out.fragments {
+		if acked&(1<<uint(i)) != 0 {
+			continue
+		}
+
+		if retransmit {
+			comm.fragments.mutex.Lock()
+			comm.fragments.stats.Retransmitted++
+			comm.fragments.mutex.Unlock()
+		}
+
+		message := comm.NewMsgMessage(NET_SERVICE)
+		message.FunctionId = NET_FUNC_FRAGMENT
+		message.Message.WriteString(out.key)                  // key of the fragmented message
+		message.Message.WriteUint8(uint8(i))                  // fragment index
+		message.Message.WriteUint8(uint8(len(out.fragments))) // fragments count
+		message.Message.WriteString(string(fragment))         // fragment data
+		message.hold()
+		comm.writeMessage(out.node, message)
+	}
+}
+
+// Handles a fragment of a message, handling the message once all its
+// fragments have been received
+func (comm *Comm) handleFragment(message *Message) {
+	key, err := message.Message.ReadString() // key of the fragmented message
+	if err != nil {
+		comm.logger.Error("Couldn't read fragment %s: %s", message, err)
+		return
+	}
+
+	index, err := message.Message.ReadUint8() // fragment index
+	if err != nil {
+		comm.logger.Error("Couldn't read fragment %s: %s", message, err)
+		return
+	}
+
+	count, err := message.Message.ReadUint8() // fragments count
+	if err != nil {
+		comm.logger.Error("Couldn't read fragment %s: %s", message, err)
+		return
+	}
+
+	data, err := message.Message.ReadString() // fragment data
+	if err != nil {
+		comm.logger.Error("Couldn't read fragment %s: %s", message, err)
+		return
+	}
+
+	if count == 0 || count > FRAGMENT_MAX_COUNT || index >= count {
+		comm.logger.Error("Invalid fragment %d of %d of %s", index, count, key)
+		return
+	}
+
+	sender := message.senderNode()
+	if sender == nil {
+		return
+	}
+
+	inKey := fmt.Sprintf("%s@%s", key, message.sourceKey())
+	now := comm.clock.Now()
+
+	comm.fragments.mutex.Lock()
+	comm.fragments.expire(now)
+
+	in, found := comm.fragments.incoming[inKey]
+	if !found {
+		if len(comm.fragments.incoming) >= FRAGMENT_MAX_REASSEMBLIES {
+			comm.fragments.mutex.Unlock()
+			comm.logger.Warning("Too many messages being reassembled, dropping fragment of %s", key)
+			return
+		}
+
+		in = new(reassembly)
+		in.fragments = make([][]byte, count)
+		in.time = now
+		comm.fragments.incoming[inKey] = in
+	}
+
+	var packet []byte
+	if !in.complete && int(count) == len(in.fragments) && in.received&(1<<index) == 0 {
+		in.fragments[index] = []byte(data)
+		in.received |= 1 << index
+
+		if in.received == (1<<count)-1 {
+			// keep the entry to acknowledge late retransmissions
+			in.complete = true
+			packet = bytes.Join(in.fragments, nil)
+			in.fragments = nil
+			comm.fragments.stats.Reassembled++
+		}
+	}
+	received := in.received
+	comm.fragments.mutex.Unlock()
+
+	comm.sendFragmentsAck(sender, key, received)
+
+	if packet != nil {
+		comm.handlePacket(packet)
+	}
+}
+
+// Handles a message reassembled from its fragments
+func (comm *Comm) handlePacket(packet []byte) {
+	msg := comm.NewMessage()
+	err := msg.readMessage(bytes.NewBuffer(packet))
+
+	if err == ErrorCorrupted {
+		comm.logger.Error("Received corrupted fragmented message: %s", msg)
+		comm.corruptions.add(&comm.corruptions.stats.UDP)
+		comm.respondCorrupted(msg)
+	} else if err != nil {
+		comm.logger.Error("Couldn't handle fragmented message because of errors: %s %s", msg, err)
+	} else {
+		comm.handleMessage(msg)
+	}
+}
+
+// Drops messages that couldn't be reassembled in time. Must be called with
+// the mutex locked.
+func (frag *fragmentation) expire(now int64) {
+	timeout := int64(frag.comm.ReassemblyTimeout) * 1000 * 1000
+	for key, in := range frag.incoming {
+		if now-in.time >= timeout {
+			if !in.complete {
+				frag.comm.logger.Warning("Couldn't reassemble message %s in time", key)
+				frag.stats.Expired++
+			}
+			frag.incoming[key] = nil, false
+		}
+	}
+}
+
+func (comm *Comm) sendFragmentsAck(node *cluster.Node, key string, received uint32) {
+	message := comm.NewMsgMessage(NET_SERVICE)
+	message.FunctionId = NET_FUNC_FRAGMENT_ACK
+	message.Message.WriteString(key)      // key of the fragmented message
+	message.Message.WriteUint32(received) // bitmap of received fragments
+	comm.SendNode(node, message)
+}
+
+// Handles the acknowledgement of fragments by the receiving node
+func (comm *Comm) handleFragmentsAck(message *Message) {
+	key, err := message.Message.ReadString() // key of the fragmented message
+	if err != nil {
+		comm.logger.Error("Couldn't read fragments ack %s: %s", message, err)
+		return
+	}
+
+	received, err := message.Message.ReadUint32() // bitmap of received fragments
+	if err != nil {
+		comm.logger.Error("Couldn't read fragments ack %s: %s", message, err)
+		return
+	}
+
+	sender := message.senderNode()
+	if sender == nil {
+		return
+	}
+
+	comm.fragments.mutex.Lock()
+	out, found := comm.fragments.outgoing[fmt.Sprintf("%s@%s", key, poolKey(sender))]
+	if found && out.acked != (1<<uint(len(out.fragments)))-1 {
+		out.acked |= received
+		if out.acked == (1<<uint(len(out.fragments)))-1 {
+			close(out.done)
+		}
+	}
+	comm.fragments.mutex.Unlock()
+}
@@ -0,0 +1,146 @@
+package comm_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"gostore/cluster"
+	"gostore/comm"
+)
+
+// Returns a message too big for an UDP packet, in 3 fragments with a marker
+// in each
+func bigPayload(first string, second string, third string) string {
+	payload := bytes.Repeat([]byte("x"), 15000)
+	copy(payload[100:], first)
+	copy(payload[8000:], second)
+	copy(payload[14500:], third)
+	return string(payload)
+}
+
+func newFragmentingCluster(transport comm.Transport) *testCluster {
+	tc := newTestCluster(2, transport)
+	for _, c := range tc.comms {
+		c.Fragmentation = true
+	}
+	return tc
+}
+
+func lengthMessage(tc *testCluster, payload string) *comm.Message {
+	message := tc.echoMessage(0, payload, nil)
+	message.Function = "RemoteLength"
+	message.Timeout = 2000 // longer than retransmissions of fragments
+	return message
+}
+
+func contains(packet []byte, marker string) bool {
+	return bytes.Index(packet, []byte(marker)) >= 0
+}
+
+func TestFragmentsRetransmission(t *testing.T) {
+	firstSent := 0
+	secondDropped := false
+	transport := newDroppingTransport(func(to *cluster.Node, packet []byte) bool {
+		if to.Id != 1 {
+			return false
+		}
+
+		if contains(packet, "fragment-one") {
+			firstSent++
+		}
+		if contains(packet, "fragment-two") && !secondDropped {
+			secondDropped = true
+			return true
+		}
+		return false
+	})
+	tc := newFragmentingCluster(transport)
+
+	payload, err := tc.call(0, 1, lengthMessage(tc, bigPayload("fragment-one", "fragment-two", "fragment-three")))
+	if err != nil || payload != "15000" {
+		t.Errorf("1) Message should have been reassembled, got %s %s", payload, err)
+	}
+
+	if stats := tc.comms[0].FragmentationStats(); stats.Fragmented != 1 || stats.Retransmitted != 1 {
+		t.Errorf("2) Only the lost fragment should have been sent again: %v", stats)
+	}
+
+	transport.mutex.Lock()
+	if firstSent != 1 {
+		t.Errorf("3) Acknowledged fragment shouldn't have been sent again, sent %d times", firstSent)
+	}
+	transport.mutex.Unlock()
+
+	if stats := tc.comms[1].FragmentationStats(); stats.Reassembled != 1 {
+		t.Errorf("4) Message should have been reassembled once: %v", stats)
+	}
+}
+
+func TestFragmentsAcksLost(t *testing.T) {
+	key := ""
+	acksDropped := 0
+	transport := newDroppingTransport(func(to *cluster.Node, packet []byte) bool {
+		// acks are the only packets to the sender with the key of the message
+		if to.Id == 0 && key != "" && contains(packet, key) && acksDropped < 3 {
+			acksDropped++
+			return true
+		}
+		return false
+	})
+	tc := newFragmentingCluster(transport)
+
+	message := lengthMessage(tc, bigPayload("fragment-one", "fragment-two", "fragment-three"))
+	transport.mutex.Lock()
+	key = message.Key().String()
+	transport.mutex.Unlock()
+
+	payload, err := tc.call(0, 1, message)
+	if err != nil || payload != "15000" {
+		t.Errorf("1) Message should have been reassembled, got %s %s", payload, err)
+	}
+
+	// all fragments are sent again since none got acknowledged
+	retransmitted := waitFor(func() bool {
+		return tc.comms[0].FragmentationStats().Retransmitted == 3
+	})
+	if !retransmitted {
+		t.Errorf("2) Fragments should have been sent again: %v", tc.comms[0].FragmentationStats())
+	}
+	time.Sleep(comm.FRAGMENT_ACK_TIMEOUT * 1000 * 1000)
+
+	if received := tc.echos[1].Received(); len(received) != 1 {
+		t.Errorf("3) Late fragments shouldn't have been handled again: %d handled", len(received))
+	}
+	if stats := tc.comms[1].FragmentationStats(); stats.Reassembled != 1 {
+		t.Errorf("4) Message should have been reassembled once: %v", stats)
+	}
+}
+
+func TestFragmentsReassemblyTimeout(t *testing.T) {
+	transport := newDroppingTransport(func(to *cluster.Node, packet []byte) bool {
+		return to.Id == 1 && contains(packet, "fragment-two")
+	})
+	tc := newFragmentingCluster(transport)
+	tc.comms[1].ReassemblyTimeout = 100
+
+	message := lengthMessage(tc, bigPayload("fragment-one", "fragment-two", "fragment-three"))
+	message.Timeout = 500
+	message.Retries = 0
+	_, err := tc.call(0, 1, message)
+	if err == nil {
+		t.Errorf("1) Message missing a fragment shouldn't have been handled")
+	}
+
+	// incomplete messages are dropped when other fragments are received
+	payload, err := tc.call(0, 1, lengthMessage(tc, bigPayload("fragment-one", "fragment-bis", "fragment-three")))
+	if err != nil || payload != "15000" {
+		t.Errorf("2) Other message should have been reassembled, got %s %s", payload, err)
+	}
+
+	if stats := tc.comms[1].FragmentationStats(); stats.Expired != 1 || stats.Reassembled != 1 {
+		t.Errorf("3) Incomplete message should have expired: %v", stats)
+	}
+	if received := tc.echos[1].Received(); len(received) != 1 {
+		t.Errorf("4) Only the complete message should have been handled: %d handled", len(received))
+	}
+}
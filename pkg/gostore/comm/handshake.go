@@ -0,0 +1,351 @@
+package comm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"gostore/cluster"
+	"gostore/tools/buffer"
+)
+
+const (
+	NET_SERVICE        = 0                  // Service id of the communication layer itself
+	NET_FUNC_HANDSHAKE = RESERVED_FUNCTIONS // Exchange of the functions tables and codecs
+
+	HANDSHAKE_TIMEOUT = 1000 // 1 second
+	HANDSHAKE_RETRIES = 5
+	HANDSHAKE_WAIT    = 3000 // 3 seconds, maximum time a call waits for the handshake with its node
+)
+
+// Functions of the services of a node: service id -> function id -> name
+type functionsTable map[byte]map[byte]string
+
+// Functions tables of the other nodes, learned by handshaking with them.
+// Since functions ids are explicit, a node running another version of a
+// service can still be called as long as the functions have the same ids.
+// Calls to functions that don't match on both ends are rejected. Calls
+// to or from a node whose table isn't known yet wait for the handshake with
+// the node, so that even the first calls are checked. Nodes that don't know
+// handshakes (older versions) are called without checking.
+//
+// Nodes also learn the compression codecs of each other, data is only
+// compressed with a codec the receiving node supports.
+//
+// A node may have been restarted with other services since we learned its
+// table, so the table is forgotten when a connection with the node gets
+// reset or when the node goes offline, and learned again on the next call.
+type peersTables struct {
+	mutex   *sync.Mutex
+	tables  map[uint16]functionsTable
+	codecs  map[uint16]map[byte]bool // compression codecs supported by nodes
+	legacy  map[uint16]bool          // nodes that don't know handshakes
+	pending map[uint16]chan bool     // closed when the pending handshake ends
+}
+
+func newPeersTables() *peersTables {
+	peers := new(peersTables)
+	peers.mutex = new(sync.Mutex)
+	peers.tables = make(map[uint16]functionsTable)
+	peers.codecs = make(map[uint16]map[byte]bool)
+	peers.legacy = make(map[uint16]bool)
+	peers.pending = make(map[uint16]chan bool)
+	return peers
+}
+
+func (peers *peersTables) get(node *cluster.Node) (table functionsTable, found bool) {
+	peers.mutex.Lock()
+	table, found = peers.tables[node.Id]
+	peers.mutex.Unlock()
+	return
+}
+
+func (peers *peersTables) set(node *cluster.Node, table functionsTable, codecs map[byte]bool) {
+	peers.mutex.Lock()
+	peers.tables[node.Id] = table
+	peers.codecs[node.Id] = codecs
+	peers.legacy[node.Id] = false, false
+	peers.end(node)
+	peers.mutex.Unlock()
+}
+
+// Marks a handshake with the node as pending. Returns false if we already
+// know the table of the node or if a handshake is already pending.
+func (peers *peersTables) start(node *cluster.Node) bool {
+	peers.mutex.Lock()
+	defer peers.mutex.Unlock()
+
+	_, known := peers.tables[node.Id]
+	_, pending := peers.pending[node.Id]
+	if known || pending || peers.legacy[node.Id] {
+		return false
+	}
+
+	peers.pending[node.Id] = make(chan bool)
+	return true
+}
+
+// Returns a channel closed when the pending handshake with the node ends,
+// nil if there is none
+func (peers *peersTables) waiting(node *cluster.Node) chan bool {
+	peers.mutex.Lock()
+	defer peers.mutex.Unlock()
+	return peers.pending[node.Id]
+}
+
+// Returns true if the node doesn't know handshakes
+func (peers *peersTables) isLegacy(node *cluster.Node) bool {
+	peers.mutex.Lock()
+	defer peers.mutex.Unlock()
+	return peers.legacy[node.Id]
+}
+
+// Remembers that the node doesn't know handshakes
+func (peers *peersTables) setLegacy(node *cluster.Node) {
+	peers.mutex.Lock()
+	peers.legacy[node.Id] = true
+	peers.end(node)
+	peers.mutex.Unlock()
+}
+
+// Ends the pending handshake with a node, waking the calls waiting for it.
+// Must be called with the mutex locked.
+func (peers *peersTables) end(node *cluster.Node) {
+	if done, found := peers.pending[node.Id]; found {
+		close(done)
+		peers.pending[node.Id] = nil, false
+	}
+}
+
+// Returns true if we know that the node supports a compression codec
+func (peers *peersTables) supportsCodec(node *cluster.Node, codec byte) bool {
+	if node.Adhoc {
+		return false
+	}
+
+	peers.mutex.Lock()
+	defer peers.mutex.Unlock()
+	return peers.codecs[node.Id][codec]
+}
+
+// Forgets the table and codecs of a node, which will be handshaked again
+func (peers *peersTables) forget(node *cluster.Node) {
+	peers.mutex.Lock()
+	peers.tables[node.Id] = nil, false
+	peers.codecs[node.Id] = nil, false
+	peers.legacy[node.Id] = false, false
+	peers.mutex.Unlock()
+}
+
+func (peers *peersTables) abort(node *cluster.Node) {
+	peers.mutex.Lock()
+	peers.end(node)
+	peers.mutex.Unlock()
+}
+
+func writeFunctionsTable(buf *buffer.Buffer, table functionsTable) {
+	buf.WriteUint8(uint8(len(table))) // services count
+	for serviceId, functions := range table {
+		buf.WriteUint8(serviceId)             // service id
+		buf.WriteUint8(uint8(len(functions))) // functions count
+		for functionId, name := range functions {
+			buf.WriteUint8(functionId) // function id
+			buf.WriteString(name)      // function name
+		}
+	}
+}
+
+func readFunctionsTable(buf *buffer.Buffer) (table functionsTable, err os.Error) {
+	table = make(functionsTable)
+
+	servicesCount, err := buf.ReadUint8() // services count
+	if err != nil {
+		return nil, err
+	}
+
+	for s := uint8(0); s < servicesCount; s++ {
+		serviceId, err := buf.ReadUint8() // service id
+		if err != nil {
+			return nil, err
+		}
+
+		functionsCount, err := buf.ReadUint8() // functions count
+		if err != nil {
+			return nil, err
+		}
+
+		functions := make(map[byte]string)
+		for f := uint8(0); f < functionsCount; f++ {
+			functionId, err := buf.ReadUint8() // function id
+			if err != nil {
+				return nil, err
+			}
+
+			name, err := buf.ReadString() // function name
+			if err != nil {
+				return nil, err
+			}
+
+			functions[functionId] = name
+		}
+		table[serviceId] = functions
+	}
+
+	return table, nil
+}
+
+// Sends our functions table to a node if we don't know its table yet. The
+// node responds with its own table.
+func (comm *Comm) handshake(node *cluster.Node) {
+	if node.Adhoc || node.Equals(comm.Cluster.MyNode) || !comm.peers.start(node) {
+		return
+	}
+
+	comm.logger.Debug("Handshaking with %s", node)
+
+	message := comm.NewMsgMessage(NET_SERVICE)
+	message.FunctionId = NET_FUNC_HANDSHAKE
+	writeFunctionsTable(message.Message, comm.functionsTable())
+	writeCodecs(message.Message)
+
+	message.Timeout = HANDSHAKE_TIMEOUT
+	message.Retries = HANDSHAKE_RETRIES
+	message.RetryDelay = 0 // calls are waiting for it
+	message.OnTimeout = func(last bool) (retry bool, handled bool) {
+		if last {
+			comm.logger.Warning("Couldn't handshake with %s", node)
+			comm.peers.abort(node)
+		}
+		return true, false
+	}
+	message.OnError = func(response *Message, error os.Error) {
+		// older nodes don't have the handshake function
+		if strings.HasPrefix(error.String(), ErrorUnknownFunction.String()) {
+			comm.logger.Warning("Node %s doesn't know handshakes, its functions won't be checked", node)
+			comm.peers.setLegacy(node)
+			return
+		}
+
+		comm.logger.Error("Handshake with %s failed: %s", node, error)
+		comm.peers.abort(node)
+	}
+	message.OnResponse = func(response *Message) {
+		table, err := readFunctionsTable(response.Message)
+		if err != nil {
+			comm.logger.Error("Couldn't read functions table of %s: %s", node, err)
+			comm.peers.abort(node)
+			return
+		}
+
+		codecs, err := readCodecs(response.Message)
+		if err != nil {
+			comm.logger.Error("Couldn't read codecs of %s: %s", node, err)
+			comm.peers.abort(node)
+			return
+		}
+		comm.peers.set(node, table, codecs)
+	}
+
+	comm.SendNode(node, message)
+}
+
+// Handles a message sent to the communication layer itself
+func (comm *Comm) handleNetMessage(message *Message) {
+	switch message.FunctionId {
+	case NET_FUNC_HANDSHAKE:
+		table, err := readFunctionsTable(message.Message)
+		if err != nil {
+			comm.RespondError(message, err)
+			return
+		}
+
+		codecs, err := readCodecs(message.Message)
+		if err != nil {
+			comm.RespondError(message, err)
+			return
+		}
+
+		node := message.SourceNode()
+		if node != nil && !node.Adhoc {
+			comm.logger.Debug("Received functions table of %s", node)
+			comm.peers.set(node, table, codecs)
+		}
+
+		response := comm.NewMsgMessage(NET_SERVICE)
+		writeFunctionsTable(response.Message, comm.functionsTable())
+		writeCodecs(response.Message)
+		comm.RespondSource(message, response)
+
+	case NET_FUNC_CANCEL:
+		comm.handleCancel(message)
+
+	case NET_FUNC_STREAM_CREDIT:
+		comm.handleStreamCredits(message)
+
+	case NET_FUNC_FRAGMENT:
+		comm.handleFragment(message)
+
+	case NET_FUNC_FRAGMENT_ACK:
+		comm.handleFragmentsAck(message)
+
+	case NET_FUNC_FAULTS:
+		comm.handleFaults(message)
+
+	case NET_FUNC_HEARTBEAT:
+		comm.handleHeartbeat(message)
+
+	case NET_FUNC_PING:
+		// the connection it came by works, nothing to do
+
+	default:
+		comm.RespondError(message, os.NewError(fmt.Sprintf("%s: #%d of communication layer", ErrorUnknownFunction, message.FunctionId)))
+	}
+}
+
+// Checks that a function call means the same function on this node and on
+// the given node, using the functions table of the node. If we don't know the
+// table of the node yet, handshakes with it and waits for its table (at most
+// HANDSHAKE_WAIT). Fails with a timeout if the node didn't respond to the
+// handshake in time.
+func (comm *Comm) checkFunction(node *cluster.Node, serviceId byte, functionId byte) os.Error {
+	if node == nil || node.Adhoc || serviceId == NET_SERVICE || functionId < RESERVED_FUNCTIONS {
+		return nil
+	}
+
+	table, found := comm.peers.get(node)
+	if !found {
+		comm.handshake(node)
+
+		if done := comm.peers.waiting(node); done != nil {
+			select {
+			case <-done:
+			case <-comm.clock.After(HANDSHAKE_WAIT * 1000 * 1000):
+			}
+		}
+
+		table, found = comm.peers.get(node)
+		if !found {
+			if comm.peers.isLegacy(node) {
+				return nil
+			}
+			return ErrorTimeout
+		}
+	}
+
+	var localName string
+	wrapper := comm.GetWrapper(serviceId)
+	if wrapper != nil {
+		localName = wrapper.id2name[functionId]
+	}
+
+	var remoteName string
+	if functions, found := table[serviceId]; found {
+		remoteName = functions[functionId]
+	}
+
+	if localName == "" || remoteName == "" || localName != remoteName {
+		return os.NewError(fmt.Sprintf("%s: function #%d of service #%d is '%s' on node %d and '%s' on node %d", ErrorIncompatibleFunction, functionId, serviceId, localName, comm.Cluster.MyNode.Id, remoteName, node.Id))
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package comm_test
+
+import (
+	"strings"
+	"testing"
+	"gostore/comm"
+)
+
+// Echo service of another version, whose functions have other ids
+type swappedService struct {
+	*echoService
+}
+
+func (ss *swappedService) Functions() map[string]byte {
+	return map[string]byte{
+		"RemoteEcho":   comm.RESERVED_FUNCTIONS + 1,
+		"RemoteLength": comm.RESERVED_FUNCTIONS,
+	}
+}
+
+func TestIncompatibleFunctions(t *testing.T) {
+	tc := newTestClusterServices(2, comm.NewMemoryTransport(), func(i int, es *echoService) comm.Service {
+		if i == 1 {
+			return &swappedService{es}
+		}
+		return es
+	})
+
+	// even the first call, sent before knowing the table of the node
+	_, err := tc.call(0, 1, tc.echoMessage(0, "first", nil))
+	if err == nil || !strings.HasPrefix(err.String(), comm.ErrorIncompatibleFunction.String()) {
+		t.Errorf("1) First call should have been rejected as incompatible, got %s", err)
+	}
+
+	_, err = tc.call(0, 1, tc.echoMessage(0, "second", nil))
+	if err == nil || !strings.HasPrefix(err.String(), comm.ErrorIncompatibleFunction.String()) {
+		t.Errorf("2) Second call should have been rejected as incompatible, got %s", err)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 0 {
+		t.Errorf("3) Incompatible calls shouldn't have been handled: %v", received)
+	}
+}
@@ -0,0 +1,104 @@
+package comm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"gostore/comm"
+)
+
+func TestWideIds(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+
+	// ids with the same low 16 bits, which legacy headers would confuse
+	first := tc.echoMessage(0, "first", nil)
+	first.Id = 1<<32 + 5
+	second := tc.echoMessage(0, "second", nil)
+	second.Id = 2<<32 + 5
+
+	type result struct {
+		payload string
+		err     os.Error
+	}
+	results := make(chan result, 1)
+	go func() {
+		payload, err := tc.call(0, 1, first)
+		results <- result{payload, err}
+	}()
+
+	payload, err := tc.call(0, 1, second)
+	if err != nil || payload != "second" {
+		t.Errorf("1) Second message should have got its own response, got %s %s", payload, err)
+	}
+
+	res := <-results
+	if res.err != nil || res.payload != "first" {
+		t.Errorf("2) First message should have got its own response, got %s %s", res.payload, res.err)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 2 {
+		t.Errorf("3) Both messages should have been handled: %v", received)
+	}
+}
+
+// Returns a message with a legacy header: | Id (2) | Flags (1) | Service Id (1) |
+// MsgSize (2) | SrcNode (2) | Function Id (1) | Msg |
+func legacyPacket(id uint16, srcNode uint16, functionId byte, payload string) []byte {
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.LittleEndian, id)
+	packet.WriteByte(0) // flags
+	packet.WriteByte(ECHO_SERVICE)
+	binary.Write(packet, binary.LittleEndian, uint16(len(payload)))
+	binary.Write(packet, binary.LittleEndian, srcNode)
+	packet.WriteByte(functionId)
+	packet.WriteString(payload)
+	return packet.Bytes()
+}
+
+func TestLegacyHeader(t *testing.T) {
+	transport := comm.NewMemoryTransport()
+	tc := newTestCluster(2, transport)
+
+	con, err := transport.DialPacket(tc.node(0, 1))
+	if err != nil {
+		t.Fatalf("1) Couldn't dial node 1: %s", err)
+	}
+	_, err = con.Write(legacyPacket(7, 0, comm.RESERVED_FUNCTIONS, "legacy"))
+	if err != nil {
+		t.Errorf("2) Couldn't send legacy message: %s", err)
+	}
+
+	handled := waitFor(func() bool {
+		return len(tc.echos[1].Received()) == 1
+	})
+	if !handled || tc.echos[1].Received()[0] != "legacy" {
+		t.Errorf("3) Message with a legacy header should have been handled: %v", tc.echos[1].Received())
+	}
+}
+
+func TestHeaderSizeWithOptions(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+
+	// fits in a packet with a header of 51 bytes, but not once the deadline,
+	// trace and checksum options are counted
+	payload := bytes.Repeat([]byte("x"), comm.MAX_MSG_SIZE-51-1)
+	message := tc.comms[0].NewMsgMessage(ECHO_SERVICE)
+	message.Function = "RemoteLength"
+	message.Message.Write(payload)
+	message.Timeout = 200
+	message.Retries = 3
+	message.SetDeadline(WAIT_TIMEOUT)
+	message.TraceId = 1
+	message.SpanId = 2
+
+	if size := message.TotalSize(); size < comm.MAX_MSG_SIZE {
+		t.Errorf("1) Size of the message should count its options, got %d", size)
+	}
+
+	response, err := tc.call(0, 1, message)
+	if err != nil || response != fmt.Sprintf("%d", len(payload)) {
+		t.Errorf("2) Message should have been received whole, got %s %s", response, err)
+	}
+}
@@ -3,22 +3,24 @@ package comm
 import (
 	"io"
 	"gostore/cluster"
-	"gostore/log"
 	"gostore/tools/buffer"
 	"gostore/tools/typedio"
 	"os"
 	"net"
 	"fmt"
+	"sync/atomic"
 )
 
 /**************************************************************************************
  * Message packet structure
  * ------------------------------------------------------------------------------------
- * | Id (4) | Flags (see below) (1) | [Initial Id (4)] | Service Id (1) |  MsgSize (4) | 
+ * | Id low bits (2) | Flags (see below) (1) | Version (1) | Id (8) | [Initial Id (8)] |
  * ------------------------------------------------------------------------------------
- *  [DataSize(8)] | SrcNodeInfo (var) | [MiddleNodeInfo (var)] | Function Id (1) |
+ *  [Options count (1) | Option type (1) | Option length (1) | Option value (var) ...] |
+ * ------------------------------------------------------------------------------------
+ *  Service Id (1) |  MsgSize (2) | [DataSize(8)] | SrcNodeInfo (var) | 
  * ------------------------------------------------------------------------------------ 
- *  Msg + [Data]
+ *  [MiddleNodeInfo (var)] | Function Id (1) | Msg | [Checksum (4)] | [Data] | [Data checksum (4)]
  * ------------------------------------------------------------------------------------
  *
  * Flags:
@@ -27,22 +29,72 @@ import (
  *	0x04 - Source node is adhoc (IP+UDPPort+TCPPort in header instead of SrcNode field)
  *	0x08 - Has Middle Node
  *	0x10 - Middle node is adhoc (IP+UDPPort+TCPPort in header instead of MiddleNode field)
+ *	0x20 - Data is compressed (codec option present, data sent in chunks, see below)
+ *	0x40 - Has header options (version 3)
+ *	0x80 - Extended header (Version and 64 bits ids)
+ *
+ * Options (unknown options are skipped):
+ *  1 - Deadline: remaining time of the call chain in ms (4)
+ *  2 - Stream frame: Sequence (4) | Flags (1) (0x01 = end of stream)
+ *  3 - Stream window: number of frames the responder can send ahead (4)
+ *  4 - Codec: id of the codec compressed data is compressed with (1)
+ *  5 - Checksum: Flags (1) (0x01 = data checksum present) (version 4)
+ *  6 - Trace: Trace Id (8) | Span Id (8) (span of the sender, 0 at the root of the trace)
+ *
+ * Checksums are CRC32C. The checksum follows the message and covers everything from the
+ * start of the header to the end of the message. The data checksum follows the data.
+ * Since a corrupted header could lose the checksum option, nodes that checksum the messages
+ * they send reject the version 4 messages that aren't checksummed. Older versions never
+ * have a checksum and are accepted without, so that nodes that don't checksum can still
+ * talk to the cluster.
+ *
+ * Compressed data: DataSize is the size of the uncompressed data and the compressed data
+ * is sent in chunks: | Chunk size (4) | Chunk data (var) | ... | 0 (4) |. Its data checksum
+ * covers the chunks data.
+ *
+ * Legacy headers (version 1) don't have the extended flag. Their ids are 16 bits long and
+ * there is no Version nor Id field: | Id (2) | Flags (1) | [Initial Id (2)] | Service Id (1) ...
  */
 
 const (
 	T_MSG  = 1
 	T_DATA = 2
 
+	MESSAGE_VERSION          = 4
+	message_version_options  = 3 // first version with header options, older is written when there is none
+	message_version_checksum = 4 // first version with checksums, older is written when there is none
+
 	prm_has_init_msg_id   = 0x01
 	prm_is_data           = 0x02
 	prm_src_node_adhoc    = 0x04
 	prm_has_middle_node   = 0x08
 	prm_middle_node_adhoc = 0x10
+	prm_compressed        = 0x20
+	prm_has_options       = 0x40
+	prm_extended_header   = 0x80
+
+	opt_deadline      = 1
+	opt_stream_frame  = 2
+	opt_stream_window = 3
+	opt_codec         = 4
+	opt_checksum      = 5
+	opt_trace         = 6
+
+	stream_flag_end = 0x01
 )
 
+// Key identifying a message: the id of the message and the node that
+// created it (ids are only unique per node)
+type MessageKey struct {
+	Id   uint64
+	Node string
+}
+
+func (k MessageKey) String() string { return fmt.Sprintf("%s/%d", k.Node, k.Id) }
+
 type Message struct {
-	Id     uint16
-	InitId uint16
+	Id     uint64
+	InitId uint64
 
 	srcNodeAdhoc   bool
 	srcNodeId      uint16
@@ -70,13 +122,42 @@ type Message struct {
 	DataSize      int64
 	DataAutoClose bool
 
+	// compression of data
+	Codec    Codec  // codec to compress the data with, the codec of the service if nil
+	MimeType string // type of the data, data of compressed types isn't compressed again
+	codec    Codec  // codec the data is compressed with on the wire
+
+	// checksums
+	DataChecksum bool // checksum the data, in addition to the header and message
+	checksum     bool // the header and message are checksummed on the wire
+	dataChecksum bool // the data is checksummed on the wire
+
 	// associated inbound connection (for releasing)
 	connection *Connection
+	frame      *frameReader // data frame read from a TCP connection
+	holders    int32        // goroutines using the message, the last one to release it frees it
+	reliable   bool         // never sent by UDP since it wouldn't be sent again if lost
 
 	// tracking handling
-	Timeout    int
+	Timeout    int // ms
 	Retries    int
-	RetryDelay int
+	RetryDelay int // ms before the first retry, doubled at each retry
+
+	// call chain handling
+	Deadline  int64     // local time (ns) after which the chain is abandoned, 0 if none
+	parentKey string    // key of the message this message is sent on behalf of
+	done      chan bool // closed when the chain gets canceled
+
+	// tracing of the call chain
+	TraceId uint64 // 0 if not traced
+	SpanId  uint64 // span of the sender the message is sent from, 0 at the root of the trace
+	span    *Span  // span of the handling of the message by this node
+
+	// streamed responses
+	streamWindow uint32 // credits given by a streaming request, 0 if not streaming
+	streamFrame  bool   // message is a frame of a streamed response
+	streamSeq    uint32
+	streamEnd    bool
 
 	OnTimeout          func(last bool) (retry bool, handled bool)
 	LastTimeoutAsError bool
@@ -95,16 +176,73 @@ func newMessage(comm *Comm) *Message {
 	r.middleNodePresent = false
 	r.Message = buffer.New()
 	r.Wait = make(chan bool, 1)
+	r.done = make(chan bool)
 
 	return r
 }
 
-func (r *Message) Hash() string { return fmt.Sprintf("%d%d", r.Id, r.SourceNode().Hash()) }
+// Returns the key of the message
+func (r *Message) Key() MessageKey { return MessageKey{r.Id, r.sourceKey()} }
+
+// Returns the key of the message this message responds to
+func (r *Message) InitKey() MessageKey { return MessageKey{r.InitId, r.sourceKey()} }
 
-func (r *Message) InitHash() string { return fmt.Sprintf("%d%d", r.InitId, r.SourceNode().Hash()) }
+// Identifies the source node using header fields only, so that it doesn't
+// depend on the node status
+func (r *Message) sourceKey() string {
+	if r.srcNodeAdhoc {
+		return fmt.Sprintf("%s:%d:%d", r.srcNodeAdr, r.srcNodeTcpPort, r.srcNodeUdpPort)
+	}
 
+	return fmt.Sprintf("%d", r.srcNodeId)
+}
+
+// Returns the size of the message once written, with its header, data and
+// checksums. The data of compressed messages is counted uncompressed.
 func (r *Message) TotalSize() uint64 {
-	return uint64(r.Message.Size) + uint64(r.DataSize) + 36
+	size := r.headerSize() + uint64(r.Message.Size) + uint64(r.DataSize)
+	if r.Type == T_DATA && (r.dataChecksum || r.comm.Checksums && r.DataChecksum) {
+		size += CHECKSUM_SIZE // data checksum
+	}
+	return size
+}
+
+// Returns the size of the written header, the checksum of the message
+// included. Checksums are only set when the message is written, but are
+// counted if they are enabled.
+func (r *Message) headerSize() uint64 {
+	checksum := r.checksum || r.comm.Checksums
+
+	var size uint64 = 2 + 1 + 1 + 8 // id low bits, flags, version, id
+	if r.InitId != 0 {
+		size += 8 // initial message id
+	}
+	if options := r.options(checksum); options != nil {
+		size += uint64(options.Size) // options
+	}
+
+	size += 1 + 2 // service id, message size
+	if r.Type == T_DATA {
+		size += 8 // data size
+	}
+
+	if r.srcNodeAdhoc {
+		size += 8 + uint64(len(r.srcNodeAdr.String())) + 2 + 2 // addr, tcp port, udp port
+	} else {
+		size += 2 // node id
+	}
+
+	if r.middleNodePresent && r.middleNodeAdhoc {
+		size += 8 + uint64(len(r.middleNodeAdr.String())) + 2 + 2 // addr, tcp port, udp port
+	} else if r.middleNodePresent {
+		size += 2 // node id
+	}
+
+	size += 1 // function id
+	if checksum {
+		size += CHECKSUM_SIZE // checksum
+	}
+	return size
 }
 
 func (r *Message) PrepareSend() {
@@ -115,9 +253,12 @@ func (r *Message) PrepareSend() {
 }
 
 func (r *Message) readMessage(reader io.Reader) (err os.Error) {
-	treader := typedio.NewReader(reader)
+	// everything up to the end of the message is checksummed
+	sum := newChecksum()
+	creader := &checksumReader{reader, sum}
+	treader := typedio.NewReader(creader)
 
-	r.Id, err = treader.ReadUint16() // message id
+	idLow, err := treader.ReadUint16() // message id low bits
 	if err != nil {
 		return
 	}
@@ -127,6 +268,28 @@ func (r *Message) readMessage(reader io.Reader) (err os.Error) {
 		return
 	}
 
+	extended := false
+	var version uint8 = 1 // legacy header
+	if flags&prm_extended_header == prm_extended_header {
+		extended = true
+
+		version, err = treader.ReadUint8() // version
+		if err != nil {
+			return err
+		}
+
+		if version > MESSAGE_VERSION {
+			return os.NewError(fmt.Sprintf("Unsupported message version %d", version))
+		}
+
+		r.Id, err = treader.ReadUint64() // message id
+		if err != nil {
+			return err
+		}
+	} else {
+		r.Id = uint64(idLow) // legacy header
+	}
+
 	hasInitId := false
 	if flags&prm_has_init_msg_id == prm_has_init_msg_id {
 		hasInitId = true
@@ -150,13 +313,33 @@ func (r *Message) readMessage(reader io.Reader) (err os.Error) {
 		r.middleNodeAdhoc = true
 	}
 
+	compressed := flags&prm_compressed == prm_compressed
+
 	if hasInitId {
-		r.InitId, err = treader.ReadUint16() // initial message id
+		if extended {
+			r.InitId, err = treader.ReadUint64() // initial message id
+		} else {
+			var initIdLow uint16
+			initIdLow, err = treader.ReadUint16() // legacy initial message id
+			r.InitId = uint64(initIdLow)
+		}
+
 		if err != nil {
 			return
 		}
 	}
 
+	if extended && flags&prm_has_options == prm_has_options {
+		err = r.readOptions(treader)
+		if err != nil {
+			return
+		}
+	}
+
+	if compressed && r.codec == nil {
+		return os.NewError("Compressed message with an unknown codec")
+	}
+
 	r.ServiceId, err = treader.ReadUint8() // service id
 	if err != nil {
 		return
@@ -230,39 +413,85 @@ func (r *Message) readMessage(reader io.Reader) (err os.Error) {
 
 	// Load message
 	r.Message = buffer.NewWithSize(int64(msgSize), false) // message
-	n, err := io.Copyn(r.Message, reader, int64(msgSize))
+	n, err := io.Copyn(r.Message, creader, int64(msgSize))
 	r.Message.Seek(0, 0)
 
 	if err != nil {
-		log.Error("COMM: Got an error reading message from message: %s", err)
+		r.comm.logger.Error("Got an error reading message from message: %s", err)
 		return err
 	}
 
 	if n != int64(msgSize) {
-		log.Error("COMM: Couldn't read the whole message. Read %d out of %d", n, msgSize)
+		r.comm.logger.Error("Couldn't read the whole message. Read %d out of %d", n, msgSize)
 		return os.NewError("Message truncated")
 	}
 
+	if r.checksum {
+		err = verifyChecksum(reader, sum) // checksum
+		if err != nil {
+			return err
+		}
+	} else if r.comm.Checksums && version >= message_version_checksum {
+		return ErrorCorrupted
+	}
+
 	// release the connection if its a message
 	if r.Type == T_MSG {
 		r.Release()
+		return nil
+	}
+
+	// the size of compressed data isn't known, it ends with an end marker
+	var data io.Reader
+	size := r.DataSize
+	if compressed {
+		data = newChunkReader(r.comm, reader, r.dataChecksum)
+		size = -1
 	} else {
-		r.Data = reader
+		if r.dataChecksum {
+			size += CHECKSUM_SIZE
+		}
+		data = io.LimitReader(reader, size)
+	}
+
+	if r.connection != nil && r.connection.proto == P_TCP {
+		r.frame = r.connection.openFrame(data, size)
+		data = r.frame
+	}
+
+	if compressed {
+		data = newDecompressReader(r.codec, data, r.DataSize)
+	} else if r.dataChecksum {
+		data = newDataChecksumReader(r.comm, data, r.DataSize)
 	}
+	r.Data = data
 
 	return nil
 }
 
 func (r *Message) writeMessage(writer io.Writer) (err os.Error) {
-	twriter := typedio.NewWriter(writer)
+	if r.Message.Size > MAX_PAYLOAD_SIZE {
+		return ErrorMessageTooBig
+	}
+
+	// everything up to the end of the message is checksummed
+	sum := newChecksum()
+	cwriter := &checksumWriter{writer, sum}
+	twriter := typedio.NewWriter(cwriter)
 
-	err = twriter.WriteUint16(r.Id) // message id
+	err = twriter.WriteUint16(uint16(r.Id)) // message id low bits
 	if err != nil {
 		return
 	}
 
+	options := r.options(r.checksum)
+
 	// prepare flags
-	var flags byte
+	var flags byte = prm_extended_header
+	if options != nil {
+		flags = flags | prm_has_options
+	}
+
 	if r.InitId != 0 {
 		flags = flags | prm_has_init_msg_id
 	}
@@ -283,13 +512,41 @@ func (r *Message) writeMessage(writer io.Writer) (err os.Error) {
 		flags = flags | prm_middle_node_adhoc
 	}
 
+	if r.Type == T_DATA && r.codec != nil {
+		flags = flags | prm_compressed
+	}
+
 	err = twriter.WriteUint8(flags) // flags
 	if err != nil {
 		return
 	}
 
+	var version uint8 = message_version_options - 1
+	if r.checksum {
+		version = message_version_checksum
+	} else if options != nil {
+		version = message_version_options
+	}
+
+	err = twriter.WriteUint8(version) // version
+	if err != nil {
+		return
+	}
+
+	err = twriter.WriteUint64(r.Id) // message id
+	if err != nil {
+		return
+	}
+
 	if r.InitId != 0 {
-		err = twriter.WriteUint16(r.InitId) // initial message id
+		err = twriter.WriteUint64(r.InitId) // initial message id
+		if err != nil {
+			return
+		}
+	}
+
+	if options != nil {
+		_, err = twriter.Write(options.Bytes()[:options.Size]) // options
 		if err != nil {
 			return
 		}
@@ -368,26 +625,278 @@ func (r *Message) writeMessage(writer io.Writer) (err os.Error) {
 
 	// Write message
 	r.Message.Seek(0, 0)
-	w, err := io.Copyn(writer, r.Message, r.Message.Size) // message
+	w, err := io.Copyn(twriter, r.Message, r.Message.Size) // message
 
 	if err != nil {
-		log.Error("Couldn't write message message to writer: %s\n", err)
+		r.comm.logger.Error("Couldn't write message message to writer: %s", err)
 		return err
 	}
 
 	if w != int64(msgSize) {
-		log.Error("Couldn't write the whole message message to write: written %d out of %d\n", w, msgSize)
+		r.comm.logger.Error("Couldn't write the whole message message to write: written %d out of %d", w, msgSize)
 		return os.NewError("Message write truncated")
 	}
 
+	if r.checksum {
+		err = writeChecksum(writer, sum) // checksum
+		if err != nil {
+			return err
+		}
+	}
+
 	// Write data
-	if r.Type == T_DATA {
+	if r.Type == T_DATA && r.codec != nil {
+		err = writeCompressed(writer, r.codec, r.Data, r.DataSize, r.dataChecksum) // compressed data
+		if err != nil {
+			r.comm.logger.Error("Couldn't write compressed data to writer: %s", err)
+			return err
+		}
+	} else if r.Type == T_DATA && r.dataChecksum {
+		dataSum := newChecksum()
+		io.Copyn(&checksumWriter{writer, dataSum}, r.Data, r.DataSize) // data
+		err = writeChecksum(writer, dataSum)                           // data checksum
+		if err != nil {
+			return err
+		}
+	} else if r.Type == T_DATA {
 		io.Copyn(writer, r.Data, r.DataSize) // data
 	}
 
 	return nil
 }
 
+// Returns the encoded header options of the message, with the checksum option
+// if asked, nil if there is none
+func (r *Message) options(checksum bool) *buffer.Buffer {
+	count := uint8(0)
+	options := buffer.New()
+	options.WriteUint8(0) // options count, written below
+
+	if r.Deadline > 0 {
+		remaining := r.Remaining()
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		options.WriteUint8(opt_deadline)       // option type
+		options.WriteUint8(4)                  // option length
+		options.WriteUint32(uint32(remaining)) // remaining ms
+		count++
+	}
+
+	if r.streamFrame {
+		var flags uint8
+		if r.streamEnd {
+			flags |= stream_flag_end
+		}
+
+		options.WriteUint8(opt_stream_frame) // option type
+		options.WriteUint8(5)                // option length
+		options.WriteUint32(r.streamSeq)     // sequence
+		options.WriteUint8(flags)            // flags
+		count++
+	}
+
+	if r.streamWindow > 0 {
+		options.WriteUint8(opt_stream_window) // option type
+		options.WriteUint8(4)                 // option length
+		options.WriteUint32(r.streamWindow)   // window
+		count++
+	}
+
+	if checksum {
+		var flags uint8
+		if r.Type == T_DATA && r.dataChecksum {
+			flags |= checksum_flag_data
+		}
+
+		options.WriteUint8(opt_checksum) // option type
+		options.WriteUint8(1)            // option length
+		options.WriteUint8(flags)        // flags
+		count++
+	}
+
+	if r.TraceId != 0 {
+		options.WriteUint8(opt_trace)  // option type
+		options.WriteUint8(16)         // option length
+		options.WriteUint64(r.TraceId) // trace id
+		options.WriteUint64(r.SpanId)  // span id
+		count++
+	}
+
+	if r.Type == T_DATA && r.codec != nil {
+		options.WriteUint8(opt_codec)    // option type
+		options.WriteUint8(1)            // option length
+		options.WriteUint8(r.codec.Id()) // codec id
+		count++
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	options.Seek(0, 0)
+	options.WriteUint8(count) // options count
+	return options
+}
+
+func (r *Message) readOptions(treader typedio.Reader) (err os.Error) {
+	count, err := treader.ReadUint8() // options count
+	if err != nil {
+		return
+	}
+
+	for i := uint8(0); i < count; i++ {
+		typ, err := treader.ReadUint8() // option type
+		if err != nil {
+			return err
+		}
+
+		length, err := treader.ReadUint8() // option length
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case typ == opt_deadline && length == 4:
+			remaining, err := treader.ReadUint32() // remaining ms
+			if err != nil {
+				return err
+			}
+			r.Deadline = r.comm.clock.Now() + int64(remaining)*1000*1000
+
+		case typ == opt_stream_frame && length == 5:
+			r.streamFrame = true
+			r.streamSeq, err = treader.ReadUint32() // sequence
+			if err != nil {
+				return err
+			}
+
+			flags, err := treader.ReadUint8() // flags
+			if err != nil {
+				return err
+			}
+			r.streamEnd = flags&stream_flag_end == stream_flag_end
+
+		case typ == opt_stream_window && length == 4:
+			r.streamWindow, err = treader.ReadUint32() // window
+			if err != nil {
+				return err
+			}
+
+		case typ == opt_codec && length == 1:
+			id, err := treader.ReadUint8() // codec id
+			if err != nil {
+				return err
+			}
+			r.codec = GetCodec(id)
+
+		case typ == opt_checksum && length == 1:
+			flags, err := treader.ReadUint8() // flags
+			if err != nil {
+				return err
+			}
+			r.checksum = true
+			r.dataChecksum = flags&checksum_flag_data == checksum_flag_data
+
+		case typ == opt_trace && length == 16:
+			r.TraceId, err = treader.ReadUint64() // trace id
+			if err != nil {
+				return err
+			}
+
+			r.SpanId, err = treader.ReadUint64() // span id
+			if err != nil {
+				return err
+			}
+
+		default:
+			// unknown option, added by a newer version
+			value := make([]byte, length)
+			_, err = io.ReadFull(treader, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sets the deadline of the call chain started by this message in ms from
+// now. The remaining time is sent with the message, so that the nodes
+// handling it know their budget.
+func (r *Message) SetDeadline(timeout int) {
+	r.Deadline = r.comm.clock.Now() + int64(timeout)*1000*1000
+}
+
+// Returns the time remaining before the deadline in ms, -1 if there is none
+func (r *Message) Remaining() int {
+	if r.Deadline == 0 {
+		return -1
+	}
+
+	remaining := (r.Deadline - r.comm.clock.Now()) / 1000000
+	if remaining < 0 {
+		return 0
+	}
+	return int(remaining)
+}
+
+// Returns true if the deadline of the message has passed
+func (r *Message) Expired() bool {
+	return r.Deadline > 0 && r.comm.clock.Now() >= r.Deadline
+}
+
+// Makes this message part of the call chain of the message being handled:
+// it inherits its deadline and trace and gets canceled if the chain is
+// canceled.
+func (r *Message) Follow(parent *Message) {
+	if parent.Deadline > 0 && (r.Deadline == 0 || parent.Deadline < r.Deadline) {
+		r.Deadline = parent.Deadline
+	}
+	r.parentKey = parent.Key().String()
+	r.Trace(parent)
+}
+
+// Makes this message part of the trace of the message being handled, sent
+// from the span of its handling by this node
+func (r *Message) Trace(parent *Message) {
+	r.TraceId = parent.TraceId
+	r.SpanId = parent.SpanId
+	if parent.span != nil {
+		r.SpanId = parent.span.Id
+	}
+}
+
+// Cancels the message and the call chain it started
+func (r *Message) Cancel() {
+	r.comm.Cancel(r)
+}
+
+// Returns true if the call chain of the message has been canceled. Remote
+// functions doing long work should check it and abort.
+func (r *Message) Canceled() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+	}
+	return false
+}
+
+// Returns a channel closed when the call chain of the message gets canceled
+func (r *Message) Done() chan bool {
+	return r.done
+}
+
+// Marks the message as canceled. Called with the cancel registry mutex locked.
+func (r *Message) cancel() {
+	if !r.Canceled() {
+		close(r.done)
+	}
+}
+
 func (r *Message) SourceNode() *cluster.Node {
 	if r.srcNodeAdhoc {
 		return cluster.NewAdhocNode(r.srcNodeAdr, r.srcNodeTcpPort, r.srcNodeUdpPort)
@@ -427,6 +936,16 @@ func (r *Message) SetMiddleNode(node *cluster.Node) {
 	}
 }
 
+// Returns the node that sent the message on the wire, which is the last node
+// that redirected it or the source node
+func (r *Message) senderNode() *cluster.Node {
+	if r.middleNodePresent {
+		return r.MiddleNode()
+	}
+
+	return r.SourceNode()
+}
+
 func (r *Message) MiddleNode() *cluster.Node {
 	if r.middleNodePresent {
 		if r.middleNodeAdhoc {
@@ -451,6 +970,40 @@ func (r *Message) String() string {
 	return fmt.Sprintf("M[ID=%d,T=%s,IID=%d,SNOD=%s,MNOD=%s,SRV=%d,FNC=%d,MSZ=%d,DSZ=%d]", r.Id, typ, r.InitId, r.SourceNode(), r.MiddleNode(), r.ServiceId, r.FunctionId, r.Message.Size, r.DataSize)
 }
 
+// Returns a copy of the message header and payload, without data, callbacks
+// and connection. Used to send the same message again.
+func (r *Message) clone() *Message {
+	c := new(Message)
+	*c = *r
+
+	c.Message = buffer.New()
+	c.Message.Write(r.Message.Bytes()[:r.Message.Size])
+	c.Message.Seek(0, 0)
+
+	c.Data = nil
+	c.DataSize = 0
+	c.DataAutoClose = false
+	c.connection = nil
+	c.frame = nil
+	c.codec = nil
+	c.checksum = false
+	c.dataChecksum = false
+	c.holders = 0
+	c.reliable = false
+
+	c.Timeout = 0
+	c.Retries = 0
+	c.OnTimeout = nil
+	c.OnResponse = nil
+	c.OnError = nil
+	c.Wait = make(chan bool, 1)
+	c.done = make(chan bool)
+	c.parentKey = ""
+	c.span = nil
+
+	return c
+}
+
 func (r *Message) SeekZero() {
 	r.Message.Seek(0, 0)
 
@@ -467,11 +1020,26 @@ func (r *Message) DataIsSeekable() (bool, io.ReadSeeker) {
 	return false, nil
 }
 
+// Marks the message as being used by one more goroutine, which will have to
+// release it
+func (r *Message) hold() {
+	atomic.AddInt32(&r.holders, 1)
+}
+
 func (r *Message) Release() {
-	if r.connection != nil {
-		r.connection.Release()
-		r.connection = nil
+	// a message received by a node can be forwarded by its handler: the
+	// reading loop and the send queue both hold it, the last one frees it
+	if holders := atomic.AddInt32(&r.holders, -1); holders > 0 {
+		return
+	} else if holders < 0 {
+		atomic.AddInt32(&r.holders, 1)
+	}
+
+	if r.frame != nil {
+		r.connection.releaseFrame(r.frame)
+		r.frame = nil
 	}
+	r.connection = nil
 
 	if r.DataAutoClose && r.Data != nil {
 		if j, ok := (r.Data).(io.Closer); ok {
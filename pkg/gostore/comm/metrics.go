@@ -0,0 +1,26 @@
+package comm
+
+import (
+	"fmt"
+	"gostore/tools/metrics"
+)
+
+// Metrics of the communication layer, labeled with the id of the node since
+// many nodes can run in the same process
+var (
+	metricSent       = metrics.NewCounter("gostore_comm_messages_sent_total", "Messages sent, including responses and retries", "node", "service")
+	metricReceived   = metrics.NewCounter("gostore_comm_messages_received_total", "Messages received, including responses and duplicates", "node", "service")
+	metricTimeouts   = metrics.NewCounter("gostore_comm_timeouts_total", "Messages that timed out waiting for their response", "node", "service")
+	metricRetries    = metrics.NewCounter("gostore_comm_retries_total", "Messages sent again after a timeout or a corruption", "node", "service")
+	metricDropped    = metrics.NewCounter("gostore_comm_queue_dropped_total", "Messages refused because the queue of their destination was full", "node")
+	metricQueueDepth = metrics.NewGauge("gostore_comm_queue_depth", "Messages waiting in the outbound queue of a destination", "node", "destination", "proto")
+	metricHandle     = metrics.NewHistogram("gostore_comm_handle_seconds", "Time taken by services to handle messages", metrics.LatencyBuckets, "node", "service", "function")
+)
+
+func (comm *Comm) metricNode() string {
+	return fmt.Sprintf("%d", comm.Cluster.MyNode.Id)
+}
+
+func metricService(serviceId byte) string {
+	return fmt.Sprintf("%d", serviceId)
+}
@@ -2,63 +2,348 @@ package comm
 
 import (
 	"gostore/cluster"
-	"net"
 	"sync"
-	"gostore/log"
+	"container/list"
+	"fmt"
+	"bufio"
+	"io"
 )
 
+const (
+	POOL_MAX_CONNECTIONS = 10    // Maximum number of TCP connections per node
+	POOL_IDLE_TIMEOUT    = 30000 // 30 seconds
+	POOL_WAIT_TIMEOUT    = 5000  // 5 seconds
+	POOL_CHECK_INTERVAL  = 1000  // 1 second
+	POOL_PROBE_INTERVAL  = 10000 // 10 seconds
+
+	NET_FUNC_PING = RESERVED_FUNCTIONS + 7 // Probe of an idle pooled connection
+)
+
+// Pool of persistent TCP connections to other nodes. Connections are full
+// duplex: messages are written on a connection checked out from the pool
+// while a reading loop handles messages coming from the other end, so
+// connections opened by other nodes are also used to respond to them.
 type Pool struct {
+	comm  *Comm
 	mutex *sync.Mutex
 
 	connections map[int]*Connection
+	nodes       map[string]*nodePool
+	seqid       int
+	running     bool
+
+	MaxConnections int // per node
+	IdleTimeout    int // ms
+	WaitTimeout    int // ms
+	ProbeInterval  int // ms between probes of an idle connection
 }
 
-func NewPool() *Pool {
+// Connections opened with a node
+type nodePool struct {
+	idle  *list.List // most recently used first
+	count int        // idle and checked out connections
+	freed chan bool  // signaled when a connection gets released
+}
+
+func NewPool(comm *Comm) *Pool {
 	pool := new(Pool)
+	pool.comm = comm
 	pool.mutex = new(sync.Mutex)
 	pool.connections = make(map[int]*Connection)
+	pool.nodes = make(map[string]*nodePool)
+	pool.running = true
+
+	pool.MaxConnections = POOL_MAX_CONNECTIONS
+	pool.IdleTimeout = POOL_IDLE_TIMEOUT
+	pool.WaitTimeout = POOL_WAIT_TIMEOUT
+	pool.ProbeInterval = POOL_PROBE_INTERVAL
 
-	// TODO: Start connection manager
+	go pool.manage()
 
 	return pool
 }
 
+// Connections are pooled by address so that a node changing address
+// doesn't reuse connections to its previous address
+func poolKey(node *cluster.Node) string {
+	return fmt.Sprintf("%s:%d", node.Address, node.TcpPort)
+}
+
+func (p *Pool) nextConnectionId() int {
+	p.mutex.Lock()
+	p.seqid++
+	id := p.seqid
+	p.mutex.Unlock()
+	return id
+}
+
+// Returns the pool of a node. Must be called with the mutex locked.
+func (p *Pool) getNodePool(key string) *nodePool {
+	np, found := p.nodes[key]
+	if !found {
+		np = new(nodePool)
+		np.idle = list.New()
+		np.freed = make(chan bool, p.MaxConnections)
+		p.nodes[key] = np
+	}
+
+	return np
+}
+
+func (np *nodePool) signalFreed() {
+	select {
+	case np.freed <- true:
+	default:
+	}
+}
+
+// Returns a TCP connection to the node, reusing an idle one if possible. If
+// the maximum number of connections to the node is reached, waits for one
+// to be released.
 func (p *Pool) GetDataConnection(node *cluster.Node) *Connection {
-	// TODO: IMPLEMENT THE POOLING
+	key := poolKey(node)
+	deadline := p.comm.clock.Now() + int64(p.WaitTimeout)*1000*1000
 
-	adr := net.TCPAddr{node.Address, int(node.TcpPort)}
-	con, err := net.DialTCP("tcp", nil, &adr) // TODO: should use local address instead of nil (implicitly local)
+	for {
+		p.mutex.Lock()
+		np := p.getNodePool(key)
+
+		if np.idle.Len() > 0 {
+			elem := np.idle.Front()
+			np.idle.Remove(elem)
+			p.mutex.Unlock()
+
+			return elem.Value.(*Connection)
+		}
+
+		if np.count < p.MaxConnections {
+			np.count++
+			p.mutex.Unlock()
+
+			connection := p.dial(node, key)
+			if connection == nil {
+				p.mutex.Lock()
+				np.count--
+				p.mutex.Unlock()
+				np.signalFreed()
+			}
+
+			return connection
+		}
+		p.mutex.Unlock()
+
+		wait := deadline - p.comm.clock.Now()
+		if wait <= 0 {
+			p.comm.logger.Error("Timeout waiting for a connection to %s", node)
+			return nil
+		}
+
+		select {
+		case <-np.freed:
+		case <-p.comm.clock.After(wait):
+		}
+	}
+}
+
+func (p *Pool) dial(node *cluster.Node, key string) *Connection {
+	gocon, err := dialStream(p.comm.transport, p.comm.Cluster.MyNode, node)
 	if err != nil {
-		log.Error("NETPOOL: Couldn't create a connection\n", err)
+		p.comm.logger.Error("Couldn't create a connection to %s: %s", node, err)
 		return nil
 	}
 
-	abcon := net.Conn(con)
-	connection := NewConnection(p, P_TCP, D_Outbound, abcon)
+	if p.comm.security.tlsEnabled() {
+		gocon, err = p.comm.security.client(node, gocon)
+		if err != nil {
+			p.comm.logger.Error("Couldn't open a TLS session with %s: %s", node, err)
+			return nil
+		}
+	}
+
+	connection := NewConnection(p, P_TCP, D_Outbound, gocon)
+	connection.peer = node
+	connection.node = node
+	connection.poolKey = key
+	connection.pooled = true
+	p.track(connection)
+
+	// read responses the other node may send on this connection
+	go p.comm.server.handleTCPConnection(connection)
+
 	return connection
 }
 
 func (p *Pool) GetMsgConnection(node *cluster.Node) *Connection {
-	// TODO: IMPLEMENT THE POOLING
-
-	adr := net.UDPAddr{node.Address, int(node.UdpPort)}
-	con, err := net.DialUDP("udp", nil, &adr) // TODO: should use local address instead of nil (implicitly local)
+	con, err := dialPacket(p.comm.transport, p.comm.Cluster.MyNode, node)
 	if err != nil {
-		log.Error("NETPOOL: Couldn't create a connection\n", err)
+		p.comm.logger.Error("Couldn't create a connection: %s", err)
 		return nil
 	}
 
-	abcon := net.Conn(con)
-	connection := NewConnection(p, P_UDP, D_Outbound, abcon)
+	connection := NewConnection(p, P_UDP, D_Outbound, con)
 	return connection
 }
 
+// Keeps track of an opened TCP connection so that it can be closed by CloseAll
+func (p *Pool) track(connection *Connection) {
+	p.mutex.Lock()
+	p.connections[connection.id] = connection
+	p.mutex.Unlock()
+}
+
+// Adds a connection opened by another node to the pool of this node so that
+// it can be used to send messages back to it.
+func (p *Pool) adopt(connection *Connection, node *cluster.Node) {
+	key := poolKey(node)
+
+	p.mutex.Lock()
+	if !p.running || connection.closed || connection.pooled {
+		p.mutex.Unlock()
+		return
+	}
+
+	np := p.getNodePool(key)
+	if np.count < p.MaxConnections {
+		np.count++
+		connection.node = node
+		connection.poolKey = key
+		connection.pooled = true
+		connection.lastUsed = p.comm.clock.Now()
+		np.idle.PushFront(connection)
+	}
+	p.mutex.Unlock()
+
+	np.signalFreed()
+}
+
+// Puts back a connection in the pool after a write
 func (p *Pool) Release(connection *Connection) {
-	// TODO: IMPLEMENT THE POOLING!!
-	// TODO: Put the connection in read mode if its inbound
-	connection.gocon.Close()
+	p.mutex.Lock()
+	if !connection.pooled || connection.closed {
+		p.mutex.Unlock()
+		return
+	}
+
+	np := p.getNodePool(connection.poolKey)
+	connection.lastUsed = p.comm.clock.Now()
+	np.idle.PushFront(connection)
+	p.mutex.Unlock()
+
+	np.signalFreed()
+}
+
+// Removes a closed connection from the pool
+func (p *Pool) remove(connection *Connection) {
+	p.mutex.Lock()
+	p.connections[connection.id] = nil, false
+
+	if !connection.pooled {
+		p.mutex.Unlock()
+		return
+	}
+	connection.pooled = false
+
+	np := p.getNodePool(connection.poolKey)
+	for elem := np.idle.Front(); elem != nil; elem = elem.Next() {
+		if elem.Value.(*Connection) == connection {
+			np.idle.Remove(elem)
+			break
+		}
+	}
+	np.count--
+	p.mutex.Unlock()
+
+	np.signalFreed()
+}
+
+// Checks that an idle connection still works by writing a ping to it. The
+// connection goes back to the pool without being marked as used, or gets
+// closed if the write failed.
+func (p *Pool) probe(connection *Connection) {
+	message := p.comm.NewMsgMessage(NET_SERVICE)
+	message.FunctionId = NET_FUNC_PING
+	message.PrepareSend()
+	message.checksum = p.comm.Checksums
+
+	bufwriter := bufio.NewWriter(io.Writer(connection.gocon))
+	err := message.writeMessage(bufwriter)
+	if err == nil {
+		err = bufwriter.Flush()
+	}
+	connection.lastProbed = p.comm.clock.Now()
+
+	if err != nil {
+		p.comm.logger.Warning("Closing connection %s, which failed a probe: %s", connection, err)
+		connection.Close()
+		return
+	}
+
+	p.mutex.Lock()
+	if connection.pooled && !connection.closed {
+		np := p.getNodePool(connection.poolKey)
+		np.idle.PushBack(connection)
+		p.mutex.Unlock()
+		np.signalFreed()
+		return
+	}
+	p.mutex.Unlock()
+}
+
+// Connection manager. Closes connections that have been idle for too long,
+// drops the ones that have been closed by the other end and probes the
+// ones that haven't been used for a while.
+func (p *Pool) manage() {
+	for p.running {
+		now := <-p.comm.clock.After(POOL_CHECK_INTERVAL * 1000 * 1000)
+		expired := make([]*Connection, 0)
+		probed := make([]*Connection, 0)
+
+		p.mutex.Lock()
+		for _, np := range p.nodes {
+			for elem := np.idle.Back(); elem != nil; {
+				prev := elem.Prev()
+				connection := elem.Value.(*Connection)
+
+				idle := int((now - connection.lastUsed) / 1000000)
+				if connection.closed || idle >= p.IdleTimeout {
+					np.idle.Remove(elem)
+					np.count--
+					connection.pooled = false
+					expired = append(expired, connection)
+
+				} else if probe := int((now - connection.lastProbed) / 1000000); idle >= p.ProbeInterval && probe >= p.ProbeInterval {
+					// checked out while being probed
+					np.idle.Remove(elem)
+					probed = append(probed, connection)
+				}
+
+				elem = prev
+			}
+		}
+		p.mutex.Unlock()
+
+		for _, connection := range expired {
+			p.comm.logger.Debug("Closing idle connection %s", connection)
+			connection.Close()
+		}
+
+		for _, connection := range probed {
+			go p.probe(connection)
+		}
+	}
 }
 
+// Closes all connections and stops the pool
 func (p *Pool) CloseAll() {
-	// TODO: Implement it
+	p.mutex.Lock()
+	p.running = false
+	connections := p.connections
+	p.connections = make(map[int]*Connection)
+	p.nodes = make(map[string]*nodePool)
+	p.mutex.Unlock()
+
+	for _, connection := range connections {
+		connection.pooled = false
+		connection.Close()
+	}
 }
@@ -0,0 +1,107 @@
+package comm_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"gostore/cluster"
+	"gostore/comm"
+)
+
+// Transport counting the TCP connections opened to each node
+type countingTransport struct {
+	comm.Transport
+
+	mutex *sync.Mutex
+	dials map[uint16]int
+}
+
+func newCountingTransport() *countingTransport {
+	return &countingTransport{comm.NewMemoryTransport(), new(sync.Mutex), make(map[uint16]int)}
+}
+
+func (ct *countingTransport) DialStream(node *cluster.Node) (net.Conn, os.Error) {
+	ct.mutex.Lock()
+	ct.dials[node.Id]++
+	ct.mutex.Unlock()
+
+	return ct.Transport.DialStream(node)
+}
+
+func (ct *countingTransport) Dials(node uint16) int {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	return ct.dials[node]
+}
+
+func TestPoolReuse(t *testing.T) {
+	transport := newCountingTransport()
+	tc := newTestCluster(2, transport)
+
+	for i := 0; i < 3; i++ {
+		payload, err := tc.call(0, 1, tc.echoMessage(0, "data ", []byte("message")))
+		if err != nil || payload != "data message" {
+			t.Errorf("1) Data message %d should have been echoed, got %s %s", i, payload, err)
+		}
+	}
+
+	if dials := transport.Dials(1); dials != 1 {
+		t.Errorf("2) Connection to node 1 should have been reused, opened %d", dials)
+	}
+
+	// node 1 sends back through the connection node 0 opened
+	payload, err := tc.call(1, 0, tc.echoMessage(1, "data ", []byte("back")))
+	if err != nil || payload != "data back" {
+		t.Errorf("3) Data message should have been echoed, got %s %s", payload, err)
+	}
+
+	if dials := transport.Dials(0); dials != 0 {
+		t.Errorf("4) Connection opened by node 0 should have been used by node 1, opened %d", dials)
+	}
+}
+
+func TestPoolFraming(t *testing.T) {
+	transport := newCountingTransport()
+	tc := newTestCluster(2, transport)
+
+	// the length function doesn't read the data, which must be skipped
+	message := tc.echoMessage(0, "unread", []byte("data left on the connection"))
+	message.Function = "RemoteLength"
+	payload, err := tc.call(0, 1, message)
+	if err != nil || payload != "6" {
+		t.Errorf("1) Data message should have been handled, got %s %s", payload, err)
+	}
+
+	payload, err = tc.call(0, 1, tc.echoMessage(0, "data ", []byte("after")))
+	if err != nil || payload != "data after" {
+		t.Errorf("2) Message following unread data should have been read, got %s %s", payload, err)
+	}
+
+	if dials := transport.Dials(1); dials != 1 {
+		t.Errorf("3) Connection should have been reused after unread data, opened %d", dials)
+	}
+}
+
+// Run with the race detector: connections are checked out, released and
+// closed from many goroutines
+func TestPoolConcurrent(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+
+	done := make(chan bool)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			data := fmt.Sprintf("%d", i)
+			payload, err := tc.call(i%2, (i+1)%2, tc.echoMessage(i%2, "data ", []byte(data)))
+			if err != nil || payload != "data "+data {
+				t.Errorf("1) Data message %d should have been echoed, got %s %s", i, payload, err)
+			}
+			done <- true
+		}(i)
+	}
+
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+}
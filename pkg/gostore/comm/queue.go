@@ -0,0 +1,184 @@
+package comm
+
+import (
+	"gostore/cluster"
+	"sync"
+	"fmt"
+)
+
+// Outbound queue of messages for a node. Messages are written one at the
+// time by a single sender so that they are received in the order they were
+// queued. Messages sent by UDP and TCP have their own queue, so that small
+// messages don't wait behind data being written to a slow connection.
+type sendQueue struct {
+	comm     *Comm
+	address  string // pool key of the node
+	proto    int
+	messages chan queuedMessage
+
+	// guarded by the queues mutex of comm
+	users    int   // goroutines queuing a message
+	lastUsed int64 // last time a message was queued
+
+	mutex    *sync.Mutex
+	maxDepth int
+	sent     int64
+	dropped  int64
+}
+
+type queuedMessage struct {
+	node    *cluster.Node
+	message *Message
+}
+
+// Statistics of a node outbound queue
+type QueueStats struct {
+	Node     string // node address
+	Proto    string // "TCP" or "UDP"
+	Depth    int    // messages currently waiting
+	Capacity int
+	MaxDepth int // highest depth reached
+	Sent     int64
+	Dropped  int64 // messages refused because the queue was full
+}
+
+func newSendQueue(comm *Comm, address string, proto int, depth int) *sendQueue {
+	sq := new(sendQueue)
+	sq.comm = comm
+	sq.address = address
+	sq.proto = proto
+	sq.messages = make(chan queuedMessage, depth)
+	sq.mutex = new(sync.Mutex)
+
+	go sq.sender()
+
+	return sq
+}
+
+func (sq *sendQueue) sender() {
+	for qm := range sq.messages {
+		sq.comm.writeMessage(qm.node, qm.message)
+
+		sq.mutex.Lock()
+		sq.sent++
+		sq.mutex.Unlock()
+	}
+}
+
+// Queues a message for sending. Returns false if the queue is full and
+// the queue doesn't block.
+func (sq *sendQueue) push(node *cluster.Node, message *Message, block bool) bool {
+	qm := queuedMessage{node, message}
+
+	if block {
+		sq.messages <- qm
+	} else {
+		select {
+		case sq.messages <- qm:
+		default:
+			sq.mutex.Lock()
+			sq.dropped++
+			sq.mutex.Unlock()
+			return false
+		}
+	}
+
+	depth := len(sq.messages)
+	sq.mutex.Lock()
+	if depth > sq.maxDepth {
+		sq.maxDepth = depth
+	}
+	sq.mutex.Unlock()
+
+	return true
+}
+
+func (sq *sendQueue) protoName() string {
+	if sq.proto == P_UDP {
+		return "UDP"
+	}
+	return "TCP"
+}
+
+// Returns the queue of a node for a protocol, creating it if needed. The
+// queue can't be removed until it is released.
+func (comm *Comm) getQueue(node *cluster.Node, proto int) *sendQueue {
+	address := poolKey(node)
+	key := fmt.Sprintf("%s/%d", address, proto)
+	now := comm.clock.Now()
+
+	comm.queuesMutex.Lock()
+	comm.sweepQueues(now)
+
+	sq, found := comm.queues[key]
+	if !found {
+		sq = newSendQueue(comm, address, proto, comm.QueueDepth)
+		comm.queues[key] = sq
+
+		metricQueueDepth.Func(func() float64 {
+			return float64(len(sq.messages))
+		}, comm.metricNode(), address, sq.protoName())
+	}
+	sq.users++
+	sq.lastUsed = now
+	comm.queuesMutex.Unlock()
+
+	return sq
+}
+
+func (comm *Comm) releaseQueue(sq *sendQueue) {
+	comm.queuesMutex.Lock()
+	sq.users--
+	comm.queuesMutex.Unlock()
+}
+
+// Removes the queues that didn't get any message for a while, stopping their
+// sender. Must be called with the queues mutex locked.
+func (comm *Comm) sweepQueues(now int64) {
+	timeout := int64(QUEUE_IDLE_TIMEOUT) * 1000 * 1000
+	if now-comm.queuesSwept < timeout {
+		return
+	}
+	comm.queuesSwept = now
+
+	for key, sq := range comm.queues {
+		if sq.users == 0 && len(sq.messages) == 0 && now-sq.lastUsed >= timeout {
+			comm.queues[key] = nil, false
+			metricQueueDepth.Remove(comm.metricNode(), sq.address, sq.protoName())
+			close(sq.messages)
+		}
+	}
+}
+
+// Adds a message to the outbound queue of the node. If the queue is full,
+// waits for room or fails the message depending on QueueBlocking.
+func (comm *Comm) enqueue(node *cluster.Node, message *Message) {
+	sq := comm.getQueue(node, comm.sendProto(message))
+	queued := sq.push(node, message, comm.QueueBlocking)
+	comm.releaseQueue(sq)
+
+	if !queued {
+		comm.logger.Warning("Send queue to %s is full, dropping message %s", node, message)
+		metricDropped.With(comm.metricNode()).Inc()
+
+		comm.unwatchMessage(message)
+		if message.OnError != nil {
+			message.OnError(message, ErrorQueueFull)
+		}
+		message.Release()
+	}
+}
+
+// Returns statistics of all outbound queues
+func (comm *Comm) QueuesStats() []QueueStats {
+	comm.queuesMutex.Lock()
+	stats := make([]QueueStats, 0, len(comm.queues))
+	for _, sq := range comm.queues {
+		sq.mutex.Lock()
+		stats = append(stats, QueueStats{sq.address, sq.protoName(), len(sq.messages), cap(sq.messages), sq.maxDepth, sq.sent, sq.dropped})
+		sq.mutex.Unlock()
+	}
+	comm.queuesMutex.Unlock()
+
+	return stats
+}
@@ -0,0 +1,131 @@
+package comm_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"gostore/cluster"
+	"gostore/comm"
+)
+
+// Transport whose packet writes wait while its gate is locked, to fill the
+// send queues
+type gatedTransport struct {
+	comm.Transport
+	gate *sync.Mutex
+}
+
+func (gt *gatedTransport) DialPacket(node *cluster.Node) (net.Conn, os.Error) {
+	con, err := gt.Transport.DialPacket(node)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedConn{con, gt.gate}, nil
+}
+
+type gatedConn struct {
+	net.Conn
+	gate *sync.Mutex
+}
+
+func (gc *gatedConn) Write(b []byte) (int, os.Error) {
+	gc.gate.Lock()
+	gc.gate.Unlock()
+	return gc.Conn.Write(b)
+}
+
+// Sends a message without waiting for its response, returns a channel
+// receiving its error if it fails
+func sendAsync(tc *testCluster, from int, to int, payload string) chan os.Error {
+	errors := make(chan os.Error, 1)
+	message := tc.echoMessage(from, payload, nil)
+	message.Timeout = WAIT_TIMEOUT // not retried while the queue is blocked
+	message.OnError = func(response *comm.Message, err os.Error) {
+		errors <- err
+	}
+	message.OnResponse = func(response *comm.Message) {
+		errors <- nil
+	}
+	go tc.comms[from].SendNode(tc.node(from, to), message)
+	return errors
+}
+
+func queueStats(c *comm.Comm, proto string) (stats comm.QueueStats, found bool) {
+	for _, stats := range c.QueuesStats() {
+		if stats.Proto == proto {
+			return stats, true
+		}
+	}
+	return
+}
+
+func TestQueueFull(t *testing.T) {
+	transport := &gatedTransport{comm.NewMemoryTransport(), new(sync.Mutex)}
+	tc := newTestCluster(2, transport)
+	tc.comms[0].QueueDepth = 2
+
+	// handshake first, so that only the test messages get queued
+	if _, err := tc.call(0, 1, tc.echoMessage(0, "warmup", nil)); err != nil {
+		t.Fatalf("1) Message should have been echoed: %s", err)
+	}
+
+	transport.gate.Lock()
+	results := make([]chan os.Error, 0)
+	for i := 0; i < 3; i++ {
+		// one message waits in the sender, two in the queue
+		results = append(results, sendAsync(tc, 0, 1, fmt.Sprintf("queued %d", i)))
+		time.Sleep(20 * 1000 * 1000)
+	}
+
+	// the queue is full, the message fails right away
+	err := <-sendAsync(tc, 0, 1, "dropped")
+	if err != comm.ErrorQueueFull {
+		t.Errorf("2) Message should have been refused by the full queue, got %s", err)
+	}
+	if stats, _ := queueStats(tc.comms[0], "UDP"); stats.Dropped != 1 || stats.Depth != 2 {
+		t.Errorf("3) Queue should be full and have dropped a message: %v", stats)
+	}
+
+	// blocking queues wait for room instead
+	tc.comms[0].QueueBlocking = true
+	blocked := sendAsync(tc, 0, 1, "blocked")
+	time.Sleep(50 * 1000 * 1000)
+	if stats, _ := queueStats(tc.comms[0], "UDP"); stats.Dropped != 1 {
+		t.Errorf("4) Message shouldn't have been dropped by a blocking queue: %v", stats)
+	}
+
+	transport.gate.Unlock()
+	results = append(results, blocked)
+	for i, result := range results {
+		if err := <-result; err != nil {
+			t.Errorf("5) Queued message %d should have been sent once the queue had room: %s", i, err)
+		}
+	}
+}
+
+func TestQueueIdleRemoval(t *testing.T) {
+	st := comm.NewSimTransport(SIM_SEED)
+	tc := newTestCluster(3, st)
+
+	if _, ok := simCall(st, tc, 0, 1, tc.echoMessage(0, "node 1", nil)); !ok {
+		t.Fatalf("1) Message to node 1 should have been echoed")
+	}
+	if stats, found := queueStats(tc.comms[0], "UDP"); !found || stats.Node != fmt.Sprintf("%s:%d", tc.node(0, 1).Address, tc.node(0, 1).TcpPort) {
+		t.Errorf("2) Queue to node 1 should have been created: %v", tc.comms[0].QueuesStats())
+	}
+
+	// idle queues are removed when other messages get queued
+	st.RunFor((comm.QUEUE_IDLE_TIMEOUT + 1000) * 1000 * 1000)
+	if _, ok := simCall(st, tc, 0, 2, tc.echoMessage(0, "node 2", nil)); !ok {
+		t.Fatalf("3) Message to node 2 should have been echoed")
+	}
+
+	for _, stats := range tc.comms[0].QueuesStats() {
+		if stats.Node != fmt.Sprintf("%s:%d", tc.node(0, 2).Address, tc.node(0, 2).TcpPort) {
+			t.Errorf("4) Idle queue should have been removed: %v", stats)
+		}
+	}
+}
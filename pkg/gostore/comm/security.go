@@ -0,0 +1,267 @@
+package comm
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"gostore"
+	"gostore/cluster"
+)
+
+const (
+	UDP_MAC_SIZE       = 32                    // Size of the HMAC-SHA256 appended to authenticated UDP packets
+	UDP_AUTH_SIZE      = 8 + UDP_MAC_SIZE      // Size of the timestamp and HMAC appended to authenticated UDP packets
+	UDP_REPLAY_WINDOW  = 10000                 // 10 seconds, maximum difference between the timestamp of a packet and our clock
+	udp_replay_keeping = 2 * UDP_REPLAY_WINDOW // ms a received packet is remembered, until its timestamp is out of the window
+)
+
+// Security of the communications between nodes, configured in the security
+// section of the cluster configuration.
+//
+// With TLS, TCP connections between nodes are encrypted and both ends present
+// the certificate configured for their node. A certificate is only accepted if
+// it is the one configured for the node we expect (outbound) or for one of the
+// nodes of the cluster (inbound), and messages received on a connection must
+// have been sent by the node it has been authenticated as.
+//
+// With a shared secret, UDP packets are signed with an HMAC of their content
+// and of the time they were sent, and packets that don't carry a valid one are
+// dropped. To prevent replays, packets sent too long ago (or too far in the
+// future, the clocks of the nodes may differ) are dropped, and so are packets
+// that have already been received within this window.
+type security struct {
+	comm *Comm
+
+	tlsConfig *tls.Config
+	certs     map[uint16][]byte // DER certificate of each node of the cluster
+
+	secret   []byte
+	mutex    *sync.Mutex
+	received map[string]bool // authentication codes of the packets received in the window
+	order    *list.List      // received packets, oldest first
+}
+
+type receivedPacket struct {
+	mac  string
+	time int64 // local time it was received at
+}
+
+func newSecurity(comm *Comm) *security {
+	sec := new(security)
+	sec.comm = comm
+	sec.mutex = new(sync.Mutex)
+	sec.received = make(map[string]bool)
+	sec.order = list.New()
+
+	config := comm.Cluster.Config
+	if config.Security.SharedSecret != "" {
+		sec.secret = []byte(config.Security.SharedSecret)
+	} else if config.Security.TLS {
+		// anyone could send UDP packets as a node, that's probably not wanted
+		if !config.Security.AllowUnauthenticatedUDP {
+			comm.logger.Fatal("TLS is enabled, but no shared secret is configured to authenticate UDP packets (set AllowUnauthenticatedUDP to allow it)")
+		}
+		comm.logger.Warning("TLS is enabled, but UDP packets aren't authenticated since no shared secret is configured")
+	}
+
+	if config.Security.TLS {
+		sec.certs = make(map[uint16][]byte)
+
+		var mynode *gostore.ConfigNode
+		for i, confnode := range config.Nodes {
+			if confnode.CertFile == "" {
+				comm.logger.Fatal("TLS is enabled, but no certificate is configured for node %d", confnode.NodeId)
+			}
+
+			cert, err := readCertificate(confnode.CertFile)
+			if err != nil {
+				comm.logger.Fatal("Couldn't read certificate of node %d: %s", confnode.NodeId, err)
+			}
+			sec.certs[confnode.NodeId] = cert
+
+			if confnode.NodeId == comm.Cluster.MyNode.Id {
+				mynode = &config.Nodes[i]
+			}
+		}
+
+		if mynode == nil || mynode.KeyFile == "" {
+			comm.logger.Fatal("TLS is enabled, but no private key is configured for the current node")
+		}
+
+		keypair, err := tls.LoadX509KeyPair(mynode.CertFile, mynode.KeyFile)
+		if err != nil {
+			comm.logger.Fatal("Couldn't load key pair of the current node: %s", err)
+		}
+
+		// certificates are pinned to nodes instead of being verified against
+		// a certificate authority
+		sec.tlsConfig = &tls.Config{
+			Certificates:       []tls.Certificate{keypair},
+			AuthenticateClient: true,
+		}
+	}
+
+	return sec
+}
+
+// Reads the first PEM certificate of a file and returns it in DER
+func readCertificate(path string) ([]byte, os.Error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, os.NewError("No certificate found in " + path)
+		}
+
+		if block.Type == "CERTIFICATE" {
+			return block.Bytes, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Returns true if TCP connections between nodes use TLS
+func (sec *security) tlsEnabled() bool {
+	return sec.tlsConfig != nil
+}
+
+// Returns true if UDP packets are authenticated
+func (sec *security) udpAuthenticated() bool {
+	return sec.secret != nil
+}
+
+// Opens a TLS session on a connection we opened to a node, making sure the
+// other end is the node.
+func (sec *security) client(node *cluster.Node, conn net.Conn) (net.Conn, os.Error) {
+	tlsconn := tls.Client(conn, sec.tlsConfig)
+	err := tlsconn.Handshake()
+	if err != nil {
+		tlsconn.Close()
+		return nil, err
+	}
+
+	peer := sec.peerNode(tlsconn)
+	if peer == nil || peer.Id != node.Id {
+		tlsconn.Close()
+		return nil, os.NewError(fmt.Sprintf("Certificate presented by %s isn't the one of node %d", conn.RemoteAddr(), node.Id))
+	}
+
+	return tlsconn, nil
+}
+
+// Opens a TLS session on a connection opened by another node. Returns the
+// node the other end has been authenticated as.
+func (sec *security) server(conn net.Conn) (net.Conn, *cluster.Node, os.Error) {
+	tlsconn := tls.Server(conn, sec.tlsConfig)
+	err := tlsconn.Handshake()
+	if err != nil {
+		tlsconn.Close()
+		return nil, nil, err
+	}
+
+	peer := sec.peerNode(tlsconn)
+	if peer == nil {
+		tlsconn.Close()
+		return nil, nil, os.NewError(fmt.Sprintf("Certificate presented by %s isn't the one of a node of the cluster", conn.RemoteAddr()))
+	}
+
+	return tlsconn, peer, nil
+}
+
+// Returns the node of the cluster whose certificate has been presented by the
+// other end of a TLS connection, nil if none.
+func (sec *security) peerNode(tlsconn *tls.Conn) *cluster.Node {
+	certs := tlsconn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	for nodeId, cert := range sec.certs {
+		if bytes.Equal(cert, certs[0].Raw) {
+			return sec.comm.Cluster.Nodes.Get(nodeId)
+		}
+	}
+
+	return nil
+}
+
+func (sec *security) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, sec.secret)
+	h.Write(data)
+	return h.Sum()
+}
+
+// Appends the time it is sent at and the authentication code of an UDP packet
+// to it
+func (sec *security) signPacket(packet *bytes.Buffer) {
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(sec.comm.clock.Now()))
+	packet.Write(timestamp)
+	packet.Write(sec.mac(packet.Bytes()))
+}
+
+// Checks the authentication code and the timestamp of a received UDP packet
+// and returns the packet without them.
+func (sec *security) verifyPacket(packet []byte) ([]byte, os.Error) {
+	if len(packet) < UDP_AUTH_SIZE {
+		return nil, os.NewError("Packet too small to be authenticated")
+	}
+
+	signed := packet[:len(packet)-UDP_MAC_SIZE]
+	mac := packet[len(signed):]
+	if subtle.ConstantTimeCompare(sec.mac(signed), mac) != 1 {
+		return nil, os.NewError("Invalid packet authentication code")
+	}
+
+	data := signed[:len(signed)-8]
+	sent := int64(binary.LittleEndian.Uint64(signed[len(data):]))
+	now := sec.comm.clock.Now()
+	if diff := (now - sent) / 1000000; diff > UDP_REPLAY_WINDOW || diff < -UDP_REPLAY_WINDOW {
+		return nil, os.NewError(fmt.Sprintf("Packet sent %d ms away from our clock, outside of the replay window", diff))
+	}
+
+	sec.mutex.Lock()
+	defer sec.mutex.Unlock()
+
+	sec.expire(now)
+	if sec.received[string(mac)] {
+		return nil, os.NewError("Packet already received")
+	}
+	sec.received[string(mac)] = true
+	sec.order.PushBack(&receivedPacket{string(mac), now})
+
+	return data, nil
+}
+
+// Forgets the packets whose timestamp can't be in the replay window anymore.
+// Must be called with the mutex locked.
+func (sec *security) expire(now int64) {
+	keeping := int64(udp_replay_keeping) * 1000 * 1000
+
+	for sec.order.Len() > 0 {
+		front := sec.order.Front()
+		packet := front.Value.(*receivedPacket)
+		if now-packet.time < keeping {
+			break
+		}
+
+		sec.order.Remove(front)
+		sec.received[packet.mac] = false, false
+	}
+}
@@ -0,0 +1,218 @@
+package comm
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"gostore"
+	"gostore/cluster"
+	"gostore/log"
+)
+
+const TLS_HANDSHAKE_TIMEOUT = 5000 // ms a test waits for the server end of a handshake
+
+// Clock of a test, only moving when told to
+type testClock struct {
+	now int64
+}
+
+func (c *testClock) Now() int64 { return c.now }
+
+func (c *testClock) After(ns int64) <-chan int64 { return time.After(ns) }
+
+// Returns the comm of a node with the given security, in a cluster whose
+// nodes use the certificates and keys of testdata of the given names
+func newSecurityTestComm(id uint16, security gostore.ConfigSecurity, certs ...string) *Comm {
+	nodes := make([]gostore.ConfigNode, len(certs))
+	for i, name := range certs {
+		nodes[i] = gostore.ConfigNode{
+			NodeId:   uint16(i),
+			NodeIP:   "127.0.0.1",
+			CertFile: fmt.Sprintf("testdata/%s.pem", name),
+			KeyFile:  fmt.Sprintf("testdata/%s.key", name),
+		}
+	}
+	rings := []gostore.ConfigRing{gostore.ConfigRing{Id: 0, ReplicationFactor: 1}}
+
+	cls := cluster.NewCluster(gostore.Config{Nodes: nodes, Rings: rings, CurrentNode: id, Security: security})
+	for _, confnode := range nodes {
+		node := cluster.NewNode(confnode.NodeId, net.ParseIP(confnode.NodeIP), 0, 0)
+		node.Status = cluster.Status_Online
+		cls.Nodes.Add(node)
+	}
+	cls.SetMyNode(cls.Nodes.Get(id))
+
+	comm := new(Comm)
+	comm.Cluster = cls
+	comm.clock = &testClock{time.Nanoseconds()}
+	comm.logger = log.Subsystem("comm").With("node", id)
+	comm.security = newSecurity(comm)
+	return comm
+}
+
+// Returns the reason the security of a node couldn't be set up, nil if it
+// could
+func securityFailure(security gostore.ConfigSecurity) (failure interface{}) {
+	defer func() {
+		failure = recover()
+	}()
+
+	newSecurityTestComm(0, security, "node0", "node1")
+	return nil
+}
+
+func TestSecretRequiredWithTLS(t *testing.T) {
+	failure := securityFailure(gostore.ConfigSecurity{TLS: true})
+	if message, ok := failure.(string); !ok || strings.Index(message, "shared secret") < 0 {
+		t.Errorf("1) TLS without shared secret should have been refused, got %v", failure)
+	}
+
+	comm := newSecurityTestComm(0, gostore.ConfigSecurity{TLS: true, AllowUnauthenticatedUDP: true}, "node0", "node1")
+	if !comm.security.tlsEnabled() || comm.security.udpAuthenticated() {
+		t.Errorf("2) TLS should have been enabled without UDP authentication when allowed")
+	}
+
+	comm = newSecurityTestComm(0, gostore.ConfigSecurity{TLS: true, SharedSecret: "secret"}, "node0", "node1")
+	if !comm.security.tlsEnabled() || !comm.security.udpAuthenticated() {
+		t.Errorf("3) TLS and UDP authentication should have been enabled")
+	}
+
+	// UDP authentication alone doesn't need certificates
+	if failure := securityFailure(gostore.ConfigSecurity{SharedSecret: "secret"}); failure != nil {
+		t.Errorf("4) Shared secret without TLS should have been accepted, got %v", failure)
+	}
+}
+
+// Opens a TLS session over a pipe from a client expecting a node to a
+// server, and returns the errors of both ends and the node the server
+// authenticated the client as
+func tlsHandshake(client *Comm, server *Comm, expected uint16) (clientErr os.Error, serverErr os.Error, peer *cluster.Node) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	done := make(chan bool, 1)
+	go func() {
+		_, peer, serverErr = server.security.server(serverConn)
+		done <- true
+	}()
+
+	_, clientErr = client.security.client(client.Cluster.Nodes.Get(expected), clientConn)
+	if clientErr != nil {
+		clientConn.Close()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(TLS_HANDSHAKE_TIMEOUT * 1000 * 1000):
+		serverConn.Close()
+		<-done
+	}
+	return
+}
+
+func TestTLSCertificates(t *testing.T) {
+	security := gostore.ConfigSecurity{TLS: true, SharedSecret: "secret"}
+	server := newSecurityTestComm(1, security, "node0", "node1")
+
+	client := newSecurityTestComm(0, security, "node0", "node1")
+	clientErr, serverErr, peer := tlsHandshake(client, server, 1)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("1) Nodes should have opened a session: %s / %s", clientErr, serverErr)
+	}
+	if peer == nil || peer.Id != 0 {
+		t.Errorf("2) Server should have authenticated the client as node 0, got %s", peer)
+	}
+
+	// the client presents a certificate that isn't the one of node 0
+	rogue := newSecurityTestComm(0, security, "rogue", "node1")
+	_, serverErr, peer = tlsHandshake(rogue, server, 1)
+	if serverErr == nil {
+		t.Errorf("3) Server should have rejected a certificate of no node of the cluster, got node %s", peer)
+	}
+
+	// the server presents a certificate that isn't the one of node 1
+	rogueServer := newSecurityTestComm(1, security, "node0", "rogue")
+	clientErr, _, _ = tlsHandshake(client, rogueServer, 1)
+	if clientErr == nil {
+		t.Errorf("4) Client should have rejected a certificate that isn't the one of the node it dialed")
+	}
+
+	// the server is a node of the cluster, but not the one dialed
+	clientErr, _, _ = tlsHandshake(client, server, 0)
+	if clientErr == nil {
+		t.Errorf("5) Client should have rejected the certificate of another node than the one it dialed")
+	}
+}
+
+// Returns a packet signed by a comm
+func signedPacket(comm *Comm, payload string) []byte {
+	packet := bytes.NewBufferString(payload)
+	comm.security.signPacket(packet)
+	return packet.Bytes()
+}
+
+func TestPacketAuthentication(t *testing.T) {
+	security := gostore.ConfigSecurity{SharedSecret: "secret"}
+	sender := newSecurityTestComm(0, security, "node0", "node1")
+	receiver := newSecurityTestComm(1, security, "node0", "node1")
+	senderClock := sender.clock.(*testClock)
+	receiverClock := receiver.clock.(*testClock)
+	senderClock.now = receiverClock.now
+
+	packet := signedPacket(sender, "payload")
+	data, err := receiver.security.verifyPacket(packet)
+	if err != nil || string(data) != "payload" {
+		t.Fatalf("1) Signed packet should have been accepted, got %s %s", data, err)
+	}
+
+	if _, err := receiver.security.verifyPacket(packet); err == nil {
+		t.Errorf("2) Replayed packet should have been rejected")
+	}
+
+	// tampered payload, timestamp and authentication code
+	for _, offset := range []int{0, len("tampered") + 2, len("tampered") + 8 + 5} {
+		tampered := signedPacket(sender, "tampered")
+		tampered[offset] ^= 0x01
+		if _, err := receiver.security.verifyPacket(tampered); err == nil {
+			t.Errorf("3) Packet tampered at %d should have been rejected", offset)
+		}
+	}
+
+	other := newSecurityTestComm(0, gostore.ConfigSecurity{SharedSecret: "other"}, "node0", "node1")
+	other.clock = senderClock
+	if _, err := receiver.security.verifyPacket(signedPacket(other, "other")); err == nil {
+		t.Errorf("4) Packet signed with another secret should have been rejected")
+	}
+
+	if _, err := receiver.security.verifyPacket([]byte("short")); err == nil {
+		t.Errorf("5) Packet too small to be signed should have been rejected")
+	}
+
+	// timestamps out of the replay window, and just in it
+	window := int64(UDP_REPLAY_WINDOW) * 1000 * 1000
+	for i, drift := range []int64{-window - 1e9, window + 1e9} {
+		senderClock.now = receiverClock.now + drift
+		if _, err := receiver.security.verifyPacket(signedPacket(sender, fmt.Sprintf("stale%d", i))); err == nil {
+			t.Errorf("6) Packet sent %d ms away from the receiver's clock should have been rejected", drift/1e6)
+		}
+	}
+	senderClock.now = receiverClock.now - window + 1e9
+	if _, err := receiver.security.verifyPacket(signedPacket(sender, "late")); err != nil {
+		t.Errorf("7) Packet sent within the replay window should have been accepted: %s", err)
+	}
+
+	// received packets are forgotten once they can't be replayed anymore
+	receiverClock.now += int64(udp_replay_keeping) * 1000 * 1000
+	senderClock.now = receiverClock.now
+	if _, err := receiver.security.verifyPacket(signedPacket(sender, "later")); err != nil {
+		t.Fatalf("8) Signed packet should have been accepted: %s", err)
+	}
+	if received := receiver.security.order.Len(); received != 1 || len(receiver.security.received) != 1 {
+		t.Errorf("9) Only the last packet should have been remembered, got %d", received)
+	}
+}
@@ -1,29 +1,28 @@
 package comm
 
 import (
+	"gostore/cluster"
 	"net"
 	"os"
-	"gostore/log"
 	"io"
+	"io/ioutil"
 	"bytes"
 )
 
 type Server struct {
-	tcpaddr *net.TCPAddr
-	udpaddr *net.UDPAddr
+	node *cluster.Node
 
-	tcpsock *net.TCPListener
-	udpsock *net.UDPConn
+	tcpsock net.Listener
+	udpsock net.PacketConn
 
 	comm *Comm
 }
 
-func NewServer(comm *Comm, tcpaddr *net.TCPAddr, udpaddr *net.UDPAddr) *Server {
+func NewServer(comm *Comm, node *cluster.Node) *Server {
 	s := new(Server)
 
 	s.comm = comm
-	s.tcpaddr = tcpaddr
-	s.udpaddr = udpaddr
+	s.node = node
 
 	s.start()
 
@@ -33,18 +32,18 @@ func NewServer(comm *Comm, tcpaddr *net.TCPAddr, udpaddr *net.UDPAddr) *Server {
 func (s *Server) start() {
 	var err os.Error
 
-	log.Debug("ServiceServer: starting listening tcp socket on %s\n", s.tcpaddr)
-	s.tcpsock, err = net.ListenTCP("tcp", s.tcpaddr)
+	s.comm.logger.Debug("Starting listening tcp socket on %s:%d", s.node.Address, s.node.TcpPort)
+	s.tcpsock, err = s.comm.transport.ListenStream(s.node)
 	if err != nil {
-		log.Fatal("Couldn't create TCP server listener: %s\n", err)
+		s.comm.logger.Fatal("Couldn't create TCP server listener: %s", err)
 	}
 
 	go s.acceptTCP()
 
-	log.Debug("ServiceServer: starting listening udp socket on %s\n", s.udpaddr)
-	s.udpsock, err = net.ListenUDP("udp", s.udpaddr)
+	s.comm.logger.Debug("Starting listening udp socket on %s:%d", s.node.Address, s.node.UdpPort)
+	s.udpsock, err = s.comm.transport.ListenPacket(s.node)
 	if err != nil {
-		log.Fatal("Couldn't create UDP server listener: %s\n", err)
+		s.comm.logger.Fatal("Couldn't create UDP server listener: %s", err)
 	}
 
 	go s.acceptUDP()
@@ -53,31 +52,121 @@ func (s *Server) start() {
 func (s *Server) acceptTCP() {
 	for {
 		conn, err := s.tcpsock.Accept()
+		if err != nil {
+			s.comm.logger.Error("Couldn't accept TCP connexion: %s", err)
+			continue
+		}
+
 		if s.comm.running {
-			if err != nil {
-				log.Error("Couldn't accept TCP connexion: %s\n", err)
-			}
+			if s.comm.security.tlsEnabled() {
+				go s.acceptTLS(conn)
+			} else {
+				connection := NewConnection(s.comm.pool, P_TCP, D_Inbound, conn)
+				s.comm.pool.track(connection)
 
-			go s.handleTCPConnection(conn)
+				go s.handleTCPConnection(connection)
+			}
 		} else {
-			log.Info("Dropping connection because communications have been paused")
+			s.comm.logger.Info("Dropping connection because communications have been paused")
+			conn.Close()
 		}
 	}
 }
 
-func (s *Server) handleTCPConnection(conn net.Conn) {
-	connection := NewConnection(s.comm.pool, P_TCP, D_Inbound, conn)
+// Authenticates the node that opened a TCP connection before reading
+// messages from it
+func (s *Server) acceptTLS(conn net.Conn) {
+	tlsconn, peer, err := s.comm.security.server(conn)
+	if err != nil {
+		s.comm.logger.Error("Rejected TCP connexion from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
 
-	reader := io.Reader(conn)
-	msg := s.comm.NewMessage()
-	msg.connection = connection
-	err := msg.readMessage(reader)
+	connection := NewConnection(s.comm.pool, P_TCP, D_Inbound, tlsconn)
+	connection.peer = peer
+	s.comm.pool.track(connection)
 
-	if err != nil {
-		log.Error("Couldn't handle message received from TCP because of errors: %s %s\n", msg, err)
-		conn.Close() // Close the connection to make sure we don't cause error
-	} else {
-		s.comm.handleMessage(msg)
+	s.handleTCPConnection(connection)
+}
+
+// Reads messages from a TCP connection until it gets closed. Data messages
+// are handled one at the time since their data is read from the connection.
+func (s *Server) handleTCPConnection(connection *Connection) {
+	for {
+		msg := s.comm.NewMessage()
+		msg.connection = connection
+		err := msg.readMessage(connection.reader)
+
+		if err == ErrorCorrupted {
+			// what follows on the connection can't be trusted
+			s.comm.logger.Error("Received corrupted message from TCP: %s", msg)
+			s.comm.corruptions.add(&s.comm.corruptions.stats.TCP)
+			if s.comm.running {
+				go s.comm.respondCorrupted(msg)
+			}
+		}
+
+		if err != nil {
+			if err != os.EOF && err != ErrorCorrupted && !connection.isClosed() {
+				s.comm.logger.Error("Couldn't handle message received from TCP because of errors: %s %s", msg, err)
+			}
+
+			// the other end reset the connection, it may have been restarted
+			if !connection.isClosed() && connection.node != nil {
+				s.comm.peers.forget(connection.node)
+			}
+			connection.Close() // Close the connection to make sure we don't cause error
+			return
+		}
+
+		// an authenticated node can't send messages on behalf of another
+		if connection.peer != nil {
+			if sender := msg.senderNode(); sender == nil || sender.Adhoc || sender.Id != connection.peer.Id {
+				s.comm.logger.Error("Closing TCP connection of node %d, which sent a message as another node: %s", connection.peer.Id, msg)
+				connection.Close()
+				return
+			}
+		}
+
+		// the node that opened the connection can be responded through it
+		if connection.direction == D_Inbound && !connection.pooled {
+			if sender := msg.senderNode(); sender != nil {
+				s.comm.pool.adopt(connection, sender)
+			}
+		}
+
+		if msg.Type == T_DATA {
+			frame := msg.frame
+			msg.hold()
+
+			if s.comm.running {
+				go func() {
+					s.comm.handleMessage(msg)
+
+					// the data is freed now, or once sent if the message got forwarded
+					msg.Release()
+				}()
+			} else {
+				s.comm.logger.Info("Dropping message because communications have been paused")
+				msg.Release()
+			}
+
+			// wait for the data to be consumed and discard what hasn't been read
+			<-connection.frameDone
+			_, err = io.Copy(ioutil.Discard, frame.reader)
+			if err != nil {
+				s.comm.logger.Error("Couldn't discard unread data of message %s: %s", msg, err)
+				connection.Close()
+				return
+			}
+
+		} else if s.comm.running {
+			go s.comm.handleMessage(msg)
+
+		} else {
+			s.comm.logger.Info("Dropping message because communications have been paused")
+		}
 	}
 }
 
@@ -89,24 +178,38 @@ func (s *Server) acceptUDP() {
 
 		if s.comm.running {
 			if err != nil {
-				log.Error("Error while reading UDP (read %d) from %s: %s\n", n, adr, err)
+				s.comm.logger.Error("Error while reading UDP (read %d) from %s: %s", n, adr, err)
 
 			} else {
-				abcon := net.Conn(s.udpsock)
-				connection := NewConnection(s.comm.pool, P_UDP, D_Inbound, abcon)
-				read := io.Reader(bytes.NewBuffer(buf))
+				// inbound UDP connections share the server socket, they
+				// are never written to nor closed
+				connection := NewConnection(s.comm.pool, P_UDP, D_Inbound, nil)
+				packet := buf[:n]
+				if s.comm.security.udpAuthenticated() {
+					packet, err = s.comm.security.verifyPacket(packet)
+					if err != nil {
+						s.comm.logger.Error("Dropping UDP packet from %s: %s", adr, err)
+						continue
+					}
+				}
+
+				read := io.Reader(bytes.NewBuffer(packet))
 				msg := s.comm.NewMessage()
 				msg.connection = connection
 				err := msg.readMessage(read)
 
-				if err != nil {
-					log.Error("Couldn't handle message received from UDP because of errors: %s %s\n", msg, err)
+				if err == ErrorCorrupted {
+					s.comm.logger.Error("Received corrupted message from UDP: %s", msg)
+					s.comm.corruptions.add(&s.comm.corruptions.stats.UDP)
+					go s.comm.respondCorrupted(msg)
+				} else if err != nil {
+					s.comm.logger.Error("Couldn't handle message received from UDP because of errors: %s %s", msg, err)
 				} else {
 					go s.comm.handleMessage(msg)
 				}
 			}
 		} else {
-			log.Info("Dropping connection because communications have been paused")
+			s.comm.logger.Info("Dropping connection because communications have been paused")
 		}
 	}
 }
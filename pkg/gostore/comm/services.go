@@ -15,6 +15,20 @@ type Service interface {
 	Boot()
 }
 
+// interface that services must implement to declare the ids of their remote
+// functions. Ids are part of the wire protocol and must never change once
+// used, new functions must be given new ids.
+type FunctionTable interface {
+	Functions() map[string]byte // function name -> id (>= RESERVED_FUNCTIONS)
+}
+
+// interface implemented by services with generated stubs (see gostore-rpcgen).
+// Functions are dispatched by their explicit ids instead of by reflection,
+// and their requests are decoded before calling the remote function.
+type Dispatcher interface {
+	FunctionTable
+	Dispatch(message *Message) (handled bool, err os.Error)
+}
 
 // services collection
 type Services struct {
@@ -33,13 +47,22 @@ func (services *Services) AddService(service Service, sconfig gostore.ConfigServ
 	wrapper := new(serviceWrapper)
 	wrapper.service = service
 	wrapper.name2id = make(map[string]byte)
-	wrapper.id2method = make([]*reflect.Method, 255)
+	wrapper.id2name = make(map[byte]string)
+	wrapper.id2method = make(map[byte]*reflect.Method)
 
 	if sconfig.Id == 0 {
 		log.Fatal("Service id cannot be 0")
 	}
 
 	wrapper.id = sconfig.Id
+
+	// data messages of the service are compressed if a codec is configured
+	if name, ok := sconfig.CustomConfig["Compression"].(string); ok && name != "" {
+		wrapper.codec = GetCodecByName(name)
+		if wrapper.codec == nil {
+			log.Fatal("Unknown compression codec %s for service %d", name, sconfig.Id)
+		}
+	}
 	services.wrappers[sconfig.Id] = wrapper
 	services.service2wrapper[service] = wrapper
 
@@ -76,26 +99,67 @@ func (services *Services) BootServices() {
 }
 
 
+// Returns the functions of all services, used to handshake with other nodes
+func (services *Services) functionsTable() functionsTable {
+	table := make(functionsTable)
+	for _, wrapper := range services.wrappers {
+		if wrapper != nil {
+			table[wrapper.id] = wrapper.id2name
+		}
+	}
+	return table
+}
+
+
 // service wrapper with remotely callable methods of the service
 type serviceWrapper struct {
-	service     Service
-	id          byte
-	name2id     map[string]byte
-	id2method   []*reflect.Method
-	methodCount byte
+	service    Service
+	dispatcher Dispatcher
+	id         byte
+	name2id    map[string]byte
+	id2name    map[byte]string
+	id2method  map[byte]*reflect.Method
+	codec      Codec // default codec of the data messages of the service
 }
 
+// Registers the remote functions of the service with the ids it declares.
+// Services with generated stubs dispatch calls themselves, the others are
+// called by reflection on their Remote* methods.
 func (wrapper *serviceWrapper) registerFunctions() {
-	typ := reflect.TypeOf(wrapper.service)
+	table, ok := wrapper.service.(FunctionTable)
+	if !ok {
+		log.Fatal("Service #%d doesn't declare the ids of its functions", wrapper.id)
+		return
+	}
+
+	for name, id := range table.Functions() {
+		if id < RESERVED_FUNCTIONS {
+			log.Fatal("Function %s of service #%d cannot use reserved id %d", name, wrapper.id, id)
+		}
+		if other, found := wrapper.id2name[id]; found {
+			log.Fatal("Functions %s and %s of service #%d have the same id %d", name, other, wrapper.id, id)
+		}
+
+		wrapper.name2id[name] = id
+		wrapper.id2name[id] = name
+	}
+
+	if dispatcher, ok := wrapper.service.(Dispatcher); ok {
+		wrapper.dispatcher = dispatcher
+		return
+	}
 
+	typ := reflect.TypeOf(wrapper.service)
 	for m := 0; m < typ.NumMethod(); m++ {
 		method := typ.Method(m)
 		mname := method.Name
 
 		if strings.HasPrefix(mname, "Remote") {
-			wrapper.name2id[mname] = wrapper.methodCount
-			wrapper.id2method[wrapper.methodCount] = &method
-			wrapper.methodCount++
+			id, found := wrapper.name2id[mname]
+			if !found {
+				log.Fatal("Function %s of service #%d has no declared id", mname, wrapper.id)
+			}
+			wrapper.id2method[id] = &method
 		}
 	}
 }
@@ -108,18 +172,21 @@ func (wrapper *serviceWrapper) functionName2Id(name string) byte {
 		return 0
 	}
 
-	return id + RESERVED_FUNCTIONS
+	return id
 }
 
-func (wrapper *serviceWrapper) callFunction(id byte, message *Message) (handled bool) {
-	method := wrapper.id2method[id-RESERVED_FUNCTIONS]
+func (wrapper *serviceWrapper) callFunction(id byte, message *Message) (handled bool, err os.Error) {
+	if wrapper.dispatcher != nil {
+		return wrapper.dispatcher.Dispatch(message)
+	}
 
-	if method != nil {
+	method, found := wrapper.id2method[id]
+	if found {
 		rService := reflect.ValueOf(wrapper.service)
 		rMessage := reflect.ValueOf(message)
 		method.Func.Call([]reflect.Value{rService, rMessage})
-		return true
+		return true, nil
 	}
 
-	return false
+	return false, nil
 }
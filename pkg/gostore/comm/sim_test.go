@@ -0,0 +1,103 @@
+package comm_test
+
+import (
+	"fmt"
+	"testing"
+	"gostore/comm"
+)
+
+const SIM_SEED = 42
+
+// Calls the echo service of a node on a simulation, running the simulation
+// long enough for the response to arrive
+func simCall(st *comm.SimTransport, tc *testCluster, from int, to int, message *comm.Message) (string, bool) {
+	responses := make(chan string, 1)
+	message.OnResponse = func(response *comm.Message) {
+		responses <- string(response.Message.Bytes()[:response.Message.Size])
+	}
+
+	// sending may wait for a handshake, which needs the simulation to run
+	go tc.comms[from].SendNode(tc.node(from, to), message)
+	st.RunFor(1000 * 1000 * 1000)
+
+	select {
+	case payload := <-responses:
+		return payload, true
+	default:
+	}
+	return "", false
+}
+
+// Runs the same calls on a new simulation, returns its trace
+func simulate(t *testing.T, seed int64) []comm.SimEvent {
+	st := comm.NewSimTransport(seed)
+	tc := newTestCluster(2, st)
+
+	for i := 0; i < 5; i++ {
+		payload := fmt.Sprintf("hello %d", i)
+		response, ok := simCall(st, tc, i%2, (i+1)%2, tc.echoMessage(i%2, payload, nil))
+		if !ok || response != payload {
+			t.Errorf("1) Message %d should have been echoed, got %s", i, response)
+		}
+	}
+
+	response, ok := simCall(st, tc, 0, 1, tc.echoMessage(0, "hello ", []byte("world")))
+	if !ok || response != "hello world" {
+		t.Errorf("2) Data message should have been echoed, got %s", response)
+	}
+
+	return st.Trace()
+}
+
+// Runs calls sent at the same time by all the nodes of a new simulation,
+// returns its trace
+func simulateConcurrent(t *testing.T, seed int64) []comm.SimEvent {
+	st := comm.NewSimTransport(seed)
+	tc := newTestCluster(3, st)
+
+	responses := make(chan string, 6)
+	for i := 0; i < 6; i++ {
+		from, to := i%3, (i+1)%3
+		message := tc.echoMessage(from, fmt.Sprintf("concurrent %d", i), nil)
+		message.OnResponse = func(response *comm.Message) {
+			responses <- string(response.Message.Bytes()[:response.Message.Size])
+		}
+		go tc.comms[from].SendNode(tc.node(from, to), message)
+	}
+	st.RunFor(2000 * 1000 * 1000)
+
+	if len(responses) != 6 {
+		t.Errorf("1) All the concurrent calls should have been responded, got %d", len(responses))
+	}
+
+	return st.Trace()
+}
+
+func sameTrace(t *testing.T, first []comm.SimEvent, second []comm.SimEvent) {
+	if len(first) == 0 {
+		t.Fatalf("3) Deliveries should have been traced")
+	}
+
+	if len(first) != len(second) {
+		t.Errorf("4) Replay should have delivered %d messages, delivered %d", len(first), len(second))
+	}
+
+	for i := 0; i < len(first) && i < len(second); i++ {
+		if !sameEvent(first[i], second[i]) {
+			t.Errorf("5) Replay diverged at delivery %d: %v instead of %v", i, second[i], first[i])
+			break
+		}
+	}
+}
+
+func sameEvent(a comm.SimEvent, b comm.SimEvent) bool {
+	return a.Step == b.Step && a.Time == b.Time && a.Kind == b.Kind && a.From == b.From && a.To == b.To && a.Size == b.Size
+}
+
+func TestSimulationReplay(t *testing.T) {
+	sameTrace(t, simulate(t, SIM_SEED), simulate(t, SIM_SEED))
+}
+
+func TestConcurrentSimulationReplay(t *testing.T) {
+	sameTrace(t, simulateConcurrent(t, SIM_SEED), simulateConcurrent(t, SIM_SEED))
+}
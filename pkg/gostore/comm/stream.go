@@ -0,0 +1,438 @@
+package comm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"gostore/cluster"
+)
+
+const (
+	NET_FUNC_STREAM_CREDIT = RESERVED_FUNCTIONS + 2 // Credits granted to a stream
+
+	STREAM_WINDOW  = 16   // Default number of frames the responder can send ahead
+	STREAM_TIMEOUT = 5000 // 5 seconds, default time to wait for a frame or for credits
+)
+
+// Streamed response to a request. The responding node sends multiple
+// ordered response frames for the same request and an end of stream marker.
+// It can only send as many frames as it has been given credits: the caller
+// grants credits as frames get consumed, which bounds the number of frames
+// buffered on its side.
+//
+// Frames can be read as an iterator (Next) or from a channel (Frames).
+//
+// Frames and credits are never sent again, so they are always sent over TCP
+// to make sure they can't be lost: a lost frame or grant would stall the
+// stream until it times out.
+type ResponseStream struct {
+	comm    *Comm
+	request *Message
+	key     string
+	mutex   *sync.Mutex
+
+	window   int
+	consumed int // frames consumed since the last credits grant
+
+	next    uint32              // sequence of the next frame to deliver
+	pending map[uint32]*Message // received frames, by sequence
+	ready   chan bool           // signaled when a frame is received
+
+	responder *cluster.Node // node sending the frames, to which credits are granted
+	ended     bool
+	err       os.Error
+	frames    chan *Message
+}
+
+// Sends a request for which the response is streamed. The request is tracked
+// with its Timeout, which is reset at each received frame; streamed requests
+// are never retried since frames may already have been consumed.
+func (comm *Comm) SendStream(node *cluster.Node, request *Message) *ResponseStream {
+	stream := new(ResponseStream)
+	stream.comm = comm
+	stream.request = request
+	stream.key = request.Key().String()
+	stream.mutex = new(sync.Mutex)
+	stream.window = STREAM_WINDOW
+	stream.pending = make(map[uint32]*Message)
+	stream.ready = make(chan bool, 1)
+	stream.responder = node
+
+	if request.Timeout <= 0 {
+		request.Timeout = STREAM_TIMEOUT
+	}
+	request.Retries = 0
+	request.LastTimeoutAsError = true
+	request.streamWindow = uint32(stream.window)
+
+	request.OnError = func(response *Message, err os.Error) {
+		stream.fail(err)
+	}
+
+	// responded without streaming (ex: by a node that doesn't support it)
+	request.OnResponse = func(response *Message) {
+		response.streamFrame = true
+		response.streamSeq = 0
+		stream.push(response)
+
+		end := comm.NewMessage()
+		end.streamFrame = true
+		end.streamSeq = 1
+		end.streamEnd = true
+		stream.push(end)
+	}
+
+	comm.streamsMutex.Lock()
+	comm.streams[stream.key] = stream
+	comm.streamsMutex.Unlock()
+
+	// the request may be handled locally, which would block until the end
+	// of the stream
+	go comm.SendNode(node, request)
+
+	return stream
+}
+
+// Returns the next frame of the stream. Returns os.EOF once the end of the
+// stream has been reached, or the error that interrupted it.
+func (stream *ResponseStream) Next() (*Message, os.Error) {
+	for {
+		stream.mutex.Lock()
+		frame, found := stream.pending[stream.next]
+		if found {
+			stream.pending[stream.next] = nil, false
+			stream.next++
+		}
+
+		if found && frame.streamEnd {
+			stream.ended = true
+			stream.mutex.Unlock()
+			stream.close()
+			return nil, os.EOF
+		}
+
+		if found && frame.FunctionId == FUNC_ERROR {
+			err := ReadErrorPayload(frame)
+			stream.ended = true
+			stream.err = err
+			stream.mutex.Unlock()
+			stream.close()
+			return nil, err
+		}
+
+		if found {
+			grant := 0
+			stream.consumed++
+			if stream.consumed >= stream.window/2 {
+				grant = stream.consumed
+				stream.consumed = 0
+			}
+			responder := stream.responder
+			stream.mutex.Unlock()
+
+			if grant > 0 {
+				stream.comm.sendCredits(responder, stream.key, grant)
+			}
+			return frame, nil
+		}
+
+		if stream.ended {
+			err := stream.err
+			stream.mutex.Unlock()
+			if err == nil {
+				err = os.EOF
+			}
+			return nil, err
+		}
+		stream.mutex.Unlock()
+
+		<-stream.ready
+	}
+
+	return nil, os.EOF
+}
+
+// Returns a channel on which the frames are sent, closed at the end of the
+// stream. Err returns the error that interrupted the stream, if any.
+func (stream *ResponseStream) Frames() chan *Message {
+	stream.mutex.Lock()
+	if stream.frames == nil {
+		stream.frames = make(chan *Message)
+		go func() {
+			for {
+				frame, err := stream.Next()
+				if err != nil {
+					break
+				}
+				stream.frames <- frame
+			}
+			close(stream.frames)
+		}()
+	}
+	frames := stream.frames
+	stream.mutex.Unlock()
+
+	return frames
+}
+
+// Returns the error that interrupted the stream, nil if it ended normally or
+// is still going.
+func (stream *ResponseStream) Err() os.Error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.err
+}
+
+// Stops the stream before its end, canceling the request on the responder
+func (stream *ResponseStream) Close() {
+	stream.mutex.Lock()
+	ended := stream.ended
+	stream.mutex.Unlock()
+
+	if !ended {
+		stream.comm.Cancel(stream.request)
+		stream.fail(ErrorCanceled)
+	}
+}
+
+// Adds a received frame to the stream
+func (stream *ResponseStream) push(frame *Message) {
+	// the data of a frame must be read before the connection can be used
+	// again, the number of buffered frames is bounded by the credits
+	if frame.Type == T_DATA && frame.Data != nil {
+		data := bytes.NewBuffer(make([]byte, 0, frame.DataSize))
+		_, err := io.Copyn(data, frame.Data, frame.DataSize)
+		frame.Release()
+		if err != nil {
+			stream.fail(err)
+			return
+		}
+		frame.Data = data
+	}
+
+	stream.mutex.Lock()
+	if frame.streamSeq >= stream.next && !stream.ended {
+		stream.pending[frame.streamSeq] = frame
+		if responder := frame.MiddleNode(); responder != nil {
+			stream.responder = responder
+		}
+	}
+	stream.mutex.Unlock()
+
+	stream.signal()
+}
+
+// Interrupts the stream with an error
+func (stream *ResponseStream) fail(err os.Error) {
+	stream.mutex.Lock()
+	if !stream.ended {
+		stream.ended = true
+		stream.err = err
+	}
+	stream.mutex.Unlock()
+
+	stream.close()
+	stream.signal()
+}
+
+func (stream *ResponseStream) signal() {
+	select {
+	case stream.ready <- true:
+	default:
+	}
+}
+
+// Stops receiving frames for the stream
+func (stream *ResponseStream) close() {
+	stream.comm.streamsMutex.Lock()
+	stream.comm.streams[stream.key] = nil, false
+	stream.comm.streamsMutex.Unlock()
+
+	stream.comm.unwatchMessage(stream.request)
+}
+
+// Handles a frame of a streamed response. Returns false if the message isn't
+// a frame of a stream of this node.
+func (comm *Comm) handleStreamFrame(frame *Message) bool {
+	key := frame.InitKey().String()
+
+	comm.streamsMutex.Lock()
+	stream, found := comm.streams[key]
+	comm.streamsMutex.Unlock()
+
+	if !found {
+		return false
+	}
+
+	// the responder is alive, give it more time
+	comm.touchTracker(key)
+	stream.push(frame)
+	return true
+}
+
+
+// Sending end of a streamed response
+type Stream struct {
+	comm    *Comm
+	request *Message
+	key     string
+	mutex   *sync.Mutex
+
+	seq     uint32
+	credits int
+	granted chan bool // signaled when credits are granted
+	ended   bool
+
+	Timeout int // ms to wait for credits before giving up
+}
+
+// Opens a stream to respond to a request sent with SendStream
+func (comm *Comm) OpenStream(request *Message) *Stream {
+	stream := new(Stream)
+	stream.comm = comm
+	stream.request = request
+	stream.key = request.Key().String()
+	stream.mutex = new(sync.Mutex)
+	stream.credits = int(request.streamWindow)
+	stream.granted = make(chan bool, 1)
+	stream.Timeout = STREAM_TIMEOUT
+
+	comm.streamsMutex.Lock()
+	comm.outStreams[stream.key] = stream
+	comm.streamsMutex.Unlock()
+
+	return stream
+}
+
+// Sends a frame of the stream, waiting for credits if the caller hasn't
+// consumed enough frames yet.
+func (stream *Stream) Send(frame *Message) os.Error {
+	deadline := stream.comm.clock.Now() + int64(stream.Timeout)*1000*1000
+
+	for {
+		stream.mutex.Lock()
+		if stream.ended {
+			stream.mutex.Unlock()
+			return os.NewError("Stream already ended")
+		}
+		if stream.credits > 0 {
+			stream.credits--
+			stream.mutex.Unlock()
+			break
+		}
+		stream.mutex.Unlock()
+
+		wait := deadline - stream.comm.clock.Now()
+		if wait <= 0 {
+			stream.abort()
+			return ErrorTimeout
+		}
+
+		select {
+		case <-stream.granted:
+		case <-stream.request.Done():
+			stream.abort()
+			return ErrorCanceled
+		case <-stream.comm.clock.After(wait):
+		}
+	}
+
+	stream.sendFrame(frame, false)
+	return nil
+}
+
+// Ends the stream
+func (stream *Stream) End() {
+	end := stream.comm.NewMsgMessage(stream.request.ServiceId)
+	stream.sendFrame(end, true)
+}
+
+// Interrupts the stream with an error, which is returned to the caller
+func (stream *Stream) Error(err os.Error) {
+	frame := stream.comm.NewMsgMessage(stream.request.ServiceId)
+	frame.FunctionId = FUNC_ERROR
+	WriteErrorPayload(frame, err)
+	stream.sendFrame(frame, true)
+}
+
+func (stream *Stream) sendFrame(frame *Message, last bool) {
+	stream.mutex.Lock()
+	if stream.ended {
+		stream.mutex.Unlock()
+		return
+	}
+	frame.streamFrame = true
+	frame.streamSeq = stream.seq
+	stream.seq++
+	if last {
+		stream.ended = true
+	}
+	stream.mutex.Unlock()
+
+	// the end marker is a frame of its own, errors end the stream
+	frame.streamEnd = last && frame.FunctionId != FUNC_ERROR
+
+	source := stream.request.SourceNode()
+	frame.SetMiddleNode(stream.comm.Cluster.MyNode)
+	frame.SetSourceNode(source)
+	frame.InitId = stream.request.Id
+	frame.reliable = true
+	stream.comm.SendNode(source, frame)
+
+	if last {
+		stream.close()
+	}
+}
+
+func (stream *Stream) abort() {
+	stream.mutex.Lock()
+	stream.ended = true
+	stream.mutex.Unlock()
+	stream.close()
+}
+
+func (stream *Stream) close() {
+	stream.comm.streamsMutex.Lock()
+	stream.comm.outStreams[stream.key] = nil, false
+	stream.comm.streamsMutex.Unlock()
+}
+
+func (comm *Comm) sendCredits(node *cluster.Node, key string, credits int) {
+	message := comm.NewMsgMessage(NET_SERVICE)
+	message.FunctionId = NET_FUNC_STREAM_CREDIT
+	message.Message.WriteString(key)             // key of the stream request
+	message.Message.WriteUint32(uint32(credits)) // granted credits
+	message.reliable = true
+	comm.SendNode(node, message)
+}
+
+// Handles credits granted by the caller of a stream
+func (comm *Comm) handleStreamCredits(message *Message) {
+	key, err := message.Message.ReadString() // key of the stream request
+	if err != nil {
+		comm.logger.Error("Couldn't read stream credits %s: %s", message, err)
+		return
+	}
+
+	credits, err := message.Message.ReadUint32() // granted credits
+	if err != nil {
+		comm.logger.Error("Couldn't read stream credits %s: %s", message, err)
+		return
+	}
+
+	comm.streamsMutex.Lock()
+	stream, found := comm.outStreams[key]
+	comm.streamsMutex.Unlock()
+
+	if found {
+		stream.mutex.Lock()
+		stream.credits += int(credits)
+		stream.mutex.Unlock()
+
+		select {
+		case stream.granted <- true:
+		default:
+		}
+	}
+}
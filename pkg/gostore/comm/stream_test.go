@@ -0,0 +1,62 @@
+package comm_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"gostore/comm"
+)
+
+// Calls the count function of node 1, whose response is streamed
+func countStream(tc *testCluster, count int) *comm.ResponseStream {
+	message := tc.echoMessage(0, fmt.Sprintf("%d", count), nil)
+	message.Function = "RemoteCount"
+	message.Timeout = 1000
+	return tc.comms[0].SendStream(tc.node(0, 1), message)
+}
+
+func TestStream(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+
+	// more frames than the window, the responder needs credits to finish
+	count := 3 * comm.STREAM_WINDOW
+	stream := countStream(tc, count)
+
+	for i := 0; i < count; i++ {
+		frame, err := stream.Next()
+		if err != nil {
+			t.Fatalf("1) Frame %d should have been received, got %s", i, err)
+		}
+
+		if payload := string(frame.Message.Bytes()[:frame.Message.Size]); payload != fmt.Sprintf("%d", i) {
+			t.Errorf("2) Frames should have been received in order, got %s instead of %d", payload, i)
+		}
+	}
+
+	if _, err := stream.Next(); err != os.EOF {
+		t.Errorf("3) Stream should have ended, got %s", err)
+	}
+
+	if received := tc.echos[1].Received(); len(received) != 1 {
+		t.Errorf("4) Streamed request should have been handled once: %v", received)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	tc := newTestCluster(2, comm.NewMemoryTransport())
+	stream := countStream(tc, -1)
+
+	frame, err := stream.Next()
+	if err != nil || string(frame.Message.Bytes()[:frame.Message.Size]) != "0" {
+		t.Errorf("1) Frame sent before the error should have been received, got %s", err)
+	}
+
+	_, err = stream.Next()
+	if err == nil || err.String() != "Negative count" {
+		t.Errorf("2) Stream should have been interrupted by the error of the responder, got %s", err)
+	}
+
+	if stream.Err() == nil {
+		t.Errorf("3) Error of the stream should have been kept")
+	}
+}
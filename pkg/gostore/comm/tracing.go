@@ -0,0 +1,255 @@
+package comm
+
+import (
+	"fmt"
+	"io"
+	"json"
+	"os"
+	"rand"
+	"sync"
+)
+
+const (
+	TRACE_MAX_SPANS = 10000 // Default number of ended spans kept by a node
+
+	span_kind_server   = 2 // OpenTelemetry kind of the spans of handled messages
+	span_status_unset  = 0
+	span_status_error  = 2
+	span_exporter_name = "gostore/comm"
+)
+
+// Span of the handling of a traced message by a node. Messages sent while
+// handling a message carry its trace and the id of its span, so the spans
+// recorded by the nodes a call chain went through form a tree. A trace is
+// started by the first message a node sends outside of the handling of
+// another one.
+type Span struct {
+	TraceId   uint64
+	Id        uint64
+	ParentId  uint64 // span of the node the message was sent from, 0 at the root of the trace
+	NodeId    uint16 // node that handled the message
+	ServiceId byte
+	Function  string
+	MessageId uint64
+	Start     int64  // ns, from the clock of the communication layer
+	End       int64  // ns
+	Error     string // error responded to the message, empty if none
+
+	previous *Span // span of the message before it was redirected locally
+}
+
+// Ended spans of a node, the oldest ones overwritten once full
+type spanRecorder struct {
+	mutex  *sync.Mutex
+	random *rand.Rand
+	spans  []*Span
+	next   int
+}
+
+func newSpanRecorder(comm *Comm) *spanRecorder {
+	sr := new(spanRecorder)
+	sr.mutex = new(sync.Mutex)
+	sr.random = rand.New(rand.NewSource(comm.random.Int63()))
+	sr.spans = make([]*Span, 0)
+	return sr
+}
+
+// Returns a new trace or span id, never 0
+func (sr *spanRecorder) newId() uint64 {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	id := uint64(sr.random.Int63())<<1 ^ uint64(sr.random.Int63())
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+func (sr *spanRecorder) record(span *Span, max int) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if max <= 0 {
+		return
+	}
+
+	if len(sr.spans) < max {
+		sr.spans = append(sr.spans, span)
+		return
+	}
+
+	if sr.next >= max {
+		sr.next = 0
+	}
+	sr.spans[sr.next] = span
+	sr.next++
+}
+
+// Starts the trace of a message sent outside of the handling of another one
+func (comm *Comm) traceRoot(message *Message) {
+	if !comm.Tracing || message.TraceId != 0 {
+		return
+	}
+	if message.ServiceId == NET_SERVICE || message.FunctionId < RESERVED_FUNCTIONS {
+		return
+	}
+
+	message.TraceId = comm.traces.newId()
+	message.SpanId = 0
+}
+
+// Starts the span of the handling of a traced message. Messages it sends
+// and the responses to it are part of the trace (see Message.Trace).
+func (comm *Comm) startSpan(message *Message) *Span {
+	if !comm.Tracing || message.TraceId == 0 {
+		return nil
+	}
+
+	span := new(Span)
+	span.TraceId = message.TraceId
+	span.Id = comm.traces.newId()
+	span.ParentId = message.SpanId
+	span.NodeId = comm.Cluster.MyNode.Id
+	span.ServiceId = message.ServiceId
+	span.Function = comm.GetWrapper(message.ServiceId).id2name[message.FunctionId]
+	span.MessageId = message.Id
+	span.Start = comm.clock.Now()
+	span.previous = message.span
+
+	message.span = span
+	return span
+}
+
+func (comm *Comm) endSpan(message *Message, span *Span) {
+	if span == nil {
+		return
+	}
+
+	comm.traces.mutex.Lock()
+	span.End = comm.clock.Now()
+	comm.traces.mutex.Unlock()
+
+	message.span = span.previous
+	comm.traces.record(span, comm.TraceMaxSpans)
+}
+
+// Records the error responded to a message in its span
+func (comm *Comm) spanError(message *Message, err os.Error) {
+	if message.span == nil {
+		return
+	}
+
+	comm.traces.mutex.Lock()
+	message.span.Error = err.String()
+	comm.traces.mutex.Unlock()
+}
+
+// Returns the spans ended by this node, oldest first
+func (comm *Comm) Spans() []Span {
+	sr := comm.traces
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	spans := make([]Span, 0, len(sr.spans))
+	for i := 0; i < len(sr.spans); i++ {
+		span := *sr.spans[(sr.next+i)%len(sr.spans)]
+		span.previous = nil
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// Writes the spans ended by this node to a file, in the OpenTelemetry JSON
+// format (see ExportSpans)
+func (comm *Comm) ExportSpansFile(path string) os.Error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return ExportSpans(file, comm.Spans())
+}
+
+// Writes spans in the JSON encoding of the OpenTelemetry protocol (OTLP), as
+// written by the OpenTelemetry file exporters, so that they can be loaded in
+// tools that inspect traces. The spans of different nodes can be exported
+// together, each node is a resource. Trace ids are 64 bits long and padded
+// to the 128 bits of OpenTelemetry.
+func ExportSpans(writer io.Writer, spans []Span) os.Error {
+	nodes := make([]uint16, 0)
+	byNode := make(map[uint16][]interface{})
+	for _, span := range spans {
+		if _, found := byNode[span.NodeId]; !found {
+			nodes = append(nodes, span.NodeId)
+			byNode[span.NodeId] = make([]interface{}, 0)
+		}
+		byNode[span.NodeId] = append(byNode[span.NodeId], encodeSpan(span))
+	}
+
+	resources := make([]interface{}, 0, len(nodes))
+	for _, node := range nodes {
+		resources = append(resources, map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{
+					spanAttribute("service.name", "gostore"),
+					spanAttribute("service.instance.id", fmt.Sprintf("%d", node)),
+				},
+			},
+			"scopeSpans": []interface{}{
+				map[string]interface{}{
+					"scope": map[string]interface{}{"name": span_exporter_name},
+					"spans": byNode[node],
+				},
+			},
+		})
+	}
+
+	bytes, err := json.Marshal(map[string]interface{}{"resourceSpans": resources})
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(bytes)
+	return err
+}
+
+func encodeSpan(span Span) interface{} {
+	status := map[string]interface{}{"code": span_status_unset}
+	if span.Error != "" {
+		status = map[string]interface{}{"code": span_status_error, "message": span.Error}
+	}
+
+	parent := ""
+	if span.ParentId != 0 {
+		parent = fmt.Sprintf("%016x", span.ParentId)
+	}
+
+	name := span.Function
+	if name == "" {
+		name = "unknown"
+	}
+
+	return map[string]interface{}{
+		"traceId":           fmt.Sprintf("%032x", span.TraceId),
+		"spanId":            fmt.Sprintf("%016x", span.Id),
+		"parentSpanId":      parent,
+		"name":              name,
+		"kind":              span_kind_server,
+		"startTimeUnixNano": fmt.Sprintf("%d", span.Start),
+		"endTimeUnixNano":   fmt.Sprintf("%d", span.End),
+		"attributes": []interface{}{
+			spanAttribute("gostore.service", fmt.Sprintf("%d", span.ServiceId)),
+			spanAttribute("gostore.message", fmt.Sprintf("%d", span.MessageId)),
+		},
+		"status": status,
+	}
+}
+
+func spanAttribute(key string, value string) interface{} {
+	return map[string]interface{}{
+		"key":   key,
+		"value": map[string]interface{}{"stringValue": value},
+	}
+}
@@ -1,152 +1,344 @@
 package comm
 
 import (
-	"time"
-	"gostore/log"
+	"container/heap"
 	"gostore/cluster"
 )
 
+const (
+	TRACKER_MAX_RETRY_DELAY = 30000 // 30 seconds
+	TRACKER_RETRY_JITTER    = 10    // +/- 10% of the retry delay
+	TRACKER_IDLE_WAIT       = 1000  // 1 second, wait when there is no message tracked
+)
+
 type MessageTracker struct {
 	message  *Message
+	key      string
 	sentTime int64
-	lastTime int64
 	retries  int
 
+	deadline  int64 // next time the tracker needs attention
+	resending bool  // deadline is the end of the retry delay, not a timeout
+	index     int   // position in the deadlines heap, -1 if not in it
+
 	destination *cluster.Node
 }
 
+// Min-heap of trackers ordered by deadline
+type trackerHeap []*MessageTracker
+
+func (h trackerHeap) Len() int { return len(h) }
+
+func (h trackerHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+
+func (h trackerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *trackerHeap) Push(x interface{}) {
+	tracker := x.(*MessageTracker)
+	tracker.index = len(*h)
+	*h = append(*h, tracker)
+}
+
+func (h *trackerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	tracker := old[n-1]
+	tracker.index = -1
+	*h = old[0 : n-1]
+	return tracker
+}
+
+// Schedules the tracker at the given deadline. Must be called with the
+// trackers mutex locked.
+func (comm *Comm) scheduleTracker(tracker *MessageTracker, deadline int64) {
+	if tracker.index >= 0 {
+		heap.Remove(&comm.trackersHeap, tracker.index)
+	}
+
+	// never wait past the deadline of the call chain
+	if tracker.message.Deadline > 0 && tracker.message.Deadline < deadline {
+		deadline = tracker.message.Deadline
+	}
+
+	tracker.deadline = deadline
+	heap.Push(&comm.trackersHeap, tracker)
+
+	// wake the tracker loop if this is the new earliest deadline
+	if tracker.index == 0 {
+		select {
+		case comm.trackersWake <- true:
+		default:
+		}
+	}
+}
+
+// Stops tracking. Must be called with the trackers mutex locked.
+func (comm *Comm) removeTracker(tracker *MessageTracker) {
+	if tracker.index >= 0 {
+		heap.Remove(&comm.trackersHeap, tracker.index)
+	}
+	comm.messageTrackers[tracker.key] = nil, false
+}
+
+// Returns true if the tracker is still tracked. Must be called with the
+// trackers mutex locked.
+func (comm *Comm) isTracked(tracker *MessageTracker) bool {
+	current, found := comm.messageTrackers[tracker.key]
+	return found && current == tracker
+}
+
+// Returns the delay to wait before the next retry of a message: its retry
+// delay doubled at each retry, with some jitter so that retries of many
+// messages don't all happen at the same time. Must be called with the
+// trackers mutex locked.
+func (comm *Comm) retryDelay(message *Message, retries int) int64 {
+	delay := int64(message.RetryDelay) * 1000 * 1000
+	if delay <= 0 {
+		return 0
+	}
+
+	max := int64(TRACKER_MAX_RETRY_DELAY) * 1000 * 1000
+	for i := 1; i < retries && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	jitter := delay * TRACKER_RETRY_JITTER / 100
+	if jitter > 0 {
+		delay += comm.random.Int63n(2*jitter+1) - jitter
+	}
+
+	return delay
+}
+
 func (comm *Comm) startMessageTracker() {
-	// track messages
 	for {
+		wait := int64(TRACKER_IDLE_WAIT) * 1000 * 1000
+		expired := make([]*MessageTracker, 0)
+
+		comm.trackersMutex.Lock()
 		if comm.running {
-			for hash, msgTrack := range comm.messageTrackers {
-				diff := int((time.Nanoseconds() - msgTrack.lastTime) / 1000000)
-
-				// TODO: Use the right retry delay 
-
-				// check the acknowledgement
-				if msgTrack.message.Timeout != 0 && diff >= msgTrack.message.Timeout {
-					comm.trackersMutex.Lock()
-					msgTrack, found := comm.messageTrackers[hash]
-
-					// make sure the message tracker is still there
-					// we may have received an ack while locking
-					if found {
-						msgTrack.retries++
-						msgTrack.lastTime = time.Nanoseconds() + int64(msgTrack.message.RetryDelay*1000*1000)
-
-						if msgTrack.retries > msgTrack.message.Retries {
-							log.Warning("%d: Comm: Timeout for message %s after %d ms. Not retrying!\n", comm.Cluster.MyNode.Id, msgTrack.message, diff)
-
-							// remove from acknowledgable messages list
-							comm.messageTrackers[hash] = nil, false
-
-							go func() {
-								if msgTrack.message.OnTimeout != nil {
-									msgTrack.message.OnTimeout(true)
-								}
-
-								if msgTrack.message.LastTimeoutAsError {
-									msgTrack.message.OnError(msgTrack.message, ErrorTimeout)
-								}
-
-								msgTrack.message.Release()
-							}()
-
-						} else {
-							go func() {
-								retry := true
-								handled := false
-								if msgTrack.message.OnTimeout != nil {
-									retry, handled = msgTrack.message.OnTimeout(false)
-								}
-
-								if retry && !handled {
-									seekable, _ := msgTrack.message.DataIsSeekable()
-									if msgTrack.message.Data != nil && !seekable {
-										log.Error("%d: Comm: Cannot automatically retry message %s after %d ms because data is not seekable!", comm.Cluster.MyNode.Id, msgTrack.message, diff)
-									} else {
-										log.Warning("%d: Comm: Timeout for message %s after %d ms. Retrying %d of %d\n", comm.Cluster.MyNode.Id, msgTrack.message, diff, msgTrack.retries, msgTrack.message.Retries)
-
-										comm.SendNode(msgTrack.destination, msgTrack.message)
-									}
-								}
-							}()
-						}
-					}
-
-					comm.trackersMutex.Unlock()
-
-					// cleanup for OnError and OnResponse tracked messages
-				} else if diff >= TRACKER_CLEAN_TIME {
-					comm.trackersMutex.Lock()
-					_, found := comm.messageTrackers[hash]
-
-					// make sure the message is still there
-					// we may have received an error or response 
-					// while waiting for the locking
-					if found {
-						comm.messageTrackers[hash] = nil, false
-					}
-
-					comm.trackersMutex.Unlock()
+			now := comm.clock.Now()
+			for comm.trackersHeap.Len() > 0 {
+				next := comm.trackersHeap[0]
+				if next.deadline > now {
+					wait = next.deadline - now
+					break
 				}
+
+				heap.Pop(&comm.trackersHeap)
+				expired = append(expired, next)
 			}
+		} else {
+			wait = TRACKER_LOOP_SLEEP * 1000 * 1000
 		}
 
-		// sleep
-		time.Sleep(TRACKER_LOOP_SLEEP * 1000 * 1000)
+		for _, msgTrack := range expired {
+			comm.expireTracker(msgTrack)
+		}
+		comm.trackersMutex.Unlock()
+
+		select {
+		case <-comm.trackersWake:
+		case <-comm.clock.After(wait):
+		}
 	}
 }
 
+// Handles a tracker that reached its deadline. Called with the trackers mutex
+// locked, callbacks are called in their own goroutine.
+func (comm *Comm) expireTracker(msgTrack *MessageTracker) {
+	message := msgTrack.message
+	now := comm.clock.Now()
+	diff := int((now - msgTrack.sentTime) / 1000000)
+
+	// cleanup for OnError and OnResponse tracked messages
+	if message.Timeout == 0 && !message.Expired() {
+		comm.removeTracker(msgTrack)
+		return
+	}
+
+	// the call chain is out of time, no need to retry
+	if message.Expired() {
+		comm.logger.Warning("Deadline exceeded for message %s after %d ms. Not retrying!", message, diff)
+		comm.removeTracker(msgTrack)
+
+		go func() {
+			if message.OnError != nil {
+				message.OnError(message, ErrorDeadlineExceeded)
+			}
+			message.Release()
+		}()
+
+		return
+	}
+
+	// retry delay has elapsed, send it again. Sending will schedule the timeout.
+	if msgTrack.resending {
+		msgTrack.resending = false
+		comm.scheduleTracker(msgTrack, now+int64(message.Timeout)*1000*1000)
+
+		comm.logger.Warning("Timeout for message %s after %d ms. Retrying %d of %d", message, diff, msgTrack.retries, message.Retries)
+		metricRetries.With(comm.metricNode(), metricService(message.ServiceId)).Inc()
+		go comm.SendNode(msgTrack.destination, message)
+		return
+	}
+
+	metricTimeouts.With(comm.metricNode(), metricService(message.ServiceId)).Inc()
+
+	msgTrack.retries++
+	if msgTrack.retries > message.Retries {
+		comm.logger.Warning("Timeout for message %s after %d ms. Not retrying!", message, diff)
+
+		// remove from acknowledgable messages list
+		comm.removeTracker(msgTrack)
+
+		go func() {
+			if message.OnTimeout != nil {
+				message.OnTimeout(true)
+			}
+
+			if message.LastTimeoutAsError && message.OnError != nil {
+				message.OnError(message, ErrorTimeout)
+			}
+
+			message.Release()
+		}()
+
+		return
+	}
+
+	go func() {
+		retry := true
+		handled := false
+		if message.OnTimeout != nil {
+			retry, handled = message.OnTimeout(false)
+		}
+
+		seekable, _ := message.DataIsSeekable()
+		resend := retry && !handled
+		if resend && message.Data != nil && !seekable {
+			comm.logger.Error("Cannot automatically retry message %s after %d ms because data is not seekable!", message, diff)
+			resend = false
+		}
+
+		comm.trackersMutex.Lock()
+		// we may have received a response while calling the callback
+		if comm.isTracked(msgTrack) {
+			if resend {
+				msgTrack.resending = true
+				comm.scheduleTracker(msgTrack, comm.clock.Now()+comm.retryDelay(message, msgTrack.retries))
+			} else {
+				comm.scheduleTracker(msgTrack, comm.clock.Now()+int64(message.Timeout)*1000*1000)
+			}
+		}
+		comm.trackersMutex.Unlock()
+	}()
+}
+
+// Sends a message again right away if the node reported having received it
+// corrupted and it has retries left. Must be called with the trackers mutex
+// locked.
+func (comm *Comm) retryCorrupted(msgTrack *MessageTracker, response *Message) bool {
+	err := ReadErrorPayload(response)
+	response.SeekZero()
+	if err.String() != ErrorCorrupted.String() {
+		return false
+	}
+
+	message := msgTrack.message
+	seekable, _ := message.DataIsSeekable()
+	if msgTrack.retries >= message.Retries || (message.Data != nil && !seekable) {
+		return false
+	}
+
+	comm.logger.Warning("Message %s received corrupted. Retrying %d of %d", message, msgTrack.retries+1, message.Retries)
+	msgTrack.retries++
+	msgTrack.resending = true
+	comm.scheduleTracker(msgTrack, comm.clock.Now())
+	return true
+}
+
 func (comm *Comm) watchMessage(message *Message, destination *cluster.Node) {
 	comm.trackersMutex.Lock()
 
-	hash := message.Hash()
+	now := comm.clock.Now()
+	hash := message.Key().String()
 	msgTrack, found := comm.messageTrackers[hash]
 	if !found {
-		msgTrack := new(MessageTracker)
+		msgTrack = new(MessageTracker)
 		msgTrack.message = message
-		msgTrack.sentTime = time.Nanoseconds()
-		msgTrack.lastTime = msgTrack.sentTime
-		msgTrack.destination = destination
-		comm.messageTrackers[message.Hash()] = msgTrack
-	} else {
-		msgTrack.lastTime = time.Nanoseconds()
-		msgTrack.destination = destination
+		msgTrack.key = hash
+		msgTrack.sentTime = now
+		msgTrack.index = -1
+		comm.messageTrackers[hash] = msgTrack
+	}
+	msgTrack.destination = destination
+	msgTrack.resending = false
+
+	deadline := now + TRACKER_CLEAN_TIME*1000*1000
+	if message.Timeout > 0 {
+		deadline = now + int64(message.Timeout)*1000*1000
 	}
+	comm.scheduleTracker(msgTrack, deadline)
 
 	comm.trackersMutex.Unlock()
 }
 
+// Postpones the timeout of a tracked message, used when a streamed response
+// is making progress.
+func (comm *Comm) touchTracker(key string) {
+	comm.trackersMutex.Lock()
+	msgTrack, found := comm.messageTrackers[key]
+	if found && msgTrack.message.Timeout > 0 {
+		comm.scheduleTracker(msgTrack, comm.clock.Now()+int64(msgTrack.message.Timeout)*1000*1000)
+	}
+	comm.trackersMutex.Unlock()
+}
+
+// Stops tracking a message that couldn't be sent
+func (comm *Comm) unwatchMessage(message *Message) {
+	comm.trackersMutex.Lock()
+	msgTrack, found := comm.messageTrackers[message.Key().String()]
+	if found {
+		comm.removeTracker(msgTrack)
+	}
+	comm.trackersMutex.Unlock()
+}
+
 // Handles an incoming message. If the message is handled by one
 // of message callbacks (OnError, OnResponse), returns true so
 // that it wont be sent to services
 func (comm *Comm) handleTracker(message *Message) bool {
-	hash := message.InitHash()
-	_, found := comm.messageTrackers[hash]
+	hash := message.InitKey().String()
+
+	comm.trackersMutex.Lock()
+	ackmsg, found := comm.messageTrackers[hash]
+	if found && message.FunctionId == FUNC_ERROR && comm.retryCorrupted(ackmsg, message) {
+		comm.trackersMutex.Unlock()
+		return true
+	}
 	if found {
-		comm.trackersMutex.Lock()
+		comm.removeTracker(ackmsg)
+	}
+	comm.trackersMutex.Unlock()
 
-		// check if the message is still there
-		// we may have been marked as timeout while locking
-		ackmsg, found := comm.messageTrackers[hash]
-		if found {
-			comm.messageTrackers[hash] = nil, false
-			comm.trackersMutex.Unlock()
-
-			if message.FunctionId == FUNC_ERROR && ackmsg.message.OnError != nil {
-				err := ReadErrorPayload(message)
-				message.SeekZero()
-				ackmsg.message.OnError(message, err)
-				return true
-
-			} else if ackmsg.message.OnResponse != nil {
-				ackmsg.message.OnResponse(message)
-				return true
-			}
-		} else {
-			comm.trackersMutex.Unlock()
+	if found {
+		if message.FunctionId == FUNC_ERROR && ackmsg.message.OnError != nil {
+			err := ReadErrorPayload(message)
+			message.SeekZero()
+			ackmsg.message.OnError(message, err)
+			return true
+
+		} else if ackmsg.message.OnResponse != nil {
+			ackmsg.message.OnResponse(message)
+			return true
 		}
 	}
 
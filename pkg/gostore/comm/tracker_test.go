@@ -0,0 +1,87 @@
+package comm
+
+import (
+	"container/heap"
+	"rand"
+	"testing"
+)
+
+func newTrackerTestComm() *Comm {
+	comm := new(Comm)
+	comm.random = rand.New(rand.NewSource(1))
+	comm.messageTrackers = make(map[string]*MessageTracker)
+	comm.trackersHeap = make(trackerHeap, 0)
+	comm.trackersWake = make(chan bool, 1)
+	return comm
+}
+
+func TestRetryDelay(t *testing.T) {
+	comm := newTrackerTestComm()
+	message := &Message{RetryDelay: 100}
+
+	expected := []int64{100, 100, 200, 400, 800}
+	for retries := 0; retries < len(expected); retries++ {
+		base := expected[retries] * 1000 * 1000
+		for i := 0; i < 100; i++ {
+			delay := comm.retryDelay(message, retries)
+			jitter := base * TRACKER_RETRY_JITTER / 100
+			if delay < base-jitter || delay > base+jitter {
+				t.Fatalf("1) Delay of retry %d should be %d ns +/- %d, got %d", retries, base, jitter, delay)
+			}
+		}
+	}
+
+	// the doubling stops at the maximum delay, jitter included
+	max := int64(TRACKER_MAX_RETRY_DELAY) * 1000 * 1000
+	for i := 0; i < 100; i++ {
+		delay := comm.retryDelay(message, 50)
+		if delay < max-max*TRACKER_RETRY_JITTER/100 || delay > max+max*TRACKER_RETRY_JITTER/100 {
+			t.Fatalf("2) Delay should be capped to %d ns, got %d", max, delay)
+		}
+	}
+
+	if delay := comm.retryDelay(&Message{}, 3); delay != 0 {
+		t.Errorf("3) Message without retry delay should be retried right away, got %d", delay)
+	}
+}
+
+func TestTrackersHeap(t *testing.T) {
+	comm := newTrackerTestComm()
+	random := rand.New(rand.NewSource(1))
+
+	trackers := make([]*MessageTracker, 50)
+	for i := range trackers {
+		trackers[i] = &MessageTracker{message: &Message{}, index: -1}
+		comm.scheduleTracker(trackers[i], random.Int63n(1000))
+	}
+
+	// postpone some and advance others
+	for i := 0; i < len(trackers); i += 3 {
+		comm.scheduleTracker(trackers[i], random.Int63n(1000))
+	}
+
+	// the deadline of the call chain caps the deadline
+	trackers[1].message.Deadline = 5
+	comm.scheduleTracker(trackers[1], 2000)
+	if trackers[1].deadline != 5 {
+		t.Errorf("1) Deadline should have been capped by the deadline of the chain, got %d", trackers[1].deadline)
+	}
+
+	for i, tracker := range comm.trackersHeap {
+		if tracker.index != i {
+			t.Errorf("2) Tracker at %d has index %d", i, tracker.index)
+		}
+	}
+
+	last := int64(-1)
+	for comm.trackersHeap.Len() > 0 {
+		tracker := heap.Pop(&comm.trackersHeap).(*MessageTracker)
+		if tracker.deadline < last {
+			t.Errorf("3) Trackers should be popped in deadline order: %d after %d", tracker.deadline, last)
+		}
+		if tracker.index != -1 {
+			t.Errorf("4) Popped tracker should be out of the heap, has index %d", tracker.index)
+		}
+		last = tracker.deadline
+	}
+}
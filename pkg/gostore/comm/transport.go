@@ -0,0 +1,88 @@
+package comm
+
+import (
+	"net"
+	"os"
+	"gostore/cluster"
+)
+
+// Transport used by the communication layer to exchange messages between
+// nodes. Messages that need a reliable ordered stream (data messages, big
+// messages) are sent over stream connections and the others are sent in
+// packets.
+type Transport interface {
+	ListenStream(node *cluster.Node) (net.Listener, os.Error)
+	ListenPacket(node *cluster.Node) (net.PacketConn, os.Error)
+
+	DialStream(node *cluster.Node) (net.Conn, os.Error)
+	DialPacket(node *cluster.Node) (net.Conn, os.Error)
+}
+
+// Transport that needs to know which node opens a connection, like a
+// simulation ordering the deliveries by sender (see SimTransport)
+type senderTransport interface {
+	DialStreamFrom(from *cluster.Node, node *cluster.Node) (net.Conn, os.Error)
+	DialPacketFrom(from *cluster.Node, node *cluster.Node) (net.Conn, os.Error)
+}
+
+// Dials a stream from a node to another, telling the transport which node
+// dials if it wants to know
+func dialStream(transport Transport, from *cluster.Node, node *cluster.Node) (net.Conn, os.Error) {
+	if st, ok := transport.(senderTransport); ok {
+		return st.DialStreamFrom(from, node)
+	}
+	return transport.DialStream(node)
+}
+
+// Dials packets from a node to another, telling the transport which node
+// dials if it wants to know
+func dialPacket(transport Transport, from *cluster.Node, node *cluster.Node) (net.Conn, os.Error) {
+	if st, ok := transport.(senderTransport); ok {
+		return st.DialPacketFrom(from, node)
+	}
+	return transport.DialPacket(node)
+}
+
+// Transport over TCP (streams) and UDP (packets), using the ports of the
+// nodes configuration
+type netTransport struct{}
+
+func NewNetTransport() Transport {
+	return netTransport{}
+}
+
+func (netTransport) ListenStream(node *cluster.Node) (net.Listener, os.Error) {
+	adr := net.TCPAddr{node.Address, int(node.TcpPort)}
+	listener, err := net.ListenTCP("tcp", &adr)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (netTransport) ListenPacket(node *cluster.Node) (net.PacketConn, os.Error) {
+	adr := net.UDPAddr{node.Address, int(node.UdpPort)}
+	con, err := net.ListenUDP("udp", &adr)
+	if err != nil {
+		return nil, err
+	}
+	return con, nil
+}
+
+func (netTransport) DialStream(node *cluster.Node) (net.Conn, os.Error) {
+	adr := net.TCPAddr{node.Address, int(node.TcpPort)}
+	con, err := net.DialTCP("tcp", nil, &adr) // TODO: should use local address instead of nil (implicitly local)
+	if err != nil {
+		return nil, err
+	}
+	return con, nil
+}
+
+func (netTransport) DialPacket(node *cluster.Node) (net.Conn, os.Error) {
+	adr := net.UDPAddr{node.Address, int(node.UdpPort)}
+	con, err := net.DialUDP("udp", nil, &adr) // TODO: should use local address instead of nil (implicitly local)
+	if err != nil {
+		return nil, err
+	}
+	return con, nil
+}
@@ -0,0 +1,347 @@
+package comm
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"gostore/cluster"
+)
+
+const (
+	MEMORY_STREAM_BUFFER = 1024 // Number of writes buffered by an in-memory stream
+	MEMORY_PACKET_BUFFER = 1024 // Number of packets buffered by an in-memory packet listener, more are dropped
+	MEMORY_ACCEPT_BUFFER = 64   // Number of in-memory streams waiting to be accepted
+)
+
+var (
+	ErrorTransportClosed      = os.NewError("Transport connection closed")
+	ErrorTransportUnreachable = os.NewError("Transport address unreachable")
+	ErrorTransportInUse       = os.NewError("Transport address already in use")
+)
+
+// In-process transport, where connections are channels between nodes running
+// in the same process. All the nodes of a cluster need to use the same
+// transport. Nodes are addressed by their address and ports, like on the
+// network, but no port is opened.
+//
+// Packets behave like UDP packets: they are dropped if the receiving node
+// isn't listening or doesn't read them fast enough.
+type MemoryTransport struct {
+	mutex *sync.Mutex
+
+	listeners map[string]*memoryListener
+	packets   map[string]*memoryPacketConn
+	seqid     int
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	mt := new(MemoryTransport)
+	mt.mutex = new(sync.Mutex)
+	mt.listeners = make(map[string]*memoryListener)
+	mt.packets = make(map[string]*memoryPacketConn)
+	return mt
+}
+
+// Address of a connection of the in-memory transport
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+
+func (a memoryAddr) String() string { return string(a) }
+
+func streamAddr(node *cluster.Node) memoryAddr {
+	return memoryAddr(fmt.Sprintf("%s:%d", node.Address, node.TcpPort))
+}
+
+func packetAddr(node *cluster.Node) memoryAddr {
+	return memoryAddr(fmt.Sprintf("%s:%d", node.Address, node.UdpPort))
+}
+
+// Returns a new address for the dialing end of a connection
+func (mt *MemoryTransport) nextAddr() memoryAddr {
+	mt.mutex.Lock()
+	mt.seqid++
+	id := mt.seqid
+	mt.mutex.Unlock()
+
+	return memoryAddr(fmt.Sprintf("memory:%d", id))
+}
+
+func (mt *MemoryTransport) ListenStream(node *cluster.Node) (net.Listener, os.Error) {
+	addr := streamAddr(node)
+
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	if _, found := mt.listeners[addr.String()]; found {
+		return nil, ErrorTransportInUse
+	}
+
+	listener := &memoryListener{mt, addr, make(chan net.Conn, MEMORY_ACCEPT_BUFFER), newMemoryClose()}
+	mt.listeners[addr.String()] = listener
+	return listener, nil
+}
+
+func (mt *MemoryTransport) ListenPacket(node *cluster.Node) (net.PacketConn, os.Error) {
+	addr := packetAddr(node)
+
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	if _, found := mt.packets[addr.String()]; found {
+		return nil, ErrorTransportInUse
+	}
+
+	con := &memoryPacketConn{mt, addr, make(chan memoryPacket, MEMORY_PACKET_BUFFER), newMemoryClose()}
+	mt.packets[addr.String()] = con
+	return con, nil
+}
+
+func (mt *MemoryTransport) DialStream(node *cluster.Node) (net.Conn, os.Error) {
+	addr := streamAddr(node)
+
+	mt.mutex.Lock()
+	listener, found := mt.listeners[addr.String()]
+	mt.mutex.Unlock()
+
+	if !found {
+		return nil, ErrorTransportUnreachable
+	}
+
+	local := mt.nextAddr()
+	toServer := newMemoryPipe()
+	toClient := newMemoryPipe()
+	client := &memoryConn{local, addr, toClient, toServer}
+	server := &memoryConn{addr, local, toServer, toClient}
+
+	select {
+	case listener.accepts <- server:
+	case <-listener.closing.closed:
+		return nil, ErrorTransportUnreachable
+	}
+
+	return client, nil
+}
+
+func (mt *MemoryTransport) DialPacket(node *cluster.Node) (net.Conn, os.Error) {
+	return &memoryPacketDial{mt, mt.nextAddr(), packetAddr(node)}, nil
+}
+
+// Delivers a packet to the connection listening on an address. The packet
+// is dropped if there is none or if its buffer is full.
+func (mt *MemoryTransport) deliver(to net.Addr, from net.Addr, b []byte) {
+	mt.mutex.Lock()
+	con, found := mt.packets[to.String()]
+	mt.mutex.Unlock()
+
+	if !found {
+		return
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	select {
+	case con.packets <- memoryPacket{data, from}:
+	default:
+	}
+}
+
+// Closing flag, closed once
+type memoryClose struct {
+	mutex  *sync.Mutex
+	closed chan bool
+	done   bool
+}
+
+func newMemoryClose() *memoryClose {
+	return &memoryClose{new(sync.Mutex), make(chan bool), false}
+}
+
+func (mc *memoryClose) close() {
+	mc.mutex.Lock()
+	if !mc.done {
+		mc.done = true
+		close(mc.closed)
+	}
+	mc.mutex.Unlock()
+}
+
+// Listener of in-memory streams
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	accepts   chan net.Conn
+	closing   *memoryClose
+}
+
+func (ml *memoryListener) Accept() (net.Conn, os.Error) {
+	select {
+	case con := <-ml.accepts:
+		return con, nil
+	case <-ml.closing.closed:
+	}
+	return nil, ErrorTransportClosed
+}
+
+func (ml *memoryListener) Close() os.Error {
+	ml.transport.mutex.Lock()
+	if ml.transport.listeners[ml.addr.String()] == ml {
+		ml.transport.listeners[ml.addr.String()] = nil, false
+	}
+	ml.transport.mutex.Unlock()
+
+	ml.closing.close()
+	return nil
+}
+
+func (ml *memoryListener) Addr() net.Addr { return ml.addr }
+
+// One direction of an in-memory stream. Writes are buffered, so that writing
+// doesn't wait for the other end to read like on a network connection.
+type memoryPipe struct {
+	data    chan []byte
+	closing *memoryClose
+	pending []byte // rest of the last received write, used by the reading end only
+}
+
+func newMemoryPipe() *memoryPipe {
+	return &memoryPipe{data: make(chan []byte, MEMORY_STREAM_BUFFER), closing: newMemoryClose()}
+}
+
+func (mp *memoryPipe) read(b []byte) (int, os.Error) {
+	if len(mp.pending) == 0 {
+		select {
+		case mp.pending = <-mp.data:
+		case <-mp.closing.closed:
+			// what has been written before closing can still be read
+			select {
+			case mp.pending = <-mp.data:
+			default:
+				return 0, os.EOF
+			}
+		}
+	}
+
+	n := copy(b, mp.pending)
+	mp.pending = mp.pending[n:]
+	return n, nil
+}
+
+func (mp *memoryPipe) write(b []byte) (int, os.Error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	select {
+	case <-mp.closing.closed:
+		return 0, ErrorTransportClosed
+	default:
+	}
+
+	select {
+	case mp.data <- data:
+		return len(b), nil
+	case <-mp.closing.closed:
+	}
+	return 0, ErrorTransportClosed
+}
+
+// End of an in-memory stream
+type memoryConn struct {
+	local  memoryAddr
+	remote memoryAddr
+	in     *memoryPipe
+	out    *memoryPipe
+}
+
+func (mc *memoryConn) Read(b []byte) (int, os.Error) { return mc.in.read(b) }
+
+func (mc *memoryConn) Write(b []byte) (int, os.Error) { return mc.out.write(b) }
+
+func (mc *memoryConn) Close() os.Error {
+	mc.in.closing.close()
+	mc.out.closing.close()
+	return nil
+}
+
+func (mc *memoryConn) LocalAddr() net.Addr  { return mc.local }
+func (mc *memoryConn) RemoteAddr() net.Addr { return mc.remote }
+
+// Timeouts aren't used by the communication layer
+func (mc *memoryConn) SetTimeout(nsec int64) os.Error      { return nil }
+func (mc *memoryConn) SetReadTimeout(nsec int64) os.Error  { return nil }
+func (mc *memoryConn) SetWriteTimeout(nsec int64) os.Error { return nil }
+
+type memoryPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// Listener of in-memory packets
+type memoryPacketConn struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	packets   chan memoryPacket
+	closing   *memoryClose
+}
+
+func (mp *memoryPacketConn) ReadFrom(b []byte) (int, net.Addr, os.Error) {
+	select {
+	case packet := <-mp.packets:
+		// like UDP, what doesn't fit in the buffer is lost
+		n := copy(b, packet.data)
+		return n, packet.from, nil
+	case <-mp.closing.closed:
+	}
+	return 0, nil, ErrorTransportClosed
+}
+
+func (mp *memoryPacketConn) WriteTo(b []byte, addr net.Addr) (int, os.Error) {
+	mp.transport.deliver(addr, mp.addr, b)
+	return len(b), nil
+}
+
+func (mp *memoryPacketConn) Close() os.Error {
+	mp.transport.mutex.Lock()
+	if mp.transport.packets[mp.addr.String()] == mp {
+		mp.transport.packets[mp.addr.String()] = nil, false
+	}
+	mp.transport.mutex.Unlock()
+
+	mp.closing.close()
+	return nil
+}
+
+func (mp *memoryPacketConn) LocalAddr() net.Addr { return mp.addr }
+
+func (mp *memoryPacketConn) SetTimeout(nsec int64) os.Error      { return nil }
+func (mp *memoryPacketConn) SetReadTimeout(nsec int64) os.Error  { return nil }
+func (mp *memoryPacketConn) SetWriteTimeout(nsec int64) os.Error { return nil }
+
+// Sending end of in-memory packets, like a dialed UDP socket
+type memoryPacketDial struct {
+	transport *MemoryTransport
+	local     memoryAddr
+	remote    memoryAddr
+}
+
+func (md *memoryPacketDial) Read(b []byte) (int, os.Error) { return 0, ErrorTransportClosed }
+
+func (md *memoryPacketDial) Write(b []byte) (int, os.Error) {
+	md.transport.deliver(md.remote, md.local, b)
+	return len(b), nil
+}
+
+func (md *memoryPacketDial) Close() os.Error { return nil }
+
+func (md *memoryPacketDial) LocalAddr() net.Addr  { return md.local }
+func (md *memoryPacketDial) RemoteAddr() net.Addr { return md.remote }
+
+func (md *memoryPacketDial) SetTimeout(nsec int64) os.Error      { return nil }
+func (md *memoryPacketDial) SetReadTimeout(nsec int64) os.Error  { return nil }
+func (md *memoryPacketDial) SetWriteTimeout(nsec int64) os.Error { return nil }
@@ -0,0 +1,541 @@
+package comm
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"rand"
+	"sync"
+	"time"
+	"gostore/cluster"
+)
+
+const (
+	SIM_EPOCH       = 1293840000 * 1000 * 1000 * 1000 // Virtual time at the start of a simulation (2011-01-01)
+	SIM_LATENCY_MIN = 1                               // 1 ms, default minimum latency of the virtual network
+	SIM_LATENCY_MAX = 20                              // 20 ms, default maximum latency of the virtual network
+	SIM_STEP_WAIT   = 2                               // 2 ms, default real time without activity after which the nodes are idle
+	SIM_IDLE_WAIT   = 1000                            // 1 second, maximum real time waited for the nodes to be idle
+)
+
+// Kinds of events of a simulation
+const (
+	sim_packet = iota
+	sim_stream
+	sim_timer
+)
+
+// Simulated network and clock, to run the nodes of a cluster in the same
+// process in a reproducible way. Nodes communicate in memory, but nothing is
+// delivered until the simulation decides it: each packet and each write on a
+// stream is given a delivery time on a virtual clock, by a latency drawn from
+// a seeded generator, and the simulation processes deliveries and timers of
+// the communication layer in the order of their virtual time. Streams keep
+// the order of their writes, packets can arrive in any order.
+//
+// Running a simulation with the same seed delivers the messages in the same
+// order at the same virtual times, which the trace of the simulation allows
+// to verify. A node reacting to a delivery may write from several goroutines
+// at once, so the order of their writes can't be relied on: each link
+// between two nodes has its own generator and numbers its writes, and
+// deliveries at the same virtual time are ordered by sending node, receiving
+// node and number on the link. Ends of connections are named after the
+// nodes that open them (see DialStreamFrom), not after the order in which
+// they are opened.
+//
+// The nodes still run in goroutines and read the files of their services in
+// real time, so the simulation only processes an event once the nodes are
+// idle: they haven't read from the transport, written to it nor used the
+// clock for a bit of real time (see SetStepWait), meaning that they are all
+// waiting for a delivery or a timer. As long as the nodes don't stay busy
+// without using the transport or the clock for that long, a run is
+// reproduced exactly.
+type SimTransport struct {
+	transport *MemoryTransport
+	mutex     *sync.Mutex
+	seed      int64
+
+	latencyMin int // ms
+	latencyMax int // ms
+	stepWait   int // ms
+
+	now    int64
+	seq    uint64 // number of the next timer
+	events simEventHeap
+	trace  []SimEvent
+	steps  int
+
+	links   map[string]*simLink // by sending and receiving ends and kind
+	dialers map[string]string   // name of the node that dialed a stream, by address of its dialing end
+
+	activity uint64 // uses of the transport and the clock by the nodes
+
+	stop chan bool
+}
+
+// Delivery processed by a simulation, recorded to compare runs
+type SimEvent struct {
+	Step int
+	Time int64  // virtual time in ns since the start of the simulation
+	Kind string // packet or stream
+	From string // sending node, as node:<id>
+	To   string // receiving node
+	Size int
+}
+
+// Packets or stream writes from a node to another, with their own generator
+// of latencies
+type simLink struct {
+	random *rand.Rand
+	seq    uint64 // number of the next write
+}
+
+// Delivery or timer waiting for its time
+type simEvent struct {
+	time    int64
+	from    string // empty for timers
+	to      string
+	seq     uint64 // number on the link, or of the timer
+	kind    int
+	size    int
+	process func()
+	index   int
+}
+
+// Min-heap of events ordered by time, then by link and number on the link.
+// Timers come before the deliveries of the same time.
+type simEventHeap []*simEvent
+
+func (h simEventHeap) Len() int { return len(h) }
+
+func (h simEventHeap) Less(i, j int) bool {
+	a, b := h[i], h[j]
+	switch {
+	case a.time != b.time:
+		return a.time < b.time
+	case a.from != b.from:
+		return a.from < b.from
+	case a.to != b.to:
+		return a.to < b.to
+	case a.kind != b.kind:
+		return a.kind < b.kind
+	}
+	return a.seq < b.seq
+}
+
+func (h simEventHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *simEventHeap) Push(x interface{}) {
+	event := x.(*simEvent)
+	event.index = len(*h)
+	*h = append(*h, event)
+}
+
+func (h *simEventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	event := old[n-1]
+	event.index = -1
+	*h = old[0 : n-1]
+	return event
+}
+
+func NewSimTransport(seed int64) *SimTransport {
+	st := new(SimTransport)
+	st.transport = NewMemoryTransport()
+	st.mutex = new(sync.Mutex)
+	st.seed = seed
+	st.latencyMin = SIM_LATENCY_MIN
+	st.latencyMax = SIM_LATENCY_MAX
+	st.stepWait = SIM_STEP_WAIT
+	st.now = SIM_EPOCH
+	st.events = make(simEventHeap, 0)
+	st.trace = make([]SimEvent, 0)
+	st.links = make(map[string]*simLink)
+	st.dialers = make(map[string]string)
+	return st
+}
+
+// Returns the seed of the simulation, to replay it
+func (st *SimTransport) Seed() int64 {
+	return st.seed
+}
+
+// Sets the latency of the virtual network in ms
+func (st *SimTransport) SetLatency(min int, max int) {
+	if max < min {
+		max = min
+	}
+
+	st.mutex.Lock()
+	st.latencyMin, st.latencyMax = min, max
+	st.mutex.Unlock()
+}
+
+// Sets the real time in ms without activity after which the nodes are
+// considered idle. Nodes doing slow work between their uses of the transport
+// need more to be reproduced exactly.
+func (st *SimTransport) SetStepWait(wait int) {
+	if wait < 1 {
+		wait = 1
+	}
+
+	st.mutex.Lock()
+	st.stepWait = wait
+	st.mutex.Unlock()
+}
+
+// Returns the virtual time in ns
+func (st *SimTransport) Now() int64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.activity++
+	return st.now
+}
+
+// Returns a channel receiving the virtual time once ns have elapsed on the
+// virtual clock
+func (st *SimTransport) After(ns int64) <-chan int64 {
+	c := make(chan int64, 1)
+
+	st.mutex.Lock()
+	event := &simEvent{time: st.now + ns, seq: st.seq, kind: sim_timer}
+	event.process = func() { c <- event.time }
+	st.seq++
+	st.push(event)
+	st.mutex.Unlock()
+
+	return c
+}
+
+// Returns the deliveries processed so far. Two runs with the same seed have
+// the same trace.
+func (st *SimTransport) Trace() []SimEvent {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	trace := make([]SimEvent, len(st.trace))
+	copy(trace, st.trace)
+	return trace
+}
+
+// Adds an event. Must be called with the mutex locked.
+func (st *SimTransport) push(event *simEvent) {
+	st.activity++
+	heap.Push(&st.events, event)
+}
+
+// Adds the delivery of a write from an end of a connection to another, at a
+// time drawn by the generator of their link but not before min. Returns the
+// delivery time. Must be called with the mutex locked.
+func (st *SimTransport) pushDelivery(event *simEvent, min int64) int64 {
+	key := fmt.Sprintf("%s>%s/%d", event.from, event.to, event.kind)
+	link, found := st.links[key]
+	if !found {
+		// the generator of a link only depends on the seed and its ends
+		link = &simLink{random: rand.New(rand.NewSource(st.seed ^ int64(crc32.ChecksumIEEE([]byte(key)))))}
+		st.links[key] = link
+	}
+
+	latency := st.latencyMin
+	if st.latencyMax > st.latencyMin {
+		latency += link.random.Intn(st.latencyMax - st.latencyMin + 1)
+	}
+
+	event.time = st.now + int64(latency)*1000*1000
+	if event.time < min {
+		event.time = min
+	}
+	event.seq = link.seq
+	link.seq++
+
+	st.push(event)
+	return event.time
+}
+
+// Returns the name of a node in the simulation, or the address of the end of
+// a connection if the node isn't known
+func simName(node *cluster.Node, addr net.Addr) string {
+	if node == nil {
+		return addr.String()
+	}
+	return fmt.Sprintf("node:%d", node.Id)
+}
+
+// Counts a read by a node
+func (st *SimTransport) read() {
+	st.mutex.Lock()
+	st.activity++
+	st.mutex.Unlock()
+}
+
+// Waits until the nodes are idle, which they are when they didn't use the
+// transport nor the clock during the step wait. Gives up after SIM_IDLE_WAIT
+// if a node stays busy.
+func (st *SimTransport) waitIdle() {
+	st.mutex.Lock()
+	wait := st.stepWait
+	st.mutex.Unlock()
+
+	for waited := 0; waited < SIM_IDLE_WAIT; waited += wait {
+		st.mutex.Lock()
+		before := st.activity
+		st.mutex.Unlock()
+
+		time.Sleep(int64(wait) * 1000 * 1000)
+
+		st.mutex.Lock()
+		idle := st.activity == before
+		st.mutex.Unlock()
+
+		if idle {
+			return
+		}
+	}
+}
+
+// Processes the next event once the nodes are idle, advancing the virtual
+// clock to its time. Returns false if there is no event.
+func (st *SimTransport) Step() bool {
+	return st.step(-1)
+}
+
+// Processes the next event if its time isn't after end (-1 for any time).
+// Returns false if there is no such event.
+func (st *SimTransport) step(end int64) bool {
+	// the nodes may still be reacting to the previous event
+	st.waitIdle()
+
+	st.mutex.Lock()
+	if st.events.Len() == 0 || (end >= 0 && st.events[0].time > end) {
+		st.mutex.Unlock()
+		return false
+	}
+
+	event := heap.Pop(&st.events).(*simEvent)
+	st.now = event.time
+	st.steps++
+	if event.kind != sim_timer {
+		kind := "packet"
+		if event.kind == sim_stream {
+			kind = "stream"
+		}
+		st.trace = append(st.trace, SimEvent{st.steps, st.now - SIM_EPOCH, kind, event.from, event.to, event.size})
+	}
+	st.mutex.Unlock()
+
+	event.process()
+	return true
+}
+
+// Runs the simulation until the virtual clock has advanced by ns
+func (st *SimTransport) RunFor(ns int64) {
+	st.mutex.Lock()
+	end := st.now + ns
+	st.mutex.Unlock()
+
+	for st.step(end) {
+	}
+
+	st.mutex.Lock()
+	st.now = end
+	st.mutex.Unlock()
+}
+
+// Runs the simulation in the background until Stop is called, so that calls
+// to the nodes can be made as usual
+func (st *SimTransport) Start() {
+	st.mutex.Lock()
+	if st.stop != nil {
+		st.mutex.Unlock()
+		return
+	}
+	stop := make(chan bool)
+	st.stop = stop
+	st.mutex.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			st.Step()
+		}
+	}()
+}
+
+func (st *SimTransport) Stop() {
+	st.mutex.Lock()
+	if st.stop != nil {
+		close(st.stop)
+		st.stop = nil
+	}
+	st.mutex.Unlock()
+}
+
+func (st *SimTransport) ListenStream(node *cluster.Node) (net.Listener, os.Error) {
+	listener, err := st.transport.ListenStream(node)
+	if err != nil {
+		return nil, err
+	}
+	return &simListener{listener, st, node}, nil
+}
+
+// Packets are delayed by the sending end
+func (st *SimTransport) ListenPacket(node *cluster.Node) (net.PacketConn, os.Error) {
+	con, err := st.transport.ListenPacket(node)
+	if err != nil {
+		return nil, err
+	}
+	return &simPacketListener{con, st}, nil
+}
+
+func (st *SimTransport) DialStream(node *cluster.Node) (net.Conn, os.Error) {
+	return st.DialStreamFrom(nil, node)
+}
+
+func (st *SimTransport) DialPacket(node *cluster.Node) (net.Conn, os.Error) {
+	return st.DialPacketFrom(nil, node)
+}
+
+// Dials a stream from a node, whose writes are named after it. The node is
+// nil if it isn't known.
+func (st *SimTransport) DialStreamFrom(from *cluster.Node, node *cluster.Node) (net.Conn, os.Error) {
+	con, err := st.transport.DialStream(node)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &simStreamConn{Conn: con, transport: st}
+	sc.from = simName(from, con.LocalAddr())
+	sc.to = simName(node, nil)
+
+	// the other end writes to the dialing node
+	st.mutex.Lock()
+	st.dialers[con.LocalAddr().String()] = sc.from
+	st.mutex.Unlock()
+
+	return sc, nil
+}
+
+// Dials packets from a node, named after it. The node is nil if it isn't
+// known.
+func (st *SimTransport) DialPacketFrom(from *cluster.Node, node *cluster.Node) (net.Conn, os.Error) {
+	con, err := st.transport.DialPacket(node)
+	if err != nil {
+		return nil, err
+	}
+	return &simPacketConn{con, st, simName(from, con.LocalAddr()), simName(node, nil)}, nil
+}
+
+// Listener of streams whose writes are delivered by the simulation, since
+// nodes also respond through the streams opened by other nodes
+type simListener struct {
+	net.Listener
+	transport *SimTransport
+	node      *cluster.Node
+}
+
+func (sl *simListener) Accept() (net.Conn, os.Error) {
+	con, err := sl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the dialing node is only known once it has been registered, which it
+	// is before it writes anything this end could respond to
+	return &simStreamConn{Conn: con, transport: sl.transport, from: simName(sl.node, nil)}, nil
+}
+
+// Receiving end of packets, whose reads are activity of the nodes
+type simPacketListener struct {
+	net.PacketConn
+	transport *SimTransport
+}
+
+func (pl *simPacketListener) ReadFrom(b []byte) (int, net.Addr, os.Error) {
+	n, addr, err := pl.PacketConn.ReadFrom(b)
+	pl.transport.read()
+	return n, addr, err
+}
+
+// Stream whose writes are delivered by the simulation, in the order they were
+// written. Errors of the delivery are returned by the next write.
+type simStreamConn struct {
+	net.Conn
+	transport *SimTransport
+	from      string
+	to        string // empty until known for accepted streams
+	last      int64  // delivery time of the last write
+	err       os.Error
+}
+
+func (sc *simStreamConn) Read(b []byte) (int, os.Error) {
+	n, err := sc.Conn.Read(b)
+	sc.transport.read()
+	return n, err
+}
+
+func (sc *simStreamConn) Write(b []byte) (int, os.Error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	st := sc.transport
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if sc.err != nil {
+		return 0, sc.err
+	}
+
+	if sc.to == "" {
+		sc.to = st.dialers[sc.RemoteAddr().String()]
+		if sc.to == "" {
+			sc.to = sc.RemoteAddr().String()
+		}
+	}
+
+	event := &simEvent{kind: sim_stream, from: sc.from, to: sc.to, size: len(data)}
+	event.process = func() {
+		_, err := sc.Conn.Write(data)
+		if err != nil {
+			st.mutex.Lock()
+			sc.err = err
+			st.mutex.Unlock()
+		}
+	}
+	sc.last = st.pushDelivery(event, sc.last)
+
+	return len(b), nil
+}
+
+// Sending end of packets delivered by the simulation
+type simPacketConn struct {
+	net.Conn
+	transport *SimTransport
+	from      string
+	to        string
+}
+
+func (pc *simPacketConn) Write(b []byte) (int, os.Error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	st := pc.transport
+	st.mutex.Lock()
+	event := &simEvent{kind: sim_packet, from: pc.from, to: pc.to, size: len(data)}
+	event.process = func() { pc.Conn.Write(data) }
+	st.pushDelivery(event, 0)
+	st.mutex.Unlock()
+
+	return len(b), nil
+}
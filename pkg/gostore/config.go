@@ -16,11 +16,36 @@ type Config struct {
 
 	Nodes       []ConfigNode
 	CurrentNode uint16
+
+	Security ConfigSecurity
+
+	FailureDetector ConfigFailureDetector
+
+	FaultInjection bool  // if true, nodes accept fault injection scripts (for tests, never in production)
+	FaultSeed      int64 // seed of the randomness of the faults, to replay them. Random if 0.
+}
+
+type ConfigSecurity struct {
+	TLS          bool   // encrypt and authenticate TCP connections between nodes
+	SharedSecret string // if set, authenticate UDP packets with an HMAC using this secret
+
+	// if true, nodes start with TLS but without shared secret, leaving UDP
+	// packets unauthenticated, instead of refusing to
+	AllowUnauthenticatedUDP bool
+}
+
+type ConfigFailureDetector struct {
+	Enabled           bool    // if true, nodes exchange heartbeats and nodes that stop sending them go offline
+	HeartbeatInterval int     // ms between heartbeats sent to each node (comm.HEARTBEAT_INTERVAL if 0)
+	PhiDisconnecting  float64 // suspicion above which a node is disconnecting (comm.PHI_DISCONNECTING if 0)
+	PhiOffline        float64 // suspicion above which a node is offline (comm.PHI_OFFLINE if 0)
 }
 
 type ConfigRing struct {
 	Id                uint8
 	ReplicationFactor uint8
+	VirtualNodes      uint16 // tokens of a node of weight 1 in the global ring (cluster.DEFAULT_VIRTUAL_NODES if 0)
+	Placement         string // walk (default), rendezvous or topology (replicas in distinct zones and racks)
 }
 
 type ConfigNodeRing struct {
@@ -35,6 +60,14 @@ type ConfigNode struct {
 	TCPPort uint16
 	UDPPort uint16
 
+	CertFile string // PEM certificate of the node, needed by all nodes when TLS is enabled
+	KeyFile  string // PEM private key of the node, only needed by the node itself
+
+	Weight uint16 // share of the global ring relative to other nodes (1 if 0)
+
+	Zone string // failure domains of the node, used by the topology placement
+	Rack string
+
 	Rings []ConfigNodeRing
 }
 
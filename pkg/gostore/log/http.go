@@ -0,0 +1,46 @@
+package log
+
+import (
+	"fmt"
+	"http"
+	"json"
+)
+
+// Admin endpoint of the log levels. GET returns the levels of the
+// subsystems in JSON, the default level under "". POST changes the level of
+// a subsystem (?subsystem=comm&level=debug), or the default one if no
+// subsystem is given. A subsystem whose level is "default" uses the default
+// level again.
+func LevelsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" || req.Method == "PUT" {
+		subsystem := req.FormValue("subsystem")
+		name := req.FormValue("level")
+
+		if name == "default" && subsystem != "" {
+			ResetLevel(subsystem)
+		} else {
+			level, err := ParseLevel(name)
+			if err != nil {
+				http.Error(resp, err.String(), http.StatusBadRequest)
+				return
+			}
+			SetLevel(subsystem, level)
+		}
+
+		Info("Log level of subsystem '%s' set to %s\n", subsystem, name)
+	}
+
+	names := make(map[string]string)
+	for subsystem, level := range Levels() {
+		names[subsystem] = LevelName(level)
+	}
+
+	bytes, err := json.Marshal(names)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Couldn't encode levels: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(bytes)
+}
@@ -1,9 +1,15 @@
+// Leveled logging with structured fields. Each package logs in its own
+// subsystem (the name of its directory, like comm or fs), whose level can be
+// changed at runtime independently of the others (see SetLevel). Entries are
+// written to sinks (the console by default), as text or JSON.
 package log
 
 import (
-	golog "log"
-	"os"
 	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,62 +22,242 @@ const (
 )
 
 var (
-	fatal   = golog.New(os.Stderr, "", golog.Ldate|golog.Lmicroseconds) // |L_Date|L_Time
-	error   = golog.New(os.Stderr, "", golog.Ldate|golog.Lmicroseconds)
-	warning = golog.New(os.Stderr, "", golog.Ldate|golog.Lmicroseconds)
-	info    = golog.New(os.Stdout, "", golog.Ldate|golog.Lmicroseconds)
-	debug   = golog.New(os.Stdout, "", golog.Ldate|golog.Lmicroseconds)
-
 	Differential = true
 	StartTime    int64 = -1
 
+	// Default level of subsystems without their own level
 	MaxLevel = 2
+
+	config   = new(sync.RWMutex) // protects levels, sinks and subsystems
+	levels   = make(map[string]int)
+	maxLevel = -1 // highest level of the subsystems having their own
+	sinks    = []Sink{NewConsoleSink(FormatText)}
+
+	subsystems = make(map[uintptr]string) // subsystem of the code at a pc
+	startOnce  = new(sync.Once)
+
+	levelNames = []string{"fatal", "error", "warning", "info", "debug"}
 )
 
-func Log(level int, message string, v ...interface{}) {
-	if level > MaxLevel {
-		return
+// Returns the name of a level
+func LevelName(level int) string {
+	if level >= 0 && level < len(levelNames) {
+		return levelNames[level]
 	}
+	return fmt.Sprintf("level%d", level)
+}
 
-	var curtime int64
-	if Differential {
-		if StartTime == -1 {
-			StartTime = time.Nanoseconds()
+// Returns the level of a name or number
+func ParseLevel(name string) (int, os.Error) {
+	for level, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return level, nil
 		}
-		curtime = time.Nanoseconds() - StartTime
+	}
+
+	var level int
+	if _, err := fmt.Sscanf(name, "%d", &level); err == nil && level >= 0 {
+		return level, nil
+	}
+	return 0, os.NewError(fmt.Sprintf("Unknown log level %s", name))
+}
+
+// Sets the level of a subsystem, or the default level (MaxLevel) if the
+// subsystem is empty
+func SetLevel(subsystem string, level int) {
+	config.Lock()
+	defer config.Unlock()
+
+	if subsystem == "" {
+		MaxLevel = level
 	} else {
-		curtime = time.Nanoseconds()
-	}
-
-	// Miliseconds
-	message = fmt.Sprintf("%dms - %s", curtime/1000000, message)
-
-	switch level {
-	case L_Fatal:
-		s := fmt.Sprintf(message, v...)
-		fatal.Output(2, s)
-		panic(s)
-	case L_Error:
-		error.Output(2, fmt.Sprintf(message, v...))
-	case L_Warning:
-		warning.Output(2, fmt.Sprintf(message, v...))
-	case L_Info:
-		info.Output(2, fmt.Sprintf(message, v...))
-	case L_Debug:
-		debug.Output(2, fmt.Sprintf(message, v...))
+		levels[subsystem] = level
+		updateMaxLevel()
+	}
+}
+
+// Must be called with the config locked
+func updateMaxLevel() {
+	maxLevel = -1
+	for _, level := range levels {
+		if level > maxLevel {
+			maxLevel = level
+		}
+	}
+}
+
+// Makes a subsystem use the default level again
+func ResetLevel(subsystem string) {
+	config.Lock()
+	levels[subsystem] = 0, false
+	updateMaxLevel()
+	config.Unlock()
+}
+
+// Sets levels from a list like "info,comm=debug,fs=warning". A level without
+// subsystem is the default level.
+func SetLevels(spec string) os.Error {
+	parsed := make(map[string]int)
+	for _, item := range strings.Split(spec, ",", -1) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		subsystem, name := "", item
+		if i := strings.Index(item, "="); i >= 0 {
+			subsystem, name = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		parsed[subsystem] = level
+	}
+
+	for subsystem, level := range parsed {
+		SetLevel(subsystem, level)
+	}
+	return nil
+}
+
+// Returns the levels of the subsystems having their own, and the default
+// level under the empty subsystem
+func Levels() map[string]int {
+	config.RLock()
+	defer config.RUnlock()
+
+	copied := map[string]int{"": MaxLevel}
+	for subsystem, level := range levels {
+		copied[subsystem] = level
+	}
+	return copied
+}
+
+// Replaces the sinks entries are written to
+func SetSinks(newSinks ...Sink) {
+	config.Lock()
+	sinks = newSinks
+	config.Unlock()
+}
+
+func AddSink(sink Sink) {
+	config.Lock()
+	sinks = append(sinks, sink)
+	config.Unlock()
+}
+
+// Logs an entry, unless its level is above the level of its subsystem. Skip
+// is the number of frames between output and the code logging, used to find
+// the subsystem when none is given.
+func output(skip int, subsystem string, fields []Field, level int, message string, v []interface{}) {
+	now := time.Nanoseconds()
+	startOnce.Do(func() {
+		config.Lock()
+		if StartTime == -1 {
+			StartTime = now
+		}
+		config.Unlock()
+	})
+
+	// don't look for the subsystem of entries no subsystem would log
+	config.RLock()
+	if level > MaxLevel && level > maxLevel {
+		config.RUnlock()
+		return
+	}
+	config.RUnlock()
+
+	if subsystem == "" {
+		subsystem = callerSubsystem(skip)
+	}
+
+	config.RLock()
+	defer config.RUnlock()
+
+	max := MaxLevel
+	if subsystemLevel, found := levels[subsystem]; found {
+		max = subsystemLevel
+	}
+	if level > max {
+		return
+	}
+
+	entry := &Entry{
+		Time:      now,
+		Elapsed:   now - StartTime,
+		Level:     level,
+		Subsystem: subsystem,
+		Message:   strings.TrimRight(fmt.Sprintf(message, v...), "\n"),
+		Fields:    fields,
+	}
+
+	for _, sink := range sinks {
+		if err := sink.Write(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write log entry: %s\n", err)
+		}
+	}
+
+	if level == L_Fatal {
+		panic(entry.Message)
+	}
+}
+
+// Returns the subsystem of the code skip frames above the caller: the name
+// of the directory of its file. Subsystems are remembered by program counter,
+// since finding the file of a pc is much slower than getting the pc.
+func callerSubsystem(skip int) string {
+	pcs := make([]uintptr, 1)
+	if runtime.Callers(skip+2, pcs) == 0 {
+		return ""
 	}
+
+	config.RLock()
+	subsystem, found := subsystems[pcs[0]]
+	config.RUnlock()
+	if found {
+		return subsystem
+	}
+
+	_, file, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	subsystem = fileSubsystem(file)
+
+	config.Lock()
+	subsystems[pcs[0]] = subsystem
+	config.Unlock()
+	return subsystem
+}
+
+func fileSubsystem(file string) string {
+	dir := file
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		dir = dir[:i]
+	}
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		dir = dir[i+1:]
+	}
+	return dir
+}
+
+func Log(level int, message string, v ...interface{}) {
+	output(2, "", nil, level, message, v)
 }
 
+// Logs an error and panics
 func Fatal(message string, v ...interface{}) {
-	Log(L_Fatal, message, v...)
+	output(2, "", nil, L_Fatal, message, v)
 }
 
-func Error(message string, v ...interface{}) { Log(L_Error, message, v...) }
+func Error(message string, v ...interface{}) { output(2, "", nil, L_Error, message, v) }
 
 func Warning(message string, v ...interface{}) {
-	Log(L_Warning, message, v...)
+	output(2, "", nil, L_Warning, message, v)
 }
 
-func Info(message string, v ...interface{}) { Log(L_Info, message, v...) }
+func Info(message string, v ...interface{}) { output(2, "", nil, L_Info, message, v) }
 
-func Debug(message string, v ...interface{}) { Log(L_Debug, message, v...) }
+func Debug(message string, v ...interface{}) { output(2, "", nil, L_Debug, message, v) }
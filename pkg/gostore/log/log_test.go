@@ -0,0 +1,252 @@
+package log_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+	"strings"
+	"testing"
+	"gostore/log"
+)
+
+type stringer struct{}
+
+func (s stringer) String() string {
+	return "stringed"
+}
+
+// Writes entries to a buffer in the given format, until the returned function
+// restores the default levels and sinks
+func capture(format log.Format) (*bytes.Buffer, func()) {
+	buf := bytes.NewBuffer(nil)
+	log.SetSinks(log.NewWriterSink(buf, format))
+
+	previous := log.Levels()
+	return buf, func() {
+		for subsystem := range log.Levels() {
+			if subsystem != "" {
+				log.ResetLevel(subsystem)
+			}
+		}
+		log.SetLevel("", previous[""])
+		log.SetSinks(log.NewConsoleSink(log.FormatText))
+	}
+}
+
+func lines(buf *bytes.Buffer) []string {
+	logged := strings.TrimSpace(buf.String())
+	if logged == "" {
+		return nil
+	}
+	return strings.Split(logged, "\n", -1)
+}
+
+func TestLevels(t *testing.T) {
+	buf, restore := capture(log.FormatText)
+	defer restore()
+
+	log.SetLevel("", log.L_Warning)
+	log.SetLevel("comm", log.L_Debug)
+
+	log.Subsystem("comm").Debug("comm debug")
+	log.Subsystem("fs").Debug("fs debug")
+	log.Subsystem("fs").Info("fs info")
+	log.Subsystem("fs").Warning("fs warning")
+	log.Subsystem("fs").Error("fs error")
+
+	logged := lines(buf)
+	if len(logged) != 3 {
+		t.Fatalf("1) Should have logged 3 entries, got %v", logged)
+	}
+	for i, message := range []string{"[comm] comm debug", "[fs] fs warning", "[fs] fs error"} {
+		if strings.Index(logged[i], message) < 0 {
+			t.Errorf("2) Entry %d should have been '%s', got '%s'", i, message, logged[i])
+		}
+	}
+
+	// the subsystem uses the default level again
+	buf.Reset()
+	log.ResetLevel("comm")
+	log.Subsystem("comm").Info("comm info")
+	if logged := lines(buf); len(logged) != 0 {
+		t.Errorf("3) Reset subsystem shouldn't log above the default level, got %v", logged)
+	}
+
+	// subsystem of the package functions is the directory of the caller
+	log.SetLevel("log", log.L_Info)
+	log.Info("package info")
+	if logged := lines(buf); len(logged) != 1 || strings.Index(logged[0], "[log] package info") < 0 {
+		t.Errorf("4) Package function should log in the subsystem of its caller, got %v", logged)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]int{"fatal": log.L_Fatal, "Error": log.L_Error, "WARNING": log.L_Warning, "info": log.L_Info, "debug": log.L_Debug, "7": 7} {
+		level, err := log.ParseLevel(name)
+		if err != nil || level != expected {
+			t.Errorf("1) Level %s should have been %d, got %d %s", name, expected, level, err)
+		}
+	}
+
+	for _, name := range []string{"", "verbose", "-1"} {
+		if _, err := log.ParseLevel(name); err == nil {
+			t.Errorf("2) Level '%s' should have been rejected", name)
+		}
+	}
+
+	if name := log.LevelName(log.L_Warning); name != "warning" {
+		t.Errorf("3) Name of warning level should have been warning, got %s", name)
+	}
+	if name := log.LevelName(9); name != "level9" {
+		t.Errorf("4) Name of an unknown level should have been level9, got %s", name)
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	_, restore := capture(log.FormatText)
+	defer restore()
+
+	err := log.SetLevels(" info, comm=debug ,fs = error,,")
+	if err != nil {
+		t.Fatalf("1) Levels should have been set: %s", err)
+	}
+
+	levels := log.Levels()
+	expected := map[string]int{"": log.L_Info, "comm": log.L_Debug, "fs": log.L_Error}
+	if len(levels) != len(expected) {
+		t.Errorf("2) Should have had levels %v, got %v", expected, levels)
+	}
+	for subsystem, level := range expected {
+		if levels[subsystem] != level {
+			t.Errorf("3) Level of '%s' should have been %d, got %d", subsystem, level, levels[subsystem])
+		}
+	}
+
+	// a bad spec doesn't change any level
+	if err := log.SetLevels("warning,comm=info,fs=loud"); err == nil {
+		t.Errorf("4) Spec with an unknown level should have been rejected")
+	}
+	levels = log.Levels()
+	for subsystem, level := range expected {
+		if levels[subsystem] != level {
+			t.Errorf("5) Rejected spec shouldn't have changed level of '%s', got %d", subsystem, levels[subsystem])
+		}
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	buf, restore := capture(log.FormatJSON)
+	defer restore()
+
+	log.SetLevel("fs", log.L_Debug)
+	logger := log.Subsystem("fs").With("node", 2, "path", "/a/b")
+	logger.With("message", stringer{}, "error", os.NewError("failed")).Info("Wrote %d bytes\n", 12)
+
+	logged := lines(buf)
+	if len(logged) != 1 {
+		t.Fatalf("1) Should have logged one line, got %v", logged)
+	}
+
+	object := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(logged[0]), &object); err != nil {
+		t.Fatalf("2) Entry should have been valid JSON: %s %s", logged[0], err)
+	}
+
+	expected := map[string]interface{}{
+		"level":     "info",
+		"subsystem": "fs",
+		"msg":       "Wrote 12 bytes",
+		"node":      float64(2),
+		"path":      "/a/b",
+		"message":   "stringed",
+		"error":     "failed",
+	}
+	for key, value := range expected {
+		if object[key] != value {
+			t.Errorf("3) Field %s should have been %v, got %v", key, value, object[key])
+		}
+	}
+	if _, found := object["time"]; !found {
+		t.Errorf("4) Entry should have had a time")
+	}
+
+	// parent logger didn't get the fields of its child
+	buf.Reset()
+	logger.Debug("debug")
+	object = make(map[string]interface{})
+	json.Unmarshal(buf.Bytes(), &object)
+	if _, found := object["message"]; found || object["node"] != float64(2) {
+		t.Errorf("5) Logger should only have its own fields, got %v", object)
+	}
+
+	// a field that can't be encoded is written as text
+	buf.Reset()
+	logger.With("channel", make(chan int)).Info("channel")
+	object = make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &object); err != nil {
+		t.Errorf("6) Entry with an unencodable field should have been valid JSON: %s %s", buf.String(), err)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := fmt.Sprintf("%s/gostore-log-%d", os.TempDir(), os.Getpid())
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("1) Couldn't create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/gostore.log"
+	format := func(entry *log.Entry) []byte {
+		return []byte(entry.Message + "\n")
+	}
+
+	// each line is 8 bytes, 2 of them fit in a file
+	sink, err := log.NewFileSink(path, format, 16, 2)
+	if err != nil {
+		t.Fatalf("2) Couldn't open file sink: %s", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := sink.Write(&log.Entry{Message: fmt.Sprintf("entry %d", i)}); err != nil {
+			t.Fatalf("3) Couldn't write entry %d: %s", i, err)
+		}
+	}
+	sink.Close()
+
+	expected := map[string]string{
+		path:        "entry 6\n",
+		path + ".1": "entry 4\nentry 5\n",
+		path + ".2": "entry 2\nentry 3\n",
+	}
+	for file, content := range expected {
+		data, err := ioutil.ReadFile(file)
+		if err != nil || string(data) != content {
+			t.Errorf("4) File %s should have contained %q, got %q %s", file, content, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("5) Only 2 rotated files should have been kept")
+	}
+
+	// reopened sink appends to the current file
+	sink, err = log.NewFileSink(path, format, 16, 2)
+	if err != nil {
+		t.Fatalf("6) Couldn't reopen file sink: %s", err)
+	}
+	sink.Write(&log.Entry{Message: "entry 7"})
+	sink.Write(&log.Entry{Message: "entry 8"})
+	sink.Close()
+
+	if data, _ := ioutil.ReadFile(path); string(data) != "entry 8\n" {
+		t.Errorf("7) Reopened file should have been rotated once full, got %q", data)
+	}
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "entry 6\nentry 7\n" {
+		t.Errorf("8) Reopened file should have been appended to, got %q", data)
+	}
+
+	if err := sink.Write(&log.Entry{Message: "closed"}); err == nil {
+		t.Errorf("9) Closed sink shouldn't accept entries")
+	}
+}
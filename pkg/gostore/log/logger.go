@@ -0,0 +1,69 @@
+package log
+
+// Key/value field of an entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger adding fields to the entries it logs, like the id of the node or
+// the path of a file. Loggers are immutable, With returns a new one.
+type Logger struct {
+	subsystem string
+	fields    []Field
+}
+
+// Returns a logger of a subsystem. Entries logged by the package functions
+// are in the subsystem of the package logging them.
+func Subsystem(name string) *Logger {
+	return &Logger{name, nil}
+}
+
+// Returns a logger adding fields to the entries of the subsystem of the
+// caller, from a list of keys and values
+func With(keyvalues ...interface{}) *Logger {
+	return &Logger{callerSubsystem(1), toFields(nil, keyvalues)}
+}
+
+// Returns a logger adding fields to the entries of this one
+func (l *Logger) With(keyvalues ...interface{}) *Logger {
+	return &Logger{l.subsystem, toFields(l.fields, keyvalues)}
+}
+
+func toFields(fields []Field, keyvalues []interface{}) []Field {
+	merged := make([]Field, len(fields), len(fields)+len(keyvalues)/2)
+	copy(merged, fields)
+
+	for i := 0; i+1 < len(keyvalues); i += 2 {
+		key, ok := keyvalues[i].(string)
+		if !ok {
+			key = "?"
+		}
+		merged = append(merged, Field{key, keyvalues[i+1]})
+	}
+	return merged
+}
+
+func (l *Logger) Log(level int, message string, v ...interface{}) {
+	output(2, l.subsystem, l.fields, level, message, v)
+}
+
+func (l *Logger) Fatal(message string, v ...interface{}) {
+	output(2, l.subsystem, l.fields, L_Fatal, message, v)
+}
+
+func (l *Logger) Error(message string, v ...interface{}) {
+	output(2, l.subsystem, l.fields, L_Error, message, v)
+}
+
+func (l *Logger) Warning(message string, v ...interface{}) {
+	output(2, l.subsystem, l.fields, L_Warning, message, v)
+}
+
+func (l *Logger) Info(message string, v ...interface{}) {
+	output(2, l.subsystem, l.fields, L_Info, message, v)
+}
+
+func (l *Logger) Debug(message string, v ...interface{}) {
+	output(2, l.subsystem, l.fields, L_Debug, message, v)
+}
@@ -0,0 +1,221 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logged entry
+type Entry struct {
+	Time      int64 // ns
+	Elapsed   int64 // ns since the first entry (StartTime)
+	Level     int
+	Subsystem string
+	Message   string
+	Fields    []Field
+}
+
+// Encodes an entry on one line, ending with a new line
+type Format func(entry *Entry) []byte
+
+// Destination of entries. Sinks are called concurrently.
+type Sink interface {
+	Write(entry *Entry) os.Error
+}
+
+// Formats entries as "date time ms - [subsystem] message key=value ...", the
+// ms being the time since the first entry if Differential is set
+func FormatText(entry *Entry) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+
+	date := time.SecondsToLocalTime(entry.Time / 1e9).Format("2006/01/02 15:04:05")
+	fmt.Fprintf(buf, "%s.%06d ", date, entry.Time%1e9/1e3)
+
+	ms := entry.Time / 1e6
+	if Differential {
+		ms = entry.Elapsed / 1e6
+	}
+	fmt.Fprintf(buf, "%dms - ", ms)
+
+	if entry.Subsystem != "" {
+		fmt.Fprintf(buf, "[%s] ", entry.Subsystem)
+	}
+	buf.WriteString(entry.Message)
+
+	for _, field := range entry.Fields {
+		fmt.Fprintf(buf, " %s=%v", field.Key, field.Value)
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Formats entries as JSON objects with the time, level, subsystem and
+// message of the entry, and its fields
+func FormatJSON(entry *Entry) []byte {
+	object := make(map[string]interface{})
+	for _, field := range entry.Fields {
+		value := field.Value
+		if stringer, ok := value.(fmt.Stringer); ok {
+			value = stringer.String()
+		} else if err, ok := value.(os.Error); ok {
+			value = err.String()
+		}
+		object[field.Key] = value
+	}
+
+	date := time.SecondsToUTC(entry.Time / 1e9).Format("2006-01-02T15:04:05")
+	object["time"] = fmt.Sprintf("%s.%06dZ", date, entry.Time%1e9/1e3)
+	object["level"] = LevelName(entry.Level)
+	object["subsystem"] = entry.Subsystem
+	object["msg"] = entry.Message
+
+	line, err := json.Marshal(object)
+	if err != nil {
+		// a field can't be encoded, write it as text
+		for _, field := range entry.Fields {
+			object[field.Key] = fmt.Sprintf("%v", field.Value)
+		}
+		line, _ = json.Marshal(object)
+	}
+	return append(line, '\n')
+}
+
+// Sink writing to an io.Writer
+type WriterSink struct {
+	mutex  *sync.Mutex
+	writer io.Writer
+	format Format
+}
+
+func NewWriterSink(writer io.Writer, format Format) *WriterSink {
+	return &WriterSink{new(sync.Mutex), writer, format}
+}
+
+func (s *WriterSink) Write(entry *Entry) os.Error {
+	line := s.format(entry)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.writer.Write(line)
+	return err
+}
+
+// Sink writing warnings and errors to stderr and the rest to stdout
+type ConsoleSink struct {
+	stdout *WriterSink
+	stderr *WriterSink
+}
+
+func NewConsoleSink(format Format) *ConsoleSink {
+	return &ConsoleSink{NewWriterSink(os.Stdout, format), NewWriterSink(os.Stderr, format)}
+}
+
+func (s *ConsoleSink) Write(entry *Entry) os.Error {
+	if entry.Level <= L_Warning {
+		return s.stderr.Write(entry)
+	}
+	return s.stdout.Write(entry)
+}
+
+// Sink writing to a file, rotated once it reaches a maximum size: the file
+// is renamed with the suffix .1, the previous .1 to .2 and so on, keeping a
+// maximum number of rotated files.
+type FileSink struct {
+	mutex    *sync.Mutex
+	path     string
+	format   Format
+	maxSize  int64 // bytes, 0 to never rotate
+	maxFiles int   // rotated files kept
+	file     *os.File
+	size     int64
+}
+
+func NewFileSink(path string, format Format, maxSize int64, maxFiles int) (*FileSink, os.Error) {
+	s := &FileSink{
+		mutex:    new(sync.Mutex),
+		path:     path,
+		format:   format,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() os.Error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = stat.Size
+	return nil
+}
+
+func (s *FileSink) Write(entry *Entry) os.Error {
+	line := s.format(entry)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return os.NewError("Log file closed")
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Renames the current file and the rotated ones, and opens a new file. Must
+// be called with the mutex locked.
+func (s *FileSink) rotate() os.Error {
+	s.file.Close()
+	s.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.maxFiles > 0 {
+		os.Rename(s.path, s.path+".1")
+	} else {
+		os.Remove(s.path)
+	}
+
+	return s.open()
+}
+
+func (s *FileSink) Close() os.Error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"gostore/services/fs"
 	"gostore/services/cls"
 	"gostore/log"
+	"time"
 )
 
 type Process struct {
@@ -20,6 +21,24 @@ type Process struct {
 }
 
 func NewProcess(config gostore.Config) *Process {
+	transport := comm.NewNetTransport()
+	if config.FaultInjection {
+		seed := config.FaultSeed
+		if seed == 0 {
+			seed = time.Nanoseconds()
+		}
+
+		// the seed replays the same faults when set in the config
+		log.Warning("Server: fault injection is enabled, with seed %d\n", seed)
+		transport = comm.NewFaultTransport(transport, seed)
+	}
+
+	return NewProcessTransport(config, transport)
+}
+
+// Returns a process whose nodes communicate with the given transport. Nodes
+// sharing an in-memory transport can run in the same process.
+func NewProcessTransport(config gostore.Config, transport comm.Transport) *Process {
 	proc := new(Process)
 	proc.Config = config
 
@@ -35,6 +54,11 @@ func NewProcess(config gostore.Config) *Process {
 	// Generate active nodes
 	for _, confnode := range config.Nodes {
 		acnode := cluster.NewNode(confnode.NodeId, net.ParseIP(confnode.NodeIP), confnode.TCPPort, confnode.UDPPort)
+		if confnode.Weight > 0 {
+			acnode.Weight = confnode.Weight
+		}
+		acnode.Zone = confnode.Zone
+		acnode.Rack = confnode.Rack
 
 		for _, confring := range confnode.Rings {
 			acnode.AddRing(confring.RingId, confring.Token)
@@ -51,7 +75,7 @@ func NewProcess(config gostore.Config) *Process {
 	proc.Cluster.FillRings()
 
 	// Create services server
-	proc.Sc = comm.NewComm(proc.Cluster)
+	proc.Sc = comm.NewCommTransport(proc.Cluster, transport)
 
 	var oneCls bool
 	for _, sconfig := range config.Services {
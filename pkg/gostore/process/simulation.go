@@ -0,0 +1,54 @@
+package process
+
+import (
+	"gostore"
+	"gostore/comm"
+)
+
+// Simulation of a cluster whose nodes all run in this process, on the
+// virtual network and clock of a simulated transport. Running a simulation
+// again with the same seed and configurations delivers the messages in the
+// same order, which makes races between nodes reproducible.
+type Simulation struct {
+	Network   *comm.SimTransport
+	Processes []*Process
+}
+
+// Returns a simulation running a process for each configuration, which must
+// be the configurations of the nodes of a same cluster. Nothing is delivered
+// until the simulation is run or started.
+func NewSimulation(configs []gostore.Config, seed int64) *Simulation {
+	sim := new(Simulation)
+	sim.Network = comm.NewSimTransport(seed)
+	sim.Processes = make([]*Process, len(configs))
+
+	for i, config := range configs {
+		sim.Processes[i] = NewProcessTransport(config, sim.Network)
+	}
+
+	return sim
+}
+
+func (sim *Simulation) Seed() int64 {
+	return sim.Network.Seed()
+}
+
+// Runs the simulation for some ms of virtual time
+func (sim *Simulation) Run(ms int) {
+	sim.Network.RunFor(int64(ms) * 1000 * 1000)
+}
+
+// Runs the simulation in the background, so that the processes can be called
+// as usual, until Stop is called
+func (sim *Simulation) Start() {
+	sim.Network.Start()
+}
+
+func (sim *Simulation) Stop() {
+	sim.Network.Stop()
+}
+
+// Returns the messages delivered so far, to compare with a replay
+func (sim *Simulation) Trace() []comm.SimEvent {
+	return sim.Network.Trace()
+}
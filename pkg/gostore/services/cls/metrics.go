@@ -0,0 +1,29 @@
+package cls
+
+import (
+	"fmt"
+	"gostore/cluster"
+	"gostore/tools/metrics"
+)
+
+var (
+	metricJoins  = metrics.NewCounter("gostore_cls_joins_total", "Nodes accepted in the cluster by the master", "node")
+	metricOnline = metrics.NewGauge("gostore_cls_nodes_online", "Nodes of the cluster online as seen by the node", "node")
+)
+
+func (cs *ClusterService) metricNode() string {
+	return fmt.Sprintf("%d", cs.cluster.MyNode.Id)
+}
+
+// Exposes the number of nodes online
+func (cs *ClusterService) watchNodes() {
+	metricOnline.Func(func() float64 {
+		online := 0
+		for node := range cs.cluster.Nodes.Iter() {
+			if node.Status == cluster.Status_Online {
+				online++
+			}
+		}
+		return float64(online)
+	}, cs.metricNode())
+}
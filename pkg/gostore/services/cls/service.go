@@ -20,6 +20,11 @@ const (
 	state_offline
 )
 
+// Remote functions ids. Ids are part of the wire protocol, never change them.
+const (
+	FUNC_CONTACT_MASTER = 2
+)
+
 var ()
 
 type ClusterService struct {
@@ -76,6 +81,12 @@ func NewClusterService(comm *comm.Comm, config gostore.Config, sconfig gostore.C
 	return cs
 }
 
+func (cs *ClusterService) Functions() map[string]byte {
+	return map[string]byte{
+		"RemoteContactMaster": FUNC_CONTACT_MASTER,
+	}
+}
+
 func (cs *ClusterService) HandleUnmanagedMessage(msg *comm.Message) {
 	log.Error("CS: Got an unmanaged message: %s", msg)
 }
@@ -89,6 +100,7 @@ func (cs *ClusterService) Boot() {
 	log.Debug("%d: Booting cluster service", myNode.Id)
 
 	cs.loadCluster()
+	cs.watchNodes()
 
 	// Contact master or listen for incoming requests if I'm master
 	masters := cs.cluster.Rings.GetRing(cs.masterRing).ResolveToken(master_token)
@@ -157,6 +169,7 @@ func (cs *ClusterService) RemoteContactMaster(msg *comm.Message) {
 
 			node.Status = cluster.Status_Online
 			cs.cluster.MergeNode(node, true)
+			metricJoins.With(cs.metricNode()).Inc()
 
 			// TODO: Send the cluster back to the node
 			resp := cs.comm.NewMsgMessage(cs.serviceId)
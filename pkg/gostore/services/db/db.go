@@ -134,8 +134,14 @@ func (db *Db) Execute(trans *Transaction) (ret *TransactionReturn) {
 
 
 	if newret.Error == nil {
+		start := time.Nanoseconds()
+		defer func() {
+			metricCommit.With(db.config.DataPath).ObserveDuration(time.Nanoseconds() - start)
+		}()
+
 		err = vs.prepareCommit()
 		if err != nil {
+			metricFailed.With(db.config.DataPath).Inc()
 			vs.rollback()
 
 			newret.Error = &TransactionError{
@@ -147,6 +153,7 @@ func (db *Db) Execute(trans *Transaction) (ret *TransactionReturn) {
 
 		err = vs.commit()
 		if err != nil {
+			metricFailed.With(db.config.DataPath).Inc()
 			newret.Error = &TransactionError{
 				Id: proto.Uint32(0), // TODO: ERRNO
 				Message: proto.String(err.String()),
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"fmt"
+	"gostore/tools/metrics"
+)
+
+// Metrics of databases, labeled with their data path
+var (
+	metricCommit      = metrics.NewHistogram("gostore_db_commit_seconds", "Time taken to commit transactions, including the sync of their mutations to disk", metrics.LatencyBuckets, "db")
+	metricFailed      = metrics.NewCounter("gostore_db_commit_errors_total", "Transactions that couldn't be committed", "db")
+	metricSegmentSize = metrics.NewGauge("gostore_db_segment_bytes", "Size of the segments", "db", "segment")
+)
+
+// Exposes the size of a segment
+func (m *segmentManager) watchSegment(seg *segment) {
+	metricSegmentSize.Func(func() float64 {
+		seg.lock.Lock()
+		defer seg.lock.Unlock()
+		return float64(seg.positionEnd - seg.positionStart)
+	}, m.dataDir, fmt.Sprintf("%d", seg.id))
+}
+
+func (m *segmentManager) unwatchSegment(seg *segment) {
+	metricSegmentSize.Remove(m.dataDir, fmt.Sprintf("%d", seg.id))
+}
@@ -94,6 +94,7 @@ func newSegmentManager(dataDir string, tokenBefore, token Token) *segmentManager
 		seg.id = m.nextSegId
 		m.segments[seg.id] = seg
 		m.nextSegId++
+		m.watchSegment(seg)
 
 		m.timeline.addSegment(seg)
 	}
@@ -151,6 +152,7 @@ func (m *segmentManager) getWritableSegment(token Token) *segment {
 		seg.id = m.nextSegId
 		m.segments[seg.id] = seg
 		m.nextSegId++
+		m.watchSegment(seg)
 	}
 
 	return seg
@@ -193,6 +195,7 @@ func (m *segmentManager) closeAll() {
 	for _, seg := range m.segments {
 		if seg != nil {
 			seg.fd.Close()
+			m.unwatchSegment(seg)
 		}
 	}
 }
@@ -2,6 +2,8 @@ package fs
 
 import (
 	"os"
+	"io"
+	"strconv"
 	"gostore/api/rest"
 	"gostore/log"
 )
@@ -9,11 +11,13 @@ import (
 type api struct {
 	fss    *FsService
 	server *rest.Server
+	logger *log.Logger
 }
 
 func createApi(fss *FsService) *api {
 	fsa := new(api)
 	fsa.fss = fss
+	fsa.logger = fss.logger.With("api", fss.apiAddress)
 
 	fsa.server = rest.NewServer(fsa, fss.apiAddress)
 	return fsa
@@ -26,6 +30,53 @@ func parsePath(req *rest.Request) (*Path, bool) {
 	return path, path.Valid()
 }
 
+// Returns the context of a call made by the API. The optional "timeout"
+// parameter gives the time budget of the call in ms.
+func (api *api) newContext(req *rest.Request) *Context {
+	context := api.fss.NewContext()
+
+	if timeout, ok := req.Params["timeout"]; ok {
+		ms, err := strconv.Atoi(timeout[0])
+		if err == nil && ms > 0 {
+			context.SetTimeout(ms)
+		}
+	}
+
+	return context
+}
+
+// Reader and writer of the client connection canceling the call when the
+// client disconnects, since nobody will get its result anyway.
+type cancelingReader struct {
+	reader  io.Reader
+	context *Context
+	logger  *log.Logger
+}
+
+func (r *cancelingReader) Read(b []byte) (n int, err os.Error) {
+	n, err = r.reader.Read(b)
+	if err != nil && err != os.EOF {
+		r.logger.Debug("Client read error, canceling call: %s", err)
+		r.context.Cancel()
+	}
+	return
+}
+
+type cancelingWriter struct {
+	writer  io.Writer
+	context *Context
+	logger  *log.Logger
+}
+
+func (w *cancelingWriter) Write(b []byte) (n int, err os.Error) {
+	n, err = w.writer.Write(b)
+	if err != nil {
+		w.logger.Debug("Client write error, canceling call: %s", err)
+		w.context.Cancel()
+	}
+	return
+}
+
 func (fsa *api) Handle(resp *rest.ResponseWriter, req *rest.Request) {
 	/*
 		GET	/path						Get whole data content
@@ -67,7 +118,8 @@ func (fsa *api) Handle(resp *rest.ResponseWriter, req *rest.Request) {
 
 
 func (api *api) post(resp *rest.ResponseWriter, req *rest.Request, path *Path) {
-	log.Debug("FSS API: Received a write request for %d bytes\n", req.ContentLength)
+	logger := api.logger.With("path", path.String())
+	logger.Debug("Received a write request for %d bytes", req.ContentLength)
 
 	mimetype := "application/octet-stream"
 	mtar, ok := req.Params["type"]
@@ -75,46 +127,53 @@ func (api *api) post(resp *rest.ResponseWriter, req *rest.Request, path *Path) {
 		mimetype = mtar[0]
 	}
 
-	err := api.fss.Write(path, req.ContentLength, mimetype, req.Body, nil)
+	context := api.newContext(req)
+	body := &cancelingReader{req.Body, context, logger}
+	err := api.fss.Write(path, req.ContentLength, mimetype, body, context)
 	if err != nil {
-		log.Error("API: Fs Write returned an error: %s\n", err)
+		logger.Error("Write returned an error: %s", err)
 		resp.ReturnError(err.String())
 	}
 
-	log.Debug("API: Fs Write returned\n")
+	logger.Debug("Write returned")
 }
 
 func (api *api) get(resp *rest.ResponseWriter, req *rest.Request, path *Path) {
-	log.Debug("FSS API: Received a read request for path %s\n", path)
+	logger := api.logger.With("path", path.String())
+	logger.Debug("Received a read request")
 
 	// TODO: Handle offset
 	// TODO: Handle version
 	// TODO: Handle size
-	_, err := api.fss.Read(path, 0, -1, 0, resp, nil)
-	log.Debug("API: Fs Read data returned\n")
+	context := api.newContext(req)
+	writer := &cancelingWriter{resp, context, logger}
+	_, err := api.fss.Read(path, 0, -1, 0, writer, context)
+	logger.Debug("Read data returned")
 	if err != nil && err != os.EOF {
-		log.Error("API: Fs Read returned an error for %s: %s\n", path, err)
+		logger.Error("Read returned an error: %s", err)
 		resp.ReturnError(err.String())
 	}
 }
 
 func (api *api) head(resp *rest.ResponseWriter, req *rest.Request, path *Path) {
-	log.Debug("FSS API: Received a head request for path %s\n", path)
+	logger := api.logger.With("path", path.String())
+	logger.Debug("Received a head request")
 
-	header, err := api.fss.HeaderJSON(path, nil)
+	header, err := api.fss.HeaderJSON(path, api.newContext(req))
 
 	resp.Write(header)
 
-	log.Debug("API: Fs Header data returned\n")
+	logger.Debug("Header data returned")
 	if err != nil {
-		log.Error("API: Fs header returned an error: %s\n", err)
+		logger.Error("Header returned an error: %s", err)
 		resp.ReturnError(err.String())
 	}
 }
 
 
 func (api *api) delete(resp *rest.ResponseWriter, req *rest.Request, path *Path) {
-	log.Debug("FSS API: Received a delete request for %s\n", path)
+	logger := api.logger.With("path", path.String())
+	logger.Debug("Received a delete request")
 
 	recursive := false
 	mrec, ok := req.Params["recursive"]
@@ -122,9 +181,9 @@ func (api *api) delete(resp *rest.ResponseWriter, req *rest.Request, path *Path)
 		recursive = (mrec[0] == "1") || (mrec[0] == "true")
 	}
 
-	err := api.fss.Delete(path, recursive, nil)
+	err := api.fss.Delete(path, recursive, api.newContext(req))
 	if err != nil {
-		log.Error("API: Fs Write returned an error: %s\n", err)
+		logger.Error("Delete returned an error: %s", err)
 		resp.ReturnError(err.String())
 	}
 }
@@ -2,6 +2,7 @@ package fs
 
 import (
 	"gostore/comm"
+	"sync"
 )
 
 type Context struct {
@@ -10,6 +11,15 @@ type Context struct {
 	MessageTimeout    int
 	MessageRetry      int
 	MessageRetryDelay int
+
+	// local time (ns) after which the whole call is abandoned, 0 if none
+	Deadline int64
+	clock    comm.Clock
+
+	// messages sent with this context, canceled by Cancel
+	mutex    *sync.Mutex
+	messages []*comm.Message
+	canceled bool
 }
 
 
@@ -22,15 +32,48 @@ func (fss *FsService) NewContext() *Context {
 	context.MessageRetry = 3
 	context.MessageRetryDelay = 500
 
+	context.mutex = new(sync.Mutex)
+	context.clock = fss.comm.Clock()
+
 	return context
 }
 
+// Sets the time budget of the call in ms. It is propagated to all the nodes
+// handling it, which give up once it is exhausted.
+func (context *Context) SetTimeout(timeout int) {
+	context.Deadline = context.clock.Now() + int64(timeout)*1000*1000
+}
+
 func (context *Context) ApplyContext(message *comm.Message) {
 	message.Timeout = context.MessageTimeout
 	message.Retries = context.MessageRetry
 	message.RetryDelay = context.MessageRetryDelay
+	message.Deadline = context.Deadline
 
 	if message.Timeout > 0 {
 		message.LastTimeoutAsError = true
 	}
+
+	context.mutex.Lock()
+	context.messages = append(context.messages, message)
+	canceled := context.canceled
+	context.mutex.Unlock()
+
+	if canceled {
+		message.Cancel()
+	}
+}
+
+// Cancels the call made with this context (ex: the client disconnected). The
+// nodes handling it abort their work and the call returns comm.ErrorCanceled.
+func (context *Context) Cancel() {
+	context.mutex.Lock()
+	context.canceled = true
+	messages := context.messages
+	context.messages = nil
+	context.mutex.Unlock()
+
+	for _, message := range messages {
+		message.Cancel()
+	}
 }
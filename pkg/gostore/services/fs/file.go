@@ -2,7 +2,6 @@ package fs
 
 import (
 	"os"
-	"gostore/log"
 	"fmt"
 )
 
@@ -80,7 +79,7 @@ func (f *File) Close() os.Error {
 func (f *File) Size() int64 {
 	dir, err := os.Stat(f.datapath)
 	if err != nil {
-		log.Error("Cannot stat data file: %s\n", f.path)
+		f.fss.logger.With("path", f.path.String()).Error("Cannot stat data file %s: %s", f.datapath, err)
 	} else {
 		return dir.Size
 	}
@@ -0,0 +1,930 @@
+// Code generated by gostore-rpcgen from "fs.rpc"
+// DO NOT EDIT!
+
+package fs
+
+import "fmt"
+import "gostore/comm"
+import "gostore/tools/buffer"
+import "io"
+import "os"
+
+// Reference fmt, io & os imports to suppress error if they are not otherwise used.
+var _ = fmt.Sprintf
+var _ io.Reader
+var _ os.Error
+
+// Remote functions ids
+const (
+	FUNC_CHILD_ADD       = 2
+	FUNC_CHILD_REMOVE    = 3
+	FUNC_CHILDREN_LIST   = 4
+	FUNC_CHILDREN_STREAM = 12
+	FUNC_DELETE          = 5
+	FUNC_DELETE_REPLICA  = 6
+	FUNC_EXISTS          = 7
+	FUNC_HEADER          = 8
+	FUNC_READ            = 9
+	FUNC_REPLICA_VERSION = 10
+	FUNC_WRITE           = 11
+)
+
+var fsServiceFunctions = map[string]byte{
+	"RemoteChildAdd":       FUNC_CHILD_ADD,
+	"RemoteChildRemove":    FUNC_CHILD_REMOVE,
+	"RemoteChildrenList":   FUNC_CHILDREN_LIST,
+	"RemoteChildrenStream": FUNC_CHILDREN_STREAM,
+	"RemoteDelete":         FUNC_DELETE,
+	"RemoteDeleteReplica":  FUNC_DELETE_REPLICA,
+	"RemoteExists":         FUNC_EXISTS,
+	"RemoteHeader":         FUNC_HEADER,
+	"RemoteRead":           FUNC_READ,
+	"RemoteReplicaVersion": FUNC_REPLICA_VERSION,
+	"RemoteWrite":          FUNC_WRITE,
+}
+
+type ChildEntry struct {
+	Name     string
+	Mimetype string
+	Size     int64
+}
+
+func (s *ChildEntry) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Name)
+	buf.WriteString(s.Mimetype)
+	buf.WriteInt64(s.Size)
+	return nil
+}
+
+func (s *ChildEntry) read(buf *buffer.Buffer) (err os.Error) {
+	s.Name, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Mimetype, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Size, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+type ChildAddRequest struct {
+	Path     string
+	Name     string
+	Mimetype string
+	Size     int64
+}
+
+func (s *ChildAddRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteString(s.Name)
+	buf.WriteString(s.Mimetype)
+	buf.WriteInt64(s.Size)
+	return nil
+}
+
+func (s *ChildAddRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Name, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Mimetype, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Size, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadChildAddRequest(message *comm.Message) (*ChildAddRequest, os.Error) {
+	s := new(ChildAddRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ChildRemoveRequest struct {
+	Path  string
+	Child string
+}
+
+func (s *ChildRemoveRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteString(s.Child)
+	return nil
+}
+
+func (s *ChildRemoveRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Child, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadChildRemoveRequest(message *comm.Message) (*ChildRemoveRequest, os.Error) {
+	s := new(ChildRemoveRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ChildrenListRequest struct {
+	Path       string
+	ForceLocal bool
+}
+
+func (s *ChildrenListRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteBool(s.ForceLocal)
+	return nil
+}
+
+func (s *ChildrenListRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.ForceLocal, err = buf.ReadBool()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadChildrenListRequest(message *comm.Message) (*ChildrenListRequest, os.Error) {
+	s := new(ChildrenListRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ChildrenListResponse struct {
+	Children []ChildEntry
+}
+
+func (s *ChildrenListResponse) write(buf *buffer.Buffer) os.Error {
+	if len(s.Children) > 65535 {
+		return os.NewError(fmt.Sprintf("ChildrenListResponse.Children has %d entries, more than 65535", len(s.Children)))
+	}
+	buf.WriteUint16(uint16(len(s.Children)))
+	for i := range s.Children {
+		if err := s.Children[i].write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ChildrenListResponse) read(buf *buffer.Buffer) (err os.Error) {
+	var childrenCount uint16
+	childrenCount, err = buf.ReadUint16()
+	if err != nil {
+		return
+	}
+	s.Children = make([]ChildEntry, childrenCount)
+	for i := range s.Children {
+		err = s.Children[i].read(buf)
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+func ReadChildrenListResponse(message *comm.Message) (*ChildrenListResponse, os.Error) {
+	s := new(ChildrenListResponse)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ChildrenStreamRequest struct {
+	Path       string
+	ForceLocal bool
+}
+
+func (s *ChildrenStreamRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteBool(s.ForceLocal)
+	return nil
+}
+
+func (s *ChildrenStreamRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.ForceLocal, err = buf.ReadBool()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadChildrenStreamRequest(message *comm.Message) (*ChildrenStreamRequest, os.Error) {
+	s := new(ChildrenStreamRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ChildrenStreamResponse struct {
+	Children []ChildEntry
+}
+
+func (s *ChildrenStreamResponse) write(buf *buffer.Buffer) os.Error {
+	if len(s.Children) > 65535 {
+		return os.NewError(fmt.Sprintf("ChildrenStreamResponse.Children has %d entries, more than 65535", len(s.Children)))
+	}
+	buf.WriteUint16(uint16(len(s.Children)))
+	for i := range s.Children {
+		if err := s.Children[i].write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ChildrenStreamResponse) read(buf *buffer.Buffer) (err os.Error) {
+	var childrenCount uint16
+	childrenCount, err = buf.ReadUint16()
+	if err != nil {
+		return
+	}
+	s.Children = make([]ChildEntry, childrenCount)
+	for i := range s.Children {
+		err = s.Children[i].read(buf)
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+func ReadChildrenStreamResponse(message *comm.Message) (*ChildrenStreamResponse, os.Error) {
+	s := new(ChildrenStreamResponse)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type DeleteRequest struct {
+	Path      string
+	Recursive bool
+	First     bool
+}
+
+func (s *DeleteRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteBool(s.Recursive)
+	buf.WriteBool(s.First)
+	return nil
+}
+
+func (s *DeleteRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Recursive, err = buf.ReadBool()
+	if err != nil {
+		return
+	}
+
+	s.First, err = buf.ReadBool()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadDeleteRequest(message *comm.Message) (*DeleteRequest, os.Error) {
+	s := new(DeleteRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type DeleteReplicaRequest struct {
+	Path    string
+	Version int64
+}
+
+func (s *DeleteReplicaRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteInt64(s.Version)
+	return nil
+}
+
+func (s *DeleteReplicaRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Version, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadDeleteReplicaRequest(message *comm.Message) (*DeleteReplicaRequest, os.Error) {
+	s := new(DeleteReplicaRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ExistsRequest struct {
+	Path       string
+	ForceLocal bool
+}
+
+func (s *ExistsRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteBool(s.ForceLocal)
+	return nil
+}
+
+func (s *ExistsRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.ForceLocal, err = buf.ReadBool()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadExistsRequest(message *comm.Message) (*ExistsRequest, os.Error) {
+	s := new(ExistsRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ExistsResponse struct {
+	Exists bool
+}
+
+func (s *ExistsResponse) write(buf *buffer.Buffer) os.Error {
+	buf.WriteBool(s.Exists)
+	return nil
+}
+
+func (s *ExistsResponse) read(buf *buffer.Buffer) (err os.Error) {
+	s.Exists, err = buf.ReadBool()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadExistsResponse(message *comm.Message) (*ExistsResponse, os.Error) {
+	s := new(ExistsResponse)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type HeaderRequest struct {
+	Path string
+}
+
+func (s *HeaderRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	return nil
+}
+
+func (s *HeaderRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadHeaderRequest(message *comm.Message) (*HeaderRequest, os.Error) {
+	s := new(HeaderRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type HeaderResponse struct {
+	Data     io.Reader
+	DataSize int64
+}
+
+func (s *HeaderResponse) write(buf *buffer.Buffer) os.Error {
+	return nil
+}
+
+func (s *HeaderResponse) read(buf *buffer.Buffer) (err os.Error) {
+	return nil
+}
+
+func ReadHeaderResponse(message *comm.Message) (*HeaderResponse, os.Error) {
+	s := new(HeaderResponse)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	s.Data = message.Data
+	s.DataSize = message.DataSize
+	return s, nil
+}
+
+type ReadRequest struct {
+	Path       string
+	Offset     int64
+	Size       int64
+	Version    int64
+	ForceLocal bool
+}
+
+func (s *ReadRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteInt64(s.Offset)
+	buf.WriteInt64(s.Size)
+	buf.WriteInt64(s.Version)
+	buf.WriteBool(s.ForceLocal)
+	return nil
+}
+
+func (s *ReadRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Offset, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	s.Size, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	s.Version, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	s.ForceLocal, err = buf.ReadBool()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadReadRequest(message *comm.Message) (*ReadRequest, os.Error) {
+	s := new(ReadRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type ReadResponse struct {
+	Offset   int64
+	Version  int64
+	Data     io.Reader
+	DataSize int64
+}
+
+func (s *ReadResponse) write(buf *buffer.Buffer) os.Error {
+	buf.WriteInt64(s.Offset)
+	buf.WriteInt64(s.Version)
+	return nil
+}
+
+func (s *ReadResponse) read(buf *buffer.Buffer) (err os.Error) {
+	s.Offset, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	s.Version, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadReadResponse(message *comm.Message) (*ReadResponse, os.Error) {
+	s := new(ReadResponse)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	s.Data = message.Data
+	s.DataSize = message.DataSize
+	return s, nil
+}
+
+type ReplicaVersionRequest struct {
+	Path        string
+	Version     int64
+	NextVersion int64
+	Size        int64
+	Mimetype    string
+}
+
+func (s *ReplicaVersionRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteInt64(s.Version)
+	buf.WriteInt64(s.NextVersion)
+	buf.WriteInt64(s.Size)
+	buf.WriteString(s.Mimetype)
+	return nil
+}
+
+func (s *ReplicaVersionRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Version, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	s.NextVersion, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	s.Size, err = buf.ReadInt64()
+	if err != nil {
+		return
+	}
+
+	s.Mimetype, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadReplicaVersionRequest(message *comm.Message) (*ReplicaVersionRequest, os.Error) {
+	s := new(ReplicaVersionRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type WriteRequest struct {
+	Path     string
+	Mimetype string
+	Data     io.Reader
+	DataSize int64
+}
+
+func (s *WriteRequest) write(buf *buffer.Buffer) os.Error {
+	buf.WriteString(s.Path)
+	buf.WriteString(s.Mimetype)
+	return nil
+}
+
+func (s *WriteRequest) read(buf *buffer.Buffer) (err os.Error) {
+	s.Path, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	s.Mimetype, err = buf.ReadString()
+	if err != nil {
+		return
+	}
+
+	return nil
+}
+
+func ReadWriteRequest(message *comm.Message) (*WriteRequest, os.Error) {
+	s := new(WriteRequest)
+	if err := s.read(message.Message); err != nil {
+		return nil, err
+	}
+	s.Data = message.Data
+	s.DataSize = message.DataSize
+	return s, nil
+}
+
+// Typed client of the FsService remote functions
+type FsServiceClient struct {
+	comm      *comm.Comm
+	serviceId byte
+}
+
+func NewFsServiceClient(c *comm.Comm, serviceId byte) *FsServiceClient {
+	return &FsServiceClient{c, serviceId}
+}
+
+// Returns a message calling RemoteChildAdd
+func (c *FsServiceClient) NewChildAddMessage(request *ChildAddRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_CHILD_ADD
+	return message, nil
+}
+
+// Returns a message calling RemoteChildRemove
+func (c *FsServiceClient) NewChildRemoveMessage(request *ChildRemoveRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_CHILD_REMOVE
+	return message, nil
+}
+
+// Returns a message calling RemoteChildrenList
+func (c *FsServiceClient) NewChildrenListMessage(request *ChildrenListRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_CHILDREN_LIST
+	return message, nil
+}
+
+// Returns a response message to RemoteChildrenList
+func (c *FsServiceClient) NewChildrenListResponse(response *ChildrenListResponse) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := response.write(message.Message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Returns a message calling RemoteChildrenStream
+func (c *FsServiceClient) NewChildrenStreamMessage(request *ChildrenStreamRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_CHILDREN_STREAM
+	return message, nil
+}
+
+// Returns a response message to RemoteChildrenStream
+func (c *FsServiceClient) NewChildrenStreamResponse(response *ChildrenStreamResponse) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := response.write(message.Message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Returns a message calling RemoteDelete
+func (c *FsServiceClient) NewDeleteMessage(request *DeleteRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_DELETE
+	return message, nil
+}
+
+// Returns a message calling RemoteDeleteReplica
+func (c *FsServiceClient) NewDeleteReplicaMessage(request *DeleteReplicaRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_DELETE_REPLICA
+	return message, nil
+}
+
+// Returns a message calling RemoteExists
+func (c *FsServiceClient) NewExistsMessage(request *ExistsRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_EXISTS
+	return message, nil
+}
+
+// Returns a response message to RemoteExists
+func (c *FsServiceClient) NewExistsResponse(response *ExistsResponse) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := response.write(message.Message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Returns a message calling RemoteHeader
+func (c *FsServiceClient) NewHeaderMessage(request *HeaderRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_HEADER
+	return message, nil
+}
+
+// Returns a response message to RemoteHeader
+func (c *FsServiceClient) NewHeaderResponse(response *HeaderResponse) (*comm.Message, os.Error) {
+	message := c.comm.NewDataMessage(c.serviceId)
+	if err := response.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.Data = response.Data
+	message.DataSize = response.DataSize
+	return message, nil
+}
+
+// Returns a message calling RemoteRead
+func (c *FsServiceClient) NewReadMessage(request *ReadRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_READ
+	return message, nil
+}
+
+// Returns a response message to RemoteRead
+func (c *FsServiceClient) NewReadResponse(response *ReadResponse) (*comm.Message, os.Error) {
+	message := c.comm.NewDataMessage(c.serviceId)
+	if err := response.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.Data = response.Data
+	message.DataSize = response.DataSize
+	return message, nil
+}
+
+// Returns a message calling RemoteReplicaVersion
+func (c *FsServiceClient) NewReplicaVersionMessage(request *ReplicaVersionRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewMsgMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.FunctionId = FUNC_REPLICA_VERSION
+	return message, nil
+}
+
+// Returns a message calling RemoteWrite
+func (c *FsServiceClient) NewWriteMessage(request *WriteRequest) (*comm.Message, os.Error) {
+	message := c.comm.NewDataMessage(c.serviceId)
+	if err := request.write(message.Message); err != nil {
+		return nil, err
+	}
+	message.Data = request.Data
+	message.DataSize = request.DataSize
+	message.FunctionId = FUNC_WRITE
+	return message, nil
+}
+
+// Returns the ids of the remote functions of the service
+func (s *FsService) Functions() map[string]byte {
+	return fsServiceFunctions
+}
+
+// Decodes the request of a message and calls its remote function
+func (s *FsService) Dispatch(message *comm.Message) (handled bool, err os.Error) {
+	switch message.FunctionId {
+	case FUNC_CHILD_ADD:
+		request, err := ReadChildAddRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteChildAdd(message, request)
+		return true, nil
+	case FUNC_CHILD_REMOVE:
+		request, err := ReadChildRemoveRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteChildRemove(message, request)
+		return true, nil
+	case FUNC_CHILDREN_LIST:
+		request, err := ReadChildrenListRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteChildrenList(message, request)
+		return true, nil
+	case FUNC_CHILDREN_STREAM:
+		request, err := ReadChildrenStreamRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteChildrenStream(message, request)
+		return true, nil
+	case FUNC_DELETE:
+		request, err := ReadDeleteRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteDelete(message, request)
+		return true, nil
+	case FUNC_DELETE_REPLICA:
+		request, err := ReadDeleteReplicaRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteDeleteReplica(message, request)
+		return true, nil
+	case FUNC_EXISTS:
+		request, err := ReadExistsRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteExists(message, request)
+		return true, nil
+	case FUNC_HEADER:
+		request, err := ReadHeaderRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteHeader(message, request)
+		return true, nil
+	case FUNC_READ:
+		request, err := ReadReadRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteRead(message, request)
+		return true, nil
+	case FUNC_REPLICA_VERSION:
+		request, err := ReadReplicaVersionRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteReplicaVersion(message, request)
+		return true, nil
+	case FUNC_WRITE:
+		request, err := ReadWriteRequest(message)
+		if err != nil {
+			return true, err
+		}
+		s.RemoteWrite(message, request)
+		return true, nil
+	}
+
+	return false, nil
+}
@@ -10,26 +10,32 @@ import (
 
 type LocalFileHeader struct {
 	headerpath string
+	logger     *log.Logger
 
 	header *FileHeader
 }
 
-func NewLocalFileHeader(headerpath string) *LocalFileHeader {
+func NewLocalFileHeader(headerpath string, logger *log.Logger) *LocalFileHeader {
 	lfh := new(LocalFileHeader)
 	lfh.headerpath = headerpath
+	lfh.logger = logger
 
 	file, err := os.Open(lfh.headerpath)
 
 	// no error
 	if err == nil {
-		lfh.header = LoadFileHeader(file)
+		lfh.header, err = LoadFileHeader(file)
+		if err != nil {
+			lfh.header = NewFileHeader()
+			lfh.logger.Error("Couldn't load header file %s: %s", lfh.headerpath, err)
+		}
 	} else {
 		if ptherror, ok := err.(*os.PathError); ok && ptherror.Error == os.ENOENT {
 			// if file doesn't exists, we don't show an error
 			lfh.header = NewFileHeader()
 		} else {
 			lfh.header = NewFileHeader()
-			log.Error("Couldn't load header file for %s: %d", lfh.headerpath, err)
+			lfh.logger.Error("Couldn't load header file %s: %s", lfh.headerpath, err)
 		}
 
 	}
@@ -40,27 +46,25 @@ func NewLocalFileHeader(headerpath string) *LocalFileHeader {
 }
 
 func (lfh *LocalFileHeader) Save() {
-	// TODO: Fix this double marshalling!
-
-	bytes, err := json.Marshal(lfh.header)
-
+	bytes, err := lfh.header.ToJSON()
 	if err != nil {
-		log.Error("Couldn't marshal header: %s", err)
+		lfh.logger.Error("Couldn't marshal header: %s", err)
+		return
 	}
 
 	file, err := os.Create(lfh.headerpath)
 	if err != nil {
-		log.Error("Couldn't save header file for %s: %s", lfh.headerpath, err)
+		lfh.logger.Error("Couldn't save header file %s: %s", lfh.headerpath, err)
 
 	} else {
-		n, err := file.Write(lfh.header.ToJSON())
+		n, err := file.Write(bytes)
 
 		if n != len(bytes) {
-			log.Error("Didn't write all header data: written %n bytes", n)
+			lfh.logger.Error("Didn't write all header data: written %d bytes out of %d", n, len(bytes))
 		}
 
 		if err != nil {
-			log.Error("Couldn't save file header: %s", err)
+			lfh.logger.Error("Couldn't save file header: %s", err)
 		}
 	}
 
@@ -86,7 +90,7 @@ func NewFileHeader() *FileHeader {
 	return fh
 }
 
-func LoadFileHeader(reader io.Reader) *FileHeader {
+func LoadFileHeader(reader io.Reader) (*FileHeader, os.Error) {
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(reader)
 	bytes := buf.Bytes()
@@ -94,25 +98,18 @@ func LoadFileHeader(reader io.Reader) *FileHeader {
 	return LoadFileHeaderFromJSON(bytes)
 }
 
-func LoadFileHeaderFromJSON(bytes []byte) *FileHeader {
+func LoadFileHeaderFromJSON(bytes []byte) (*FileHeader, os.Error) {
 	fh := new(FileHeader)
-	errtok := json.Unmarshal(bytes, fh)
-
-	if errtok != nil {
-		fh = new(FileHeader)
-		log.Error("Couldn't load file header: %s, %s", errtok, bytes)
+	err := json.Unmarshal(bytes, fh)
+	if err != nil {
+		return nil, err
 	}
 
-	return fh
+	return fh, nil
 }
 
-func (f *FileHeader) ToJSON() []byte {
-	bytes, err := json.Marshal(f)
-	if err != nil {
-		log.Error("Couldn't marshal header: %s", err)
-	}
-
-	return bytes
+func (f *FileHeader) ToJSON() ([]byte, os.Error) {
+	return json.Marshal(f)
 }
 
 func (f *FileHeader) GetChild(name string) *FileChild {
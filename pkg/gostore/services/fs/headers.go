@@ -30,7 +30,7 @@ func (fh *FileHeaders) GetFileHeader(path *Path) *LocalFileHeader {
 	header, found := fh.headers[path.String()]
 	if !found {
 		headerpath := fmt.Sprintf("%s/%d.head", fh.fss.dataDir, path.Hash())
-		header = NewLocalFileHeader(headerpath)
+		header = NewLocalFileHeader(headerpath, fh.fss.logger.With("path", path.String()))
 		fh.headers[path.String()] = header
 	}
 
@@ -0,0 +1,36 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"gostore/tools/metrics"
+)
+
+var (
+	metricOperations  = metrics.NewHistogram("gostore_fs_operation_seconds", "Time taken by file system operations, as seen by the node calling them", metrics.LatencyBuckets, "node", "operation")
+	metricErrors      = metrics.NewCounter("gostore_fs_operation_errors_total", "File system operations that returned an error", "node", "operation")
+	metricReplBacklog = metrics.NewGauge("gostore_fs_replication_backlog", "Files waiting for their data to be downloaded from their master", "node")
+)
+
+func (fss *FsService) metricNode() string {
+	return fmt.Sprintf("%d", fss.cluster.MyNode.Id)
+}
+
+// Records the latency and the error of an operation started at a given time
+// of the clock of the communication layer. Deferred by operations, with
+// their returned error.
+func (fss *FsService) observe(operation string, start int64, err *os.Error) {
+	metricOperations.With(fss.metricNode(), operation).ObserveDuration(fss.comm.Clock().Now() - start)
+	if *err != nil {
+		metricErrors.With(fss.metricNode(), operation).Inc()
+	}
+}
+
+// Exposes the length of the replication queue
+func (fss *FsService) watchReplicationBacklog() {
+	metricReplBacklog.Func(func() float64 {
+		fss.replQueueMutex.Lock()
+		defer fss.replQueueMutex.Unlock()
+		return float64(fss.replQueue.Len())
+	}, fss.metricNode())
+}
@@ -22,11 +22,16 @@ type FsService struct {
 	cluster *cluster.Cluster
 	ring    *cluster.Ring
 
+	logger *log.Logger
+
 	sconfig   *gostore.ConfigService
 	dataDir   string
 	serviceId uint8
 	running   bool
 
+	// generated stubs of the remote functions (see fs.rpc)
+	client *FsServiceClient
+
 	// api
 	api        *api
 	apiAddress string
@@ -53,10 +58,12 @@ func NewFsService(comm *comm.Comm, sconfig *gostore.ConfigService) *FsService {
 	fss.comm = comm
 	fss.cluster = comm.Cluster
 	fss.serviceId = sconfig.Id
+	fss.logger = log.Subsystem("fs").With("node", fss.cluster.MyNode.Id, "service", fss.serviceId)
+	fss.client = NewFsServiceClient(comm, fss.serviceId)
 
 	datadir, ok := sconfig.CustomConfig["DataDir"]
 	if !ok {
-		log.Fatal("FSS: DataDir config should be setted!")
+		fss.logger.Fatal("DataDir config should be setted!")
 	}
 	fss.dataDir = datadir.(string)
 
@@ -66,7 +73,7 @@ func NewFsService(comm *comm.Comm, sconfig *gostore.ConfigService) *FsService {
 
 	apiAddress, ok := sconfig.CustomConfig["ApiAddress"]
 	if !ok {
-		log.Fatal("FSS: ApiAddress config should be setted!")
+		fss.logger.Fatal("ApiAddress config should be setted!")
 	}
 	fss.apiAddress = apiAddress.(string)
 
@@ -87,17 +94,18 @@ func NewFsService(comm *comm.Comm, sconfig *gostore.ConfigService) *FsService {
 	// TODO: We should be able to start as many watcher as we have core (or we need!)
 	fss.replQueue = list.New()
 	fss.replQueueMutex = new(sync.Mutex)
+	fss.watchReplicationBacklog()
 	go fss.replicationWatcher()
 
 	return fss
 }
 
 func (fss *FsService) HandleUnmanagedMessage(msg *comm.Message) {
-	log.Error("FSS: Got an unmanaged message: %s", msg)
+	fss.logger.With("message", msg.Id).Error("Got an unmanaged message: %s", msg)
 }
 
 func (fss *FsService) HandleUnmanagedError(errorMessage *comm.Message, error os.Error) {
-	log.Error("FSS: Got an unmanaged error: %s", errorMessage)
+	fss.logger.With("message", errorMessage.Id).Error("Got an unmanaged error %s: %s", error, errorMessage)
 }
 
 func (fss *FsService) Boot() {
@@ -124,7 +132,7 @@ func (fss *FsService) Lock(key string) {
 func (fss *FsService) Unlock(key string) {
 	mutex, found := fss.mutexes[key]
 	if !found {
-		log.Error("FSS: Couldn't find file mutex to unlock for key %s\n", key)
+		fss.logger.Error("Couldn't find file mutex to unlock for key %s", key)
 		return
 	}
 
@@ -2,7 +2,6 @@ package fs
 
 import (
 	"gostore/comm"
-	"gostore/log"
 	"gostore/cluster"
 	"os"
 	"fmt"
@@ -13,19 +12,22 @@ import (
  * Delete
  */
 func (fss *FsService) Delete(path *Path, recursive bool, context *Context) (returnError os.Error) {
+	defer fss.observe("delete", fss.comm.Clock().Now(), &returnError)
+
 	if context == nil {
 		context = fss.NewContext()
 	}
 
-	message := fss.comm.NewMsgMessage(fss.serviceId)
-	message.Function = "RemoteDelete"
+	message, err := fss.client.NewDeleteMessage(&DeleteRequest{
+		Path:      path.String(),
+		Recursive: recursive,
+		First:     true,
+	})
+	if err != nil {
+		return err
+	}
 	context.ApplyContext(message)
 
-	// write payload
-	message.Message.WriteString(path.String()) // path
-	message.Message.WriteBool(recursive)       // recursive
-	message.Message.WriteBool(true)            // first flag
-
 	message.OnResponse = func(response *comm.Message) {
 		message.Wait <- true
 	}
@@ -47,13 +49,17 @@ func (fss *FsService) Delete(path *Path, recursive bool, context *Context) (retu
 	return
 }
 
-func (fss *FsService) RemoteDelete(message *comm.Message) {
-	strPath, _ := message.Message.ReadString() // path
-	path := NewPath(strPath)
-	recursive, _ := message.Message.ReadBool() // recursive flag
-	first, _ := message.Message.ReadBool()     // first level flag
+func (fss *FsService) RemoteDelete(message *comm.Message, request *DeleteRequest) {
+	path := NewPath(request.Path)
+	recursive, first := request.Recursive, request.First
 
-	log.Debug("%d FSS: Received a new delete message for path=%s recursive=%d\n", fss.cluster.MyNode.Id, path, recursive)
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received a new delete message (recursive=%t)", recursive)
+
+	if message.Canceled() {
+		fss.comm.RespondError(message, comm.ErrorCanceled)
+		return
+	}
 
 	resolveResult := fss.ring.Resolve(path.String())
 	if resolveResult.IsFirst(fss.cluster.MyNode) {
@@ -75,18 +81,17 @@ func (fss *FsService) RemoteDelete(message *comm.Message) {
 				localheader.Save()
 
 				// sync replicas
-				syncChan := fss.sendToReplicaNode(resolveResult, func(node *cluster.Node) *comm.Message {
-					msg := fss.comm.NewMsgMessage(fss.serviceId)
-					msg.Function = "RemoteDeleteReplica"
-					msg.Message.WriteString(path.String())             // path
-					msg.Message.WriteInt64(localheader.header.Version) // version
-					return msg
+				syncChan := fss.sendToReplicaNode(message, resolveResult, func(node *cluster.Node) (*comm.Message, os.Error) {
+					return fss.client.NewDeleteReplicaMessage(&DeleteReplicaRequest{
+						Path:    path.String(),
+						Version: localheader.header.Version,
+					})
 				})
 
 				// wait for sync
 				syncErr := <-syncChan
 				if syncErr != nil {
-					log.Error("FSS: Couldn't delete replica from nodes: %s\n", syncErr)
+					logger.Error("Couldn't delete replica from nodes: %s", syncErr)
 				}
 
 				fss.Unlock(path.String())
@@ -105,24 +110,27 @@ func (fss *FsService) RemoteDelete(message *comm.Message) {
 						deletechild = func() {
 							childpath := path.ChildPath(child.Name)
 
-							msg := fss.comm.NewMsgMessage(fss.serviceId)
-							msg.Function = "RemoteDelete"
-
-							// write payload
-							msg.Message.WriteString(childpath.String()) // path
-							msg.Message.WriteBool(recursive)            // recursive = 1 here
-							msg.Message.WriteBool(false)                // not first here
-
+							msg, err := fss.client.NewDeleteMessage(&DeleteRequest{
+								Path:      childpath.String(),
+								Recursive: recursive, // recursive = 1 here
+								First:     false,     // not first here
+							})
+							if err != nil {
+								logger.Error("Couldn't delete child %s: %s", child.Name, err)
+								c <- 1
+								return
+							}
 
 							childres := fss.ring.Resolve(childpath.String())
 
+							msg.Follow(message)
 							msg.Timeout = 1000 // TODO: Config
 							msg.OnTimeout = func(last bool) (retry bool, handled bool) {
 								if try < 10 {
 									try++
 									deletechild()
 								} else {
-									log.Error("FSS: Couldn't delete child=%s of path=%s after 10 tries\n", child, path)
+									logger.Error("Couldn't delete child %s after 10 tries", child.Name)
 									c <- 1
 								}
 
@@ -150,18 +158,17 @@ func (fss *FsService) RemoteDelete(message *comm.Message) {
 					localheader.Save()
 
 					// sync replicas
-					syncChan := fss.sendToReplicaNode(resolveResult, func(node *cluster.Node) *comm.Message {
-						msg := fss.comm.NewMsgMessage(fss.serviceId)
-						msg.Function = "RemoteDeleteReplica"
-						msg.Message.WriteString(path.String())                  // path
-						localheader.header.Version, _ = msg.Message.ReadInt64() // version
-						return msg
+					syncChan := fss.sendToReplicaNode(message, resolveResult, func(node *cluster.Node) (*comm.Message, os.Error) {
+						return fss.client.NewDeleteReplicaMessage(&DeleteReplicaRequest{
+							Path:    path.String(),
+							Version: localheader.header.Version,
+						})
 					})
 
 					// wait for sync
 					syncErr := <-syncChan
 					if syncErr != nil {
-						log.Error("FSS: Couldn't delete replica from nodes: %s\n", syncErr)
+						logger.Error("Couldn't delete replica from nodes: %s", syncErr)
 						fss.comm.RespondError(message, os.NewError(fmt.Sprintf("Couldn't replicate %s to nodes: %s", path.String(), syncErr)))
 						return
 					}
@@ -182,20 +189,25 @@ func (fss *FsService) RemoteDelete(message *comm.Message) {
 					parent := path.ParentPath()
 					if !path.Equals(parent) {
 
-						msg := fss.comm.NewMsgMessage(fss.serviceId)
-						msg.Function = "RemoteChildRemove"
+						msg, err := fss.client.NewChildRemoveMessage(&ChildRemoveRequest{
+							Path:  parent.String(),
+							Child: path.Parts[len(path.Parts)-1],
+						})
+						if err != nil {
+							logger.Error("Couldn't delete from parent: %s", err)
+							fss.comm.RespondError(message, err)
+							return
+						}
+						msg.Follow(message)
 						msg.LastTimeoutAsError = false
 
-						msg.Message.WriteString(parent.String())               // parent path
-						msg.Message.WriteString(path.Parts[len(path.Parts)-1]) // name
-
 						msg.Timeout = 1000 // TODO: Config
 						msg.OnTimeout = func(last bool) (retry bool, handled bool) {
 							if try < 10 {
 								try++
 								deleteparent()
 							} else {
-								log.Error("FSS: Couldn't delete path=%s from parent after 10 tries\n", path)
+								logger.Error("Couldn't delete from parent after 10 tries")
 								fss.comm.RespondError(message, os.NewError(fmt.Sprintf("Couldn't delete %s from parent after 10 tries.", path.String())))
 							}
 
@@ -225,13 +237,11 @@ func (fss *FsService) RemoteDelete(message *comm.Message) {
 	}
 }
 
-func (fss *FsService) RemoteDeleteReplica(message *comm.Message) {
-	// read payload
-	str, _ := message.Message.ReadString()
-	path := NewPath(str)                      // path
-	version, _ := message.Message.ReadInt64() // version
+func (fss *FsService) RemoteDeleteReplica(message *comm.Message, request *DeleteReplicaRequest) {
+	path := NewPath(request.Path)
+	version := request.Version
 
-	log.Debug("%d FSS: Received sync delete replica for path '%s' version '%d'\n", fss.cluster.MyNode.Id, path, version)
+	fss.logger.With("path", path.String(), "message", message.Id).Debug("Received sync delete replica for version %d", version)
 
 	// Get the header
 	localheader := fss.headers.GetFileHeader(path)
@@ -1,7 +1,6 @@
 package fs
 
 import (
-	"gostore/log"
 	"gostore/comm"
 	"os"
 )
@@ -11,20 +10,27 @@ import (
  * Exists
  */
 func (fss *FsService) Exists(path *Path, context *Context) (value bool, returnError os.Error) {
+	defer fss.observe("exists", fss.comm.Clock().Now(), &returnError)
+
 	if context == nil {
 		context = fss.NewContext()
 	}
 
-	message := fss.comm.NewMsgMessage(fss.serviceId)
-	message.Function = "RemoteExists"
+	message, err := fss.client.NewExistsMessage(&ExistsRequest{
+		Path:       path.String(),
+		ForceLocal: context.ForceLocal,
+	})
+	if err != nil {
+		return false, err
+	}
 	context.ApplyContext(message)
 
-	// write payload
-	message.Message.WriteString(path.String())    // path
-	message.Message.WriteBool(context.ForceLocal) // force local
-
 	message.OnResponse = func(response *comm.Message) {
-		value, returnError = response.Message.ReadBool()
+		var result *ExistsResponse
+		result, returnError = ReadExistsResponse(response)
+		if returnError == nil {
+			value = result.Exists
+		}
 		message.Wait <- true
 	}
 
@@ -45,14 +51,10 @@ func (fss *FsService) Exists(path *Path, context *Context) (value bool, returnEr
 	return
 }
 
-func (fss *FsService) RemoteExists(message *comm.Message) {
+func (fss *FsService) RemoteExists(message *comm.Message, request *ExistsRequest) {
+	path := NewPath(request.Path)
 
-	// Read payload
-	pathString, _ := message.Message.ReadString()
-	path := NewPath(pathString)                 // path
-	forceLocal, _ := message.Message.ReadBool() // force local
-
-	log.Debug("%d: FSS: Received new exists message for path %s\n", fss.cluster.MyNode.Id, path)
+	fss.logger.With("path", path.String(), "message", message.Id).Debug("Received new exists message")
 
 	result := fss.ring.Resolve(path.String())
 
@@ -61,18 +63,23 @@ func (fss *FsService) RemoteExists(message *comm.Message) {
 
 	// if file exists locally or its been handed off
 	if localheader.header.Exists {
-		response := fss.comm.NewMsgMessage(fss.serviceId)
-		response.Message.WriteBool(true)
-		fss.comm.RespondSource(message, response)
+		fss.respondExists(message, true)
 
 	} else {
 		// if I'm the master or we force local
-		if result.IsFirst(fss.cluster.MyNode) || forceLocal {
-			response := fss.comm.NewMsgMessage(fss.serviceId)
-			response.Message.WriteBool(false)
-			fss.comm.RespondSource(message, response)
+		if result.IsFirst(fss.cluster.MyNode) || request.ForceLocal {
+			fss.respondExists(message, false)
 		} else {
 			fss.comm.RedirectFirst(result, message)
 		}
 	}
 }
+
+func (fss *FsService) respondExists(message *comm.Message, exists bool) {
+	response, err := fss.client.NewExistsResponse(&ExistsResponse{Exists: exists})
+	if err != nil {
+		fss.comm.RespondError(message, err)
+		return
+	}
+	fss.comm.RespondSource(message, response)
+}
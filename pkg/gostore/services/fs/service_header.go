@@ -1,7 +1,6 @@
 package fs
 
 import (
-	"gostore/log"
 	"gostore/comm"
 	"os"
 	"bytes"
@@ -15,25 +14,30 @@ func (fss *FsService) Header(path *Path, context *Context) (header *FileHeader,
 	if returnError != nil {
 		return nil, returnError
 	}
-	return LoadFileHeaderFromJSON(bytes), nil
+	return LoadFileHeaderFromJSON(bytes)
 }
 
 
 func (fss *FsService) HeaderJSON(path *Path, context *Context) (returnValue []byte, returnError os.Error) {
+	defer fss.observe("header", fss.comm.Clock().Now(), &returnError)
+
 	if context == nil {
 		context = fss.NewContext()
 	}
 
-	message := fss.comm.NewMsgMessage(fss.serviceId)
-	message.Function = "RemoteHeader"
+	message, err := fss.client.NewHeaderMessage(&HeaderRequest{Path: path.String()})
+	if err != nil {
+		return nil, err
+	}
 	context.ApplyContext(message)
 
-	// write payload
-	message.Message.WriteString(path.String()) // path
-
 	message.OnResponse = func(response *comm.Message) {
-		returnValue = make([]byte, response.DataSize)
-		response.Data.Read(returnValue)
+		var result *HeaderResponse
+		result, returnError = ReadHeaderResponse(response)
+		if returnError == nil {
+			returnValue = make([]byte, result.DataSize)
+			result.Data.Read(returnValue)
+		}
 
 		message.Wait <- true
 	}
@@ -55,13 +59,11 @@ func (fss *FsService) HeaderJSON(path *Path, context *Context) (returnValue []by
 	return
 }
 
-func (fss *FsService) RemoteHeader(message *comm.Message) {
+func (fss *FsService) RemoteHeader(message *comm.Message, request *HeaderRequest) {
+	path := NewPath(request.Path)
 
-	// read payload
-	str, _ := message.Message.ReadString()
-	path := NewPath(str)
-
-	log.Debug("FSS: Received new need header message for path %s\n", path)
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received new need header message")
 
 	result := fss.ring.Resolve(path.String())
 
@@ -73,12 +75,21 @@ func (fss *FsService) RemoteHeader(message *comm.Message) {
 		if localheader.header.Exists || result.IsFirst(fss.cluster.MyNode) {
 
 			// respond data
-			response := fss.comm.NewDataMessage(fss.serviceId)
-
-			localheader := fss.headers.GetFileHeader(path)
-			header := localheader.header.ToJSON()
-			response.DataSize = int64(len(header))
-			response.Data = bytes.NewBuffer(header)
+			header, err := localheader.header.ToJSON()
+			if err != nil {
+				logger.Error("Couldn't marshal header: %s", err)
+				fss.comm.RespondError(message, err)
+				return
+			}
+
+			response, err := fss.client.NewHeaderResponse(&HeaderResponse{
+				Data:     bytes.NewBuffer(header),
+				DataSize: int64(len(header)),
+			})
+			if err != nil {
+				fss.comm.RespondError(message, err)
+				return
+			}
 
 			fss.comm.RespondSource(message, response)
 		} else {
@@ -90,16 +101,16 @@ func (fss *FsService) RemoteHeader(message *comm.Message) {
 	}
 }
 
-func (fss *FsService) RemoteReplicaVersion(message *comm.Message) {
-	// Read payload
-	str, _ := message.Message.ReadString() // path
-	path := NewPath(str)
-	version, _ := message.Message.ReadInt64()     // current version
-	nextversion, _ := message.Message.ReadInt64() // next version
-	size, _ := message.Message.ReadInt64()        // size
-	mimetype, _ := message.Message.ReadString()   // mimetype
+func (fss *FsService) RemoteReplicaVersion(message *comm.Message, request *ReplicaVersionRequest) {
+	path := NewPath(request.Path)
 
-	log.Debug("%d FSS: Received sync version replica for path '%s'\n", fss.cluster.MyNode.Id, path)
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received sync version replica %d", request.Version)
+
+	if message.Canceled() {
+		fss.comm.RespondError(message, comm.ErrorCanceled)
+		return
+	}
 
 	// Get the header
 	localheader := fss.headers.GetFileHeader(path)
@@ -108,10 +119,10 @@ func (fss *FsService) RemoteReplicaVersion(message *comm.Message) {
 	localheader.header.Path = path.String()
 	localheader.header.Name = path.BaseName()
 	localheader.header.Exists = true
-	localheader.header.Version = version
-	localheader.header.NextVersion = nextversion
-	localheader.header.MimeType = mimetype
-	localheader.header.Size = size
+	localheader.header.Version = request.Version
+	localheader.header.NextVersion = request.NextVersion
+	localheader.header.MimeType = request.Mimetype
+	localheader.header.Size = request.Size
 	localheader.Save()
 
 	// enqueue replication for background download
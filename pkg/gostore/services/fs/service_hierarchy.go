@@ -2,24 +2,29 @@ package fs
 
 import (
 	"gostore/comm"
-	"gostore/log"
 	"gostore/cluster"
 	"os"
 	"fmt"
 )
 
+const (
+	CHILDREN_STREAM_BATCH = 100 // Number of children per frame of a streamed listing
+)
+
 /*
  * Children
  */
-func (fss *FsService) RemoteChildAdd(message *comm.Message) {
-	// read payload
-	str, _ := message.Message.ReadString()
-	path := NewPath(str)                        // path
-	child, _ := message.Message.ReadString()    // name
-	mimetype, _ := message.Message.ReadString() // type
-	size, _ := message.Message.ReadInt64()      // size
+func (fss *FsService) RemoteChildAdd(message *comm.Message, request *ChildAddRequest) {
+	path := NewPath(request.Path)
+	child, mimetype, size := request.Name, request.Mimetype, request.Size
 
-	log.Debug("%d FSS: Received message to add new child '%s' to '%s' (size=%d, type=%s)\n", fss.cluster.MyNode.Id, child, path, size, mimetype)
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received message to add new child %s (size=%d, type=%s)", child, size, mimetype)
+
+	if message.Canceled() {
+		fss.comm.RespondError(message, comm.ErrorCanceled)
+		return
+	}
 
 	// resolve path
 	mynode := fss.cluster.MyNode
@@ -48,15 +53,24 @@ func (fss *FsService) RemoteChildAdd(message *comm.Message) {
 		go func() {
 			parent := path.ParentPath()
 			if !path.Equals(parent) {
-				msg := fss.comm.NewMsgMessage(fss.serviceId)
-				msg.Function = "RemoteChildAdd"
+				msg, err := fss.client.NewChildAddMessage(&ChildAddRequest{
+					Path:     parent.String(),
+					Name:     path.Parts[len(path.Parts)-1],
+					Mimetype: mimetype,
+					Size:     size,
+				})
+				if err != nil {
+					syncParent <- err
+					return
+				}
 
+				msg.Follow(message)
 				msg.Timeout = 5000 // TODO: Config
 				msg.Retries = 10
 				msg.RetryDelay = 100
 				msg.OnTimeout = func(last bool) (retry bool, handled bool) {
 					if last {
-						log.Error("%d FSS: Couln't add %s to parent after 10 tries\n", fss.cluster.MyNode.Id, path)
+						logger.Error("Couldn't add to parent after 10 tries")
 					}
 					return true, false
 				}
@@ -68,11 +82,6 @@ func (fss *FsService) RemoteChildAdd(message *comm.Message) {
 					syncParent <- nil
 				}
 
-				msg.Message.WriteString(parent.String())               // path
-				msg.Message.WriteString(path.Parts[len(path.Parts)-1]) // name
-				msg.Message.WriteString(mimetype)                      // type
-				msg.Message.WriteInt64(size)                           // size
-
 				parentResolve := fss.ring.Resolve(parent.String())
 				fss.comm.SendFirst(parentResolve, msg)
 			} else {
@@ -81,22 +90,14 @@ func (fss *FsService) RemoteChildAdd(message *comm.Message) {
 		}()
 
 		// replicate to nodes
-		syncChan := fss.sendToReplicaNode(resolv, func(node *cluster.Node) *comm.Message {
-			msg := fss.comm.NewMsgMessage(fss.serviceId)
-			msg.Function = "RemoteChildAdd"
-
-			msg.Message.WriteString(path.String()) // path
-			msg.Message.WriteString(child)         // name
-			msg.Message.WriteString(mimetype)      // type
-			msg.Message.WriteInt64(size)           // size
-
-			return msg
+		syncChan := fss.sendToReplicaNode(message, resolv, func(node *cluster.Node) (*comm.Message, os.Error) {
+			return fss.client.NewChildAddMessage(request)
 		})
 
 		// wait for replicas sync check for sync error
 		syncError := <-syncChan
 		if syncError != nil {
-			log.Error("FSS: Couldn't replicate add child to nodes: %s\n", syncError)
+			logger.Error("Couldn't replicate add child to nodes: %s", syncError)
 			fss.comm.RespondError(message, os.NewError(fmt.Sprintf("Couldn't replicate add child to nodes: %s\n", syncError)))
 			// TODO: ROLLBACK!!
 		}
@@ -104,7 +105,7 @@ func (fss *FsService) RemoteChildAdd(message *comm.Message) {
 		if !existed {
 			parentError := <-syncParent
 			if parentError != nil {
-				log.Error("FSS: Couldn't add myself to parent: %s\n", parentError)
+				logger.Error("Couldn't add myself to parent: %s", parentError)
 				fss.comm.RespondError(message, parentError)
 				// TODO: ROLLBACK!!
 			}
@@ -116,12 +117,12 @@ func (fss *FsService) RemoteChildAdd(message *comm.Message) {
 	fss.comm.RespondSource(message, msg)
 }
 
-func (fss *FsService) RemoteChildRemove(message *comm.Message) {
-	str, _ := message.Message.ReadString() // path
-	path := NewPath(str)
-	child, _ := message.Message.ReadString() // child
+func (fss *FsService) RemoteChildRemove(message *comm.Message, request *ChildRemoveRequest) {
+	path := NewPath(request.Path)
+	child := request.Child
 
-	log.Debug("FSS: Received message to remove the child %s from %s\n", child, path)
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received message to remove the child %s", child)
 
 	// resolve path
 	mynode := fss.cluster.MyNode
@@ -137,14 +138,8 @@ func (fss *FsService) RemoteChildRemove(message *comm.Message) {
 
 	if resolv.IsFirst(mynode) {
 		// replicate to nodes
-		syncChan := fss.sendToReplicaNode(resolv, func(node *cluster.Node) *comm.Message {
-			msg := fss.comm.NewMsgMessage(fss.serviceId)
-			msg.Function = "RemoteChildRemove"
-
-			msg.Message.WriteString(path.String()) // path
-			msg.Message.WriteString(child)         // child name
-
-			return msg
+		syncChan := fss.sendToReplicaNode(message, resolv, func(node *cluster.Node) (*comm.Message, os.Error) {
+			return fss.client.NewChildRemoveMessage(request)
 		})
 
 		// wait for replicas sync
@@ -152,7 +147,7 @@ func (fss *FsService) RemoteChildRemove(message *comm.Message) {
 
 		// check for sync error
 		if syncError != nil {
-			log.Error("FSS: Couldn't replicate remove child to nodes: %s\n", syncError)
+			logger.Error("Couldn't replicate remove child to nodes: %s", syncError)
 			fss.comm.RespondError(message, os.NewError("Couldn't replicate remove child to all nodes"))
 		}
 
@@ -166,29 +161,29 @@ func (fss *FsService) RemoteChildRemove(message *comm.Message) {
 }
 
 func (fss *FsService) Children(path *Path, context *Context) (returnValue []FileChild, returnError os.Error) {
+	defer fss.observe("children", fss.comm.Clock().Now(), &returnError)
+
 	if context == nil {
 		context = fss.NewContext()
 	}
 
-	message := fss.comm.NewMsgMessage(fss.serviceId)
-	message.Function = "RemoteChildrenList"
+	message, err := fss.client.NewChildrenListMessage(&ChildrenListRequest{
+		Path:       path.String(),
+		ForceLocal: context.ForceLocal,
+	})
+	if err != nil {
+		return nil, err
+	}
 	context.ApplyContext(message)
 
-	// write payload
-	message.Message.WriteString(path.String())    // path
-	message.Message.WriteBool(context.ForceLocal) // force local
-
 	message.OnResponse = func(response *comm.Message) {
-		count, _ := response.Message.ReadUint16() // children count
-		returnValue = make([]FileChild, count)
-
-		var i uint16
-		for i = 0; i < count; i++ {
-			name, _ := response.Message.ReadString()     // child name
-			mimetype, _ := response.Message.ReadString() // child mime type
-			size, _ := response.Message.ReadInt64()      // child size
-
-			returnValue[i] = NewFileChild(name, mimetype, size)
+		var result *ChildrenListResponse
+		result, returnError = ReadChildrenListResponse(response)
+		if returnError == nil {
+			returnValue = make([]FileChild, len(result.Children))
+			for i, child := range result.Children {
+				returnValue[i] = NewFileChild(child.Name, child.Mimetype, child.Size)
+			}
 		}
 
 		message.Wait <- true
@@ -211,12 +206,12 @@ func (fss *FsService) Children(path *Path, context *Context) (returnValue []File
 	return
 }
 
-func (fss *FsService) RemoteChildrenList(message *comm.Message) {
-	str, _ := message.Message.ReadString()
-	forceLocal, _ := message.Message.ReadBool()
-	path := NewPath(str)
+func (fss *FsService) RemoteChildrenList(message *comm.Message, request *ChildrenListRequest) {
+	path := NewPath(request.Path)
+	forceLocal := request.ForceLocal
 
-	log.Debug("FSS: Received message to list child for %s\n", path)
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received message to list children")
 
 	result := fss.ring.Resolve(path.String())
 
@@ -229,18 +224,17 @@ func (fss *FsService) RemoteChildrenList(message *comm.Message) {
 			children := localheader.header.Children
 
 			// Create the message to send back
-			var count uint16 = uint16(len(children))
-
-			response := fss.comm.NewMsgMessage(fss.serviceId)
-
-			// Write child count
-			response.Message.WriteUint16(count) // children count
-			for _, child := range children {
-				response.Message.WriteString(child.Name)     // name
-				response.Message.WriteString(child.MimeType) // type
-				response.Message.WriteInt64(child.Size)      // size
+			entries := make([]ChildEntry, len(children))
+			for i, child := range children {
+				entries[i] = ChildEntry{child.Name, child.MimeType, child.Size}
 			}
 
+			response, err := fss.client.NewChildrenListResponse(&ChildrenListResponse{Children: entries})
+			if err != nil {
+				logger.Error("Couldn't list children: %s", err)
+				fss.comm.RespondError(message, err)
+				return
+			}
 			fss.comm.RespondSource(message, response)
 
 		} else { // we don't have the header, we redirect to the appropriate node
@@ -263,3 +257,118 @@ func (fss *FsService) RemoteChildrenList(message *comm.Message) {
 		}
 	}
 }
+
+// Iterator over the children of a path, streamed by the node having its header
+type ChildrenIterator struct {
+	stream *comm.ResponseStream
+	batch  []ChildEntry
+}
+
+// Returns the next child, os.EOF once all children have been returned
+func (it *ChildrenIterator) Next() (child FileChild, err os.Error) {
+	for len(it.batch) == 0 {
+		frame, err := it.stream.Next()
+		if err != nil {
+			return child, err
+		}
+
+		response, err := ReadChildrenStreamResponse(frame)
+		if err != nil {
+			it.stream.Close()
+			return child, err
+		}
+		it.batch = response.Children
+	}
+
+	entry := it.batch[0]
+	it.batch = it.batch[1:]
+	return NewFileChild(entry.Name, entry.Mimetype, entry.Size), nil
+}
+
+// Stops the iteration before the end
+func (it *ChildrenIterator) Close() {
+	it.stream.Close()
+}
+
+// Lists the children of a path without having to hold all of them in a
+// single message, for directories with a lot of children.
+func (fss *FsService) ChildrenIter(path *Path, context *Context) (*ChildrenIterator, os.Error) {
+	if context == nil {
+		context = fss.NewContext()
+	}
+
+	message, err := fss.client.NewChildrenStreamMessage(&ChildrenStreamRequest{
+		Path:       path.String(),
+		ForceLocal: context.ForceLocal,
+	})
+	if err != nil {
+		return nil, err
+	}
+	context.ApplyContext(message)
+
+	var node *cluster.Node
+	if context.ForceLocal {
+		node = fss.cluster.MyNode
+	} else {
+		node = fss.ring.Resolve(path.String()).GetOnline(0)
+	}
+
+	return &ChildrenIterator{fss.comm.SendStream(node, message), nil}, nil
+}
+
+func (fss *FsService) RemoteChildrenStream(message *comm.Message, request *ChildrenStreamRequest) {
+	path := NewPath(request.Path)
+	forceLocal := request.ForceLocal
+
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received message to stream children")
+
+	result := fss.ring.Resolve(path.String())
+
+	// not one of the nodes, redirect (see RemoteChildrenList)
+	if !result.InOnlineNodes(fss.cluster.MyNode) {
+		if forceLocal {
+			fss.comm.RespondError(message, ErrorFileNotFound)
+		} else {
+			fss.comm.RedirectOne(result, message)
+		}
+		return
+	}
+
+	localheader := fss.headers.GetFileHeader(path)
+	if !localheader.header.Exists {
+		if result.IsFirst(fss.cluster.MyNode) || forceLocal {
+			fss.comm.RespondError(message, ErrorFileNotFound)
+		} else {
+			fss.comm.RedirectFirst(result, message)
+		}
+		return
+	}
+
+	// send the children by batches, as fast as the caller consumes them
+	children := localheader.header.Children
+	stream := fss.comm.OpenStream(message)
+	for start := 0; start < len(children); start += CHILDREN_STREAM_BATCH {
+		end := start + CHILDREN_STREAM_BATCH
+		if end > len(children) {
+			end = len(children)
+		}
+
+		entries := make([]ChildEntry, end-start)
+		for i, child := range children[start:end] {
+			entries[i] = ChildEntry{child.Name, child.MimeType, child.Size}
+		}
+
+		frame, err := fss.client.NewChildrenStreamResponse(&ChildrenStreamResponse{Children: entries})
+		if err != nil {
+			logger.Error("Couldn't stream children: %s", err)
+			stream.Error(err)
+			return
+		}
+		if err := stream.Send(frame); err != nil {
+			logger.Error("Couldn't stream children: %s", err)
+			return
+		}
+	}
+	stream.End()
+}
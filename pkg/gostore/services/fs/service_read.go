@@ -1,7 +1,6 @@
 package fs
 
 import (
-	"gostore/log"
 	"gostore/comm"
 	"os"
 	"io"
@@ -11,23 +10,30 @@ import (
  * Read
  */
 func (fss *FsService) Read(path *Path, offset int64, size int64, version int64, writer io.Writer, context *Context) (returnReadN int64, returnError os.Error) {
+	defer fss.observe("read", fss.comm.Clock().Now(), &returnError)
+
 	if context == nil {
 		context = fss.NewContext()
 	}
 
-	message := fss.comm.NewMsgMessage(fss.serviceId)
-	message.Function = "RemoteRead"
+	message, err := fss.client.NewReadMessage(&ReadRequest{
+		Path:       path.String(),
+		Offset:     offset,
+		Size:       size,
+		Version:    version,
+		ForceLocal: context.ForceLocal,
+	})
+	if err != nil {
+		return 0, err
+	}
 	context.ApplyContext(message)
 
-	// write payload
-	message.Message.WriteString(path.String())    // path
-	message.Message.WriteInt64(offset)            // offset
-	message.Message.WriteInt64(size)              // size
-	message.Message.WriteInt64(version)           // version
-	message.Message.WriteBool(context.ForceLocal) // force local
-
 	message.OnResponse = func(response *comm.Message) {
-		returnReadN, returnError = io.Copyn(writer, response.Data, response.DataSize)
+		var result *ReadResponse
+		result, returnError = ReadReadResponse(response)
+		if returnError == nil {
+			returnReadN, returnError = io.Copyn(writer, result.Data, result.DataSize)
+		}
 
 		message.Wait <- true
 	}
@@ -49,17 +55,12 @@ func (fss *FsService) Read(path *Path, offset int64, size int64, version int64,
 	return
 }
 
-func (fss *FsService) RemoteRead(message *comm.Message) {
-	// Read payload
-	str, _ := message.Message.ReadString() // path
-	path := NewPath(str)
-	offset, _ := message.Message.ReadInt64()    // offset
-	size, _ := message.Message.ReadInt64()      // size
-	version, _ := message.Message.ReadInt64()   // version
-	forceLocal, _ := message.Message.ReadBool() // force local
+func (fss *FsService) RemoteRead(message *comm.Message, request *ReadRequest) {
+	path := NewPath(request.Path)
+	offset, size, version := request.Offset, request.Size, request.Version
+	forceLocal := request.ForceLocal
 
-
-	log.Debug("FSS: Received new need read message for path %s, version %d, at offset %d, size of %d\n", path, version, offset, size)
+	fss.logger.With("path", path.String(), "message", message.Id).Debug("Received new need read message for version %d, at offset %d, size of %d", version, offset, size)
 
 	result := fss.ring.Resolve(path.String())
 
@@ -71,16 +72,21 @@ func (fss *FsService) RemoteRead(message *comm.Message) {
 		// if the file exists and we have it locally
 		if localheader.header.Exists && file.Exists() {
 			// Send it back
-			response := fss.comm.NewDataMessage(fss.serviceId)
-
 			// TODO: Handle offset
-			response.Message.WriteInt64(offset)                     // offset
-			response.Message.WriteInt64(localheader.header.Version) // version
-
 			// TODO: Handle the asked read size
-			response.DataSize = localheader.header.Size
-			response.Data = io.Reader(file)
+			response, err := fss.client.NewReadResponse(&ReadResponse{
+				Offset:   offset,
+				Version:  localheader.header.Version,
+				Data:     io.Reader(file),
+				DataSize: localheader.header.Size,
+			})
+			if err != nil {
+				file.Close()
+				fss.comm.RespondError(message, err)
+				return
+			}
 			response.DataAutoClose = true
+			response.MimeType = localheader.header.MimeType
 
 			fss.comm.RespondSource(message, response)
 		} else {
@@ -2,7 +2,6 @@ package fs
 
 import (
 	"gostore/comm"
-	"gostore/log"
 	"gostore/cluster"
 	"time"
 	"fmt"
@@ -27,8 +26,9 @@ func (fss *FsService) replicationWatcher() {
 
 				path := next.Value.(*Path)
 				localheader := fss.headers.GetFileHeader(path)
+				logger := fss.logger.With("path", path.String())
 
-				log.Info("%d: FSS: Starting replica download for path %s version %d...", fss.cluster.MyNode.Id, path, localheader.header.Version)
+				logger.Info("Starting replica download for version %d...", localheader.header.Version)
 
 				// TODO: Make sure we don't download the same replica twice...
 
@@ -44,19 +44,19 @@ func (fss *FsService) replicationWatcher() {
 						fd.Close()
 						if err == nil {
 							os.Rename(tempfile, file.datapath)
-							log.Info("%d: FSS: Successfully replicated %s version %d locally", fss.cluster.MyNode.Id, path, localheader.header.Version)
+							logger.Info("Successfully replicated version %d locally", localheader.header.Version)
 
 						} else {
-							log.Error("%d: FSS: Couldn't replicate file %s locally because couldn't read: %s", fss.cluster.MyNode.Id, path, err)
+							logger.Error("Couldn't replicate file locally because couldn't read: %s", err)
 						}
 
 					} else {
-						log.Error("%d: FSS: Couldn't open temporary file %s to download replica localy for path %s", fss.cluster.MyNode.Id, tempfile, path)
+						logger.Error("Couldn't open temporary file %s to download replica locally", tempfile)
 						os.Remove(tempfile)
 					}
 
 				} else {
-					log.Info("%d: FSS: Local replica for %s version %d already exist", fss.cluster.MyNode.Id, path, localheader.header.Version)
+					logger.Info("Local replica for version %d already exist", localheader.header.Version)
 				}
 
 			} else {
@@ -72,7 +72,7 @@ func (fss *FsService) replicationWatcher() {
 
 		// TODO: Put that in configuration
 		if !fss.replForce {
-			time.Sleep(100 * 1000 * 1000)
+			<-fss.comm.Clock().After(100 * 1000 * 1000)
 		}
 	}
 }
@@ -81,8 +81,8 @@ func (fss *FsService) Flush() os.Error {
 	fss.replForce = true
 
 	for fss.replQueue.Len() > 0 || fss.replForce {
-		// sleep 1ms
-		time.Sleep(1000000)
+		// sleep 1ms, on the clock of the communication layer
+		<-fss.comm.Clock().After(1000000)
 	}
 
 	return nil
@@ -95,7 +95,7 @@ func (fss *FsService) replicationEnqueue(path *Path) {
 }
 
 
-func (fss *FsService) sendToReplicaNode(resolv *cluster.ResolveResult, req_cb func(node *cluster.Node) *comm.Message) chan os.Error {
+func (fss *FsService) sendToReplicaNode(parent *comm.Message, resolv *cluster.ResolveResult, req_cb func(node *cluster.Node) (*comm.Message, os.Error)) chan os.Error {
 	toSyncCount := resolv.Count() - 1 // minus one for the master
 	var syncError os.Error = nil
 	myNodeId := fss.cluster.MyNode.Id
@@ -106,26 +106,34 @@ func (fss *FsService) sendToReplicaNode(resolv *cluster.ResolveResult, req_cb fu
 		go func() {
 			for i := 0; i < resolv.Count(); i++ {
 				node := resolv.Get(i)
+				logger := fss.logger.With("message", parent.Id, "replica", node.Id)
 
 				if node.Status == cluster.Status_Online && node.Id != myNodeId {
 					// get the new message
-					req := req_cb(node)
+					req, err := req_cb(node)
+					if err != nil {
+						syncError = err
+						logger.Error("Couldn't build message to replicate: %s", err)
+						c <- true
+						continue
+					}
+					req.Follow(parent)
 
 					req.Timeout = 1000 // TODO: Config
 					req.OnResponse = func(message *comm.Message) {
-						log.Debug("%d: FSS: Received acknowledge message for message %s\n", fss.cluster.MyNode.Id, req)
+						logger.Debug("Received acknowledge message for message %s", req)
 						c <- true
 					}
 					req.OnTimeout = func(last bool) (retry bool, handled bool) {
 						// TODO: Retry it!
 						syncError = comm.ErrorTimeout
-						log.Error("%d: FSS: Couldn't send message to replicate node %s because of a timeout for message %s\n", fss.cluster.MyNode.Id, node, req)
+						logger.Error("Couldn't send message to replica because of a timeout for message %s", req)
 						c <- true
 
 						return true, false
 					}
 					req.OnError = func(message *comm.Message, syncError os.Error) {
-						log.Error("%d: FSS: Received an error while sending to replica %s for message %s: %d %s\n", fss.cluster.MyNode.Id, req, node, syncError)
+						logger.Error("Received an error while sending to replica for message %s: %s", req, syncError)
 						c <- true
 					}
 
@@ -2,7 +2,6 @@ package fs
 
 import (
 	"gostore/comm"
-	"gostore/log"
 	"gostore/cluster"
 	"os"
 	"time"
@@ -15,20 +14,25 @@ import (
  * Write
  */
 func (fss *FsService) Write(path *Path, size int64, mimetype string, data io.Reader, context *Context) (returnError os.Error) {
+	defer fss.observe("write", fss.comm.Clock().Now(), &returnError)
+
 	if context == nil {
 		context = fss.NewContext()
 	}
 
-	message := fss.comm.NewDataMessage(fss.serviceId)
-	message.Function = "RemoteWrite"
+	message, err := fss.client.NewWriteMessage(&WriteRequest{
+		Path:     path.String(),
+		Mimetype: mimetype,
+		Data:     data,
+		DataSize: size,
+	})
+	if err != nil {
+		return err
+	}
+	message.MimeType = mimetype
+	message.DataChecksum = true // corrupted data is sent again instead of being stored
 	context.ApplyContext(message)
 
-	// write payload
-	message.Message.WriteString(path.String()) // path
-	message.Message.WriteString(mimetype)      // mimetype
-	message.Data = data
-	message.DataSize = size
-
 	message.OnResponse = func(response *comm.Message) {
 		message.Wait <- true
 	}
@@ -51,19 +55,17 @@ func (fss *FsService) Write(path *Path, size int64, mimetype string, data io.Rea
 }
 
 
-func (fss *FsService) RemoteWrite(message *comm.Message) {
-	// read payload
-	str, _ := message.Message.ReadString() // path
-	path := NewPath(str)
-	mimetype, _ := message.Message.ReadString() // mimetype
+func (fss *FsService) RemoteWrite(message *comm.Message, request *WriteRequest) {
+	path := NewPath(request.Path)
+	mimetype := request.Mimetype
 
-
-	log.Debug("%d FSS: Received new write message for path %s and size of %d and type %s\n", fss.cluster.MyNode.Id, path, message.DataSize, mimetype)
+	logger := fss.logger.With("path", path.String(), "message", message.Id)
+	logger.Debug("Received new write message of size %d and type %s", message.DataSize, mimetype)
 
 	resolveResult := fss.ring.Resolve(path.String())
 
 	if !resolveResult.IsFirst(fss.cluster.MyNode) {
-		log.Error("FSS: Received write for which I'm not master: %s\n", message)
+		logger.Error("Received write for which I'm not master: %s", message)
 		fss.comm.RespondError(message, os.NewError(fmt.Sprintf("Cannot accept write, I'm not the master for %s", path)))
 		return
 	}
@@ -74,15 +76,20 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 	fd, err := os.Create(tempfile)
 	if err != nil {
 		os.Remove(tempfile)
-		log.Error("%d: FSS: Got an error while creating a temporary file (%s) for write of %s: %s", tempfile, path, err)
+		logger.Error("Got an error while creating a temporary file (%s): %s", tempfile, err)
 		fss.comm.RespondError(message, os.NewError(fmt.Sprintf("Got an error while creating a temporary file: %s", err)))
 		return
 	}
 
-	_, err = io.Copyn(fd, message.Data, message.DataSize)
+	_, err = io.Copyn(fd, request.Data, request.DataSize)
 	if err != nil && err != os.EOF {
-		log.Error("%d: FSS: Got an error while creating a temporary file (%s) for write of %s: %s", tempfile, path, err)
-		fss.comm.RespondError(message, os.NewError(fmt.Sprintf("Got an error while creating a temporary file: %s", err)))
+		logger.Error("Got an error while creating a temporary file (%s): %s", tempfile, err)
+		if err == comm.ErrorCorrupted {
+			// kept as is, so that the source sends the data again
+			fss.comm.RespondError(message, err)
+		} else {
+			fss.comm.RespondError(message, os.NewError(fmt.Sprintf("Got an error while creating a temporary file: %s", err)))
+		}
 
 		fd.Close()
 		os.Remove(tempfile)
@@ -91,6 +98,14 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 
 	fd.Close()
 
+	// last chance to abort before the write is committed
+	if message.Canceled() {
+		logger.Debug("Write canceled")
+		os.Remove(tempfile)
+		fss.comm.RespondError(message, comm.ErrorCanceled)
+		return
+	}
+
 	fss.Lock(path.String())
 	localheader := fss.headers.GetFileHeader(path)
 	version := localheader.header.NextVersion
@@ -98,7 +113,7 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 	localheader.header.Path = path.String()
 	localheader.header.Name = path.BaseName()
 	localheader.header.MimeType = mimetype
-	localheader.header.Size = message.DataSize
+	localheader.header.Size = request.DataSize
 	localheader.header.Version = version
 	localheader.header.Exists = true
 
@@ -114,15 +129,24 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 	go func() {
 		parent := path.ParentPath()
 		if !path.Equals(parent) {
-			req := fss.comm.NewMsgMessage(fss.serviceId)
-			req.Function = "RemoteChildAdd"
+			req, err := fss.client.NewChildAddMessage(&ChildAddRequest{
+				Path:     parent.String(),
+				Name:     path.Parts[len(path.Parts)-1],
+				Mimetype: mimetype,
+				Size:     request.DataSize,
+			})
+			if err != nil {
+				syncParent <- err
+				return
+			}
 
+			req.Follow(message)
 			req.Timeout = 5000 // TODO: Config
 			req.Retries = 10
 			req.RetryDelay = 100
 			req.OnTimeout = func(last bool) (retry bool, handled bool) {
 				if last {
-					log.Error("%d FSS: Couln't add %s to parent after 10 tries\n", fss.cluster.MyNode.Id, path)
+					logger.Error("Couldn't add to parent after 10 tries")
 				}
 				return true, false
 			}
@@ -134,11 +158,6 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 				syncParent <- nil
 			}
 
-			req.Message.WriteString(parent.String())               // path
-			req.Message.WriteString(path.Parts[len(path.Parts)-1]) // name
-			req.Message.WriteString(mimetype)                      // type
-			req.Message.WriteInt64(message.DataSize)               // size
-
 			parentResolve := fss.ring.Resolve(parent.String())
 			fss.comm.SendFirst(parentResolve, req)
 		} else {
@@ -147,22 +166,19 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 	}()
 
 	// send new header to all replicas
-	syncReplica := fss.sendToReplicaNode(resolveResult, func(node *cluster.Node) *comm.Message {
-		req := fss.comm.NewMsgMessage(fss.serviceId)
-		req.Function = "RemoteReplicaVersion"
-
-		req.Message.WriteString(path.String())                 // path
-		req.Message.WriteInt64(localheader.header.Version)     // current version
-		req.Message.WriteInt64(localheader.header.NextVersion) // next version
-		req.Message.WriteInt64(localheader.header.Size)        // size
-		req.Message.WriteString(localheader.header.MimeType)   // mimetype
-
-		return req
+	syncReplica := fss.sendToReplicaNode(message, resolveResult, func(node *cluster.Node) (*comm.Message, os.Error) {
+		return fss.client.NewReplicaVersionMessage(&ReplicaVersionRequest{
+			Path:        path.String(),
+			Version:     localheader.header.Version,
+			NextVersion: localheader.header.NextVersion,
+			Size:        localheader.header.Size,
+			Mimetype:    localheader.header.MimeType,
+		})
 	})
 
 	replicaError := <-syncReplica
 	if replicaError != nil {
-		log.Error("FSS: Couldn't replicate header to nodes: %s\n", replicaError)
+		logger.Error("Couldn't replicate header to nodes: %s", replicaError)
 		fss.comm.RespondError(message, replicaError)
 		return
 
@@ -171,7 +187,7 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 
 	parentError := <-syncParent
 	if parentError != nil {
-		log.Error("FSS: Couldn't add myself to parent: %s\n", parentError)
+		logger.Error("Couldn't add myself to parent: %s", parentError)
 		fss.comm.RespondError(message, parentError)
 		return
 
@@ -179,7 +195,7 @@ func (fss *FsService) RemoteWrite(message *comm.Message) {
 	}
 
 	// confirm
-	log.Debug("%d FSS: Sending write confirmation for path %s message %s\n", fss.cluster.MyNode.Id, path, message)
+	logger.Debug("Sending write confirmation for message %s", message)
 	response := fss.comm.NewMsgMessage(fss.serviceId)
 	fss.comm.RespondSource(message, response)
 }
@@ -1,112 +1,213 @@
 // Author: Andre-Philippe Paquet
 // Date: November 2010
 
+// Consistent hashing ring. Elements are kept sorted by hash in an immutable
+// snapshot that is replaced by a copy on every change, so that resolving
+// never waits on a change being made, and elements returned by a resolution
+// keep walking the snapshot they were resolved in.
 package hashring
 
 import (
-	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 type HashRing struct {
-	list *list.List
+	mutex *sync.Mutex // serializes changes
+
+	snapshot unsafe.Pointer // *snapshot, only loaded and stored atomically
+}
+
+// Immutable elements of the ring, sorted by hash
+type snapshot struct {
+	elements []Element
+	values   []interface{} // distinct values of the elements
 }
 
 func NewRing() *HashRing {
 	ring := new(HashRing)
-	ring.list = list.New()
+	ring.mutex = new(sync.Mutex)
+	ring.setSnapshot(new(snapshot))
 	return ring
 }
 
+// Returns the current snapshot without locking, so that resolving never waits
+func (r *HashRing) getSnapshot() *snapshot {
+	return (*snapshot)(atomic.LoadPointer(&r.snapshot))
+}
 
-func (r *HashRing) resolveElement(hash string) *list.Element {
-	curelem := r.list.Front()
-	if curelem == nil {
-		return curelem
-	}
-
-	curringelem := (curelem.Value).(*Element)
-	if hash <= curringelem.Hash {
-		return curelem
-	}
+func (r *HashRing) setSnapshot(snap *snapshot) {
+	atomic.StorePointer(&r.snapshot, unsafe.Pointer(snap))
+}
 
-	if hash > r.list.Back().Value.(*Element).Hash {
-		return nil
-	}
+// Returns the index of the first element whose hash is greater or equal
+// to the hash, or the number of elements if there is none
+func (s *snapshot) search(hash string) int {
+	return sort.Search(len(s.elements), func(i int) bool { return s.elements[i].Hash >= hash })
+}
 
-	for curelem != nil && hash > curringelem.Hash {
-		nextelem := curelem.Next()
+// Returns a new snapshot of the given elements, in order
+func newSnapshot(elements []*Element) *snapshot {
+	snap := &snapshot{make([]Element, len(elements)), make([]interface{}, 0)}
+	seen := make(map[interface{}]bool)
+	for i, ringelem := range elements {
+		snap.elements[i] = Element{ringelem.Hash, ringelem.Value, i, snap}
 
-		if nextelem == nil || hash <= (nextelem.Value).(*Element).Hash {
-			return nextelem
-		} else {
-			curelem = nextelem
-			curringelem = (nextelem.Value).(*Element)
+		if !seen[ringelem.Value] {
+			seen[ringelem.Value] = true
+			snap.values = append(snap.values, ringelem.Value)
 		}
 	}
+	return snap
+}
 
-	return nil
+// Returns the elements of the snapshot
+func (s *snapshot) list() []*Element {
+	elements := make([]*Element, len(s.elements))
+	for i := range s.elements {
+		elements[i] = &s.elements[i]
+	}
+	return elements
 }
 
 func (r *HashRing) AddElement(ringelem *Element) {
-	var elem *list.Element
-	elemhash := ringelem.Hash
+	r.AddElements(ringelem)
+}
+
+// Adds many elements at once, copying the ring only once
+func (r *HashRing) AddElements(ringelems ...*Element) {
+	r.update(nil, ringelems)
+}
+
+// Removes all elements having the given value
+func (r *HashRing) RemoveValue(value interface{}) int {
+	return r.ReplaceValue(value)
+}
+
+// Replaces all elements having the given value by new elements in a single
+// change, returning the number of elements removed
+func (r *HashRing) ReplaceValue(value interface{}, ringelems ...*Element) int {
+	return r.update(func(ringelem *Element) bool { return ringelem.Value == value }, ringelems)
+}
+
+// Returns a ring having the current elements of this one. Changes made to
+// one of the rings afterward don't affect the other.
+func (r *HashRing) Copy() *HashRing {
+	ring := NewRing()
+	ring.setSnapshot(r.getSnapshot())
+	return ring
+}
 
-	nextelem := r.resolveElement(elemhash)
-	if nextelem == nil {
-		if r.list.Front() != nil {
-			elem = r.list.PushBack(ringelem)
+// Removes the current elements matching the remove function (if any) and
+// adds new elements, replacing the snapshot once. Returns the number of
+// elements removed.
+func (r *HashRing) update(remove func(*Element) bool, ringelems []*Element) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	added := make(elementsByHash, len(ringelems))
+	copy(added, ringelems)
+	sort.Sort(added)
+
+	current := r.getSnapshot().list()
+	removed := 0
+	if remove != nil {
+		kept := current[:0]
+		for _, ringelem := range current {
+			if remove(ringelem) {
+				removed++
+			} else {
+				kept = append(kept, ringelem)
+			}
+		}
+		current = kept
+	}
+
+	// merge the sorted new elements into the current ones. New elements go
+	// before current ones of the same hash.
+	merged := make([]*Element, 0, len(current)+len(added))
+	for len(current) > 0 || len(added) > 0 {
+		if len(current) == 0 || (len(added) > 0 && added[0].Hash <= current[0].Hash) {
+			merged = append(merged, added[0])
+			added = added[1:]
 		} else {
-			elem = r.list.PushFront(ringelem)
+			merged = append(merged, current[0])
+			current = current[1:]
 		}
-	} else {
-		elem = r.list.InsertBefore(ringelem, nextelem)
 	}
 
-	ringelem.elem = elem
-	ringelem.ring = r
+	if removed > 0 || len(ringelems) > 0 {
+		r.setSnapshot(newSnapshot(merged))
+	}
+	return removed
 }
 
 func (r *HashRing) FirstElement() *Element {
-	front := r.list.Front()
-	if front != nil {
-		return front.Value.(*Element)
+	snap := r.getSnapshot()
+	if len(snap.elements) > 0 {
+		return &snap.elements[0]
 	}
 
 	return nil
 }
 
-func (r *HashRing) RemoveElement(ringelem *Element) {
-	hash := ringelem.Hash
-	nextelem := r.resolveElement(hash)
+// Removes the first element having the hash of the given element. Returns
+// false if the ring has no element with this hash.
+func (r *HashRing) RemoveElement(ringelem *Element) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	if nextelem.Value.(*Element).Hash == hash {
-		r.list.Remove(nextelem)
+	snap := r.getSnapshot()
+	i := snap.search(ringelem.Hash)
+	if i == len(snap.elements) || snap.elements[i].Hash != ringelem.Hash {
+		return false
 	}
+
+	elements := snap.list()
+	r.setSnapshot(newSnapshot(append(elements[:i], elements[i+1:]...)))
+	return true
 }
 
+// Returns the number of elements in the ring
+func (r *HashRing) Count() int {
+	return len(r.getSnapshot().elements)
+}
 
+// Returns the distinct values of the elements, in the order of their first
+// element in the ring. The slice must not be modified.
+func (r *HashRing) Values() []interface{} {
+	return r.getSnapshot().values
+}
+
+// Returns the first element whose hash is greater or equal to the hash,
+// wrapping around to the first element of the ring
 func (r *HashRing) ResolveString(hash string) *Element {
-	nextelem := r.resolveElement(hash)
+	snap := r.getSnapshot()
+	if len(snap.elements) == 0 {
+		return nil
+	}
 
-	if nextelem == nil {
-		if r.list.Front() != nil {
-			return r.list.Front().Value.(*Element)
-		} else {
-			return nil
-		}
+	i := snap.search(hash)
+	if i == len(snap.elements) {
+		i = 0
 	}
 
-	return nextelem.Value.(*Element)
+	return &snap.elements[i]
 }
 
 
 type Element struct {
 	Hash  string
 	Value interface{}
-	elem  *list.Element
-	ring  *HashRing
+
+	index    int
+	snapshot *snapshot
 }
 
+// Returns a new element to add to a ring. Only elements returned by the ring
+// can be walked with Next.
 func NewElement(hash string, value interface{}) *Element {
 	re := new(Element)
 	re.Value = value
@@ -114,11 +215,20 @@ func NewElement(hash string, value interface{}) *Element {
 	return re
 }
 
+// Returns the next element of the ring, wrapping around to the first one, or
+// nil if the element doesn't come from a ring
 func (re *Element) Next() *Element {
-	next := re.elem.Next()
-	if next != nil {
-		return next.Value.(*Element)
+	if re.snapshot == nil {
+		return nil
 	}
 
-	return re.ring.list.Front().Value.(*Element)
+	elements := re.snapshot.elements
+	return &elements[(re.index+1)%len(elements)]
 }
+
+
+type elementsByHash []*Element
+
+func (e elementsByHash) Len() int           { return len(e) }
+func (e elementsByHash) Less(i, j int) bool { return e[i].Hash < e[j].Hash }
+func (e elementsByHash) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -4,7 +4,12 @@
 package hashring_test
 
 import (
+	"container/list"
+	"crypto/md5"
+	"fmt"
 	"gostore/tools/hashring"
+	"sort"
+	"strconv"
 	"testing"
 )
 
@@ -82,3 +87,226 @@ func TestRemoveElement(t *testing.T) {
 		t.Errorf("4) aaa should resolve to bcd: %s", node)
 	}
 }
+
+func TestAddElements(t *testing.T) {
+	ring := hashring.NewRing()
+
+	ring.AddElement(hashring.NewElement("def", "def"))
+	ring.AddElements(hashring.NewElement("ghi", "ghi"), hashring.NewElement("abc", "abc"), hashring.NewElement("bcd", "bcd"))
+
+	if ring.Count() != 4 {
+		t.Errorf("1) Ring should have 4 elements: %d", ring.Count())
+	}
+
+	expected := []string{"abc", "bcd", "def", "ghi", "abc"}
+	node := ring.FirstElement()
+	for i, hash := range expected {
+		if node.Hash != hash {
+			t.Errorf("%d) Element should be %s: %s", i+2, hash, node.Hash)
+		}
+		node = node.Next()
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ring := hashring.NewRing()
+
+	ring.AddElements(hashring.NewElement("abc", "abc"), hashring.NewElement("def", "def"))
+	node := ring.ResolveString("bbb")
+
+	// changes to the ring don't affect already resolved elements
+	ring.AddElement(hashring.NewElement("fgh", "fgh"))
+	ring.RemoveElement(hashring.NewElement("abc", "abc"))
+
+	if node.Hash != "def" || node.Next().Hash != "abc" {
+		t.Errorf("1) Resolved element should still be followed by abc: %s", node.Next().Hash)
+	}
+
+	node = ring.ResolveString("bbb")
+	if node.Hash != "def" || node.Next().Hash != "fgh" {
+		t.Errorf("2) New resolution should be followed by fgh: %s", node.Next().Hash)
+	}
+
+	// removing a missing element doesn't change anything
+	if ring.RemoveElement(hashring.NewElement("xyz", "xyz")) {
+		t.Errorf("3) Missing element shouldn't have been removed")
+	}
+	if ring.Count() != 2 {
+		t.Errorf("4) Ring should have 2 elements: %d", ring.Count())
+	}
+
+	// elements not resolved from a ring can't be walked
+	if next := hashring.NewElement("abc", "abc").Next(); next != nil {
+		t.Errorf("5) New element shouldn't have a next element: %s", next.Hash)
+	}
+}
+
+func TestReplaceValue(t *testing.T) {
+	ring := hashring.NewRing()
+
+	ring.AddElements(hashring.NewElement("abc", "a"), hashring.NewElement("def", "b"), hashring.NewElement("ghi", "a"))
+	copied := ring.Copy()
+
+	removed := ring.ReplaceValue("a", hashring.NewElement("bcd", "a"))
+	if removed != 2 || ring.Count() != 2 {
+		t.Errorf("1) Should have removed 2 elements and have 2 left: %d, %d", removed, ring.Count())
+	}
+
+	node := ring.ResolveString("zzz")
+	if node.Hash != "bcd" || node.Next().Hash != "def" {
+		t.Errorf("2) zzz should resolve to bcd, followed by def: %s", node.Hash)
+	}
+
+	// the copy still has the previous elements
+	node = copied.ResolveString("zzz")
+	if copied.Count() != 3 || node.Hash != "abc" {
+		t.Errorf("3) Copy should still resolve zzz to abc: %s", node.Hash)
+	}
+
+	removed = ring.RemoveValue("b")
+	if removed != 1 || ring.Count() != 1 || ring.FirstElement().Value != "a" {
+		t.Errorf("4) Only bcd should be left: %d", ring.Count())
+	}
+}
+
+func TestValues(t *testing.T) {
+	ring := hashring.NewRing()
+
+	ring.AddElements(hashring.NewElement("abc", "b"), hashring.NewElement("def", "a"), hashring.NewElement("ghi", "b"))
+	values := ring.Values()
+	if len(values) != 2 || values[0] != "b" || values[1] != "a" {
+		t.Errorf("1) Values should be b and a: %s", values)
+	}
+
+	ring.RemoveValue("b")
+	values = ring.Values()
+	if len(values) != 1 || values[0] != "a" {
+		t.Errorf("2) Values should be a: %s", values)
+	}
+}
+
+
+/*
+ * Benchmarks, compared to the previous linked list implementation
+ */
+var (
+	benchRings     = make(map[int]*hashring.HashRing)
+	benchListRings = make(map[int]*listRing)
+)
+
+func benchHash(i int) string {
+	hash := md5.New()
+	hash.Write([]byte(strconv.Itoa(i)))
+	return fmt.Sprintf("%x", hash.Sum())
+}
+
+func benchRing(b *testing.B, tokens int) *hashring.HashRing {
+	if ring, found := benchRings[tokens]; found {
+		return ring
+	}
+
+	b.StopTimer()
+	elements := make([]*hashring.Element, tokens)
+	for i := 0; i < tokens; i++ {
+		elements[i] = hashring.NewElement(benchHash(i), i)
+	}
+	ring := hashring.NewRing()
+	ring.AddElements(elements...)
+	benchRings[tokens] = ring
+	b.StartTimer()
+
+	return ring
+}
+
+func benchListRing(b *testing.B, tokens int) *listRing {
+	if ring, found := benchListRings[tokens]; found {
+		return ring
+	}
+
+	b.StopTimer()
+	hashes := make([]string, tokens)
+	for i := 0; i < tokens; i++ {
+		hashes[i] = benchHash(i)
+	}
+	sort.SortStrings(hashes)
+
+	// elements are pushed in order, adding them one by one would take ages
+	ring := &listRing{list.New()}
+	for _, hash := range hashes {
+		ring.list.PushBack(hashring.NewElement(hash, hash))
+	}
+	benchListRings[tokens] = ring
+	b.StartTimer()
+
+	return ring
+}
+
+func benchResolve(b *testing.B, tokens int) {
+	ring := benchRing(b, tokens)
+	for i := 0; i < b.N; i++ {
+		ring.ResolveString(benchHash(i))
+	}
+}
+
+func benchListResolve(b *testing.B, tokens int) {
+	ring := benchListRing(b, tokens)
+	for i := 0; i < b.N; i++ {
+		ring.ResolveString(benchHash(i))
+	}
+}
+
+func BenchmarkResolve1k(b *testing.B)   { benchResolve(b, 1000) }
+func BenchmarkResolve10k(b *testing.B)  { benchResolve(b, 10000) }
+func BenchmarkResolve100k(b *testing.B) { benchResolve(b, 100000) }
+
+func BenchmarkListResolve1k(b *testing.B)   { benchListResolve(b, 1000) }
+func BenchmarkListResolve10k(b *testing.B)  { benchListResolve(b, 10000) }
+func BenchmarkListResolve100k(b *testing.B) { benchListResolve(b, 100000) }
+
+// Previous implementation of the ring lookup, walking a sorted linked list
+type listRing struct {
+	list *list.List
+}
+
+func (r *listRing) resolveElement(hash string) *list.Element {
+	curelem := r.list.Front()
+	if curelem == nil {
+		return curelem
+	}
+
+	curringelem := (curelem.Value).(*hashring.Element)
+	if hash <= curringelem.Hash {
+		return curelem
+	}
+
+	if hash > r.list.Back().Value.(*hashring.Element).Hash {
+		return nil
+	}
+
+	for curelem != nil && hash > curringelem.Hash {
+		nextelem := curelem.Next()
+
+		if nextelem == nil || hash <= (nextelem.Value).(*hashring.Element).Hash {
+			return nextelem
+		} else {
+			curelem = nextelem
+			curringelem = (nextelem.Value).(*hashring.Element)
+		}
+	}
+
+	return nil
+}
+
+func (r *listRing) ResolveString(hash string) *hashring.Element {
+	nextelem := r.resolveElement(hash)
+
+	if nextelem == nil {
+		if r.list.Front() != nil {
+			return r.list.Front().Value.(*hashring.Element)
+		} else {
+			return nil
+		}
+	}
+
+	return nextelem.Value.(*hashring.Element)
+}
@@ -0,0 +1,155 @@
+// Linearizability checker of histories of concurrent operations, used to test
+// the consistency of services against a sequential model of what they do.
+package linearizability
+
+import (
+	"bytes"
+)
+
+// Sequential specification of the object operations are made on
+type Model interface {
+	// Returns the initial state
+	Init() interface{}
+
+	// Applies an operation to a state. Returns false if the output can't be
+	// returned from this state, else the new state. The output is nil if the
+	// operation is pending (its outcome is unknown).
+	Step(state interface{}, input interface{}, output interface{}) (ok bool, next interface{})
+
+	// Returns a key identifying a state, equal for equivalent states
+	Key(state interface{}) string
+}
+
+type Result struct {
+	Linearizable bool
+
+	// Order in which the operations took effect, if linearizable. Pending
+	// operations that never took effect aren't in it.
+	Linearization []Operation
+
+	// Smallest set of operations of the history whose outputs can't be
+	// explained, only if not linearizable. The history stays not
+	// linearizable if the outcome of all the other operations is unknown
+	// (they may or may not have taken effect), but becomes linearizable if
+	// the outcome of any of these ones is unknown too.
+	Minimal []Operation
+}
+
+// Checks if a history is linearizable: if its operations can be ordered so
+// that each one takes effect at once between its call and its return and the
+// outputs are those of the model. The history of independent objects (the
+// files of a file system) should be checked one object at a time, which is
+// much faster.
+func Check(model Model, operations []Operation) Result {
+	order, ok := linearize(model, operations)
+	if ok {
+		return Result{Linearizable: true, Linearization: order}
+	}
+	return Result{Linearizable: false, Minimal: minimize(model, operations)}
+}
+
+// Search of a linearization, trying the operations that can take effect
+// first one after the other and backtracking (Wing & Gong). The states
+// already explored with the same operations done aren't explored again.
+type search struct {
+	model      Model
+	operations []Operation
+	visited    map[string]bool
+	order      []Operation
+}
+
+func linearize(model Model, operations []Operation) ([]Operation, bool) {
+	s := &search{model, operations, make(map[string]bool), make([]Operation, 0, len(operations))}
+	if s.explore(model.Init(), make([]bool, len(operations))) {
+		return s.order, true
+	}
+	return nil, false
+}
+
+func (s *search) explore(state interface{}, done []bool) bool {
+	// done once all returned operations took effect, pending operations may
+	// never take effect
+	finished := true
+	var firstReturn int64
+	for i, op := range s.operations {
+		if !done[i] && !op.Pending() {
+			if finished || op.Return < firstReturn {
+				firstReturn = op.Return
+			}
+			finished = false
+		}
+	}
+	if finished {
+		return true
+	}
+
+	key := s.key(state, done)
+	if s.visited[key] {
+		return false
+	}
+	s.visited[key] = true
+
+	for i, op := range s.operations {
+		// an operation can take effect next only if no remaining operation
+		// returned before its call
+		if done[i] || op.Call > firstReturn {
+			continue
+		}
+
+		ok, next := s.model.Step(state, op.Input, op.Output)
+		if !ok {
+			continue
+		}
+
+		done[i] = true
+		s.order = append(s.order, op)
+		if s.explore(next, done) {
+			return true
+		}
+		s.order = s.order[:len(s.order)-1]
+		done[i] = false
+	}
+
+	return false
+}
+
+func (s *search) key(state interface{}, done []bool) string {
+	buf := bytes.NewBufferString(s.model.Key(state))
+	buf.WriteByte('|')
+	for i := 0; i < len(done); i += 8 {
+		var b byte
+		for j := i; j < i+8 && j < len(done); j++ {
+			if done[j] {
+				b |= 1 << uint(j-i)
+			}
+		}
+		buf.WriteByte(b)
+	}
+	return buf.String()
+}
+
+// Makes the operations of a history that isn't linearizable pending one
+// after the other, as long as it stays not linearizable. The operations that
+// can't be made pending are the minimal set of operations that can't be
+// explained. Operations aren't removed since the remaining ones would often
+// see the effect of nothing, like reads of values never written.
+func minimize(model Model, operations []Operation) []Operation {
+	current := make([]Operation, len(operations))
+	copy(current, operations)
+
+	minimal := make([]Operation, 0)
+	for i, op := range current {
+		if op.Pending() {
+			continue
+		}
+
+		current[i].Output = nil
+		current[i].Return = 0
+		if _, ok := linearize(model, current); ok {
+			current[i] = op
+			minimal = append(minimal, op)
+		}
+	}
+
+	return minimal
+}
@@ -0,0 +1,118 @@
+package linearizability_test
+
+import (
+	"fmt"
+	"gostore/tools/linearizability"
+	"testing"
+)
+
+// Register that can be written and read
+type registerModel struct{}
+
+type registerInput struct {
+	write bool
+	value int
+}
+
+func (registerModel) Init() interface{} {
+	return 0
+}
+
+func (registerModel) Step(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+	in := input.(registerInput)
+	if in.write {
+		return true, in.value
+	}
+	return output == nil || output.(int) == state.(int), state
+}
+
+func (registerModel) Key(state interface{}) string {
+	return fmt.Sprint(state)
+}
+
+func write(id int, client int, value int, call int64, ret int64) linearizability.Operation {
+	return linearizability.Operation{id, client, registerInput{true, value}, true, call, ret}
+}
+
+func read(id int, client int, value int, call int64, ret int64) linearizability.Operation {
+	return linearizability.Operation{id, client, registerInput{false, 0}, value, call, ret}
+}
+
+func TestLinearizable(t *testing.T) {
+	// the read overlaps the write, it can see the new value
+	history := []linearizability.Operation{
+		write(0, 0, 1, 10, 30),
+		read(1, 1, 1, 20, 25),
+		read(2, 1, 1, 40, 50),
+	}
+
+	result := linearizability.Check(registerModel{}, history)
+	if !result.Linearizable {
+		t.Errorf("1) History should be linearizable: %v", result.Minimal)
+	}
+	if len(result.Linearization) != 3 || result.Linearization[0].Id != 0 {
+		t.Errorf("2) Write should take effect first: %v", result.Linearization)
+	}
+}
+
+func TestNotLinearizable(t *testing.T) {
+	// the second read sees the old value after the first saw the new one
+	history := []linearizability.Operation{
+		write(0, 0, 1, 10, 100),
+		read(1, 1, 0, 5, 8),
+		read(2, 1, 1, 20, 30),
+		read(3, 2, 0, 40, 50),
+		read(4, 2, 1, 60, 70),
+	}
+
+	result := linearizability.Check(registerModel{}, history)
+	if result.Linearizable {
+		t.Errorf("1) History shouldn't be linearizable: %v", result.Linearization)
+	}
+
+	if len(result.Minimal) != 2 || result.Minimal[0].Id != 2 || result.Minimal[1].Id != 3 {
+		t.Errorf("2) Minimal history should be reads 2 and 3: %v", result.Minimal)
+	}
+}
+
+func TestPending(t *testing.T) {
+	// a write that timed out may have taken effect, or not
+	history := []linearizability.Operation{
+		write(0, 0, 1, 10, 0),
+		read(1, 1, 0, 20, 30),
+		read(2, 1, 1, 40, 50),
+	}
+	history[0].Output = nil
+
+	result := linearizability.Check(registerModel{}, history)
+	if !result.Linearizable {
+		t.Errorf("1) History should be linearizable: %v", result.Minimal)
+	}
+
+	history = history[:2]
+	result = linearizability.Check(registerModel{}, history)
+	if !result.Linearizable {
+		t.Errorf("2) History should be linearizable without the write: %v", result.Minimal)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	history := linearizability.NewHistory()
+	w := history.Call(0, registerInput{true, 1})
+	r := history.Call(1, registerInput{false, 0})
+	history.Return(r, 1)
+	history.Call(2, registerInput{false, 0})
+
+	operations := history.Operations()
+	if len(operations) != 3 {
+		t.Fatalf("1) History should have 3 operations: %v", operations)
+	}
+	if !operations[w].Pending() || operations[r].Pending() {
+		t.Errorf("2) Only the read should have returned: %v", operations)
+	}
+
+	result := linearizability.Check(registerModel{}, operations)
+	if !result.Linearizable {
+		t.Errorf("3) History should be linearizable: %v", result.Minimal)
+	}
+}
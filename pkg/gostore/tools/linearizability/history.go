@@ -0,0 +1,84 @@
+package linearizability
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Operation of a history: a call made by a client, with its input, its
+// output and the times at which it was called and returned. Operations that
+// didn't return, or whose outcome is unknown (timeouts), have a nil output
+// and no return time: they may have taken effect at any time after their
+// call, or never.
+type Operation struct {
+	Id     int
+	Client int
+	Input  interface{}
+	Output interface{}
+	Call   int64 // ns
+	Return int64 // ns, 0 if unknown
+}
+
+func (op Operation) Pending() bool {
+	return op.Return == 0
+}
+
+func (op Operation) String() string {
+	if op.Pending() {
+		return fmt.Sprintf("#%d client %d: %v -> ? [%d, ...]", op.Id, op.Client, op.Input, op.Call)
+	}
+	return fmt.Sprintf("#%d client %d: %v -> %v [%d, %d]", op.Id, op.Client, op.Input, op.Output, op.Call, op.Return)
+}
+
+// History of the operations made by concurrent clients
+type History struct {
+	mutex      *sync.Mutex
+	operations []Operation
+	start      int64
+}
+
+func NewHistory() *History {
+	h := new(History)
+	h.mutex = new(sync.Mutex)
+	h.operations = make([]Operation, 0)
+	h.start = time.Nanoseconds()
+	return h
+}
+
+// Records the call of an operation by a client. Returns the id of the
+// operation, to record its return.
+func (h *History) Call(client int, input interface{}) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	id := len(h.operations)
+	h.operations = append(h.operations, Operation{Id: id, Client: client, Input: input, Call: h.now()})
+	return id
+}
+
+// Records the return of an operation with its output. Operations whose
+// outcome is unknown must not be returned.
+func (h *History) Return(id int, output interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.operations[id].Output = output
+	h.operations[id].Return = h.now()
+}
+
+// Returns the time since the start of the history, never 0. Must be called
+// with the mutex locked.
+func (h *History) now() int64 {
+	return time.Nanoseconds() - h.start + 1
+}
+
+// Returns the operations recorded so far
+func (h *History) Operations() []Operation {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	operations := make([]Operation, len(h.operations))
+	copy(operations, h.operations)
+	return operations
+}
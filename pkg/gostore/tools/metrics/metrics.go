@@ -0,0 +1,273 @@
+// Lightweight metrics (counters, gauges and histograms) exposed in the text
+// format of Prometheus. Metrics are declared once by the packages they
+// measure, usually with the id of the node as label since many nodes can run
+// in the same process.
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	type_counter   = "counter"
+	type_gauge     = "gauge"
+	type_histogram = "histogram"
+)
+
+var (
+	// Registry of the metrics of the process, exposed on /metrics
+	Default = NewRegistry()
+
+	// Default buckets of histograms of latencies, in seconds
+	LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	// Default buckets of histograms of sizes, in bytes
+	SizeBuckets = []float64{1024, 16384, 131072, 1048576, 8388608, 67108864, 536870912, 4294967296}
+)
+
+type Registry struct {
+	mutex    *sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	r := new(Registry)
+	r.mutex = new(sync.Mutex)
+	r.families = make(map[string]*family)
+	return r
+}
+
+// Returns the family of a metric, created if it doesn't exist. Declaring a
+// metric again returns the same one, as long as it's declared the same way.
+func (r *Registry) family(name string, help string, typ string, buckets []float64, labels []string) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if f, found := r.families[name]; found {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("Metric %s declared again with another type or labels", name))
+		}
+		return f
+	}
+
+	f := &family{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		buckets:  buckets,
+		labels:   labels,
+		mutex:    new(sync.Mutex),
+		children: make(map[string]*child),
+	}
+	r.families[name] = f
+	return f
+}
+
+// Metric and its children, one by combination of label values
+type family struct {
+	name    string
+	help    string
+	typ     string
+	buckets []float64 // upper bounds of histograms buckets
+	labels  []string
+
+	mutex    *sync.Mutex
+	children map[string]*child
+}
+
+type child struct {
+	values []string // label values
+
+	mutex  *sync.Mutex
+	value  float64
+	fn     func() float64 // computed gauge, nil if set
+	counts []uint64       // histogram buckets counts, not cumulative
+	count  uint64
+}
+
+func (f *family) child(values []string) *child {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("Metric %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c, found := f.children[key]
+	if !found {
+		c = &child{values: values, mutex: new(sync.Mutex)}
+		if f.typ == type_histogram {
+			c.counts = make([]uint64, len(f.buckets))
+		}
+		f.children[key] = c
+	}
+	return c
+}
+
+func (f *family) remove(values []string) {
+	f.mutex.Lock()
+	f.children[strings.Join(values, "\xff")] = nil, false
+	f.mutex.Unlock()
+}
+
+// Counter that only goes up
+type Counter struct {
+	c *child
+}
+
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("Counters can't decrease")
+	}
+
+	c.c.mutex.Lock()
+	c.c.value += delta
+	c.c.mutex.Unlock()
+}
+
+func (c Counter) Value() float64 {
+	c.c.mutex.Lock()
+	defer c.c.mutex.Unlock()
+	return c.c.value
+}
+
+type CounterVec struct {
+	f *family
+}
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.family(name, help, type_counter, nil, labels)}
+}
+
+func NewCounter(name string, help string, labels ...string) *CounterVec {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// Returns the counter of the given label values
+func (v *CounterVec) With(values ...string) Counter {
+	return Counter{v.f.child(values)}
+}
+
+// Value that goes up and down
+type Gauge struct {
+	c *child
+}
+
+func (g Gauge) Set(value float64) {
+	g.c.mutex.Lock()
+	g.c.value = value
+	g.c.mutex.Unlock()
+}
+
+func (g Gauge) Add(delta float64) {
+	g.c.mutex.Lock()
+	g.c.value += delta
+	g.c.mutex.Unlock()
+}
+
+func (g Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g Gauge) Value() float64 {
+	g.c.mutex.Lock()
+	defer g.c.mutex.Unlock()
+
+	if g.c.fn != nil {
+		return g.c.fn()
+	}
+	return g.c.value
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func (r *Registry) NewGauge(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.family(name, help, type_gauge, nil, labels)}
+}
+
+func NewGauge(name string, help string, labels ...string) *GaugeVec {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func (v *GaugeVec) With(values ...string) Gauge {
+	return Gauge{v.f.child(values)}
+}
+
+// Computes the gauge of the given label values when metrics are collected,
+// for values already kept elsewhere like the length of a queue. The function
+// must not block.
+func (v *GaugeVec) Func(fn func() float64, values ...string) {
+	c := v.f.child(values)
+	c.mutex.Lock()
+	c.fn = fn
+	c.mutex.Unlock()
+}
+
+// Removes the gauge of the given label values, when what it measured is gone
+func (v *GaugeVec) Remove(values ...string) {
+	v.f.remove(values)
+}
+
+// Distribution of observed values in buckets
+type Histogram struct {
+	f *family
+	c *child
+}
+
+func (h Histogram) Observe(value float64) {
+	h.c.mutex.Lock()
+	defer h.c.mutex.Unlock()
+
+	for i, bound := range h.f.buckets {
+		if value <= bound {
+			h.c.counts[i]++
+			break
+		}
+	}
+	h.c.value += value
+	h.c.count++
+}
+
+// Observes a duration given in ns, in seconds
+func (h Histogram) ObserveDuration(ns int64) {
+	h.Observe(float64(ns) / 1e9)
+}
+
+// Returns the number of observations and their sum
+func (h Histogram) Count() (uint64, float64) {
+	h.c.mutex.Lock()
+	defer h.c.mutex.Unlock()
+	return h.c.count, h.c.value
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+// Returns a histogram whose buckets have the given upper bounds, in
+// increasing order
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.family(name, help, type_histogram, buckets, labels)}
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func (v *HistogramVec) With(values ...string) Histogram {
+	return Histogram{v.f, v.f.child(values)}
+}
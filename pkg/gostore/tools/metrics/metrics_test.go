@@ -0,0 +1,92 @@
+package metrics_test
+
+import (
+	"bytes"
+	"gostore/tools/metrics"
+	"strings"
+	"testing"
+)
+
+func text(registry *metrics.Registry) string {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	registry.WriteText(buf)
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("test_messages_total", "Messages sent", "node", "service")
+
+	counter.With("1", "2").Inc()
+	counter.With("1", "2").Add(2)
+	counter.With("2", "2").Inc()
+
+	if value := counter.With("1", "2").Value(); value != 3 {
+		t.Errorf("1) Counter should be 3, got %v", value)
+	}
+
+	// declaring it again returns the same counter
+	again := registry.NewCounter("test_messages_total", "Messages sent", "node", "service")
+	if value := again.With("2", "2").Value(); value != 1 {
+		t.Errorf("2) Counter declared again should be 1, got %v", value)
+	}
+
+	expected := "# HELP test_messages_total Messages sent\n" +
+		"# TYPE test_messages_total counter\n" +
+		"test_messages_total{node=\"1\",service=\"2\"} 3\n" +
+		"test_messages_total{node=\"2\",service=\"2\"} 1\n"
+	if output := text(registry); output != expected {
+		t.Errorf("3) Unexpected output:\n%s", output)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	registry := metrics.NewRegistry()
+	gauge := registry.NewGauge("test_queue_depth", "Messages \"queued\"", "node")
+
+	gauge.With("1").Set(10)
+	gauge.With("1").Dec()
+	length := 5
+	gauge.Func(func() float64 { return float64(length) }, "2")
+	length = 7
+
+	output := text(registry)
+	if !strings.Contains(output, "test_queue_depth{node=\"1\"} 9\n") {
+		t.Errorf("1) Gauge should be 9:\n%s", output)
+	}
+	if !strings.Contains(output, "test_queue_depth{node=\"2\"} 7\n") {
+		t.Errorf("2) Computed gauge should be 7:\n%s", output)
+	}
+
+	gauge.Remove("2")
+	if output := text(registry); strings.Contains(output, "node=\"2\"") {
+		t.Errorf("3) Removed gauge shouldn't be output:\n%s", output)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	registry := metrics.NewRegistry()
+	histogram := registry.NewHistogram("test_latency_seconds", "Latency", []float64{0.01, 0.1, 1})
+
+	histogram.With().Observe(0.0078125)
+	histogram.With().Observe(0.0625)
+	histogram.With().ObserveDuration(62500 * 1000) // 62.5ms
+	histogram.With().Observe(4)
+
+	count, sum := histogram.With().Count()
+	if count != 4 || sum != 4.1328125 {
+		t.Errorf("1) Histogram should have 4 observations summing to 4.1328125, got %d and %v", count, sum)
+	}
+
+	expected := "# HELP test_latency_seconds Latency\n" +
+		"# TYPE test_latency_seconds histogram\n" +
+		"test_latency_seconds_bucket{le=\"0.01\"} 1\n" +
+		"test_latency_seconds_bucket{le=\"0.1\"} 3\n" +
+		"test_latency_seconds_bucket{le=\"1\"} 3\n" +
+		"test_latency_seconds_bucket{le=\"+Inf\"} 4\n" +
+		"test_latency_seconds_sum 4.1328125\n" +
+		"test_latency_seconds_count 4\n"
+	if output := text(registry); output != expected {
+		t.Errorf("2) Unexpected output:\n%s", output)
+	}
+}
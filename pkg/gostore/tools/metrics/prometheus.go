@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"http"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Writes the metrics of the registry in the Prometheus text format, sorted
+// by name and label values so that successive outputs can be compared
+func (r *Registry) WriteText(writer io.Writer) os.Error {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mutex.Unlock()
+	sort.SortStrings(names)
+
+	buf := bufio.NewWriter(writer)
+	for _, name := range names {
+		r.mutex.Lock()
+		f := r.families[name]
+		r.mutex.Unlock()
+
+		f.writeText(buf)
+	}
+
+	return buf.Flush()
+}
+
+func (f *family) writeText(buf *bufio.Writer) {
+	f.mutex.Lock()
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	sort.SortStrings(keys)
+
+	children := make([]*child, len(keys))
+	for i, key := range keys {
+		children[i] = f.children[key]
+	}
+	f.mutex.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.typ)
+
+	for _, c := range children {
+		labels := f.labelPairs(c.values)
+
+		switch f.typ {
+		case type_counter:
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, joinLabels(labels), formatValue(Counter{c}.Value()))
+
+		case type_gauge:
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, joinLabels(labels), formatValue(Gauge{c}.Value()))
+
+		case type_histogram:
+			c.mutex.Lock()
+			cumulative := uint64(0)
+			for i, bound := range f.buckets {
+				cumulative += c.counts[i]
+				le := append(labels, fmt.Sprintf("le=\"%s\"", formatValue(bound)))
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, joinLabels(le), cumulative)
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, joinLabels(append(labels, "le=\"+Inf\"")), c.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, joinLabels(labels), formatValue(c.value))
+			fmt.Fprintf(buf, "%s_count%s %d\n", f.name, joinLabels(labels), c.count)
+			c.mutex.Unlock()
+		}
+	}
+}
+
+func (f *family) labelPairs(values []string) []string {
+	pairs := make([]string, len(values), len(values)+1)
+	for i, value := range values {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", f.labels[i], escapeLabel(value))
+	}
+	return pairs
+}
+
+func joinLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.Ftoa64(value, 'g', -1)
+}
+
+func escapeHelp(help string) string {
+	help = strings.Replace(help, "\\", "\\\\", -1)
+	return strings.Replace(help, "\n", "\\n", -1)
+}
+
+func escapeLabel(value string) string {
+	value = escapeHelp(value)
+	return strings.Replace(value, "\"", "\\\"", -1)
+}
+
+// Serves the metrics of the registry to Prometheus
+func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(resp)
+}
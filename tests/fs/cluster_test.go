@@ -2,14 +2,21 @@ package main_test
 
 import (
 	"gostore"
+	"gostore/comm"
 	"gostore/process"
 	"gostore/log"
 	"fmt"
 	"os"
 )
 
+const (
+	FS_SERVICE  = 2
+	FAULTS_SEED = 1 // seed of the faults injected in the cluster, so that they are the same on each run
+)
+
 type TestCluster struct {
-	nodes []*process.Process
+	nodes  []*process.Process
+	faults *comm.FaultTransport
 }
 
 
@@ -27,10 +34,37 @@ func SetupCluster() {
 
 func NewTestCluster(nodescount int) *TestCluster {
 	tc := new(TestCluster)
-	firstport := 20000
+	tc.nodes = make([]*process.Process, nodescount)
+
+	// nodes communicate in memory, only their API listens on a port. Tests
+	// inject faults in their communications to test failures.
+	tc.faults = comm.NewFaultTransport(comm.NewMemoryTransport(), FAULTS_SEED)
+
+	for i, conf := range testConfigs(nodescount, 20000, "data") {
+		tc.nodes[i] = process.NewProcessTransport(conf, tc.faults)
+	}
 
+	return tc
+}
+
+// Returns a cluster whose nodes communicate by TCP and UDP, like in
+// production. No fault can be injected in it.
+func NewNetTestCluster(nodescount int, firstport int) *TestCluster {
+	tc := new(TestCluster)
 	tc.nodes = make([]*process.Process, nodescount)
 
+	for i, conf := range testConfigs(nodescount, firstport, "data/net") {
+		tc.nodes[i] = process.NewProcess(conf)
+	}
+
+	return tc
+}
+
+// Returns the configurations of the nodes of a cluster, listening on ports
+// from firstport and storing their data in datadir
+func testConfigs(nodescount int, firstport int, datadir string) []gostore.Config {
+	configs := make([]gostore.Config, nodescount)
+
 	nodes := make([]gostore.ConfigNode, nodescount)
 	for i := 0; i < nodescount; i++ {
 		nodes[i].NodeId = uint16(i)
@@ -44,9 +78,9 @@ func NewTestCluster(nodescount int) *TestCluster {
 	rings[0].ReplicationFactor = 3
 
 	for i := 0; i < nodescount; i++ {
-		datadir := fmt.Sprintf("data/%d", i)
+		nodedir := fmt.Sprintf("%s/%d", datadir, i)
 
-		conf := new(gostore.Config)
+		conf := &configs[i]
 
 		conf.CurrentNode = uint16(i)
 		conf.Nodes = nodes
@@ -57,20 +91,18 @@ func NewTestCluster(nodescount int) *TestCluster {
 		conf.Services = make([]gostore.ConfigService, 1)
 
 		// add FS
-		conf.Services[0].Id = 2
+		conf.Services[0].Id = FS_SERVICE
 		conf.Services[0].Type = "fs"
 		conf.Services[0].CustomConfig = make(map[string]interface{})
-		conf.Services[0].CustomConfig["DataDir"] = datadir
+		conf.Services[0].CustomConfig["DataDir"] = nodedir
 		conf.Services[0].CustomConfig["ApiAddress"] = fmt.Sprintf("127.0.0.1:%d", (firstport + i*10 + 2))
 
 		// Clear and create data dir
-		os.RemoveAll(datadir)
-		os.Mkdir(datadir, 0777)
-
-		tc.nodes[i] = process.NewProcess(*conf)
+		os.RemoveAll(nodedir)
+		os.MkdirAll(nodedir, 0777)
 	}
 
-	return tc
+	return configs
 }
 
 func GetProcessForPath(paths ...string) (resp *process.Process, other *process.Process) {
@@ -97,3 +129,12 @@ func GetProcessForPath(paths ...string) (resp *process.Process, other *process.P
 
 	return resp, other
 }
+
+// Returns the ids of the nodes of processes, to partition them
+func NodeIds(procs ...*process.Process) []uint16 {
+	ids := make([]uint16, len(procs))
+	for i, proc := range procs {
+		ids[i] = proc.Cluster.MyNode.Id
+	}
+	return ids
+}
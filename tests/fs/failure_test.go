@@ -0,0 +1,92 @@
+package main_test
+
+import (
+	"testing"
+	"gostore"
+	"gostore/cluster"
+	"gostore/log"
+	"gostore/process"
+)
+
+// Watcher recording the status changes of the nodes
+type statusWatcher struct {
+	offline []uint16
+	online  []uint16
+}
+
+func (w *statusWatcher) NodeJoining(node *cluster.Node)       {}
+func (w *statusWatcher) NodeConnecting(node *cluster.Node)    {}
+func (w *statusWatcher) NodeDisconnecting(node *cluster.Node) {}
+func (w *statusWatcher) NodeLeaving(node *cluster.Node)       {}
+func (w *statusWatcher) NodeLeaved(node *cluster.Node)        {}
+
+func (w *statusWatcher) NodeJoiningRing(node *cluster.Node, ring *cluster.Ring, moved []*cluster.MovedRange) {
+}
+
+func (w *statusWatcher) NodeLeavingRing(node *cluster.Node, ring *cluster.Ring, moved []*cluster.MovedRange) {
+}
+
+func (w *statusWatcher) NodeOnline(node *cluster.Node) {
+	w.online = append(w.online, node.Id)
+}
+
+func (w *statusWatcher) NodeOffline(node *cluster.Node) {
+	w.offline = append(w.offline, node.Id)
+}
+
+func TestFailureDetection(t *testing.T) {
+	log.Info("Testing TestFailureDetection...")
+
+	nodes := make([]gostore.ConfigNode, 3)
+	for i := range nodes {
+		nodes[i].NodeId = uint16(i)
+		nodes[i].NodeIP = "127.0.0.1"
+		nodes[i].TCPPort = uint16(40000 + i*10)
+		nodes[i].UDPPort = uint16(40000 + i*10 + 1)
+	}
+
+	configs := make([]gostore.Config, len(nodes))
+	for i := range configs {
+		configs[i].CurrentNode = uint16(i)
+		configs[i].Nodes = nodes
+		configs[i].Rings = []gostore.ConfigRing{gostore.ConfigRing{Id: 0, ReplicationFactor: 2}}
+		configs[i].FailureDetector.Enabled = true
+	}
+
+	sim := process.NewSimulation(configs, FAULTS_SEED)
+	watcher := new(statusWatcher)
+	observer := sim.Processes[0]
+	observer.Cluster.Notifier.Bind(watcher)
+
+	// nodes loaded from the cluster data file are offline until heard of
+	restarted := observer.Cluster.Nodes.Get(1)
+	observer.Cluster.ChangeNodeStatus(restarted, cluster.Status_Offline, restarted.Status)
+
+	sim.Run(5000)
+	node := observer.Cluster.Nodes.Get(2)
+	if node.Status != cluster.Status_Online || len(watcher.offline) > 0 {
+		t.Fatalf("1) Node 2 should be online while sending heartbeats: %s", node)
+	}
+	if restarted.Status != cluster.Status_Online || len(watcher.online) != 1 || watcher.online[0] != 1 {
+		t.Fatalf("2) Node 1 should be online once its heartbeats are received: %s, %v", restarted, watcher.online)
+	}
+
+	// a paused node stops sending heartbeats
+	sim.Processes[2].Sc.Pause()
+	sim.Run(10000)
+	if node.Status != cluster.Status_Offline || len(watcher.offline) != 1 || watcher.offline[0] != 2 {
+		t.Fatalf("3) Node 2 should be offline without heartbeats: %s, %v", node, watcher.offline)
+	}
+	if phi := observer.Sc.Phi(node); phi < observer.Sc.PhiOffline {
+		t.Errorf("4) Suspicion of node 2 should be above the offline threshold: %f", phi)
+	}
+	if other := observer.Cluster.Nodes.Get(1); other.Status != cluster.Status_Online {
+		t.Errorf("5) Node 1 should still be online: %s", other)
+	}
+
+	sim.Processes[2].Sc.Resume()
+	sim.Run(3000)
+	if node.Status != cluster.Status_Online || len(watcher.online) != 2 || watcher.online[1] != 2 {
+		t.Errorf("6) Node 2 should be online again: %s, %v", node, watcher.online)
+	}
+}
@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"testing"
+	"gostore/comm"
 	"gostore/services/fs"
 	"gostore/log"
 	"bytes"
@@ -111,3 +112,23 @@ func TestChildrenList(t *testing.T) {
 		t.Errorf("15) Didn't receive 'hierarchie' child. Received: %s\n", children)
 	}
 }
+
+func TestTooBigMessages(t *testing.T) {
+	SetupCluster()
+	log.Info("Testing TestTooBigMessages...")
+
+	// lists of more than 65535 entries can't be counted on 16 bits
+	client := fs.NewFsServiceClient(tc.nodes[0].Sc, 1)
+	_, err := client.NewChildrenListResponse(&fs.ChildrenListResponse{Children: make([]fs.ChildEntry, 65536)})
+	if err == nil {
+		t.Errorf("1) Building a response of 65536 children should fail")
+	}
+
+	// payloads bigger than 65535 bytes are refused instead of being truncated
+	long := bytes.Repeat([]byte("a"), 70000)
+	byts := []byte("data")
+	err = tc.nodes[0].Fss.Write(fs.NewPath("/tests/hierarchie/"+string(long)), int64(len(byts)), "", bytes.NewBuffer(byts), nil)
+	if err != comm.ErrorMessageTooBig {
+		t.Errorf("2) Writing a path of 70000 bytes should fail with a too big message: %s", err)
+	}
+}
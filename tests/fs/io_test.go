@@ -95,6 +95,30 @@ func TestReadWrite(t *testing.T) {
 	}
 }
 
+func TestWriteCorruptedData(t *testing.T) {
+	SetupCluster()
+	defer tc.faults.Reset()
+	log.Info("Testing TestWriteCorruptedData...")
+
+	// a bit of the data is flipped on its way to the master
+	path := fs.NewPath("/tests/io/corrupted")
+	_, other := GetProcessForPath(path.String())
+	data := "data corrupted on the network"
+	tc.faults.CorruptNext(data)
+
+	buf := buffer.NewFromString(data)
+	err := other.Fss.Write(path, buf.Size, "", buf, nil)
+	if err != nil {
+		t.Errorf("1) Write should have been sent again after the corruption of its data, got %s\n", err)
+	}
+
+	bufwriter := bytes.NewBuffer(make([]byte, 0))
+	n, err := other.Fss.Read(path, 0, -1, 0, io.Writer(bufwriter), nil)
+	if err != nil || n != int64(len(data)) || bufwriter.String() != data {
+		t.Errorf("2) Didn't read the uncorrupted data: %s!=%s (%s)\n", data, bufwriter, err)
+	}
+}
+
 func TestUnicode(t *testing.T) {
 	SetupCluster()
 	log.Info("Testing TestUnicode...")
@@ -0,0 +1,213 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"rand"
+	"testing"
+	"time"
+	"gostore/log"
+	"gostore/services/fs"
+	"gostore/tools/buffer"
+	"gostore/tools/linearizability"
+)
+
+const (
+	LIN_CLIENTS    = 5
+	LIN_OPERATIONS = 30 // operations by client
+)
+
+// Operation on a file
+type fsInput struct {
+	Kind string // write, read, delete or header
+	Data string // written data
+}
+
+type fsReadOutput struct {
+	Found bool
+	Data  string
+}
+
+type fsHeaderOutput struct {
+	Exists  bool
+	Version int64
+	Size    int64
+}
+
+// State of a file. Versions are only known when a header has been read, else
+// Version is the minimum version the file can have.
+type fsState struct {
+	Exists       bool
+	Data         string
+	Version      int64
+	VersionKnown bool
+}
+
+// Sequential model of a file, checked against the operations made on it
+type fsModel struct{}
+
+func (fsModel) Init() interface{} {
+	return fsState{}
+}
+
+func (fsModel) Step(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+	s := state.(fsState)
+	in := input.(fsInput)
+
+	switch in.Kind {
+	case "write":
+		return true, fsState{true, in.Data, s.Version + 1, false}
+
+	case "delete":
+		// a file that doesn't exist can't be deleted
+		if output != nil && !output.(bool) {
+			return !s.Exists, s
+		}
+		if output != nil && !s.Exists {
+			return false, s
+		}
+		return true, fsState{false, "", s.Version, false}
+
+	case "read":
+		if output == nil {
+			return true, s
+		}
+
+		out := output.(fsReadOutput)
+		return out.Found == s.Exists && out.Data == s.Data, s
+
+	case "header":
+		if output == nil {
+			return true, s
+		}
+
+		out := output.(fsHeaderOutput)
+		if out.Exists != s.Exists {
+			return false, s
+		}
+		if !out.Exists {
+			return true, s
+		}
+
+		if out.Size != int64(len(s.Data)) {
+			return false, s
+		}
+		if s.VersionKnown && out.Version != s.Version || !s.VersionKnown && out.Version < s.Version {
+			return false, s
+		}
+		return true, fsState{s.Exists, s.Data, out.Version, true}
+	}
+
+	return false, s
+}
+
+func (fsModel) Key(state interface{}) string {
+	return fmt.Sprintf("%v", state)
+}
+
+func notFound(err os.Error) bool {
+	return err != nil && err.String() == fs.ErrorFileNotFound.String()
+}
+
+// Makes an operation on a file and records it. Operations that failed
+// otherwise than by not finding the file may or may not have taken effect,
+// they stay pending.
+func fsOperation(history *linearizability.History, client int, path string, input fsInput) {
+	proc := tc.nodes[client%len(tc.nodes)]
+	id := history.Call(client, input)
+
+	switch input.Kind {
+	case "write":
+		buf := buffer.NewFromString(input.Data)
+		err := proc.Fss.Write(fs.NewPath(path), buf.Size, "", buf, nil)
+		if err == nil {
+			history.Return(id, true)
+		}
+
+	case "delete":
+		err := proc.Fss.Delete(fs.NewPath(path), false, nil)
+		if err == nil {
+			history.Return(id, true)
+		} else if notFound(err) {
+			history.Return(id, false)
+		}
+
+	case "read":
+		data := bytes.NewBuffer(make([]byte, 0))
+		_, err := proc.Fss.Read(fs.NewPath(path), 0, -1, 0, data, nil)
+		if err == nil {
+			history.Return(id, fsReadOutput{true, data.String()})
+		} else if notFound(err) {
+			history.Return(id, fsReadOutput{false, ""})
+		}
+
+	case "header":
+		header, err := proc.Fss.Header(fs.NewPath(path), nil)
+		if err == nil {
+			history.Return(id, fsHeaderOutput{header.Exists, header.Version, header.Size})
+		}
+	}
+}
+
+func TestFsLinearizability(t *testing.T) {
+	SetupCluster()
+	defer tc.faults.Reset()
+	log.Info("Testing TestFsLinearizability...")
+
+	paths := []string{"/tests/linearizability/file1", "/tests/linearizability/file2"}
+	histories := make(map[string]*linearizability.History)
+	for _, path := range paths {
+		histories[path] = linearizability.NewHistory()
+	}
+
+	// lossy network, and the master of the first file partitioned for a while
+	tc.faults.SetDrop(0.05)
+	tc.faults.SetDuplicate(0.05)
+	tc.faults.SetReorder(0.05)
+
+	master, _ := GetProcessForPath(paths[0])
+	others := make([]uint16, 0)
+	for _, proc := range tc.nodes {
+		if proc != master {
+			others = append(others, proc.Cluster.MyNode.Id)
+		}
+	}
+	go func() {
+		time.Sleep(1000 * 1000 * 1000)
+		tc.faults.Partition(NodeIds(master), others)
+		time.Sleep(2000 * 1000 * 1000)
+		tc.faults.Heal()
+	}()
+
+	kinds := []string{"write", "read", "delete", "header"}
+	done := make(chan bool)
+	for c := 0; c < LIN_CLIENTS; c++ {
+		go func(client int) {
+			random := rand.New(rand.NewSource(FAULTS_SEED + int64(client)))
+			for i := 0; i < LIN_OPERATIONS; i++ {
+				path := paths[random.Intn(len(paths))]
+				input := fsInput{Kind: kinds[random.Intn(len(kinds))]}
+				if input.Kind == "write" {
+					input.Data = fmt.Sprintf("client%d-write%d", client, i)
+				}
+				fsOperation(histories[path], client, path, input)
+			}
+			done <- true
+		}(c)
+	}
+	for c := 0; c < LIN_CLIENTS; c++ {
+		<-done
+	}
+
+	// files are independent, they are checked one at a time
+	for _, path := range paths {
+		result := linearizability.Check(fsModel{}, histories[path].Operations())
+		if !result.Linearizable {
+			t.Errorf("History of %s isn't linearizable, operations that can't be explained:", path)
+			for _, op := range result.Minimal {
+				t.Errorf("    %s", op)
+			}
+		}
+	}
+}
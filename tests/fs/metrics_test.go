@@ -0,0 +1,39 @@
+package main_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"gostore/log"
+	"gostore/services/fs"
+	"gostore/tools/buffer"
+	"gostore/tools/metrics"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	SetupCluster()
+	log.Info("Testing TestWriteMetrics...")
+
+	buf := buffer.NewFromString("measured")
+	err := tc.nodes[3].Fss.Write(fs.NewPath("/tests/metrics/write"), buf.Size, "", buf, nil)
+	if err != nil {
+		t.Fatalf("1) Got an error while writing: %s", err)
+	}
+
+	text := bytes.NewBuffer(make([]byte, 0))
+	err = metrics.Default.WriteText(text)
+	if err != nil {
+		t.Fatalf("2) Got an error while writing metrics: %s", err)
+	}
+
+	expected := []string{
+		"gostore_fs_operation_seconds_count{node=\"3\",operation=\"write\"}",
+		"gostore_comm_messages_sent_total{node=\"3\",service=\"2\"}",
+		"gostore_fs_replication_backlog{node=\"3\"}",
+	}
+	for i, metric := range expected {
+		if !strings.Contains(text.String(), metric) {
+			t.Errorf("%d) Metric %s should have been exposed", i+3, metric)
+		}
+	}
+}
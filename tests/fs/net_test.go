@@ -0,0 +1,58 @@
+package main_test
+
+import (
+	"testing"
+	"gostore/services/fs"
+	"gostore/log"
+	"bytes"
+	"io"
+)
+
+const (
+	NET_FIRST_PORT = 21000 // nodes of the TCP/UDP cluster listen on ports from here
+)
+
+// Writes and reads files on nodes communicating by TCP and UDP, which pool
+// their TCP connections and frame the data sent on them
+func TestFsNetTransport(t *testing.T) {
+	SetupCluster()
+	log.Info("Testing TestFsNetTransport...")
+
+	ntc := NewNetTestCluster(3, NET_FIRST_PORT)
+
+	// small file, sent by UDP
+	path := fs.NewPath("/tests/net/small")
+	byts := []byte("sent over the network")
+	err := ntc.nodes[0].Fss.Write(path, int64(len(byts)), "", bytes.NewBuffer(byts), nil)
+	if err != nil {
+		t.Errorf("1) Write returned an error: %s\n", err)
+	}
+
+	bufwriter := bytes.NewBuffer(make([]byte, 0))
+	n, err := ntc.nodes[2].Fss.Read(path, 0, -1, 0, io.Writer(bufwriter), nil)
+	if err != nil || n != int64(len(byts)) || bytes.Compare(bufwriter.Bytes(), byts) != 0 {
+		t.Errorf("2) Didn't read written data correctly: %s!=%s (%s)\n", byts, bufwriter, err)
+	}
+
+	// files bigger than an UDP packet, written and read a few times so
+	// that pooled connections get reused
+	for i := 0; i < 5; i++ {
+		path = fs.NewPath("/tests/net/big")
+		byts = bytes.Repeat([]byte{byte('a' + i)}, 200*1024)
+		err = ntc.nodes[i%3].Fss.Write(path, int64(len(byts)), "", bytes.NewBuffer(byts), nil)
+		if err != nil {
+			t.Errorf("3) Write %d returned an error: %s\n", i, err)
+		}
+
+		bufwriter = bytes.NewBuffer(make([]byte, 0))
+		n, err = ntc.nodes[(i+1)%3].Fss.Read(path, 0, -1, 0, io.Writer(bufwriter), nil)
+		if err != nil || n != int64(len(byts)) || bytes.Compare(bufwriter.Bytes(), byts) != 0 {
+			t.Errorf("4) Didn't read written data %d correctly: read %d bytes (%s)\n", i, n, err)
+		}
+	}
+
+	exists, err := ntc.nodes[1].Fss.Exists(fs.NewPath("/tests/net/big"), nil)
+	if err != nil || !exists {
+		t.Errorf("5) Written file should exist: %v (%s)\n", exists, err)
+	}
+}
@@ -1,20 +1,20 @@
 package main_test
 
 import (
+	"os"
 	"testing"
 	"bytes"
 	"io"
 	"gostore/comm"
 	"gostore/services/fs"
 	"gostore/tools/buffer"
-	"net"
 	"time"
 	"gostore/log"
 )
 
 /*
-	[ ] Timeout network (IP)
-	[ ] Timeout machine (destination too slow)
+	[X] Timeout network (IP)
+	[X] Timeout machine (destination too slow)
 	[ ] Connection break
 	[ ] Flapping
 	[ ] Test multiple break points (check all connexions made by each method)
@@ -34,6 +34,7 @@ func timeoutTest(delay int, cmdcb func(), timeoutcb func(returned bool)) {
 
 func TestFsReadNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsReadNetworkTimeout...")
 
 	bufwriter := bytes.NewBuffer(make([]byte, 0))
@@ -41,8 +42,7 @@ func TestFsReadNetworkTimeout(t *testing.T) {
 
 	resp, other := GetProcessForPath("/")
 
-	initadr := other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address
-	other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(other), NodeIds(resp))
 
 	// Test full timeout and return of an error
 	timeoutTest(1500*4, func() {
@@ -59,11 +59,9 @@ func TestFsReadNetworkTimeout(t *testing.T) {
 
 	// Test one timeout + 1 retry, no error
 	timeoutTest(1500*4, func() {
-		// wait 50ms and change addr of the remote node
-		go func() {
-			time.Sleep(500000000)
-			other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = initadr
-		}()
+		// the first attempt is lost, the retry goes through
+		tc.faults.Heal()
+		tc.faults.DropNext(other.Cluster.MyNode.Id, resp.Cluster.MyNode.Id, 1)
 
 		_, err := other.Fss.Read(fs.NewPath("/"), 0, -1, 0, buffer, nil)
 		if err == comm.ErrorTimeout {
@@ -79,12 +77,12 @@ func TestFsReadNetworkTimeout(t *testing.T) {
 
 func TestFsExistsNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsExistsNetworkTimeout...")
 
 	resp, other := GetProcessForPath("/")
 
-	initadr := other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address
-	other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(other), NodeIds(resp))
 
 	// Test full timeout and return of an error
 	timeoutTest(1500*4, func() {
@@ -101,11 +99,9 @@ func TestFsExistsNetworkTimeout(t *testing.T) {
 
 	// Test one timeout + 1 retry, no error
 	timeoutTest(1500*4, func() {
-		// wait 50ms and change addr of the remote node
-		go func() {
-			time.Sleep(500000000)
-			other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = initadr
-		}()
+		// the first attempt is lost, the retry goes through
+		tc.faults.Heal()
+		tc.faults.DropNext(other.Cluster.MyNode.Id, resp.Cluster.MyNode.Id, 1)
 
 		_, err := other.Fss.Exists(fs.NewPath("/"), nil)
 		if err == comm.ErrorTimeout {
@@ -121,12 +117,12 @@ func TestFsExistsNetworkTimeout(t *testing.T) {
 
 func TestFsWriteNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsWriteNetworkTimeout...")
 
 	resp, other := GetProcessForPath("/")
 
-	initadr := other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address
-	other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(other), NodeIds(resp))
 
 	// Test full timeout and return of an error
 	timeoutTest(1500*4, func() {
@@ -144,11 +140,9 @@ func TestFsWriteNetworkTimeout(t *testing.T) {
 
 	// Test one timeout + 1 retry, no error
 	timeoutTest(1500*4, func() {
-		// wait 50ms and change addr of the remote node
-		go func() {
-			time.Sleep(500000000)
-			other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = initadr
-		}()
+		// the first attempt is lost, the retry goes through
+		tc.faults.Heal()
+		tc.faults.DropNext(other.Cluster.MyNode.Id, resp.Cluster.MyNode.Id, 1)
 
 		buf := buffer.NewFromString("write1")
 		err := other.Fss.Write(fs.NewPath("/"), buf.Size, "", buf, nil)
@@ -165,14 +159,14 @@ func TestFsWriteNetworkTimeout(t *testing.T) {
 
 func TestFsDeleteNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsDeleteNetworkTimeout...")
 
 	resp, other := GetProcessForPath("/tests/timeouts/delete1")
 	buf := buffer.NewFromString("write1")
 	other.Fss.Write(fs.NewPath("/tests/timeouts/delete1"), buf.Size, "", buf, nil)
 
-	initadr := other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address
-	other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(other), NodeIds(resp))
 
 	// Test full timeout and return of an error
 	timeoutTest(1500*4, func() {
@@ -194,11 +188,9 @@ func TestFsDeleteNetworkTimeout(t *testing.T) {
 
 	// Test one timeout + 1 retry, no error
 	timeoutTest(1500*4, func() {
-		// wait 50ms and change addr of the remote node
-		go func() {
-			time.Sleep(500000000)
-			other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = initadr
-		}()
+		// the first attempt is lost, the retry goes through
+		tc.faults.Heal()
+		tc.faults.DropNext(other.Cluster.MyNode.Id, resp.Cluster.MyNode.Id, 1)
 
 		buf = buffer.NewFromString("write1")
 		err := other.Fss.Write(fs.NewPath("/tests/timeouts/delete2"), buf.Size, "", buf, nil)
@@ -215,14 +207,14 @@ func TestFsDeleteNetworkTimeout(t *testing.T) {
 
 func TestFsHeaderNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsHeaderNetworkTimeout...")
 
 	time.Sleep(500000000)
 
 	resp, other := GetProcessForPath("/")
 
-	initadr := other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address
-	other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(other), NodeIds(resp))
 
 	// Test full timeout and return of an error
 	timeoutTest(1500*4, func() {
@@ -239,11 +231,9 @@ func TestFsHeaderNetworkTimeout(t *testing.T) {
 
 	// Test one timeout + 1 retry, no error
 	timeoutTest(1500*4, func() {
-		// wait 50ms and change addr of the remote node
-		go func() {
-			time.Sleep(500000000)
-			other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = initadr
-		}()
+		// the first attempt is lost, the retry goes through
+		tc.faults.Heal()
+		tc.faults.DropNext(other.Cluster.MyNode.Id, resp.Cluster.MyNode.Id, 1)
 
 		_, err := other.Fss.Header(fs.NewPath("/"), nil)
 		if err == comm.ErrorTimeout {
@@ -259,12 +249,12 @@ func TestFsHeaderNetworkTimeout(t *testing.T) {
 
 func TestFsHeaderJSONNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsHeaderJSONNetworkTimeout...")
 
 	resp, other := GetProcessForPath("/")
 
-	initadr := other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address
-	other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(other), NodeIds(resp))
 
 	// Test full timeout and return of an error
 	timeoutTest(1500*4, func() {
@@ -281,11 +271,9 @@ func TestFsHeaderJSONNetworkTimeout(t *testing.T) {
 
 	// Test one timeout + 1 retry, no error
 	timeoutTest(1500*4, func() {
-		// wait 50ms and change addr of the remote node
-		go func() {
-			time.Sleep(500000000)
-			other.Cluster.Nodes.Get(resp.Cluster.MyNode.Id).Address = initadr
-		}()
+		// the first attempt is lost, the retry goes through
+		tc.faults.Heal()
+		tc.faults.DropNext(other.Cluster.MyNode.Id, resp.Cluster.MyNode.Id, 1)
 
 		_, err := other.Fss.HeaderJSON(fs.NewPath("/"), nil)
 		if err == comm.ErrorTimeout {
@@ -301,13 +289,13 @@ func TestFsHeaderJSONNetworkTimeout(t *testing.T) {
 
 func TestFsChildAddWriteNeedNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsChildAddWriteNeedNetworkTimeout...")
 
 	resp2, other2 := GetProcessForPath("/tests/timeout2/write")
 	resp1, other1 := GetProcessForPath("/tests/timeout2")
 
-	initadr := resp2.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address
-	resp2.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(resp2), NodeIds(resp1))
 
 	// Create the child, it should never get added to the parent
 	buf := buffer.NewFromString("write1")
@@ -330,11 +318,9 @@ func TestFsChildAddWriteNeedNetworkTimeout(t *testing.T) {
 	// Test one timeout + 1 retry, no error
 	buf = buffer.NewFromString("write1")
 
-	go func() {
-		time.Sleep(1500 * 1000 * 1000)
-		// set the address back
-		resp2.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address = initadr
-	}()
+	// the first attempt to add the child is lost, the retry goes through
+	tc.faults.Heal()
+	tc.faults.DropNext(resp2.Cluster.MyNode.Id, resp1.Cluster.MyNode.Id, 1)
 
 	err = other2.Fss.Write(fs.NewPath("/tests/timeout2/write3"), buf.Size, "", buf, nil)
 	if err != nil {
@@ -355,6 +341,7 @@ func TestFsChildAddWriteNeedNetworkTimeout(t *testing.T) {
 
 func TestFsChildRemoveDeleteNetworkTimeout(t *testing.T) {
 	SetupCluster()
+	defer tc.faults.Reset()
 	log.Info("Testing TestFsChildRemoveDeleteNetworkTimeout...")
 
 	resp3, other3 := GetProcessForPath("/test/timeout/delete1", "/test/timeout")
@@ -366,9 +353,7 @@ func TestFsChildRemoveDeleteNetworkTimeout(t *testing.T) {
 	buf = buffer.NewFromString("write1")
 	resp3.Fss.Write(fs.NewPath("/test/timeout/delete2"), buf.Size, "", buf, nil)
 
-	initadr := resp2.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address
-	resp2.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
-	resp3.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address = net.ParseIP("224.0.0.2")
+	tc.faults.Partition(NodeIds(resp2, resp3), NodeIds(resp1))
 
 	time.Sleep(900000000)
 	// Delete child, it should never get delete from the parent
@@ -394,9 +379,8 @@ func TestFsChildRemoveDeleteNetworkTimeout(t *testing.T) {
 		t.Error("3) Received an error: %s", err)
 	}
 
-	// Set back the address
-	resp2.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address = initadr
-	resp3.Cluster.Nodes.Get(resp1.Cluster.MyNode.Id).Address = initadr
+	// Heal the partition
+	tc.faults.Heal()
 
 	time.Sleep(6000000000)
 	children, _ = other1.Fss.Children(fs.NewPath("/test/timeout"), nil)
@@ -413,3 +397,103 @@ func TestFsChildRemoveDeleteNetworkTimeout(t *testing.T) {
 	}
 
 }
+
+func TestFsExistsSlowNodeTimeout(t *testing.T) {
+	SetupCluster()
+	defer tc.faults.Reset()
+	log.Info("Testing TestFsExistsSlowNodeTimeout...")
+
+	resp, other := GetProcessForPath("/")
+
+	// the node is slower than the timeout and retries of the call
+	tc.faults.SlowFunction(resp.Cluster.MyNode.Id, FS_SERVICE, fs.FUNC_EXISTS, 1500*8)
+
+	// Test full timeout and return of an error
+	timeoutTest(1500*4, func() {
+		_, err := other.Fss.Exists(fs.NewPath("/"), nil)
+		if err != comm.ErrorTimeout {
+			t.Error("1) Didn't receive timeout error: %s", err)
+		}
+	},
+		func(returned bool) {
+			if !returned {
+				t.Error("2) Exists slow node timeout is endlessly sleeping")
+			}
+		})
+
+	// Test the node back to its normal speed
+	tc.faults.SlowFunction(resp.Cluster.MyNode.Id, FS_SERVICE, fs.FUNC_EXISTS, 0)
+	timeoutTest(1500*4, func() {
+		_, err := other.Fss.Exists(fs.NewPath("/"), nil)
+		if err != nil {
+			t.Error("3) Received an error: %s", err)
+		}
+	},
+		func(returned bool) {
+			if !returned {
+				t.Error("4) Exists slow node timeout is endlessly sleeping")
+			}
+		})
+}
+
+func TestFsWriteCancel(t *testing.T) {
+	SetupCluster()
+	defer tc.faults.Reset()
+	log.Info("Testing TestFsWriteCancel...")
+
+	path := "/tests/cancel/write1"
+	resp, other := GetProcessForPath(path, "/tests/cancel")
+	parent, _ := GetProcessForPath("/tests/cancel")
+	replicas := resp.Cluster.Rings.GetGlobalRing().Resolve(path)
+
+	buf := buffer.NewFromString("write0")
+	err := other.Fss.Write(fs.NewPath("/tests/cancel/write0"), buf.Size, "", buf, nil)
+	if err != nil {
+		t.Fatalf("1) Received an error: %s", err)
+	}
+
+	// the replicas and the parent are slow, the write is canceled while they handle it
+	for i := 1; i < replicas.Count(); i++ {
+		tc.faults.SlowFunction(replicas.Get(i).Id, FS_SERVICE, fs.FUNC_REPLICA_VERSION, 1000)
+	}
+	tc.faults.SlowFunction(parent.Cluster.MyNode.Id, FS_SERVICE, fs.FUNC_CHILD_ADD, 1000)
+
+	context := other.Fss.NewContext()
+	result := make(chan os.Error, 1)
+	go func() {
+		buf := buffer.NewFromString("write1")
+		result <- other.Fss.Write(fs.NewPath(path), buf.Size, "", buf, context)
+	}()
+
+	time.Sleep(300 * 1000 * 1000)
+	context.Cancel()
+
+	select {
+	case err = <-result:
+		if err != comm.ErrorCanceled {
+			t.Errorf("2) Canceled write should have failed with %s, got %s", comm.ErrorCanceled, err)
+		}
+	case <-time.After(800 * 1000 * 1000):
+		t.Errorf("3) Canceled write didn't return before the slow nodes answered")
+	}
+
+	// once they're done, the replicas and the parent must have aborted
+	time.Sleep(1500 * 1000 * 1000)
+
+	for i := 1; i < replicas.Count(); i++ {
+		replica := tc.nodes[replicas.Get(i).Id]
+		local := replica.Fss.NewContext()
+		local.ForceLocal = true
+		exists, _ := replica.Fss.Exists(fs.NewPath(path), local)
+		if exists {
+			t.Errorf("4) Replica %d shouldn't have received the canceled write", replica.Cluster.MyNode.Id)
+		}
+	}
+
+	children, _ := other.Fss.Children(fs.NewPath("/tests/cancel"), nil)
+	for _, child := range children {
+		if child.Name == "write1" {
+			t.Errorf("5) Canceled write shouldn't have been added to its parent")
+		}
+	}
+}
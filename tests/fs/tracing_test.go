@@ -0,0 +1,104 @@
+package main_test
+
+import (
+	"bytes"
+	"json"
+	"testing"
+	"time"
+	"gostore/comm"
+	"gostore/log"
+	"gostore/services/fs"
+	"gostore/tools/buffer"
+)
+
+// Returns the spans of a trace recorded by all nodes
+func traceSpans(traceId uint64) []comm.Span {
+	spans := make([]comm.Span, 0)
+	for _, proc := range tc.nodes {
+		for _, span := range proc.Sc.Spans() {
+			if span.TraceId == traceId {
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans
+}
+
+func TestWriteTrace(t *testing.T) {
+	SetupCluster()
+	log.Info("Testing TestWriteTrace...")
+
+	path := "/tests/tracing/write"
+	master, other := GetProcessForPath(path)
+
+	buf := buffer.NewFromString("traced")
+	err := other.Fss.Write(fs.NewPath(path), buf.Size, "", buf, nil)
+	if err != nil {
+		t.Fatalf("1) Got an error while writing: %s", err)
+	}
+
+	// spans are recorded once handlers return, after they responded
+	time.Sleep(100 * 1000 * 1000)
+
+	var write *comm.Span
+	spans := master.Sc.Spans()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Function == "RemoteWrite" {
+			write = &spans[i]
+			break
+		}
+	}
+	if write == nil {
+		t.Fatalf("2) Master didn't record a span for the write")
+	}
+
+	trace := traceSpans(write.TraceId)
+	ids := make(map[uint64]comm.Span)
+	for _, span := range trace {
+		ids[span.Id] = span
+	}
+
+	replicas, childAdd := 0, false
+	for _, span := range trace {
+		if span.Id != write.Id {
+			if _, found := ids[span.ParentId]; !found {
+				t.Errorf("3) Span %s of node %d has no parent in the trace", span.Function, span.NodeId)
+			}
+		}
+
+		if span.ParentId == write.Id {
+			switch span.Function {
+			case "RemoteReplicaVersion":
+				replicas++
+			case "RemoteChildAdd":
+				childAdd = true
+			}
+		}
+		if span.Error != "" {
+			t.Errorf("4) Span %s of node %d has an error: %s", span.Function, span.NodeId, span.Error)
+		}
+	}
+
+	if replicas != 2 {
+		t.Errorf("5) Write should have been replicated to 2 nodes in its trace, got %d", replicas)
+	}
+	if !childAdd {
+		t.Errorf("6) Child add to the parent should be in the trace of the write")
+	}
+
+	// exported spans can be loaded by OpenTelemetry tools
+	exported := bytes.NewBuffer(make([]byte, 0))
+	err = comm.ExportSpans(exported, trace)
+	if err != nil {
+		t.Fatalf("7) Got an error while exporting spans: %s", err)
+	}
+
+	var otlp map[string]interface{}
+	err = json.Unmarshal(exported.Bytes(), &otlp)
+	if err != nil {
+		t.Fatalf("8) Exported spans aren't valid JSON: %s", err)
+	}
+	if resources, ok := otlp["resourceSpans"].([]interface{}); !ok || len(resources) == 0 {
+		t.Errorf("9) Exported spans should have a resource by node: %v", otlp)
+	}
+}